@@ -0,0 +1,370 @@
+// Package console models the text screen behind the UEFI
+// SimpleTextOutput protocol. The screen has a mode (columns and rows),
+// a cursor, and an attribute for each cell. Changes can be rendered to a
+// host terminal with ANSI escape sequences, or passed through as plain text.
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// EFI text attributes. The low nibble is the foreground,
+// bits 4-6 the background.
+const (
+	Black = iota
+	Blue
+	Green
+	Cyan
+	Red
+	Magenta
+	Brown
+	LightGray
+	DarkGray
+	LightBlue
+	LightGreen
+	LightCyan
+	LightRed
+	LightMagenta
+	Yellow
+	White
+
+	// MaxAttribute is the largest legal attribute.
+	MaxAttribute = 0x7f
+	// DefaultAttribute is light gray on black, as after a Reset.
+	DefaultAttribute = LightGray
+)
+
+// Mode is a text mode.
+type Mode struct {
+	Cols int
+	Rows int
+}
+
+// Modes are the modes we support. Mode 0 must be 80x25.
+var Modes = []Mode{
+	{Cols: 80, Rows: 25},
+	{Cols: 80, Rows: 50},
+	{Cols: 100, Rows: 31},
+}
+
+// Cell is one character on the screen.
+type Cell struct {
+	Ch   rune
+	Attr uint8
+}
+
+// Screen is a virtual text screen.
+type Screen struct {
+	Mode          int
+	Cols          int
+	Rows          int
+	Col           int
+	Row           int
+	Attr          uint8
+	CursorVisible bool
+	Cells         []Cell
+
+	out  io.Writer
+	ansi bool
+	buf  bytes.Buffer
+	// hist is the recent output, for Watch. base is how much
+	// output came before it.
+	hist     string
+	base     int
+	watchers []*watcher
+	// Where the host terminal cursor is, and its attribute.
+	// -1 means we don't know.
+	hcol, hrow int
+	hattr      int
+	// damage marks the rows that changed, for Damage.
+	damage []bool
+}
+
+// maxHist is how much output we keep for Watch.
+const maxHist = 64 * 1024
+
+type watcher struct {
+	pattern string
+	off     int
+	fn      func()
+}
+
+// efiToANSI maps the EFI color order (blue, green, red) to
+// the ANSI one (red, green, blue).
+var efiToANSI = [8]int{0, 4, 2, 6, 1, 5, 3, 7}
+
+// New returns a Screen in mode 0, rendering to w. If ansi is false,
+// characters are written to w as they come, with no positioning.
+// w may be nil.
+func New(w io.Writer, ansi bool) *Screen {
+	s := &Screen{out: w, ansi: ansi, hcol: -1, hrow: -1, hattr: -1}
+	s.Reset()
+	return s
+}
+
+// Reset sets mode 0 and the default attribute, and clears the screen.
+func (s *Screen) Reset() {
+	s.Attr = DefaultAttribute
+	s.CursorVisible = true
+	if err := s.SetMode(0); err != nil {
+		panic(err)
+	}
+}
+
+// SetMode sets mode n, and clears the screen.
+func (s *Screen) SetMode(n int) error {
+	if n < 0 || n >= len(Modes) {
+		return fmt.Errorf("mode %d: only modes 0-%d are supported", n, len(Modes)-1)
+	}
+	m := Modes[n]
+	s.Mode, s.Cols, s.Rows = n, m.Cols, m.Rows
+	s.Cells = make([]Cell, m.Cols*m.Rows)
+	s.damage = make([]bool, m.Rows)
+	if s.ansi {
+		// Ask the terminal (xterm and friends) to resize. Others ignore it.
+		fmt.Fprintf(&s.buf, "\x1b[8;%d;%dt", m.Rows, m.Cols)
+	}
+	s.Clear()
+	return nil
+}
+
+// Clear clears the screen to the current background and homes the cursor.
+func (s *Screen) Clear() {
+	for i := range s.Cells {
+		s.Cells[i] = Cell{Ch: ' ', Attr: s.Attr}
+	}
+	s.damageAll()
+	s.Col, s.Row = 0, 0
+	if s.ansi {
+		s.setAttr(s.Attr)
+		s.buf.WriteString("\x1b[2J")
+		s.hcol, s.hrow = -1, -1
+	}
+	s.flush()
+}
+
+// SetAttribute sets the attribute for following output.
+func (s *Screen) SetAttribute(a uint8) error {
+	if a > MaxAttribute {
+		return fmt.Errorf("attribute %#x: max is %#x", a, MaxAttribute)
+	}
+	s.Attr = a
+	return nil
+}
+
+// SetCursor moves the cursor.
+func (s *Screen) SetCursor(col, row int) error {
+	if col < 0 || col >= s.Cols || row < 0 || row >= s.Rows {
+		return fmt.Errorf("cursor (%d,%d) is outside %dx%d", col, row, s.Cols, s.Rows)
+	}
+	s.Col, s.Row = col, row
+	s.flush()
+	return nil
+}
+
+// EnableCursor shows or hides the cursor.
+func (s *Screen) EnableCursor(on bool) {
+	s.CursorVisible = on
+	if s.ansi {
+		if on {
+			s.buf.WriteString("\x1b[?25h")
+		} else {
+			s.buf.WriteString("\x1b[?25l")
+		}
+	}
+	s.flush()
+}
+
+// WriteString writes str at the cursor, with UEFI semantics:
+// CR goes to column 0, LF goes down a row without changing the column,
+// BS moves left, and writing past the end of a line wraps.
+// Writing past the last row scrolls.
+func (s *Screen) WriteString(str string) {
+	for _, r := range str {
+		if !s.ansi && s.out != nil {
+			s.buf.WriteRune(r)
+		}
+		switch r {
+		case '\r':
+			s.Col = 0
+		case '\n':
+			s.down()
+		case '\b':
+			if s.Col > 0 {
+				s.Col--
+			}
+		default:
+			s.put(r)
+			if s.Col++; s.Col == s.Cols {
+				s.Col = 0
+				s.down()
+			}
+		}
+	}
+	s.flush()
+	s.watch(str)
+}
+
+// Watch calls fn once, the first time pattern is written after Watch is called.
+// The pattern can span calls to WriteString.
+func (s *Screen) Watch(pattern string, fn func()) {
+	s.WatchFrom(pattern, s.Written(), fn)
+}
+
+// WatchFrom is like Watch, but looks at output from off, as returned by
+// Written, on. If the pattern is already there, fn is called now.
+// Only the last 64K of output is kept.
+func (s *Screen) WatchFrom(pattern string, off int, fn func()) {
+	s.watchers = append(s.watchers, &watcher{pattern: pattern, off: off, fn: fn})
+	s.watch("")
+}
+
+// Written returns how much has been written to the screen, in bytes of UTF-8.
+func (s *Screen) Written() int {
+	return s.base + len(s.hist)
+}
+
+func (s *Screen) watch(str string) {
+	s.hist += str
+	if n := len(s.hist) - maxHist; n > 0 {
+		s.hist = s.hist[n:]
+		s.base += n
+	}
+	var fire []*watcher
+	w := s.watchers[:0]
+	for _, x := range s.watchers {
+		start := x.off - s.base
+		if start < 0 {
+			start = 0
+		}
+		if strings.Contains(s.hist[start:], x.pattern) {
+			fire = append(fire, x)
+			continue
+		}
+		w = append(w, x)
+	}
+	s.watchers = w
+	// Call them last: they might write, or add watchers.
+	for _, x := range fire {
+		x.fn()
+	}
+}
+
+// Cell returns the cell at col, row.
+func (s *Screen) Cell(col, row int) Cell {
+	return s.Cells[row*s.Cols+col]
+}
+
+// Text returns the screen as text, one line per row, with
+// trailing spaces removed.
+func (s *Screen) Text() string {
+	var b strings.Builder
+	for r := 0; r < s.Rows; r++ {
+		var l []rune
+		for c := 0; c < s.Cols; c++ {
+			l = append(l, s.Cell(c, r).Ch)
+		}
+		b.WriteString(strings.TrimRight(string(l), " "))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Damage returns the rows that changed since the last call,
+// for something that draws the screen, other than the host terminal.
+func (s *Screen) Damage() []int {
+	var rows []int
+	for r, d := range s.damage {
+		if d {
+			rows = append(rows, r)
+			s.damage[r] = false
+		}
+	}
+	return rows
+}
+
+func (s *Screen) damageAll() {
+	for r := range s.damage {
+		s.damage[r] = true
+	}
+}
+
+func (s *Screen) put(r rune) {
+	s.Cells[s.Row*s.Cols+s.Col] = Cell{Ch: r, Attr: s.Attr}
+	s.damage[s.Row] = true
+	if !s.ansi {
+		return
+	}
+	s.moveTo(s.Col, s.Row)
+	s.setAttr(s.Attr)
+	s.buf.WriteRune(r)
+	// Terminals differ on what happens at the right margin,
+	// so forget where we are there.
+	if s.hcol++; s.hcol >= s.Cols {
+		s.hcol, s.hrow = -1, -1
+	}
+}
+
+// down moves the cursor down a row, scrolling if it is on the last one.
+func (s *Screen) down() {
+	if s.Row < s.Rows-1 {
+		s.Row++
+		return
+	}
+	copy(s.Cells, s.Cells[s.Cols:])
+	for i := len(s.Cells) - s.Cols; i < len(s.Cells); i++ {
+		s.Cells[i] = Cell{Ch: ' ', Attr: s.Attr}
+	}
+	s.damageAll()
+	if s.ansi {
+		s.redraw()
+	}
+}
+
+// redraw draws the whole screen.
+func (s *Screen) redraw() {
+	for r := 0; r < s.Rows; r++ {
+		s.moveTo(0, r)
+		for c := 0; c < s.Cols; c++ {
+			cell := s.Cell(c, r)
+			s.setAttr(cell.Attr)
+			s.buf.WriteRune(cell.Ch)
+		}
+		s.hcol, s.hrow = -1, -1
+	}
+}
+
+func (s *Screen) moveTo(col, row int) {
+	if col == s.hcol && row == s.hrow {
+		return
+	}
+	fmt.Fprintf(&s.buf, "\x1b[%d;%dH", row+1, col+1)
+	s.hcol, s.hrow = col, row
+}
+
+func (s *Screen) setAttr(a uint8) {
+	if int(a) == s.hattr {
+		return
+	}
+	fg, bg := a&0xf, (a>>4)&7
+	f := 30 + efiToANSI[fg&7]
+	if fg&8 != 0 {
+		f += 60
+	}
+	fmt.Fprintf(&s.buf, "\x1b[0;%d;%dm", f, 40+efiToANSI[bg])
+	s.hattr = int(a)
+}
+
+// flush puts the host cursor where ours is and writes out what we have.
+func (s *Screen) flush() {
+	if s.ansi {
+		s.moveTo(s.Col, s.Row)
+	}
+	if s.out != nil && s.buf.Len() > 0 {
+		s.out.Write(s.buf.Bytes())
+	}
+	s.buf.Reset()
+}
@@ -0,0 +1,140 @@
+package console
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	s := New(nil, false)
+	s.WriteString("ab\r\ncd\bx")
+	if s.Col != 2 || s.Row != 1 {
+		t.Errorf("cursor: got (%d,%d), want (2,1)", s.Col, s.Row)
+	}
+	if got, want := s.Text()[:7], "ab\ncx\n\n"; got != want {
+		t.Errorf("Text: got %q, want %q", got, want)
+	}
+	// LF does not return the carriage.
+	s.WriteString("\ny")
+	if c := s.Cell(2, 2); c.Ch != 'y' || c.Attr != DefaultAttribute {
+		t.Errorf("Cell(2,2): got %v, want {'y', %#x}", c, DefaultAttribute)
+	}
+}
+
+func TestWrapAndScroll(t *testing.T) {
+	s := New(nil, false)
+	s.WriteString(strings.Repeat("a", 81))
+	if s.Col != 1 || s.Row != 1 {
+		t.Errorf("wrap: got (%d,%d), want (1,1)", s.Col, s.Row)
+	}
+	s.Clear()
+	s.WriteString("top\r\n")
+	for i := 0; i < s.Rows; i++ {
+		s.WriteString("x\r\n")
+	}
+	if s.Row != s.Rows-1 {
+		t.Errorf("row after scroll: got %d, want %d", s.Row, s.Rows-1)
+	}
+	if c := s.Cell(0, 0); c.Ch != 'x' {
+		t.Errorf("top line after scroll: got %q, want 'x'", c.Ch)
+	}
+}
+
+func TestModes(t *testing.T) {
+	s := New(nil, false)
+	for i, m := range Modes {
+		if err := s.SetMode(i); err != nil {
+			t.Fatalf("SetMode(%d): got %v, want nil", i, err)
+		}
+		if s.Cols != m.Cols || s.Rows != m.Rows || len(s.Cells) != m.Cols*m.Rows {
+			t.Errorf("SetMode(%d): got %dx%d, want %dx%d", i, s.Cols, s.Rows, m.Cols, m.Rows)
+		}
+	}
+	if err := s.SetMode(len(Modes)); err == nil {
+		t.Errorf("SetMode(%d): got nil, want error", len(Modes))
+	}
+	if err := s.SetCursor(s.Cols, 0); err == nil {
+		t.Errorf("SetCursor(%d, 0): got nil, want error", s.Cols)
+	}
+	if err := s.SetAttribute(0x80); err == nil {
+		t.Errorf("SetAttribute(0x80): got nil, want error")
+	}
+}
+
+func TestANSI(t *testing.T) {
+	var b bytes.Buffer
+	s := New(&b, true)
+	b.Reset()
+	if err := s.SetAttribute(Yellow | Blue<<4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCursor(3, 2); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	s.WriteString("hi")
+	if got, want := b.String(), "\x1b[0;93;44mhi"; got != want {
+		t.Errorf("ANSI: got %q, want %q", got, want)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := New(nil, false)
+	var n int
+	s.WriteString("Select")
+	s.Watch("Select option", func() { n++ })
+	s.WriteString(" option")
+	if n != 0 {
+		t.Errorf("Watch fired on output from before it was set")
+	}
+	s.WriteString("Select op")
+	s.WriteString("tion\r\n")
+	s.WriteString("Select option")
+	if n != 1 {
+		t.Errorf("Watch: fired %d times, want 1", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := New(nil, false)
+	s.WriteString("hi")
+	if err := s.SetAttribute(Red | Green<<4); err != nil {
+		t.Fatal(err)
+	}
+	s.WriteString("!")
+	n := s.Snapshot()
+	if n.Cols != 80 || n.Rows != 25 || len(n.Lines) != 25 || len(n.Attributes) != 25 {
+		t.Fatalf("Snapshot: got %dx%d with %d lines, %d attributes, want 80x25 with 25 of each", n.Cols, n.Rows, len(n.Lines), len(n.Attributes))
+	}
+	if n.Lines[0][:3] != "hi!" || n.Attributes[0][:6] != "070724" {
+		t.Errorf("Snapshot line 0: got %q %q, want hi! 070724", n.Lines[0][:3], n.Attributes[0][:6])
+	}
+	if n.Cursor != (Cursor{Col: 3, Row: 0, Visible: true}) {
+		t.Errorf("Snapshot cursor: got %v, want {3 0 true}", n.Cursor)
+	}
+	var b bytes.Buffer
+	if err := s.WriteSnapshot(&b, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "hi!\n\n") {
+		t.Errorf("text snapshot: got %q, want hi!\\n\\n...", b.String()[:8])
+	}
+	if err := s.WriteSnapshot(&b, "png"); err == nil {
+		t.Errorf("WriteSnapshot(png): got nil, want error")
+	}
+}
+
+func TestWatchFrom(t *testing.T) {
+	s := New(nil, false)
+	s.WriteString("Select option")
+	var n int
+	s.WatchFrom("option", 0, func() { n++ })
+	if n != 1 {
+		t.Errorf("WatchFrom(0) on output already there: fired %d times, want 1", n)
+	}
+	s.WatchFrom("option", s.Written(), func() { n++ })
+	if n != 1 {
+		t.Errorf("WatchFrom(Written()): fired before more output")
+	}
+}
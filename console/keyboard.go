@@ -0,0 +1,276 @@
+package console
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// EFI scan codes, for keys that have no character.
+const (
+	ScanNull     = 0x00
+	ScanUp       = 0x01
+	ScanDown     = 0x02
+	ScanRight    = 0x03
+	ScanLeft     = 0x04
+	ScanHome     = 0x05
+	ScanEnd      = 0x06
+	ScanInsert   = 0x07
+	ScanDelete   = 0x08
+	ScanPageUp   = 0x09
+	ScanPageDown = 0x0a
+	ScanF1       = 0x0b
+	ScanF2       = 0x0c
+	ScanF3       = 0x0d
+	ScanF4       = 0x0e
+	ScanF5       = 0x0f
+	ScanF6       = 0x10
+	ScanF7       = 0x11
+	ScanF8       = 0x12
+	ScanF9       = 0x13
+	ScanF10      = 0x14
+	ScanF11      = 0x15
+	ScanF12      = 0x16
+	ScanEsc      = 0x17
+)
+
+// Characters UEFI wants for some keys.
+const (
+	CharBackspace = 0x08
+	CharTab       = 0x09
+	CharLinefeed  = 0x0a
+	CharReturn    = 0x0d
+)
+
+// Key is a key press: a scan code, or a character, or both.
+// The modifiers are what we could tell from the input.
+type Key struct {
+	Scan  uint16
+	Char  rune
+	Shift bool
+	Ctrl  bool
+	Alt   bool
+}
+
+// ss3 are the keys sent as ESC O x.
+var ss3 = map[byte]uint16{
+	'A': ScanUp, 'B': ScanDown, 'C': ScanRight, 'D': ScanLeft,
+	'H': ScanHome, 'F': ScanEnd,
+	'P': ScanF1, 'Q': ScanF2, 'R': ScanF3, 'S': ScanF4,
+}
+
+// tilde are the keys sent as ESC [ n ~.
+var tilde = map[int]uint16{
+	1: ScanHome, 2: ScanInsert, 3: ScanDelete, 4: ScanEnd,
+	5: ScanPageUp, 6: ScanPageDown, 7: ScanHome, 8: ScanEnd,
+	11: ScanF1, 12: ScanF2, 13: ScanF3, 14: ScanF4,
+	15: ScanF5, 17: ScanF6, 18: ScanF7, 19: ScanF8,
+	20: ScanF9, 21: ScanF10, 23: ScanF11, 24: ScanF12,
+}
+
+// Decode turns bytes from a terminal into keys. Terminals send an
+// escape sequence in one write, so b should be what one read returned:
+// an ESC at the end of b is the Esc key. Sequences we don't know are dropped.
+func Decode(b []byte) []Key {
+	var keys []Key
+	s := string(b)
+	for len(s) > 0 {
+		k, n := decode(s)
+		s = s[n:]
+		if k == (Key{}) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// decode decodes one key from the start of s, returning it and how many
+// bytes it used.
+func decode(s string) (Key, int) {
+	if s[0] != 0x1b {
+		return char(s)
+	}
+	if len(s) == 1 {
+		return Key{Scan: ScanEsc}, 1
+	}
+	switch s[1] {
+	case 'O':
+		if len(s) > 2 {
+			if sc, ok := ss3[s[2]]; ok {
+				return Key{Scan: sc}, 3
+			}
+		}
+	case '[':
+		// Parameters, then a final byte in 0x40-0x7e.
+		for i := 2; i < len(s); i++ {
+			c := s[i]
+			if c < 0x40 || c > 0x7e {
+				continue
+			}
+			k, ok := csi(s[2:i], c)
+			if !ok {
+				// Not a key we know. Drop it, rather than have
+				// the guest see it as a bunch of characters.
+				return Key{}, i + 1
+			}
+			return k, i + 1
+		}
+	default:
+		// ESC followed by a character is Alt and the character.
+		k, n := char(s[1:])
+		k.Alt = true
+		return k, n + 1
+	}
+	return Key{Scan: ScanEsc}, 1
+}
+
+// csi decodes the parameters and final byte of an ESC [ sequence.
+func csi(params string, final byte) (Key, bool) {
+	var k Key
+	p := strings.Split(params, ";")
+	if len(p) > 1 {
+		// xterm: the second parameter is 1 + a bitmask of shift, alt, ctrl.
+		if m, err := strconv.Atoi(p[1]); err == nil && m > 1 {
+			m--
+			k.Shift, k.Alt, k.Ctrl = m&1 != 0, m&2 != 0, m&4 != 0
+		}
+	}
+	if final == '~' {
+		n, err := strconv.Atoi(p[0])
+		if err != nil {
+			return k, false
+		}
+		sc, ok := tilde[n]
+		k.Scan = sc
+		return k, ok
+	}
+	if final == 'Z' {
+		// Back tab.
+		k.Char, k.Shift = CharTab, true
+		return k, true
+	}
+	sc, ok := ss3[final]
+	k.Scan = sc
+	return k, ok
+}
+
+// char decodes a character, which might be a control character.
+func char(s string) (Key, int) {
+	r, n := utf8.DecodeRuneInString(s)
+	switch {
+	case r == '\r' || r == '\n':
+		return Key{Char: CharReturn}, n
+	case r == 0x7f || r == CharBackspace:
+		return Key{Char: CharBackspace}, n
+	case r == CharTab:
+		return Key{Char: CharTab}, n
+	case r < 0x20:
+		return Key{Char: r, Ctrl: true}, n
+	case r >= 'A' && r <= 'Z':
+		return Key{Char: r, Shift: true}, n
+	}
+	return Key{Char: r}, n
+}
+
+// Keyboard is a queue of keys, filled from a terminal or a script,
+// and emptied by the text input services.
+type Keyboard struct {
+	mu   sync.Mutex
+	keys []Key
+	// seen is how many of keys Arrived has returned.
+	seen  int
+	ready chan struct{}
+}
+
+// NewKeyboard returns an empty Keyboard.
+func NewKeyboard() *Keyboard {
+	return &Keyboard{ready: make(chan struct{}, 1)}
+}
+
+// Push adds keys to the queue.
+func (k *Keyboard) Push(keys ...Key) {
+	k.mu.Lock()
+	k.keys = append(k.keys, keys...)
+	k.mu.Unlock()
+	select {
+	case k.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop takes the next key from the queue.
+func (k *Keyboard) Pop() (Key, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) == 0 {
+		return Key{}, false
+	}
+	key := k.keys[0]
+	k.keys = k.keys[1:]
+	if k.seen > 0 {
+		k.seen--
+	}
+	return key, true
+}
+
+// Arrived returns the keys pushed since it was last called. They
+// stay in the queue, for Pop.
+func (k *Keyboard) Arrived() []Key {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := append([]Key{}, k.keys[k.seen:]...)
+	k.seen = len(k.keys)
+	return keys
+}
+
+// Arriving says whether there are keys that Arrived has not returned.
+func (k *Keyboard) Arriving() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.seen < len(k.keys)
+}
+
+// Pending says whether there is a key in the queue.
+func (k *Keyboard) Pending() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.keys) > 0
+}
+
+// Reset empties the queue.
+func (k *Keyboard) Reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.seen = nil, 0
+}
+
+// Wait waits up to d for a key, and says whether there is one.
+func (k *Keyboard) Wait(d time.Duration) bool {
+	if k.Pending() {
+		return true
+	}
+	select {
+	case <-k.ready:
+	case <-time.After(d):
+	}
+	return k.Pending()
+}
+
+// Feed reads keys from r, which is usually a terminal in
+// raw mode, until it gets an error. Run it in a goroutine.
+func (k *Keyboard) Feed(r io.Reader) error {
+	var b [64]byte
+	for {
+		n, err := r.Read(b[:])
+		if n > 0 {
+			k.Push(Decode(b[:n])...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package console
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	for i, tt := range []struct {
+		in   string
+		keys []Key
+	}{
+		{in: "a\r", keys: []Key{{Char: 'a'}, {Char: CharReturn}}},
+		{in: "A\x7f\t", keys: []Key{{Char: 'A', Shift: true}, {Char: CharBackspace}, {Char: CharTab}}},
+		{in: "\x1b", keys: []Key{{Scan: ScanEsc}}},
+		{in: "\x1b[A\x1b[B\x1b[C\x1b[D", keys: []Key{{Scan: ScanUp}, {Scan: ScanDown}, {Scan: ScanRight}, {Scan: ScanLeft}}},
+		{in: "\x1bOH\x1b[F\x1b[5~\x1b[6~", keys: []Key{{Scan: ScanHome}, {Scan: ScanEnd}, {Scan: ScanPageUp}, {Scan: ScanPageDown}}},
+		{in: "\x1bOP\x1b[15~\x1b[24~", keys: []Key{{Scan: ScanF1}, {Scan: ScanF5}, {Scan: ScanF12}}},
+		{in: "\x1b[1;5C", keys: []Key{{Scan: ScanRight, Ctrl: true}}},
+		{in: "\x1bx", keys: []Key{{Char: 'x', Alt: true}}},
+		{in: "\x03", keys: []Key{{Char: 3, Ctrl: true}}},
+		{in: "\x1b[99~z", keys: []Key{{Char: 'z'}}},
+	} {
+		if got := Decode([]byte(tt.in)); !reflect.DeepEqual(got, tt.keys) {
+			t.Errorf("Test %d: Decode(%q): got %v, want %v", i, tt.in, got, tt.keys)
+		}
+	}
+}
+
+func TestKeyboard(t *testing.T) {
+	k := NewKeyboard()
+	if k.Wait(time.Millisecond) {
+		t.Fatalf("Wait on empty keyboard: got true, want false")
+	}
+	go k.Push(Key{Char: 'q'})
+	if !k.Wait(time.Second) {
+		t.Fatalf("Wait: got false, want true")
+	}
+	if key, ok := k.Pop(); !ok || key.Char != 'q' {
+		t.Errorf("Pop: got %v, %v, want q, true", key, ok)
+	}
+	if _, ok := k.Pop(); ok {
+		t.Errorf("Pop on empty keyboard: got true, want false")
+	}
+}
+
+func TestArrived(t *testing.T) {
+	k := NewKeyboard()
+	k.Push(Type("ab")...)
+	if got := k.Arrived(); len(got) != 2 || got[0].Char != 'a' || got[1].Char != 'b' {
+		t.Fatalf("Arrived: got %v, want a, b", got)
+	}
+	if k.Arriving() {
+		t.Errorf("Arriving after Arrived: got true, want false")
+	}
+	k.Pop()
+	k.Push(Type("c")...)
+	if !k.Arriving() {
+		t.Errorf("Arriving after Push: got false, want true")
+	}
+	if got := k.Arrived(); len(got) != 1 || got[0].Char != 'c' {
+		t.Errorf("Arrived after Pop and Push: got %v, want c", got)
+	}
+	// They are all still there, for Pop.
+	if key, ok := k.Pop(); !ok || key.Char != 'b' {
+		t.Errorf("Pop: got %v, %v, want b, true", key, ok)
+	}
+}
@@ -0,0 +1,235 @@
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Script types keys for an unattended run, in the spirit of expect.
+// It is a list of Steps, each of which waits for output, waits
+// for some time to pass, or types keys. The text form is one step per line:
+//
+//	# comments and blank lines are ignored
+//	wait "Select option"   wait until this is output
+//	type "2"               type these characters
+//	key Enter              type these keys, by name: Esc, F10, Ctrl-X, ...
+//	sleep 500ms            wait this long, as the guest's timers see it
+//
+// Quotes are optional for wait and type, and strings in them
+// can use Go escapes.
+
+// Step is one step in a Script. Only one of its fields is set.
+type Step struct {
+	Wait  string
+	Sleep time.Duration
+	Keys  []Key
+}
+
+// Script runs Steps, feeding keys to a Keyboard.
+type Script struct {
+	steps []Step
+	k     *Keyboard
+	s     *Screen
+	now   func() time.Duration
+	// until is when the current sleep ends, if sleeping.
+	until    time.Duration
+	sleeping bool
+	// watching is set while waiting for output.
+	watching bool
+	// mark is how much output there was when the last wait matched.
+	// The next wait looks at output after it.
+	mark int
+}
+
+// names are the keys we know by name. Letters, digits and other
+// printable characters are their own names.
+var names = map[string]Key{
+	"enter":     {Char: CharReturn},
+	"return":    {Char: CharReturn},
+	"tab":       {Char: CharTab},
+	"backspace": {Char: CharBackspace},
+	"space":     {Char: ' '},
+	"esc":       {Scan: ScanEsc},
+	"escape":    {Scan: ScanEsc},
+	"up":        {Scan: ScanUp},
+	"down":      {Scan: ScanDown},
+	"left":      {Scan: ScanLeft},
+	"right":     {Scan: ScanRight},
+	"home":      {Scan: ScanHome},
+	"end":       {Scan: ScanEnd},
+	"insert":    {Scan: ScanInsert},
+	"delete":    {Scan: ScanDelete},
+	"pgup":      {Scan: ScanPageUp},
+	"pageup":    {Scan: ScanPageUp},
+	"pgdn":      {Scan: ScanPageDown},
+	"pagedown":  {Scan: ScanPageDown},
+}
+
+func init() {
+	for i := 0; i < 12; i++ {
+		names[fmt.Sprintf("f%d", i+1)] = Key{Scan: uint16(ScanF1 + i)}
+	}
+}
+
+// KeyByName returns the key with a name like Enter, F5, Ctrl-C,
+// Alt-x or Shift-Tab. Names are not case sensitive, but single
+// characters are taken as they are.
+func KeyByName(n string) (Key, error) {
+	var k Key
+	name := n
+	for {
+		i := strings.Index(name, "-")
+		if i < 1 || i == len(name)-1 {
+			break
+		}
+		switch strings.ToLower(name[:i]) {
+		case "ctrl":
+			k.Ctrl = true
+		case "alt":
+			k.Alt = true
+		case "shift":
+			k.Shift = true
+		default:
+			return Key{}, fmt.Errorf("key %q: unknown modifier %q", n, name[:i])
+		}
+		name = name[i+1:]
+	}
+	if r := []rune(name); len(r) == 1 {
+		k.Char = r[0]
+		if k.Ctrl {
+			// Ctrl and a letter is the control character, as a terminal sends it.
+			switch c := r[0] | 0x20; {
+			case c >= 'a' && c <= 'z':
+				k.Char = c - 'a' + 1
+			}
+		}
+		return k, nil
+	}
+	b, ok := names[strings.ToLower(name)]
+	if !ok {
+		return Key{}, fmt.Errorf("key %q: unknown key", n)
+	}
+	b.Shift, b.Ctrl, b.Alt = k.Shift, k.Ctrl, k.Alt
+	return b, nil
+}
+
+// Type returns the keys to type s.
+func Type(s string) []Key {
+	var keys []Key
+	for _, r := range s {
+		k, _ := char(string(r))
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ParseScript reads a script in text form.
+func ParseScript(r io.Reader) ([]Step, error) {
+	var steps []Step
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		cmd, arg := l, ""
+		if i := strings.IndexAny(l, " \t"); i > 0 {
+			cmd, arg = l[:i], strings.TrimSpace(l[i:])
+		}
+		var st Step
+		switch cmd {
+		case "wait", "type":
+			if len(arg) > 0 && (arg[0] == '"' || arg[0] == '`') {
+				u, err := strconv.Unquote(arg)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %q: %v", line, arg, err)
+				}
+				arg = u
+			}
+			if len(arg) == 0 {
+				return nil, fmt.Errorf("line %d: %s needs a string", line, cmd)
+			}
+			if cmd == "wait" {
+				st.Wait = arg
+			} else {
+				st.Keys = Type(arg)
+			}
+		case "key":
+			for _, n := range strings.Fields(arg) {
+				k, err := KeyByName(n)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+				st.Keys = append(st.Keys, k)
+			}
+			if len(st.Keys) == 0 {
+				return nil, fmt.Errorf("line %d: key needs at least one key name", line)
+			}
+		case "sleep":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			st.Sleep = d
+		default:
+			return nil, fmt.Errorf("line %d: unknown command %q", line, cmd)
+		}
+		steps = append(steps, st)
+	}
+	return steps, s.Err()
+}
+
+// NewScript returns a Script that types into k. Waits watch s, and
+// sleeps use now, which should be the clock the guest's timers use.
+func NewScript(steps []Step, k *Keyboard, s *Screen, now func() time.Duration) *Script {
+	return &Script{steps: steps, k: k, s: s, now: now}
+}
+
+// Run runs the script as far as it can go. Call it whenever
+// the guest looks for keys, or time passes.
+func (s *Script) Run() {
+	for len(s.steps) > 0 {
+		if s.watching {
+			return
+		}
+		if s.sleeping {
+			if s.now() < s.until {
+				return
+			}
+			s.sleeping = false
+			s.steps = s.steps[1:]
+			continue
+		}
+		st := s.steps[0]
+		switch {
+		case len(st.Wait) > 0:
+			s.watching = true
+			s.s.WatchFrom(st.Wait, s.mark, func() {
+				s.watching = false
+				s.mark = s.s.Written()
+				s.steps = s.steps[1:]
+				s.Run()
+			})
+			return
+		case st.Sleep > 0:
+			s.sleeping, s.until = true, s.now()+st.Sleep
+		default:
+			s.k.Push(st.Keys...)
+			s.steps = s.steps[1:]
+		}
+	}
+}
+
+// Next returns when the script next has something to do, if it is sleeping.
+func (s *Script) Next() (time.Duration, bool) {
+	return s.until, s.sleeping
+}
+
+// Done says whether the script has run all its steps.
+func (s *Script) Done() bool {
+	return len(s.steps) == 0
+}
@@ -0,0 +1,105 @@
+package console
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyByName(t *testing.T) {
+	for i, tt := range []struct {
+		n   string
+		k   Key
+		bad bool
+	}{
+		{n: "Enter", k: Key{Char: CharReturn}},
+		{n: "f10", k: Key{Scan: ScanF10}},
+		{n: "Ctrl-X", k: Key{Char: 0x18, Ctrl: true}},
+		{n: "Shift-Tab", k: Key{Char: CharTab, Shift: true}},
+		{n: "x", k: Key{Char: 'x'}},
+		{n: "-", k: Key{Char: '-'}},
+		{n: "Hyper-x", bad: true},
+		{n: "Nope", bad: true},
+	} {
+		k, err := KeyByName(tt.n)
+		if (err != nil) != tt.bad {
+			t.Errorf("Test %d: KeyByName(%q): got %v, want error %v", i, tt.n, err, tt.bad)
+			continue
+		}
+		if k != tt.k {
+			t.Errorf("Test %d: KeyByName(%q): got %v, want %v", i, tt.n, k, tt.k)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	steps, err := ParseScript(strings.NewReader(`
+# the menu
+wait "Select option"
+type 2
+key Enter Down
+sleep 1.5s
+type "a\tb"
+`))
+	if err != nil {
+		t.Fatalf("ParseScript: got %v, want nil", err)
+	}
+	want := []Step{
+		{Wait: "Select option"},
+		{Keys: []Key{{Char: '2'}}},
+		{Keys: []Key{{Char: CharReturn}, {Scan: ScanDown}}},
+		{Sleep: 1500 * time.Millisecond},
+		{Keys: []Key{{Char: 'a'}, {Char: CharTab}, {Char: 'b'}}},
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("ParseScript: got %v, want %v", steps, want)
+	}
+	for _, bad := range []string{"jump", "wait", "sleep forever", "key Nope", `type "x`} {
+		if _, err := ParseScript(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseScript(%q): got nil, want error", bad)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	var now time.Duration
+	k := NewKeyboard()
+	s := New(nil, false)
+	sc := NewScript([]Step{
+		{Wait: "Select"},
+		{Keys: []Key{{Char: '2'}}},
+		{Sleep: time.Second},
+		{Keys: []Key{{Char: CharReturn}}},
+		{Wait: "Select"},
+		{Keys: []Key{{Char: 'q'}}},
+	}, k, s, func() time.Duration { return now })
+	sc.Run()
+	if k.Pending() {
+		t.Fatalf("key typed before the wait matched")
+	}
+	s.WriteString("Select option: ")
+	if key, ok := k.Pop(); !ok || key.Char != '2' {
+		t.Fatalf("after wait: got %v, %v, want 2, true", key, ok)
+	}
+	sc.Run()
+	if k.Pending() {
+		t.Fatalf("key typed before the sleep ended")
+	}
+	if until, ok := sc.Next(); !ok || until != time.Second {
+		t.Errorf("Next: got %v, %v, want 1s, true", until, ok)
+	}
+	now = time.Second
+	sc.Run()
+	if key, ok := k.Pop(); !ok || key.Char != CharReturn {
+		t.Fatalf("after sleep: got %v, %v, want Enter, true", key, ok)
+	}
+	// The second wait only matches new output.
+	if k.Pending() {
+		t.Fatalf("second wait matched old output")
+	}
+	s.WriteString("Select option: ")
+	if key, ok := k.Pop(); !ok || key.Char != 'q' || !sc.Done() {
+		t.Fatalf("end: got %v, %v, done %v, want q, true, true", key, ok, sc.Done())
+	}
+}
@@ -0,0 +1,67 @@
+package console
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Cursor is where the cursor is in a Snapshot.
+type Cursor struct {
+	Col     int  `json:"col"`
+	Row     int  `json:"row"`
+	Visible bool `json:"visible"`
+}
+
+// Snapshot is the screen as it was at some point, for comparing
+// against a golden file. Lines are full width, and each Attributes
+// entry is the line's attributes as two hex digits per cell.
+type Snapshot struct {
+	Mode       int      `json:"mode"`
+	Cols       int      `json:"cols"`
+	Rows       int      `json:"rows"`
+	Cursor     Cursor   `json:"cursor"`
+	Lines      []string `json:"lines"`
+	Attributes []string `json:"attributes"`
+}
+
+// Snapshot returns a Snapshot of the screen.
+func (s *Screen) Snapshot() *Snapshot {
+	n := &Snapshot{
+		Mode:   s.Mode,
+		Cols:   s.Cols,
+		Rows:   s.Rows,
+		Cursor: Cursor{Col: s.Col, Row: s.Row, Visible: s.CursorVisible},
+	}
+	for r := 0; r < s.Rows; r++ {
+		var l strings.Builder
+		var a strings.Builder
+		for c := 0; c < s.Cols; c++ {
+			cell := s.Cell(c, r)
+			l.WriteRune(cell.Ch)
+			fmt.Fprintf(&a, "%02x", cell.Attr)
+		}
+		n.Lines = append(n.Lines, l.String())
+		n.Attributes = append(n.Attributes, a.String())
+	}
+	return n
+}
+
+// WriteSnapshot writes the screen to w. The format is "text",
+// which is what Text returns, or "json", which is a Snapshot.
+func (s *Screen) WriteSnapshot(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		_, err := io.WriteString(w, s.Text())
+		return err
+	case "json":
+		b, err := json.MarshalIndent(s.Snapshot(), "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	return fmt.Errorf("snapshot format %q: only text and json are supported", format)
+}
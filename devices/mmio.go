@@ -0,0 +1,94 @@
+package devices
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// MMIODevice is a device in guest physical address space, where there
+// is no memory. Addresses are offsets from the start of the region the
+// device claimed. Sizes are 1, 2, 4 or 8.
+type MMIODevice interface {
+	Read(off uint64, size int) uint64
+	Write(off uint64, size int, v uint64)
+}
+
+// mmioRegion is addresses claimed by a device.
+type mmioRegion struct {
+	name string
+	base uint64
+	n    uint64
+	d    MMIODevice
+}
+
+func (r *mmioRegion) String() string {
+	return fmt.Sprintf("%s at %#x-%#x", r.name, r.base, r.base+r.n-1)
+}
+
+// MMIO is the devices that have claimed regions of guest physical
+// address space. Only accesses to addresses with no memory get to them.
+type MMIO struct {
+	regions []*mmioRegion
+}
+
+// Register claims n bytes at base for d. Regions can't overlap.
+func (m *MMIO) Register(name string, base, n uint64, d MMIODevice) error {
+	r := &mmioRegion{name: name, base: base, n: n, d: d}
+	if n == 0 || base+n < base {
+		return fmt.Errorf("%v: bad region", r)
+	}
+	for _, o := range m.regions {
+		if base < o.base+o.n && o.base < base+n {
+			return fmt.Errorf("%v: overlaps %v", r, o)
+		}
+	}
+	m.regions = append(m.regions, r)
+	sort.Slice(m.regions, func(i, j int) bool { return m.regions[i].base < m.regions[j].base })
+	return nil
+}
+
+// find returns the region that has all of size bytes at addr.
+func (m *MMIO) find(addr uint64, size int) *mmioRegion {
+	for _, r := range m.regions {
+		if addr >= r.base && addr+uint64(size) <= r.base+r.n {
+			return r
+		}
+	}
+	return nil
+}
+
+// Device returns the name of the device that has addr, if any.
+func (m *MMIO) Device(addr uint64) (string, bool) {
+	if r := m.find(addr, 1); r != nil {
+		return r.name, true
+	}
+	return "", false
+}
+
+// Access does a read or write of len(data) bytes at addr. For a read,
+// the value is written to data. Access returns false if no device has
+// the addresses; a read from them gets all ones.
+func (m *MMIO) Access(addr uint64, write bool, data []byte) bool {
+	size := len(data)
+	var r *mmioRegion
+	switch size {
+	case 1, 2, 4, 8:
+		r = m.find(addr, size)
+	}
+	var v [8]byte
+	switch {
+	case r == nil && !write:
+		for i := range data {
+			data[i] = 0xff
+		}
+	case r == nil:
+	case write:
+		copy(v[:], data)
+		r.d.Write(addr-r.base, size, binary.LittleEndian.Uint64(v[:]))
+	default:
+		binary.LittleEndian.PutUint64(v[:], r.d.Read(addr-r.base, size))
+		copy(data, v[:])
+	}
+	return r != nil
+}
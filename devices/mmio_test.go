@@ -0,0 +1,52 @@
+package devices
+
+import (
+	"bytes"
+	"testing"
+)
+
+// scratch is MMIO registers that remember the last write.
+type scratch struct {
+	off  uint64
+	size int
+	v    uint64
+}
+
+func (s *scratch) Read(off uint64, size int) uint64 {
+	return s.v
+}
+
+func (s *scratch) Write(off uint64, size int, v uint64) {
+	s.off, s.size, s.v = off, size, v
+}
+
+func TestMMIO(t *testing.T) {
+	var m MMIO
+	var s scratch
+	if err := m.Register("scratch", 0xfed00000, 0x400, &s); err != nil {
+		t.Fatalf("Register: got %v, want nil", err)
+	}
+	if err := m.Register("other", 0xfecfff00, 0x200, &scratch{}); err == nil {
+		t.Errorf("Register overlapping region: got nil, want error")
+	}
+	if !m.Access(0xfed000f0, true, []byte{1, 2, 3, 4}) {
+		t.Fatalf("Write: got false, want true")
+	}
+	if s.off != 0xf0 || s.size != 4 || s.v != 0x04030201 {
+		t.Errorf("Write: got %#x, want offset 0xf0, size 4, value 0x04030201", s)
+	}
+	b := make([]byte, 8)
+	if !m.Access(0xfed00010, false, b) {
+		t.Fatalf("Read: got false, want true")
+	}
+	if want := []byte{1, 2, 3, 4, 0, 0, 0, 0}; !bytes.Equal(b, want) {
+		t.Errorf("Read: got %#x, want %#x", b, want)
+	}
+	b = make([]byte, 2)
+	if m.Access(0xfed003ff, false, b) {
+		t.Errorf("Read across the end: got true, want false")
+	}
+	if want := []byte{0xff, 0xff}; !bytes.Equal(b, want) {
+		t.Errorf("Unclaimed read: got %#x, want %#x", b, want)
+	}
+}
@@ -0,0 +1,124 @@
+package devices
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// PortDevice is a device on IO ports. Ports are offsets from the
+// start of the range the device claimed. Sizes are 1, 2 or 4.
+type PortDevice interface {
+	In(off uint16, size int) uint32
+	Out(off uint16, size int, v uint32)
+}
+
+// Registers is a device with byte-wide registers, like most legacy ones.
+type Registers interface {
+	In(off uint16) uint8
+	Out(off uint16, v uint8)
+}
+
+// byteWide is a PortDevice for Registers.
+type byteWide struct {
+	r Registers
+}
+
+// ByteWide returns a PortDevice for r. Wider IO is split into bytes at
+// successive ports, as it is on an 8-bit bus.
+func ByteWide(r Registers) PortDevice {
+	return &byteWide{r: r}
+}
+
+func (b *byteWide) In(off uint16, size int) uint32 {
+	var v uint32
+	for i := 0; i < size; i++ {
+		v |= uint32(b.r.In(off+uint16(i))) << (8 * i)
+	}
+	return v
+}
+
+func (b *byteWide) Out(off uint16, size int, v uint32) {
+	for i := 0; i < size; i++ {
+		b.r.Out(off+uint16(i), uint8(v>>(8*i)))
+	}
+}
+
+// portRange is ports claimed by a device.
+type portRange struct {
+	name string
+	base uint16
+	n    int
+	d    PortDevice
+}
+
+func (r *portRange) String() string {
+	return fmt.Sprintf("%s at %#x-%#x", r.name, r.base, int(r.base)+r.n-1)
+}
+
+// Ports is the IO port space: the devices that have claimed ranges of it.
+type Ports struct {
+	ranges []*portRange
+}
+
+// Register claims n ports at base for d. Ranges can't overlap.
+func (p *Ports) Register(name string, base uint16, n int, d PortDevice) error {
+	r := &portRange{name: name, base: base, n: n, d: d}
+	if n <= 0 || int(base)+n > 0x10000 {
+		return fmt.Errorf("%v: bad range", r)
+	}
+	for _, o := range p.ranges {
+		if int(base) < int(o.base)+o.n && int(o.base) < int(base)+n {
+			return fmt.Errorf("%v: overlaps %v", r, o)
+		}
+	}
+	p.ranges = append(p.ranges, r)
+	sort.Slice(p.ranges, func(i, j int) bool { return p.ranges[i].base < p.ranges[j].base })
+	return nil
+}
+
+// find returns the range that has all of size ports at port.
+func (p *Ports) find(port uint16, size int) *portRange {
+	for _, r := range p.ranges {
+		if port >= r.base && int(port)+size <= int(r.base)+r.n {
+			return r
+		}
+	}
+	return nil
+}
+
+// Device returns the name of the device that has port, if any.
+func (p *Ports) Device(port uint16) (string, bool) {
+	if r := p.find(port, 1); r != nil {
+		return r.name, true
+	}
+	return "", false
+}
+
+// IO does an in or out of size bytes at port, count times, which is
+// more than once for string IO with a rep prefix. data has the values,
+// one after the other; for an in, they are written there.
+// IO returns false if no device has the ports. An in from them reads
+// all ones, as from a bus with nothing on it.
+func (p *Ports) IO(port uint16, size, count int, out bool, data []byte) bool {
+	if size != 1 && size != 2 && size != 4 {
+		return false
+	}
+	r := p.find(port, size)
+	for i := 0; i < count; i++ {
+		b := data[i*size : (i+1)*size]
+		var v [4]byte
+		switch {
+		case r == nil && !out:
+			copy(b, []byte{0xff, 0xff, 0xff, 0xff})
+		case r == nil:
+		case out:
+			copy(v[:], b)
+			r.d.Out(port-r.base, size, binary.LittleEndian.Uint32(v[:]))
+		default:
+			binary.LittleEndian.PutUint32(v[:], r.d.In(port-r.base, size))
+			copy(b, v[:])
+		}
+	}
+	return r != nil
+}
@@ -0,0 +1,58 @@
+package devices
+
+import (
+	"bytes"
+	"testing"
+)
+
+// regs is byte-wide registers that remember what was written.
+type regs [8]uint8
+
+func (r *regs) In(off uint16) uint8     { return r[off] }
+func (r *regs) Out(off uint16, v uint8) { r[off] = v }
+
+func TestPorts(t *testing.T) {
+	var p Ports
+	var r regs
+	if err := p.Register("regs", 0x100, len(r), ByteWide(&r)); err != nil {
+		t.Fatalf("Register: got %v, want nil", err)
+	}
+	if err := p.Register("other", 0x107, 2, ByteWide(&regs{})); err == nil {
+		t.Errorf("Register overlapping range: got nil, want error")
+	}
+	if !p.IO(0x102, 2, 1, true, []byte{0x34, 0x12}) {
+		t.Fatalf("outw 0x102: got false, want true")
+	}
+	if r[2] != 0x34 || r[3] != 0x12 {
+		t.Errorf("outw 0x102: registers are %#x, want 0x34, 0x12 at 2", r)
+	}
+	b := make([]byte, 4)
+	if !p.IO(0x100, 4, 1, false, b) {
+		t.Fatalf("inl 0x100: got false, want true")
+	}
+	if want := []byte{0, 0, 0x34, 0x12}; !bytes.Equal(b, want) {
+		t.Errorf("inl 0x100: got %#x, want %#x", b, want)
+	}
+	// rep outsb: the last one wins.
+	p.IO(0x105, 1, 3, true, []byte{1, 2, 3})
+	if r[5] != 3 {
+		t.Errorf("rep outsb: got %#x, want 3", r[5])
+	}
+	// rep insb
+	b = make([]byte, 3)
+	p.IO(0x105, 1, 3, false, b)
+	if want := []byte{3, 3, 3}; !bytes.Equal(b, want) {
+		t.Errorf("rep insb: got %#x, want %#x", b, want)
+	}
+	// Off the end of the range is not claimed.
+	b = make([]byte, 2)
+	if p.IO(0x107, 2, 1, false, b) {
+		t.Errorf("inw 0x107: got true, want false")
+	}
+	if want := []byte{0xff, 0xff}; !bytes.Equal(b, want) {
+		t.Errorf("inw 0x107: got %#x, want %#x", b, want)
+	}
+	if n, ok := p.Device(0x104); !ok || n != "regs" {
+		t.Errorf("Device(0x104): got %q, %v, want regs, true", n, ok)
+	}
+}
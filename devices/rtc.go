@@ -0,0 +1,314 @@
+package devices
+
+import (
+	"sync"
+	"time"
+)
+
+// The CMOS index and data ports. The high bit of the index disables NMI.
+const (
+	CMOSIndex = 0x70
+	CMOSData  = 0x71
+)
+
+// MC146818 registers, as CMOS addresses.
+const (
+	RTCSeconds      = 0x00
+	RTCSecondsAlarm = 0x01
+	RTCMinutes      = 0x02
+	RTCMinutesAlarm = 0x03
+	RTCHours        = 0x04
+	RTCHoursAlarm   = 0x05
+	RTCDayOfWeek    = 0x06
+	RTCDayOfMonth   = 0x07
+	RTCMonth        = 0x08
+	RTCYear         = 0x09
+	RTCRegA         = 0x0a
+	RTCRegB         = 0x0b
+	RTCRegC         = 0x0c
+	RTCRegD         = 0x0d
+	RTCCentury      = 0x32
+)
+
+// Register bits.
+const (
+	RegAUIP = 0x80 // update in progress
+
+	RegBSet  = 0x80 // stop updates, so the time can be set
+	RegBPIE  = 0x40
+	RegBAIE  = 0x20 // alarm interrupt enable
+	RegBUIE  = 0x10
+	RegBDM   = 0x04 // binary, not BCD
+	RegB24Hr = 0x02
+	RegCIRQF = 0x80
+	RegCAF   = 0x20 // alarm
+	RegCUF   = 0x10 // update ended
+	RegDVRT  = 0x80 // the battery is fine
+
+	// AlarmDontCare in an alarm register matches anything.
+	AlarmDontCare = 0xc0
+	// hourPM is the PM bit, in 12 hour mode.
+	hourPM = 0x80
+)
+
+// RTC is an MC146818 real time clock and its CMOS RAM, on the
+// CMOS index and data ports. The time is a clock plus an offset,
+// which setting the time changes. The clock is wall clock time,
+// as the RTC keeps it, in UTC as far as Go is concerned.
+// There is no interrupt controller, so interrupts are only flags in
+// register C, for a guest that polls.
+type RTC struct {
+	mu     sync.Mutex
+	clock  func() time.Time
+	offset time.Duration
+	index  uint8
+	ram    [128]byte
+	// checked is when we last looked for alarms and updates.
+	checked time.Time
+}
+
+// NewRTC returns an RTC running on clock, in BCD and 24 hour mode.
+func NewRTC(clock func() time.Time) *RTC {
+	r := &RTC{clock: clock}
+	// 32.768kHz and 1024Hz periodic rate, as the BIOS sets it.
+	r.ram[RTCRegA] = 0x26
+	r.ram[RTCRegB] = RegB24Hr
+	r.ram[RTCRegD] = RegDVRT
+	return r
+}
+
+// HostClock returns the host's local time, as an RTC keeps it.
+func HostClock() time.Time {
+	n := time.Now()
+	_, off := n.Zone()
+	return n.UTC().Add(time.Duration(off) * time.Second)
+}
+
+// now returns the time. r.mu must be held.
+func (r *RTC) now() time.Time {
+	return r.clock().Add(r.offset)
+}
+
+// Now returns the time.
+func (r *RTC) Now() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.now()
+}
+
+// set sets the time. r.mu must be held.
+func (r *RTC) set(t time.Time) {
+	r.offset = t.Sub(r.clock())
+	r.checked = time.Time{}
+}
+
+// Set sets the time. Only the offset from the clock changes.
+func (r *RTC) Set(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.set(t)
+}
+
+// SetAlarm sets the alarm to go off at hour, min, sec every day,
+// and enables or disables the alarm interrupt.
+func (r *RTC) SetAlarm(hour, min, sec int, on bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ram[RTCHoursAlarm] = r.hour(hour)
+	r.ram[RTCMinutesAlarm] = r.encode(min)
+	r.ram[RTCSecondsAlarm] = r.encode(sec)
+	if on {
+		r.ram[RTCRegB] |= RegBAIE
+	} else {
+		r.ram[RTCRegB] &^= RegBAIE
+	}
+}
+
+// encode encodes a value as BCD or binary, as register B says.
+func (r *RTC) encode(v int) uint8 {
+	if r.ram[RTCRegB]&RegBDM != 0 {
+		return uint8(v)
+	}
+	return uint8(v/10<<4 | v%10)
+}
+
+func (r *RTC) decode(v uint8) int {
+	if r.ram[RTCRegB]&RegBDM != 0 {
+		return int(v)
+	}
+	return int(v>>4)*10 + int(v&0xf)
+}
+
+// hour encodes an hour, in 12 or 24 hour mode.
+func (r *RTC) hour(h int) uint8 {
+	if r.ram[RTCRegB]&RegB24Hr != 0 {
+		return r.encode(h)
+	}
+	h12 := h % 12
+	if h12 == 0 {
+		h12 = 12
+	}
+	v := r.encode(h12)
+	if h >= 12 {
+		v |= hourPM
+	}
+	return v
+}
+
+func (r *RTC) decodeHour(v uint8) int {
+	if r.ram[RTCRegB]&RegB24Hr != 0 {
+		return r.decode(v)
+	}
+	h := r.decode(v&^hourPM) % 12
+	if v&hourPM != 0 {
+		h += 12
+	}
+	return h
+}
+
+// latch puts the time in the time registers.
+func (r *RTC) latch(t time.Time) {
+	r.ram[RTCSeconds] = r.encode(t.Second())
+	r.ram[RTCMinutes] = r.encode(t.Minute())
+	r.ram[RTCHours] = r.hour(t.Hour())
+	r.ram[RTCDayOfWeek] = r.encode(int(t.Weekday()) + 1)
+	r.ram[RTCDayOfMonth] = r.encode(t.Day())
+	r.ram[RTCMonth] = r.encode(int(t.Month()))
+	r.ram[RTCYear] = r.encode(t.Year() % 100)
+	r.ram[RTCCentury] = r.encode(t.Year() / 100)
+}
+
+// registers returns the time in the time registers.
+func (r *RTC) registers() time.Time {
+	century := r.decode(r.ram[RTCCentury])
+	if century == 0 {
+		century = 20
+	}
+	return time.Date(century*100+r.decode(r.ram[RTCYear]), time.Month(r.decode(r.ram[RTCMonth])),
+		r.decode(r.ram[RTCDayOfMonth]), r.decodeHour(r.ram[RTCHours]), r.decode(r.ram[RTCMinutes]),
+		r.decode(r.ram[RTCSeconds]), 0, time.UTC)
+}
+
+// alarm says whether the alarm registers match t.
+func (r *RTC) alarm(t time.Time) bool {
+	for _, a := range []struct {
+		v uint8
+		f int
+	}{
+		{r.ram[RTCSecondsAlarm], t.Second()},
+		{r.ram[RTCMinutesAlarm], t.Minute()},
+	} {
+		if a.v&AlarmDontCare != AlarmDontCare && r.decode(a.v) != a.f {
+			return false
+		}
+	}
+	h := r.ram[RTCHoursAlarm]
+	return h&AlarmDontCare == AlarmDontCare || r.decodeHour(h) == t.Hour()
+}
+
+// check sets the flags in register C for what happened since the last check.
+func (r *RTC) check() {
+	n := r.now().Truncate(time.Second)
+	if r.checked.IsZero() || r.ram[RTCRegB]&RegBSet != 0 {
+		r.checked = n
+		return
+	}
+	if !n.After(r.checked) {
+		return
+	}
+	r.ram[RTCRegC] |= RegCUF
+	// No more than a day: after that, every alarm has gone off.
+	for t, i := r.checked.Add(time.Second), 0; !t.After(n) && i < 24*60*60; t, i = t.Add(time.Second), i+1 {
+		if r.alarm(t) {
+			r.ram[RTCRegC] |= RegCAF
+			break
+		}
+	}
+	r.checked = n
+	b, c := r.ram[RTCRegB], r.ram[RTCRegC]
+	if (b&RegBAIE != 0 && c&RegCAF != 0) || (b&RegBUIE != 0 && c&RegCUF != 0) {
+		r.ram[RTCRegC] |= RegCIRQF
+	}
+}
+
+// isTime says whether a register is part of the time.
+func isTime(i uint8) bool {
+	switch i {
+	case RTCSeconds, RTCMinutes, RTCHours, RTCDayOfWeek, RTCDayOfMonth, RTCMonth, RTCYear, RTCCentury:
+		return true
+	}
+	return false
+}
+
+// In implements Registers. Offset 0 is the index port and 1 the data port.
+func (r *RTC) In(off uint16) uint8 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off == 0 {
+		// The index port is write only.
+		return 0xff
+	}
+	i := r.index
+	switch {
+	case isTime(i):
+		if r.ram[RTCRegB]&RegBSet == 0 {
+			r.latch(r.now())
+		}
+	case i == RTCRegA:
+		// Updates take the first 244us of each second.
+		v := r.ram[RTCRegA] &^ RegAUIP
+		if r.ram[RTCRegB]&RegBSet == 0 && r.now().Nanosecond() < 244000 {
+			v |= RegAUIP
+		}
+		return v
+	case i == RTCRegC:
+		r.check()
+		v := r.ram[RTCRegC]
+		r.ram[RTCRegC] = 0
+		return v
+	}
+	return r.ram[i]
+}
+
+// Out implements Registers.
+func (r *RTC) Out(off uint16, v uint8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off == 0 {
+		r.index = v & 0x7f
+		return
+	}
+	i := r.index
+	switch {
+	case isTime(i):
+		// While SET is on, the time is in the registers, and it is
+		// set when SET goes off. Otherwise it is set now.
+		if r.ram[RTCRegB]&RegBSet == 0 {
+			r.latch(r.now())
+			r.ram[i] = v
+			r.set(r.registers())
+			return
+		}
+		r.ram[i] = v
+	case i == RTCRegA:
+		r.ram[i] = v &^ RegAUIP
+	case i == RTCRegB:
+		old := r.ram[RTCRegB]
+		t := r.now()
+		if old&RegBSet != 0 {
+			t = r.registers()
+		}
+		r.ram[RTCRegB] = v
+		// Latch in the new format, which might be different.
+		if v&RegBSet != 0 {
+			r.latch(t)
+		}
+		if v&RegBSet == 0 && old&RegBSet != 0 {
+			r.set(t)
+		}
+	case i == RTCRegC || i == RTCRegD:
+		// Read only.
+	default:
+		r.ram[i] = v
+	}
+}
@@ -0,0 +1,67 @@
+package devices
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTC(t *testing.T) {
+	clock := time.Date(2021, time.March, 4, 15, 16, 17, 500000000, time.UTC)
+	r := NewRTC(func() time.Time { return clock })
+	p := ByteWide(r)
+	read := func(i uint8) uint8 {
+		p.Out(0, 1, uint32(i))
+		return uint8(p.In(1, 1))
+	}
+	write := func(i, v uint8) {
+		p.Out(0, 1, uint32(i))
+		p.Out(1, 1, uint32(v))
+	}
+	for _, tt := range []struct {
+		reg  uint8
+		want uint8
+	}{
+		{RTCSeconds, 0x17}, {RTCMinutes, 0x16}, {RTCHours, 0x15}, {RTCDayOfWeek, 5},
+		{RTCDayOfMonth, 0x04}, {RTCMonth, 0x03}, {RTCYear, 0x21}, {RTCCentury, 0x20},
+		{RTCRegD, RegDVRT},
+	} {
+		if v := read(tt.reg); v != tt.want {
+			t.Errorf("Register %#x: got %#x, want %#x", tt.reg, v, tt.want)
+		}
+	}
+	// Binary, 12 hour mode.
+	write(RTCRegB, RegBDM)
+	if v := read(RTCHours); v != hourPM|3 {
+		t.Errorf("Hours in 12 hour binary mode: got %#x, want %#x", v, hourPM|3)
+	}
+	// Set the time to 2022-01-02 03:04:05, with SET on while we do it.
+	write(RTCRegB, RegBSet|RegBDM|RegB24Hr)
+	for _, w := range [][2]uint8{{RTCYear, 22}, {RTCMonth, 1}, {RTCDayOfMonth, 2}, {RTCHours, 3}, {RTCMinutes, 4}, {RTCSeconds, 5}} {
+		write(w[0], w[1])
+	}
+	if n := r.Now(); n.Year() != 2021 {
+		t.Errorf("Time changed while SET is on: %v", n)
+	}
+	write(RTCRegB, RegBDM|RegB24Hr)
+	if n, want := r.Now(), time.Date(2022, time.January, 2, 3, 4, 5, 0, time.UTC); !n.Equal(want) {
+		t.Errorf("Time: got %v, want %v", n, want)
+	}
+	// The clock runs on from the new time.
+	clock = clock.Add(time.Minute)
+	if v := read(RTCMinutes); v != 5 {
+		t.Errorf("Minutes a minute later: got %d, want 5", v)
+	}
+	// An alarm 10 seconds from now.
+	read(RTCRegC)
+	r.SetAlarm(3, 5, 15, true)
+	if v := read(RTCRegC); v&RegCAF != 0 {
+		t.Errorf("Register C before the alarm: got %#x, want AF clear", v)
+	}
+	clock = clock.Add(20 * time.Second)
+	if v := read(RTCRegC); v&(RegCAF|RegCIRQF) != RegCAF|RegCIRQF {
+		t.Errorf("Register C after the alarm: got %#x, want AF and IRQF set", v)
+	}
+	if v := read(RTCRegC); v != 0 {
+		t.Errorf("Register C read twice: got %#x, want 0", v)
+	}
+}
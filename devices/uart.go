@@ -0,0 +1,277 @@
+// Package devices models the hardware UEFI apps poke directly,
+// through IO ports or memory mapped IO, rather than through a protocol.
+package devices
+
+import (
+	"io"
+	"sync"
+)
+
+// COM1 is the usual base port of the first UART.
+const COM1 = 0x3f8
+
+// 16550 registers, as offsets from the base port. Some share an
+// offset, and which one you get depends on the direction, or on the
+// divisor latch access bit (DLAB) in the LCR.
+const (
+	RBR = 0 // receive buffer, on read
+	THR = 0 // transmit holding, on write
+	DLL = 0 // divisor latch low, with DLAB
+	IER = 1 // interrupt enable
+	DLM = 1 // divisor latch high, with DLAB
+	IIR = 2 // interrupt identification, on read
+	FCR = 2 // FIFO control, on write
+	LCR = 3 // line control
+	MCR = 4 // modem control
+	LSR = 5 // line status
+	MSR = 6 // modem status
+	SCR = 7 // scratch
+)
+
+// Register bits.
+const (
+	LCRDLAB = 0x80
+
+	MCRDTR  = 0x01
+	MCRRTS  = 0x02
+	MCROUT1 = 0x04
+	MCROUT2 = 0x08
+	MCRLoop = 0x10
+
+	LSRDR   = 0x01 // data ready
+	LSRTHRE = 0x20 // transmit holding register empty
+	LSRTEMT = 0x40 // transmitter empty
+
+	MSRCTS = 0x10
+	MSRDSR = 0x20
+	MSRRI  = 0x40
+	MSRDCD = 0x80
+
+	IERRDA  = 0x01 // received data available
+	IERTHRE = 0x02
+
+	IIRNone   = 0x01
+	IIRTHRE   = 0x02
+	IIRRDA    = 0x04
+	IIRFIFOOn = 0xc0
+
+	FCREnable = 0x01
+)
+
+// UART is a 16550. Output is written as soon as it is sent, so the
+// transmitter is always empty. There is no interrupt controller, so
+// the interrupt registers only tell a guest that polls what would
+// have interrupted it.
+type UART struct {
+	mu  sync.Mutex
+	out io.Writer
+	// in is what has been received and not yet read.
+	in                                []byte
+	ier, fcr, lcr, mcr, scr, dll, dlm uint8
+}
+
+// NewUART returns a UART that sends to w, which may be nil.
+func NewUART(w io.Writer) *UART {
+	u := &UART{out: w}
+	u.Reset()
+	return u
+}
+
+// Reset puts the registers back as they are at power on,
+// with 115200 baud, 8 bits, no parity and one stop bit.
+// Anything received and not read is dropped.
+func (u *UART) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.in = nil
+	u.ier, u.fcr, u.mcr, u.scr = 0, 0, 0, 0
+	u.lcr = 3
+	u.dll, u.dlm = 1, 0
+}
+
+// Feed reads from r until it gets an error, and receives what it reads.
+// It is meant to run in its own goroutine.
+func (u *UART) Feed(r io.Reader) {
+	var b [256]byte
+	for {
+		n, err := r.Read(b[:])
+		u.receive(b[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (u *UART) receive(b []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.in = append(u.in, b...)
+}
+
+// send sends a byte, or, in loopback mode, receives it.
+// u.mu must be held.
+func (u *UART) send(b byte) {
+	if u.mcr&MCRLoop != 0 {
+		u.in = append(u.in, b)
+		return
+	}
+	if u.out != nil {
+		u.out.Write([]byte{b})
+	}
+}
+
+// In reads the register at offset off.
+func (u *UART) In(off uint16) uint8 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dlab := u.lcr&LCRDLAB != 0
+	switch off {
+	case RBR:
+		if dlab {
+			return u.dll
+		}
+		if len(u.in) == 0 {
+			return 0
+		}
+		b := u.in[0]
+		u.in = u.in[1:]
+		return b
+	case IER:
+		if dlab {
+			return u.dlm
+		}
+		return u.ier
+	case IIR:
+		v := uint8(IIRNone)
+		switch {
+		case u.ier&IERRDA != 0 && len(u.in) > 0:
+			v = IIRRDA
+		case u.ier&IERTHRE != 0:
+			v = IIRTHRE
+		}
+		if u.fcr&FCREnable != 0 {
+			v |= IIRFIFOOn
+		}
+		return v
+	case LCR:
+		return u.lcr
+	case MCR:
+		return u.mcr
+	case LSR:
+		v := uint8(LSRTHRE | LSRTEMT)
+		if len(u.in) > 0 {
+			v |= LSRDR
+		}
+		return v
+	case MSR:
+		if u.mcr&MCRLoop == 0 {
+			// Someone is always there.
+			return MSRCTS | MSRDSR | MSRDCD
+		}
+		// In loopback, the modem control outputs come back as the inputs.
+		var v uint8
+		for _, b := range []struct{ mcr, msr uint8 }{{MCRRTS, MSRCTS}, {MCRDTR, MSRDSR}, {MCROUT1, MSRRI}, {MCROUT2, MSRDCD}} {
+			if u.mcr&b.mcr != 0 {
+				v |= b.msr
+			}
+		}
+		return v
+	case SCR:
+		return u.scr
+	}
+	return 0xff
+}
+
+// Out writes v to the register at offset off.
+func (u *UART) Out(off uint16, v uint8) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dlab := u.lcr&LCRDLAB != 0
+	switch off {
+	case THR:
+		if dlab {
+			u.dll = v
+			return
+		}
+		u.send(v)
+	case IER:
+		if dlab {
+			u.dlm = v
+			return
+		}
+		u.ier = v & 0xf
+	case FCR:
+		u.fcr = v
+	case LCR:
+		u.lcr = v
+	case MCR:
+		u.mcr = v & 0x1f
+	case SCR:
+		u.scr = v
+	}
+	// LSR and MSR are read only.
+}
+
+// Write sends b. It is for the Serial IO protocol, which does not go
+// through the registers.
+func (u *UART) Write(b []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range b {
+		u.send(c)
+	}
+	return len(b), nil
+}
+
+// Read reads what has been received, up to len(b), and does not wait.
+func (u *UART) Read(b []byte) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := copy(b, u.in)
+	u.in = u.in[n:]
+	return n
+}
+
+// Pending says how much has been received and not read.
+func (u *UART) Pending() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.in)
+}
+
+// Baud returns the baud rate the divisor is set for.
+func (u *UART) Baud() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	d := int(u.dlm)<<8 | int(u.dll)
+	if d == 0 {
+		return 0
+	}
+	return 115200 / d
+}
+
+// SetLine sets the baud rate and the LCR, as a driver would.
+func (u *UART) SetLine(baud int, lcr uint8) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	d := 1
+	if baud > 0 {
+		d = 115200 / baud
+	}
+	u.dll, u.dlm = uint8(d), uint8(d>>8)
+	u.lcr = lcr &^ LCRDLAB
+}
+
+// Control returns the MCR.
+func (u *UART) Control() uint8 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.mcr
+}
+
+// SetControl sets the MCR.
+func (u *UART) SetControl(mcr uint8) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.mcr = mcr & 0x1f
+}
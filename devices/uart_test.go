@@ -0,0 +1,59 @@
+package devices
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUART(t *testing.T) {
+	var out bytes.Buffer
+	u := NewUART(&out)
+	if v := u.In(LSR); v != LSRTHRE|LSRTEMT {
+		t.Errorf("LSR: got %#x, want %#x", v, LSRTHRE|LSRTEMT)
+	}
+	for _, c := range []byte("hi") {
+		u.Out(THR, c)
+	}
+	if out.String() != "hi" {
+		t.Errorf("Output: got %q, want %q", out.String(), "hi")
+	}
+	u.Feed(strings.NewReader("ok"))
+	if v := u.In(LSR); v&LSRDR == 0 {
+		t.Errorf("LSR after input: got %#x, want DR set", v)
+	}
+	for _, want := range []byte("ok") {
+		if c := u.In(RBR); c != want {
+			t.Errorf("RBR: got %q, want %q", c, want)
+		}
+	}
+	if v := u.In(LSR); v&LSRDR != 0 {
+		t.Errorf("LSR after reading it all: got %#x, want DR clear", v)
+	}
+	// 9600 baud: a divisor of 12.
+	u.Out(LCR, LCRDLAB|3)
+	u.Out(DLL, 12)
+	u.Out(DLM, 0)
+	u.Out(LCR, 3)
+	if b := u.Baud(); b != 9600 {
+		t.Errorf("Baud: got %d, want 9600", b)
+	}
+	u.Out(IER, IERRDA)
+	if v := u.In(IER); v != IERRDA {
+		t.Errorf("IER: got %#x, want %#x", v, IERRDA)
+	}
+	u.Out(MCR, MCRLoop|MCRRTS)
+	u.Out(THR, 'x')
+	if out.String() != "hi" {
+		t.Errorf("Loopback: %q was sent", out.String())
+	}
+	if v := u.In(IIR); v != IIRRDA {
+		t.Errorf("IIR: got %#x, want %#x", v, IIRRDA)
+	}
+	if c := u.In(RBR); c != 'x' {
+		t.Errorf("Loopback: got %q, want 'x'", c)
+	}
+	if v := u.In(MSR); v != MSRCTS {
+		t.Errorf("MSR in loopback: got %#x, want %#x", v, MSRCTS)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2012-2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,amd64
+
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+	"github.com/linuxboot/voodoo/services"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi/depex"
+)
+
+// dxeDriver is a DXE driver file in a firmware volume.
+type dxeDriver struct {
+	file  guid.GUID
+	name  string
+	image []byte
+	depex []uefi.DepExOp
+}
+
+// dxeDrivers is a fiano visitor that finds the DXE drivers in a
+// firmware image, in order, with their PE32, DEPEX, and user
+// interface sections, wherever they are encapsulated.
+type dxeDrivers struct {
+	drivers []*dxeDriver
+	cur     *dxeDriver
+}
+
+// Run implements uefi.Visitor.
+func (v *dxeDrivers) Run(f uefi.Firmware) error {
+	return f.Apply(v)
+}
+
+// Visit implements uefi.Visitor.
+func (v *dxeDrivers) Visit(f uefi.Firmware) error {
+	switch f := f.(type) {
+	case *uefi.File:
+		if f.Header.Type != uefi.FVFileTypeDriver {
+			break
+		}
+		v.cur = &dxeDriver{file: f.Header.GUID}
+		err := f.ApplyChildren(v)
+		v.drivers = append(v.drivers, v.cur)
+		v.cur = nil
+		return err
+	case *uefi.Section:
+		if v.cur == nil {
+			break
+		}
+		switch f.Header.Type {
+		case uefi.SectionTypePE32:
+			// The image is what follows the header, which is
+			// longer if the size did not fit.
+			b, n := f.Buf(), 4
+			if f.Header.Size == [3]uint8{0xff, 0xff, 0xff} {
+				n = 8
+			}
+			if len(b) < n {
+				return fmt.Errorf("%v: PE32 section is %d bytes", v.cur.file, len(b))
+			}
+			v.cur.image = b[n:]
+		case uefi.SectionTypeDXEDepEx:
+			v.cur.depex = f.DepEx
+		case uefi.SectionTypeUserInterface:
+			v.cur.name = f.Name
+		}
+	}
+	return f.ApplyChildren(v)
+}
+
+// loadFV loads the DXE drivers in the firmware image in file n, a ROM
+// or just a volume, and adds them, with their dependency expressions,
+// to run before the main image. Drivers that can't be loaded are
+// left out, and said so, since one bad driver should not stop us
+// looking at the rest.
+func loadFV(t trace.Trace, n string) error {
+	buf, err := ioutil.ReadFile(n)
+	if err != nil {
+		return err
+	}
+	fw, err := uefi.Parse(buf)
+	if err != nil {
+		return err
+	}
+	v := &dxeDrivers{}
+	if err := v.Run(fw); err != nil {
+		return err
+	}
+	if len(v.drivers) == 0 {
+		return fmt.Errorf("no DXE drivers")
+	}
+	for _, d := range v.drivers {
+		name := d.file.String()
+		if d.name != "" {
+			name = fmt.Sprintf("%s(%v)", d.name, d.file)
+		}
+		if d.image == nil {
+			log.Printf("%s: no PE32 section, leaving it out", name)
+			continue
+		}
+		e, err := depex.Parse(d.depex)
+		if err != nil {
+			log.Printf("%s: DEPEX: %v, leaving it out", name, err)
+			continue
+		}
+		f, err := pe.NewFile(bytes.NewReader(d.image))
+		if err != nil {
+			log.Printf("%s: %v, leaving it out", name, err)
+			continue
+		}
+		entry, driver, err := loadImage(t, f)
+		if err != nil {
+			log.Printf("%s: %v, leaving it out", name, err)
+			continue
+		}
+		file := d.file
+		if err := services.AddDriver(name, &file, e, entry, driver); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		Debug("DXE driver %s: entry %#x, %v", name, entry, e.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package graphics
+
+import (
+	"fmt"
+
+	"github.com/linuxboot/voodoo/console"
+)
+
+// Palette is the EFI text colors as pixels. The values are edk2's.
+var Palette = [16][PixelSize]byte{
+	console.Black:        {0x00, 0x00, 0x00},
+	console.Blue:         {0x98, 0x00, 0x00},
+	console.Green:        {0x00, 0x98, 0x00},
+	console.Cyan:         {0x98, 0x98, 0x00},
+	console.Red:          {0x00, 0x00, 0x98},
+	console.Magenta:      {0x98, 0x00, 0x98},
+	console.Brown:        {0x00, 0x98, 0x98},
+	console.LightGray:    {0x98, 0x98, 0x98},
+	console.DarkGray:     {0x30, 0x30, 0x30},
+	console.LightBlue:    {0xff, 0x00, 0x00},
+	console.LightGreen:   {0x00, 0xff, 0x00},
+	console.LightCyan:    {0xff, 0xff, 0x00},
+	console.LightRed:     {0x00, 0x00, 0xff},
+	console.LightMagenta: {0xff, 0x00, 0xff},
+	console.Yellow:       {0x00, 0xff, 0xff},
+	console.White:        {0xff, 0xff, 0xff},
+}
+
+// cursorRows are the glyph rows the cursor, an underline, is drawn on.
+var cursorRows = []int{GlyphHeight - 2, GlyphHeight - 1}
+
+// Fits says whether a text mode fits on the framebuffer.
+func (fb *Framebuffer) Fits(m console.Mode) bool {
+	return m.Cols*GlyphWidth <= fb.Width && m.Rows*GlyphHeight <= fb.Height
+}
+
+// TextConsole draws a text screen on a framebuffer, as edk2's
+// GraphicsConsole does: the text is centered, and the rest of the
+// framebuffer is black.
+type TextConsole struct {
+	fb *Framebuffer
+	s  *console.Screen
+	// What the framebuffer has on it: the geometry it was
+	// drawn for, and where the cursor is, if it is drawn.
+	width, height int
+	cols, rows    int
+	ccol, crow    int
+	cursor        bool
+}
+
+// NewTextConsole returns a TextConsole that draws s on fb.
+func NewTextConsole(fb *Framebuffer, s *console.Screen) *TextConsole {
+	return &TextConsole{fb: fb, s: s}
+}
+
+// Redraw makes the next Draw clear the framebuffer and draw everything.
+// Call it when something else has drawn on the framebuffer.
+func (c *TextConsole) Redraw() {
+	c.cols = 0
+}
+
+// origin returns the top left of the text.
+func (c *TextConsole) origin() (int, int) {
+	return (c.fb.Width - c.s.Cols*GlyphWidth) / 2, (c.fb.Height - c.s.Rows*GlyphHeight) / 2
+}
+
+// Draw draws what changed on the screen since the last Draw.
+func (c *TextConsole) Draw(m Memory) error {
+	s, fb := c.s, c.fb
+	if !fb.Fits(console.Mode{Cols: s.Cols, Rows: s.Rows}) {
+		return fmt.Errorf("text mode %dx%d does not fit on %dx%d", s.Cols, s.Rows, fb.Width, fb.Height)
+	}
+	todo := make([]bool, s.Rows)
+	for _, r := range s.Damage() {
+		todo[r] = true
+	}
+	if c.width != fb.Width || c.height != fb.Height || c.cols != s.Cols || c.rows != s.Rows {
+		if err := fb.Clear(m); err != nil {
+			return err
+		}
+		for r := range todo {
+			todo[r] = true
+		}
+		c.width, c.height, c.cols, c.rows = fb.Width, fb.Height, s.Cols, s.Rows
+		c.cursor = false
+	}
+	// Drawing a row without the cursor erases it.
+	if c.cursor && c.crow < s.Rows {
+		todo[c.crow] = true
+	}
+	c.cursor = s.CursorVisible
+	c.ccol, c.crow = s.Col, s.Row
+	if c.cursor {
+		todo[c.crow] = true
+	}
+	for r, t := range todo {
+		if !t {
+			continue
+		}
+		if err := c.drawRow(m, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drawRow draws a row of text, and the cursor if it is on it.
+func (c *TextConsole) drawRow(m Memory, row int) error {
+	s := c.s
+	stride := s.Cols * GlyphWidth * PixelSize
+	b := make([]byte, stride*GlyphHeight)
+	for col := 0; col < s.Cols; col++ {
+		cell := s.Cell(col, row)
+		g := *GlyphFor(cell.Ch)
+		if c.cursor && col == c.ccol && row == c.crow {
+			for _, y := range cursorRows {
+				g[y] = 0xff
+			}
+		}
+		fg, bg := Palette[cell.Attr&0xf], Palette[(cell.Attr>>4)&7]
+		for y, bits := range g {
+			p := b[y*stride+col*GlyphWidth*PixelSize:]
+			for x := 0; x < GlyphWidth; x++ {
+				px := bg
+				if bits&(0x80>>x) != 0 {
+					px = fg
+				}
+				copy(p[x*PixelSize:], px[:])
+			}
+		}
+	}
+	ox, oy := c.origin()
+	for y := 0; y < GlyphHeight; y++ {
+		if err := m.Write(c.fb.Pixel(ox, oy+row*GlyphHeight+y), b[y*stride:(y+1)*stride]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
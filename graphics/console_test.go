@@ -0,0 +1,63 @@
+package graphics
+
+import (
+	"testing"
+
+	"github.com/linuxboot/voodoo/console"
+)
+
+func TestTextConsole(t *testing.T) {
+	// 80x25 is 640x400; leave a border of 8 pixels.
+	fb := &Framebuffer{Width: 656, Height: 416}
+	m := make(mem, fb.Size())
+	s := console.New(nil, false)
+	c := NewTextConsole(fb, s)
+	if err := s.SetAttribute(console.Yellow | console.Blue<<4); err != nil {
+		t.Fatal(err)
+	}
+	s.WriteString("A")
+	if err := c.Draw(m); err != nil {
+		t.Fatalf("Draw: got %v, want nil", err)
+	}
+	// Row 4 of the A is .##.##..
+	for x, want := range []int{console.Blue, console.Yellow, console.Yellow, console.Blue} {
+		if p := m.px(fb, 8+x, 8+4); p != Palette[want] {
+			t.Errorf("A: pixel %d of row 4 is %#x, want %#x", x, p, Palette[want])
+		}
+	}
+	if p := m.px(fb, 0, 0); p != Palette[console.Black] {
+		t.Errorf("Border: got %#x, want black", p)
+	}
+	// The cursor is after the A, in the foreground color of its cell,
+	// which is the default.
+	under := 8 + GlyphHeight - 1
+	if p := m.px(fb, 8+GlyphWidth, under); p != Palette[console.LightGray] {
+		t.Errorf("Cursor: got %#x, want %#x", p, Palette[console.LightGray])
+	}
+	s.EnableCursor(false)
+	if err := c.Draw(m); err != nil {
+		t.Fatalf("Draw: got %v, want nil", err)
+	}
+	if p := m.px(fb, 8+GlyphWidth, under); p != Palette[console.Black] {
+		t.Errorf("Hidden cursor: got %#x, want black", p)
+	}
+	if err := s.SetMode(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Draw(m); err == nil {
+		t.Errorf("Draw 80x50 on %dx%d: got nil, want error", fb.Width, fb.Height)
+	}
+}
+
+func TestGlyphFor(t *testing.T) {
+	if g := GlyphFor('A'); g[4] != 0x6c {
+		t.Errorf("A: row 4 is %#x, want 0x6c", g[4])
+	}
+	// BOXDRAW_DOWN_RIGHT: nothing above the middle, the line down the middle below it.
+	if g := GlyphFor(0x250c); g[0] != 0 || g[15] != 0x18 || g[7] != 0x1f {
+		t.Errorf("BOXDRAW_DOWN_RIGHT: got %#x", *g)
+	}
+	if g := GlyphFor(0x4e00); *g != missing {
+		t.Errorf("U+4E00: got %#x, want the missing glyph", *g)
+	}
+}
@@ -0,0 +1,249 @@
+// Package graphics models the linear framebuffer behind the UEFI
+// Graphics Output Protocol. The framebuffer lives in guest memory,
+// which is reached through a Memory. Pixels are 32 bits, blue, green,
+// red and reserved, which is also the layout of a Blt pixel.
+package graphics
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Memory is guest memory. trace.Trace is one.
+type Memory interface {
+	Read(addr uintptr, b []byte) error
+	Write(addr uintptr, b []byte) error
+}
+
+// Mode is a graphics mode.
+type Mode struct {
+	Width  int
+	Height int
+}
+
+// Modes are the modes we support.
+var Modes = []Mode{
+	{Width: 640, Height: 480},
+	{Width: 800, Height: 600},
+	{Width: 1024, Height: 768},
+	{Width: 1280, Height: 1024},
+}
+
+// PixelSize is the size of a pixel, in the framebuffer and in Blt buffers.
+const PixelSize = 4
+
+// Blt operations.
+const (
+	VideoFill = iota
+	VideoToBltBuffer
+	BufferToVideo
+	VideoToVideo
+)
+
+// Framebuffer is a framebuffer in guest memory.
+type Framebuffer struct {
+	Base   uintptr
+	Width  int
+	Height int
+}
+
+// Size returns the size of the framebuffer in bytes.
+func (fb *Framebuffer) Size() int {
+	return fb.Width * fb.Height * PixelSize
+}
+
+// Stride returns the size of a row in bytes. There's no padding.
+func (fb *Framebuffer) Stride() int {
+	return fb.Width * PixelSize
+}
+
+// Pixel returns the address of the pixel at x, y.
+func (fb *Framebuffer) Pixel(x, y int) uintptr {
+	return fb.Base + uintptr(y*fb.Stride()+x*PixelSize)
+}
+
+// check checks that a rectangle is inside the framebuffer.
+// It is written so that nothing can overflow.
+func (fb *Framebuffer) check(x, y, w, h int) error {
+	if x < 0 || y < 0 || w <= 0 || h <= 0 || w > fb.Width || h > fb.Height || x > fb.Width-w || y > fb.Height-h {
+		return fmt.Errorf("%dx%d at (%d,%d) is not inside %dx%d", w, h, x, y, fb.Width, fb.Height)
+	}
+	return nil
+}
+
+// inside checks, before they are converted to int, that a rectangle
+// from the guest is inside the framebuffer.
+func (fb *Framebuffer) inside(x, y, w, h uint64) error {
+	W, H := uint64(fb.Width), uint64(fb.Height)
+	if w == 0 || h == 0 || w > W || h > H || x > W-w || y > H-h {
+		return fmt.Errorf("%#x x %#x at (%#x,%#x) is not inside %dx%d", w, h, x, y, fb.Width, fb.Height)
+	}
+	return nil
+}
+
+// maxBuffer bounds the coordinates and delta of a Blt buffer. The
+// guest's memory bounds the buffer itself; this only keeps the
+// address arithmetic from overflowing.
+const maxBuffer = 1 << 24
+
+// inBuffer checks that a rectangle in a Blt buffer, of a size inside
+// the framebuffer, can be addressed.
+func inBuffer(x, y, delta uint64) error {
+	if x > maxBuffer || y > maxBuffer || delta > maxBuffer {
+		return fmt.Errorf("(%#x,%#x) in a buffer with delta %#x: too large", x, y, delta)
+	}
+	return nil
+}
+
+// Clear sets the framebuffer to black.
+func (fb *Framebuffer) Clear(m Memory) error {
+	return fb.Fill(m, [PixelSize]byte{}, 0, 0, fb.Width, fb.Height)
+}
+
+// Fill fills a rectangle with a pixel.
+func (fb *Framebuffer) Fill(m Memory, px [PixelSize]byte, x, y, w, h int) error {
+	if err := fb.check(x, y, w, h); err != nil {
+		return err
+	}
+	row := make([]byte, w*PixelSize)
+	for i := 0; i < len(row); i += PixelSize {
+		copy(row[i:], px[:])
+	}
+	for r := y; r < y+h; r++ {
+		if err := m.Write(fb.Pixel(x, r), row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToBuffer copies the w x h rectangle at sx, sy to dx, dy in the
+// buffer at buf, which has delta bytes per row.
+func (fb *Framebuffer) ToBuffer(m Memory, buf uintptr, delta, sx, sy, dx, dy, w, h int) error {
+	if err := fb.check(sx, sy, w, h); err != nil {
+		return err
+	}
+	row := make([]byte, w*PixelSize)
+	for r := 0; r < h; r++ {
+		if err := m.Read(fb.Pixel(sx, sy+r), row); err != nil {
+			return err
+		}
+		if err := m.Write(buf+uintptr((dy+r)*delta+dx*PixelSize), row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FromBuffer copies the w x h rectangle at sx, sy in the buffer at buf,
+// which has delta bytes per row, to dx, dy.
+func (fb *Framebuffer) FromBuffer(m Memory, buf uintptr, delta, sx, sy, dx, dy, w, h int) error {
+	if err := fb.check(dx, dy, w, h); err != nil {
+		return err
+	}
+	row := make([]byte, w*PixelSize)
+	for r := 0; r < h; r++ {
+		if err := m.Read(buf+uintptr((sy+r)*delta+sx*PixelSize), row); err != nil {
+			return err
+		}
+		if err := m.Write(fb.Pixel(dx, dy+r), row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy copies the w x h rectangle at sx, sy to dx, dy. They can overlap.
+func (fb *Framebuffer) Copy(m Memory, sx, sy, dx, dy, w, h int) error {
+	if err := fb.check(sx, sy, w, h); err != nil {
+		return err
+	}
+	if err := fb.check(dx, dy, w, h); err != nil {
+		return err
+	}
+	rows := make([][]byte, h)
+	for r := range rows {
+		rows[r] = make([]byte, w*PixelSize)
+		if err := m.Read(fb.Pixel(sx, sy+r), rows[r]); err != nil {
+			return err
+		}
+	}
+	for r, row := range rows {
+		if err := m.Write(fb.Pixel(dx, dy+r), row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Blt does a Blt operation, with the arguments of EFI_GRAPHICS_OUTPUT_PROTOCOL.Blt,
+// which are UINTN and come from the guest: they are checked before they
+// are converted. A delta of 0 means the buffer is w pixels wide.
+func (fb *Framebuffer) Blt(m Memory, buf uintptr, op int, sx, sy, dx, dy, w, h, delta uint64) error {
+	var err error
+	switch op {
+	case VideoFill:
+		err = fb.inside(dx, dy, w, h)
+	case VideoToBltBuffer:
+		if err = fb.inside(sx, sy, w, h); err == nil {
+			err = inBuffer(dx, dy, delta)
+		}
+	case BufferToVideo:
+		if err = fb.inside(dx, dy, w, h); err == nil {
+			err = inBuffer(sx, sy, delta)
+		}
+	case VideoToVideo:
+		if err = fb.inside(sx, sy, w, h); err == nil {
+			err = fb.inside(dx, dy, w, h)
+		}
+	default:
+		return fmt.Errorf("Blt operation %d: only 0-3 are supported", op)
+	}
+	if err != nil {
+		return err
+	}
+	if delta == 0 {
+		delta = w * PixelSize
+	}
+	switch op {
+	case VideoFill:
+		var px [PixelSize]byte
+		if err := m.Read(buf, px[:]); err != nil {
+			return err
+		}
+		return fb.Fill(m, px, int(dx), int(dy), int(w), int(h))
+	case VideoToBltBuffer:
+		return fb.ToBuffer(m, buf, int(delta), int(sx), int(sy), int(dx), int(dy), int(w), int(h))
+	case BufferToVideo:
+		return fb.FromBuffer(m, buf, int(delta), int(sx), int(sy), int(dx), int(dy), int(w), int(h))
+	}
+	return fb.Copy(m, int(sx), int(sy), int(dx), int(dy), int(w), int(h))
+}
+
+// Image returns the framebuffer as an image.
+func (fb *Framebuffer) Image(m Memory) (*image.RGBA, error) {
+	b := make([]byte, fb.Size())
+	if err := m.Read(fb.Base, b); err != nil {
+		return nil, err
+	}
+	i := image.NewRGBA(image.Rect(0, 0, fb.Width, fb.Height))
+	for y := 0; y < fb.Height; y++ {
+		for x := 0; x < fb.Width; x++ {
+			p := b[y*fb.Stride()+x*PixelSize:]
+			i.SetRGBA(x, y, color.RGBA{R: p[2], G: p[1], B: p[0], A: 0xff})
+		}
+	}
+	return i, nil
+}
+
+// WritePNG writes the framebuffer to w as a PNG.
+func (fb *Framebuffer) WritePNG(m Memory, w io.Writer) error {
+	i, err := fb.Image(m)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, i)
+}
@@ -0,0 +1,123 @@
+package graphics
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// mem is guest memory for tests.
+type mem []byte
+
+func (m mem) Read(addr uintptr, b []byte) error {
+	if int(addr)+len(b) > len(m) {
+		return fmt.Errorf("read %#x bytes at %#x: out of range", len(b), addr)
+	}
+	copy(b, m[addr:])
+	return nil
+}
+
+func (m mem) Write(addr uintptr, b []byte) error {
+	if int(addr)+len(b) > len(m) {
+		return fmt.Errorf("write %#x bytes at %#x: out of range", len(b), addr)
+	}
+	copy(m[addr:], b)
+	return nil
+}
+
+var (
+	red  = [PixelSize]byte{0, 0, 0xff, 0}
+	blue = [PixelSize]byte{0xff, 0, 0, 0}
+)
+
+// newFB returns a 16x8 framebuffer at 0, and a 64-byte buffer after it.
+func newFB() (*Framebuffer, mem, uintptr) {
+	fb := &Framebuffer{Base: 0, Width: 16, Height: 8}
+	return fb, make(mem, fb.Size()+64), uintptr(fb.Size())
+}
+
+func (m mem) px(fb *Framebuffer, x, y int) [PixelSize]byte {
+	var p [PixelSize]byte
+	copy(p[:], m[fb.Pixel(x, y):])
+	return p
+}
+
+func TestBlt(t *testing.T) {
+	fb, m, buf := newFB()
+	copy(m[buf:], red[:])
+	if err := fb.Blt(m, buf, VideoFill, 0, 0, 2, 1, 3, 2, 0); err != nil {
+		t.Fatalf("VideoFill: got %v, want nil", err)
+	}
+	if p := m.px(fb, 4, 2); p != red {
+		t.Errorf("VideoFill: pixel (4,2) is %#x, want %#x", p, red)
+	}
+	if p := m.px(fb, 5, 2); p != [PixelSize]byte{} {
+		t.Errorf("VideoFill: pixel (5,2) is %#x, want 0", p)
+	}
+	// Overlapping copy one to the right.
+	if err := fb.Blt(m, 0, VideoToVideo, 2, 1, 3, 1, 3, 2, 0); err != nil {
+		t.Fatalf("VideoToVideo: got %v, want nil", err)
+	}
+	if p := m.px(fb, 5, 2); p != red {
+		t.Errorf("VideoToVideo: pixel (5,2) is %#x, want %#x", p, red)
+	}
+	// A 2x2 buffer, 3 pixels wide, of blue.
+	for i := 0; i < 6; i++ {
+		copy(m[int(buf)+i*PixelSize:], blue[:])
+	}
+	if err := fb.Blt(m, buf, BufferToVideo, 1, 0, 10, 6, 2, 2, 3*PixelSize); err != nil {
+		t.Fatalf("BufferToVideo: got %v, want nil", err)
+	}
+	if p := m.px(fb, 11, 7); p != blue {
+		t.Errorf("BufferToVideo: pixel (11,7) is %#x, want %#x", p, blue)
+	}
+	if err := fb.Blt(m, buf, VideoToBltBuffer, 4, 2, 0, 0, 1, 1, 0); err != nil {
+		t.Fatalf("VideoToBltBuffer: got %v, want nil", err)
+	}
+	if !bytes.Equal(m[buf:buf+PixelSize], red[:]) {
+		t.Errorf("VideoToBltBuffer: got %#x, want %#x", m[buf:buf+PixelSize], red)
+	}
+	for i, bad := range []struct {
+		op                        int
+		sx, sy, dx, dy, w, h, dlt uint64
+	}{
+		{op: VideoFill, dx: 15, w: 2, h: 1},
+		{op: VideoToVideo, w: 0, h: 1},
+		{op: 7, w: 1, h: 1},
+		// Sizes from the guest that overflow an int.
+		{op: VideoFill, dx: 1, w: 0x7fffffffffffffff, h: 1},
+		{op: VideoFill, dy: 1, w: 1, h: 0xffffffffffffffff},
+		{op: VideoToVideo, sx: 0xfffffffffffffff0, dx: 0, w: 0x20, h: 1},
+		{op: BufferToVideo, dx: 0xffffffffffffffff, w: 2, h: 1},
+		// Buffer coordinates whose addresses overflow.
+		{op: VideoToBltBuffer, dx: 1 << 62, w: 1, h: 1},
+		{op: BufferToVideo, sy: 1, w: 1, h: 1, dlt: 1 << 63},
+	} {
+		if err := fb.Blt(m, buf, bad.op, bad.sx, bad.sy, bad.dx, bad.dy, bad.w, bad.h, bad.dlt); err == nil {
+			t.Errorf("Test %d: Blt(%+v): got nil, want error", i, bad)
+		}
+	}
+}
+
+func TestPNG(t *testing.T) {
+	fb, m, _ := newFB()
+	if err := fb.Fill(m, red, 0, 0, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := fb.WritePNG(m, &b); err != nil {
+		t.Fatalf("WritePNG: got %v, want nil", err)
+	}
+	i, err := png.Decode(&b)
+	if err != nil {
+		t.Fatalf("png.Decode: got %v, want nil", err)
+	}
+	if got, want := color.RGBAModel.Convert(i.At(0, 0)), (color.RGBA{R: 0xff, A: 0xff}); got != want {
+		t.Errorf("pixel 0,0: got %v, want %v", got, want)
+	}
+	if i.Bounds().Dx() != 16 || i.Bounds().Dy() != 8 {
+		t.Errorf("size: got %v, want 16x8", i.Bounds())
+	}
+}
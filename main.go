@@ -11,12 +11,20 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"reflect"
+	"strings"
+	"time"
 
+	"github.com/linuxboot/voodoo/console"
+	"github.com/linuxboot/voodoo/devices"
+	"github.com/linuxboot/voodoo/graphics"
 	"github.com/linuxboot/voodoo/services"
 	"github.com/linuxboot/voodoo/trace"
 	"github.com/linuxboot/voodoo/trace/kvm"
+	"github.com/linuxboot/voodoo/uefi/fmp"
+	"github.com/linuxboot/voodoo/uefi/smbios"
 	"golang.org/x/sys/unix"
 )
 
@@ -32,21 +40,188 @@ var (
 	debug           = flag.Bool("debug", false, "Enable debug prints")
 	dryrun          = flag.Bool("dryrun", false, "set up but don't run")
 	regpath         = flag.String("registerfile", "", "file to log registers to, in .csv format")
-	handleConsoleIO = flag.Bool("doIO", false, "break glass -- enable this to check IO exits for console")
+	handleConsoleIO = flag.Bool("doIO", false, "break glass -- enable this to see COM1 output on stdout, if there is no -serial-out")
+	serialIn        = flag.String("serial-in", "", "where COM1 input comes from: stdin, which then no longer goes to the console, or a unix socket")
+	serialOut       = flag.String("serial-out", "", "file to write COM1 output to; if -serial-in is a socket, the default is the socket")
+	consoleMode     = flag.String("console", "ansi", "how to show the text console: ansi (a screen drawn with escape sequences) or plain (what is written, as it is written, e.g. for logs)")
+	snapshot        = flag.String("screenshot", "", "file to write a snapshot of the text screen to, at exit or when -screenshot-on is seen")
+	snapshotFormat  = flag.String("screenshot-format", "text", "format of the screen snapshot: text or json")
+	snapshotOn      = flag.String("screenshot-on", "", "take the screen snapshot when this string is output, instead of at exit")
+	keys            = flag.String("keys", "", "script of keys to type: wait for output, sleep, type and key commands, one per line")
+	virtualTime     = flag.Bool("virtualtime", false, "only let time pass when the guest waits for it; on when -keys is used")
+	smbiosConfig    = flag.String("smbios", "", "JSON or YAML file describing the platform for the SMBIOS table")
+	gopMode         = flag.Int("gopmode", 1, "graphics mode to start in: 0 is 640x480, 1 800x600, 2 1024x768, 3 1280x1024")
+	pngFile         = flag.String("png", "", "file to write the framebuffer to as a PNG, at exit, or as -png-every and -png-on say; a %d in the name is replaced by a count")
+	pngEvery        = flag.Duration("png-every", 0, "also write the framebuffer PNG this often")
+	pngOn           = flag.String("png-on", "", "write the framebuffer PNG when this string is output, instead of at exit")
+	rtcClock        = flag.String("rtc", "host", "what the RTC runs on: host (the host clock) or virtual (the guest's clock, which -virtualtime affects)")
+	rtcStart        = flag.String("rtc-start", "", "RFC3339 time the RTC starts at; the default is the host's local time")
+	varsFile        = flag.String("vars", "", "JSON file the non-volatile UEFI variables are read from at start and written to at exit")
+	reboots         = flag.Int("reboots", 0, "how many times a cold or warm ResetSystem runs the image again, keeping non-volatile variables; after that, a reset exits 10 (cold), 11 (warm), 12 (platform specific), 13 (error status), or 0 (shutdown)")
+	capsuleDir      = flag.String("capsule-dir", "", "directory UpdateCapsule writes capsules to")
+	capsulePolicy   = flag.String("capsule-policy", "all", "capsules UpdateCapsule takes: all, none, persist (only those that persist across reset), or immediate (only those that don't)")
+	capsuleMax      = flag.Uint64("capsule-max", 32<<20, "largest capsule UpdateCapsule takes, in bytes")
+	fmpConfig       = flag.String("fmp", "", "JSON file describing fake firmware devices for the Firmware Management Protocol; their images are host files, which SetImage writes")
+	drivers         images
+	fv              = flag.String("fv", "", "UEFI ROM or firmware volume whose DXE drivers are dispatched, by their DEPEX, before the main image, with a report of those that are left")
 	regfile         *os.File
+	screen          *console.Screen
+	stdinKeys       *console.Keyboard // the keyboard, if it reads stdin
+	atExit          []func()
+	pngs            int
 	Debug           = func(string, ...interface{}) {}
 	step            = func(...string) {}
 	dat             uintptr
 	line            int
 )
 
+// exit runs the atExit functions and exits.
+func exit(code int) {
+	for _, f := range atExit {
+		f()
+	}
+	os.Exit(code)
+}
+
+// writeSnapshot writes the screen snapshot to the -screenshot file.
+func writeSnapshot() {
+	f, err := os.Create(*snapshot)
+	if err != nil {
+		log.Printf("Screen snapshot: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := screen.WriteSnapshot(f, *snapshotFormat); err != nil {
+		log.Printf("Screen snapshot: %v", err)
+	}
+}
+
+// writePNG writes the framebuffer to the -png file.
+func writePNG(m graphics.Memory) {
+	n := *pngFile
+	if strings.Contains(n, "%d") {
+		n = fmt.Sprintf(n, pngs)
+	}
+	pngs++
+	f, err := os.Create(n)
+	if err != nil {
+		log.Printf("Framebuffer PNG: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := services.Framebuffer().WritePNG(m, f); err != nil {
+		log.Printf("Framebuffer PNG: %v", err)
+	}
+}
+
+// setupSerial sets up the UART on COM1, and where its input and output go.
+// Stdin goes to the keyboard unless the UART has it.
+func setupSerial(k *console.Keyboard) error {
+	var in io.Reader
+	var out io.Writer
+	switch *serialIn {
+	case "":
+	case "stdin":
+		in = os.Stdin
+	default:
+		c, err := net.Dial("unix", *serialIn)
+		if err != nil {
+			return err
+		}
+		in, out = c, c
+	}
+	if len(*serialOut) > 0 {
+		f, err := os.Create(*serialOut)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	if out == nil && *handleConsoleIO {
+		out = os.Stdout
+	}
+	uart := devices.NewUART(out)
+	services.SetSerial(uart)
+	if err := ports.Register("COM1", devices.COM1, 8, devices.ByteWide(uart)); err != nil {
+		return err
+	}
+	if in != nil {
+		go uart.Feed(in)
+	}
+	if in != os.Stdin {
+		stdinKeys = k
+		go k.Feed(os.Stdin)
+	}
+	return nil
+}
+
+// setupRTC sets up the RTC on the CMOS ports, which the runtime
+// time services share.
+func setupRTC() error {
+	clock := devices.HostClock
+	switch *rtcClock {
+	case "host":
+	case "virtual":
+		start := devices.HostClock()
+		clock = func() time.Time { return start.Add(services.Elapsed()) }
+	default:
+		return fmt.Errorf("-rtc must be host or virtual, not %q", *rtcClock)
+	}
+	rtc := devices.NewRTC(clock)
+	if len(*rtcStart) > 0 {
+		t, err := time.Parse(time.RFC3339, *rtcStart)
+		if err != nil {
+			return err
+		}
+		// The RTC keeps local time; keep the wall clock time given.
+		rtc.Set(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC))
+	}
+	services.SetRTC(rtc)
+	return ports.Register("CMOS", devices.CMOSIndex, 2, devices.ByteWide(rtc))
+}
+
+// setupCapsules sets the capsule policy.
+func setupCapsules() error {
+	p := services.CapsulePolicy{Dir: *capsuleDir, MaxSize: *capsuleMax}
+	switch *capsulePolicy {
+	case "all":
+		p.Persist, p.Immediate = true, true
+	case "none":
+	case "persist":
+		p.Persist = true
+	case "immediate":
+		p.Immediate = true
+	default:
+		return fmt.Errorf("-capsule-policy must be all, none, persist or immediate, not %q", *capsulePolicy)
+	}
+	if len(p.Dir) > 0 {
+		if err := os.MkdirAll(p.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	services.SetCapsulePolicy(p)
+	return nil
+}
+
 func any(f ...string) {
 	var b [1]byte
 	for _, ff := range f {
 		log.Println(ff)
 	}
 	log.Printf("hit the any key")
-	os.Stdin.Read(b[:])
+	// Stdin is read for the guest, so the key has to come from there.
+	switch {
+	case stdinKeys != nil:
+		for !stdinKeys.Wait(time.Hour) {
+		}
+		stdinKeys.Pop()
+	case *serialIn == "stdin":
+		// The serial port would get it, and we would never know.
+		log.Printf("stdin is the serial port's: ^C to quit")
+		select {}
+	default:
+		os.Stdin.Read(b[:])
+	}
 }
 
 func showone(indent string, in interface{}) string {
@@ -107,22 +282,110 @@ func main() {
 		log.Fatal(err)
 	}
 
+	switch *consoleMode {
+	case "ansi":
+		screen = console.New(os.Stdout, true)
+	case "plain":
+		screen = console.New(os.Stdout, false)
+	default:
+		log.Fatalf("console must be ansi or plain, not %q", *consoleMode)
+	}
+	services.SetConsole(screen)
+	if err := rawStdin(); err != nil {
+		log.Fatalf("Setting up stdin: %v", err)
+	}
+	atExit = append(atExit, restoreTerm)
+	// Panics, ours or the services', come through here, too.
+	defer restoreTerm()
+	keyboard := console.NewKeyboard()
+	services.SetKeyboard(keyboard)
+	if err := setupSerial(keyboard); err != nil {
+		fatalf("Serial: %v", err)
+	}
+	if err := setupRTC(); err != nil {
+		fatalf("RTC: %v", err)
+	}
+	if err := setupCapsules(); err != nil {
+		fatalf("Capsules: %v", err)
+	}
+	if err := loadVars(); err != nil {
+		fatalf("Variables: %v", err)
+	}
+	if len(*varsFile) > 0 {
+		atExit = append(atExit, func() { saveVars(*varsFile) })
+	}
+	if len(*keys) > 0 {
+		f, err := os.Open(*keys)
+		if err != nil {
+			fatal(err)
+		}
+		steps, err := console.ParseScript(f)
+		f.Close()
+		if err != nil {
+			fatalf("%s: %v", *keys, err)
+		}
+		services.SetScript(steps)
+		*virtualTime = true
+	}
+	services.SetVirtualTime(*virtualTime)
+	if len(*snapshot) > 0 {
+		if len(*snapshotOn) > 0 {
+			screen.Watch(*snapshotOn, writeSnapshot)
+		} else {
+			atExit = append(atExit, writeSnapshot)
+		}
+	}
+
+	if len(*smbiosConfig) > 0 {
+		c, err := smbios.Load(*smbiosConfig)
+		if err != nil {
+			fatal(err)
+		}
+		services.SetSMBIOS(c)
+	}
+	if len(*fmpConfig) > 0 {
+		c, err := fmp.Load(*fmpConfig)
+		if err != nil {
+			fatal(err)
+		}
+		services.SetFirmwareDevices(c)
+	}
+	if err := services.SetGOPMode(*gopMode); err != nil {
+		fatal(err)
+	}
+	var nextPNG time.Time
+	if len(*pngFile) > 0 {
+		switch {
+		case len(*pngOn) > 0:
+			screen.Watch(*pngOn, func() { writePNG(v) })
+		case *pngEvery > 0:
+			nextPNG = time.Now().Add(*pngEvery)
+			fallthrough
+		default:
+			atExit = append(atExit, func() { writePNG(v) })
+		}
+	}
+
 	st, h, err := services.NewSystemtable(v.Tab())
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	Debug("params are %#08x %#08x", h, st)
 	trace.Params(r, uintptr(h), uintptr(st))
+	if mainEBC {
+		// The EBC image starts in the interpreter, through a thunk.
+		rip, err := services.EBCThunk(h, r.Rip)
+		if err != nil {
+			fatal(err)
+		}
+		r.Rip = rip
+	}
 	// bogus params to see if we can manages a segv
 	//r.Rcx = uint64(imageHandle)
 	//r.Rdx = uint64(systemTable)
 	r.Eflags |= 0x100
 
-	if err := v.SetRegs(r); err != nil {
-		log.Fatalf("GetRegs: got %v, want nil", err)
-	}
-
 	// Reserve space for DXE data.
 	services.SetAllocBase(0x40000000)
 
@@ -130,13 +393,23 @@ func main() {
 	// When it does the final return, it has to halt.
 	// Put a halt on top of stack, and point top of stack to it.
 	if err := trace.WriteWord(v, uintptr(efisp), 0xf4f4f4f4f4f4f4f4); err != nil {
-		log.Fatalf("Writing halts at %#x: got %v, want nil", efisp, err)
+		fatalf("Writing halts at %#x: got %v, want nil", efisp, err)
 	}
 
 	sp := uint64(r.Rsp)
 	efisp -= 8
 	if err := trace.WriteWord(v, uintptr(efisp), sp); err != nil {
-		log.Fatalf("Writing stack %#x at %#x: got %v, want nil", efisp, efisp-8, err)
+		fatalf("Writing stack %#x at %#x: got %v, want nil", efisp, efisp-8, err)
+	}
+
+	// Drivers run first; when they are done, the image starts with
+	// the registers and stack set up above.
+	if err := loadDrivers(v, r); err != nil {
+		fatal(err)
+	}
+
+	if err := v.SetRegs(r); err != nil {
+		fatalf("GetRegs: got %v, want nil", err)
 	}
 	if *dryrun {
 		log.Panic("dry run")
@@ -145,6 +418,10 @@ func main() {
 	p := r
 	for {
 		line++
+		if !nextPNG.IsZero() && time.Now().After(nextPNG) {
+			writePNG(v)
+			nextPNG = time.Now().Add(*pngEvery)
+		}
 		Debug("------------------------------------------------------------------->> %d: ", line)
 		// DOUBLE CHECK that run fails to produce an event!
 		for err := v.Run(); err != nil; err = v.Run() {
@@ -157,9 +434,9 @@ func main() {
 		if err != nil {
 			if err == io.EOF {
 				fmt.Println("\n===:DXE Exits!")
-				os.Exit(0)
+				exit(0)
 			}
-			log.Fatalf("Could not get regs: %v", err)
+			fatalf("Could not get regs: %v", err)
 		}
 
 		// TODO: add a test for bogus RIP. In a VM, anything goes, however.
@@ -170,14 +447,17 @@ func main() {
 			// This ONLY happens on an exit OR calling a UEFI function.
 			if *debug {
 				if err := trace.Regs(os.Stdout, r); err != nil {
-					log.Fatal(err)
+					fatal(err)
 				}
 			}
 			haltasm := trace.Asm(insn, r.Rip)
 			if err := halt(v, &ev, insn, r, haltasm); err != nil {
 				if err == io.EOF {
 					fmt.Println("\n===:DXE Exits!")
-					os.Exit(0)
+					exit(0)
+				}
+				if rs, ok := err.(*services.Reset); ok {
+					reset(rs)
 				}
 				//showone(os.Stderr, "", &r)
 				log.Printf("Can't do %#x(%v): %v", ev.Signo, unix.SignalName(s), err)
@@ -188,35 +468,37 @@ func main() {
 			// The handlers will always change, at least, eip, so just blindly set them
 			// back. TODO: see if we need more granularity.
 			if err := v.SetRegs(r); err != nil {
-				log.Fatalf("Can't set stack to %#x: %v", dat, err)
+				fatalf("Can't set stack to %#x: %v", dat, err)
 			}
 
 			step("returned from halt, set regs, move along")
 
 		case ev.Trapno == kvm.ExitIo:
-			checkConsole(insn, r, g)
+			ioExit(v.(*kvm.Tracee), r)
+		case ev.Trapno == kvm.ExitMmio:
+			mmioExit(v.(*kvm.Tracee), insn, r)
 		default:
 			log.Printf("Trapno: got %#x", ev.Trapno)
 			if ev.Trapno == kvm.ExitShutdown {
 				i, r, g, err := trace.Inst(v)
 				if err != nil {
-					log.Fatalf("Inst: got %v, want nil", err)
+					fatalf("Inst: got %v, want nil", err)
 				}
 				cpc, err := trace.Pop(v, r)
 				if err != nil {
 					log.Printf("Could not pop stack to get caller pc")
 					cpc = 0xdeadbeef
 				}
-				log.Fatalf("Shutdown from %#x! [%v, %v, %q, %v]", cpc, i, showone("", r), g, err)
+				fatalf("Shutdown from %#x! [%v, %v, %q, %v]", cpc, i, showone("", r), g, err)
 			}
 		}
 		r, err = v.GetRegs()
 		if err != nil {
-			log.Fatalf("GetRegs: got %v, want nil", err)
+			fatalf("GetRegs: got %v, want nil", err)
 		}
 		if regfile != nil {
 			if err := trace.RegDiff(regfile, r, p); err != nil {
-				log.Fatal(err)
+				fatal(err)
 			}
 		}
 		p = r
@@ -226,7 +508,7 @@ func main() {
 
 		i, r, g, err := trace.Inst(v)
 		if err != nil {
-			log.Fatalf("Inst: got %v, want nil", err)
+			fatalf("Inst: got %v, want nil", err)
 		}
 		Debug("Inst returns %v, %v, %q, %v", i, r, g, err)
 	}
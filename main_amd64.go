@@ -7,14 +7,32 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"syscall"
 
+	"github.com/linuxboot/voodoo/devices"
 	"github.com/linuxboot/voodoo/services"
 	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/trace/kvm"
 	"golang.org/x/arch/x86/x86asm"
 	"golang.org/x/sys/unix"
 )
 
+// unclaimedPort is an IO to a port no device has, and where it came from.
+type unclaimedPort struct {
+	port uint16
+	rip  uint64
+}
+
+var (
+	// ports are the IO ports devices have claimed.
+	ports = &devices.Ports{}
+	// mmio are the MMIO regions devices have claimed.
+	mmio = &devices.MMIO{}
+	// unclaimed is the unclaimed port IO we have reported.
+	unclaimed = map[unclaimedPort]bool{}
+)
+
 // halt handles the halt case. Things differ a bit from segv.
 // First off, the pc will be one off, having been incrementd. Other issues apply as well.
 func halt(p trace.Trace, i *unix.SignalfdSiginfo, inst *x86asm.Inst, r *syscall.PtraceRegs, asm string) error {
@@ -29,6 +47,9 @@ func halt(p trace.Trace, i *unix.SignalfdSiginfo, inst *x86asm.Inst, r *syscall.
 	r.Rip = pc
 	Debug("================={HALT START FUNCTION @ %#x", addr)
 	if err := services.Dispatch(&services.Fault{Proc: p, Info: i, Inst: inst, Regs: r, Asm: asm}); err != nil {
+		if rs, ok := err.(*services.Reset); ok {
+			return rs
+		}
 		return fmt.Errorf("Don't know what to do with %v: %v", trace.CallInfo(i, inst, r), err)
 	}
 	// Advance to the next instruction. This advance should only happen if the dispatch worked?
@@ -37,15 +58,41 @@ func halt(p trace.Trace, i *unix.SignalfdSiginfo, inst *x86asm.Inst, r *syscall.
 	return nil
 }
 
-func checkConsole(i *x86asm.Inst, r *syscall.PtraceRegs, asm string) {
-	if asm != "out %al,(%dx)" {
+// ioExit handles an IO exit. If no device has the port,
+// it says so, once for each port and RIP.
+func ioExit(t *kvm.Tracee, r *syscall.PtraceRegs) {
+	port, size, count, out, data := t.IO()
+	if ports.IO(port, size, count, out, data) {
 		return
 	}
-	c := uint8(r.Rax)
-	if *debug {
-		Debug("CONSOUT: %c", c)
-	} else if *handleConsoleIO {
-		fmt.Printf("%c", c)
+	k := unclaimedPort{port: port, rip: r.Rip}
+	if unclaimed[k] {
+		return
+	}
+	unclaimed[k] = true
+	dir := "in"
+	if out {
+		dir = "out"
 	}
+	log.Printf("IO: %s of %d bytes at port %#x, from %#x: no device there", dir, size, port, r.Rip)
+}
 
+// mmioExit handles an MMIO exit: an access to guest physical memory
+// where there is no memory. If no device has the address, it says so,
+// with the instruction that did it. Reads get all ones.
+func mmioExit(t *kvm.Tracee, inst *x86asm.Inst, r *syscall.PtraceRegs) {
+	addr, size, write, data := t.MMIO()
+	if mmio.Access(addr, write, data) {
+		return
+	}
+	dir := "read"
+	if write {
+		dir = fmt.Sprintf("write of %#x", data)
+	}
+	log.Printf("MMIO: %s, %d bytes at %#x, has no device: %#x: %s", dir, size, addr, r.Rip, trace.Asm(inst, r.Rip))
+	if *debug {
+		if err := trace.Regs(os.Stderr, r); err != nil {
+			log.Print(err)
+		}
+	}
 }
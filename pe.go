@@ -8,10 +8,13 @@ package main
 
 import (
 	"debug/pe"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"strings"
 	"syscall"
 
+	"github.com/linuxboot/voodoo/services"
 	"github.com/linuxboot/voodoo/trace"
 )
 
@@ -21,14 +24,20 @@ func loadPE(t trace.Trace, n string, r *syscall.PtraceRegs, log func(string, ...
 		return err
 	}
 	defer f.Close()
-	h, ok := f.OptionalHeader.(*pe.OptionalHeader64)
-	if !ok {
-		return fmt.Errorf("File type is %T, but has to be %T", f.OptionalHeader, pe.OptionalHeader64{})
+	h, err := optionalHeader(f)
+	if err != nil {
+		return err
 	}
 	// We need to relocate to start at *offset.
 	// UEFI runs in page zero. I can't believe it.
 	base := uintptr(h.ImageBase)
 	eip := base + uintptr(h.BaseOfCode)
+	// EBC images are called through a thunk, once there is an EBC
+	// service to make one, so start with the real entry point.
+	mainEBC = f.Machine == pe.IMAGE_FILE_MACHINE_EBC
+	if mainEBC {
+		eip = base + uintptr(h.AddressOfEntryPoint)
+	}
 	heap := base + uintptr(h.SizeOfImage)
 	// heap is at end  of the image.
 	// Stack goes at top of reserved stack area.
@@ -66,3 +75,187 @@ func loadPE(t trace.Trace, n string, r *syscall.PtraceRegs, log func(string, ...
 	r.Rip = uint64(eip)
 	return nil
 }
+
+// mainEBC is set if the main image is EBC, and has to start through a thunk.
+var mainEBC bool
+
+// optionalHeader returns the optional header of f. EBC images are PE32,
+// not PE32+, so their header is widened to look like the others.
+func optionalHeader(f *pe.File) (*pe.OptionalHeader64, error) {
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		return h, nil
+	case *pe.OptionalHeader32:
+		if f.Machine != pe.IMAGE_FILE_MACHINE_EBC {
+			break
+		}
+		return &pe.OptionalHeader64{
+			Magic:               h.Magic,
+			SizeOfCode:          h.SizeOfCode,
+			AddressOfEntryPoint: h.AddressOfEntryPoint,
+			BaseOfCode:          h.BaseOfCode,
+			ImageBase:           uint64(h.ImageBase),
+			SectionAlignment:    h.SectionAlignment,
+			FileAlignment:       h.FileAlignment,
+			SizeOfImage:         h.SizeOfImage,
+			SizeOfHeaders:       h.SizeOfHeaders,
+			Subsystem:           h.Subsystem,
+			SizeOfStackReserve:  uint64(h.SizeOfStackReserve),
+			SizeOfStackCommit:   uint64(h.SizeOfStackCommit),
+			SizeOfHeapReserve:   uint64(h.SizeOfHeapReserve),
+			SizeOfHeapCommit:    uint64(h.SizeOfHeapCommit),
+			NumberOfRvaAndSizes: h.NumberOfRvaAndSizes,
+			DataDirectory:       h.DataDirectory,
+		}, nil
+	}
+	return nil, fmt.Errorf("File type is %T, machine %#x, but has to be %T, or EBC", f.OptionalHeader, f.Machine, pe.OptionalHeader64{})
+}
+
+// images is a flag that can be given more than once, for each of the
+// images it names.
+type images []string
+
+func (i *images) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *images) Set(s string) error {
+	*i = append(*i, s)
+	return nil
+}
+
+func init() {
+	flag.Var(&drivers, "driver", "UEFI driver image to run before the main image; boot service and runtime drivers that succeed stay resident. It can be given more than once, and they run in order")
+}
+
+// Base relocation types we know how to apply.
+const (
+	relAbsolute = 0
+	relHighLow  = 3
+	relDir64    = 10
+)
+
+// relocate applies the base relocations in img, which are in the
+// directory dir, for img being delta bytes from where it was linked.
+func relocate(img []byte, dir pe.DataDirectory, delta uint64) error {
+	end := int(dir.VirtualAddress) + int(dir.Size)
+	if end > len(img) {
+		return fmt.Errorf("relocations at %#x, %#x bytes, are past the end of the image at %#x", dir.VirtualAddress, dir.Size, len(img))
+	}
+	for off := int(dir.VirtualAddress); off < end; {
+		if off+8 > end {
+			return fmt.Errorf("relocation block at %#x: short header", off)
+		}
+		page := binary.LittleEndian.Uint32(img[off:])
+		size := int(binary.LittleEndian.Uint32(img[off+4:]))
+		if size < 8 || off+size > end {
+			return fmt.Errorf("relocation block at %#x: bad size %#x", off, size)
+		}
+		for i := off + 8; i+2 <= off+size; i += 2 {
+			e := binary.LittleEndian.Uint16(img[i:])
+			a := int(page) + int(e&0xfff)
+			switch e >> 12 {
+			case relAbsolute:
+			case relHighLow:
+				if a+4 > len(img) {
+					return fmt.Errorf("relocation at %#x is past the end of the image", a)
+				}
+				binary.LittleEndian.PutUint32(img[a:], binary.LittleEndian.Uint32(img[a:])+uint32(delta))
+			case relDir64:
+				if a+8 > len(img) {
+					return fmt.Errorf("relocation at %#x is past the end of the image", a)
+				}
+				binary.LittleEndian.PutUint64(img[a:], binary.LittleEndian.Uint64(img[a:])+delta)
+			default:
+				return fmt.Errorf("relocation at %#x: type %d is not supported", a, e>>12)
+			}
+		}
+		off += size
+	}
+	return nil
+}
+
+// loadDriver loads the PE image in file n into pages of DXE memory,
+// relocated to where they are. It returns the entry point, and whether
+// the image is a driver, and not an application.
+func loadDriver(t trace.Trace, n string) (uintptr, bool, error) {
+	f, err := pe.Open(n)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	return loadImage(t, f)
+}
+
+// loadImage is loadDriver for a PE file from anywhere.
+func loadImage(t trace.Trace, f *pe.File) (uintptr, bool, error) {
+	h, err := optionalHeader(f)
+	if err != nil {
+		return 0, false, err
+	}
+	var driver bool
+	switch h.Subsystem {
+	case pe.IMAGE_SUBSYSTEM_EFI_APPLICATION:
+	case pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER, pe.IMAGE_SUBSYSTEM_EFI_RUNTIME_DRIVER:
+		driver = true
+	default:
+		return 0, false, fmt.Errorf("subsystem %d is not a UEFI application or driver", h.Subsystem)
+	}
+	img := make([]byte, h.SizeOfImage)
+	for _, s := range f.Sections {
+		dat, err := s.Data()
+		if err != nil {
+			return 0, false, fmt.Errorf("Can't get data for section %s: %v", s.Name, err)
+		}
+		if s.VirtualSize < uint32(len(dat)) {
+			dat = dat[:s.VirtualSize]
+		}
+		if int(s.VirtualAddress)+len(dat) > len(img) {
+			return 0, false, fmt.Errorf("section %s, at %#x, is past the end of the image", s.Name, s.VirtualAddress)
+		}
+		copy(img[s.VirtualAddress:], dat)
+	}
+	base := uintptr(services.UEFIAllocate((uintptr(len(img))+4095)/4096, true))
+	if delta := uint64(base) - h.ImageBase; delta != 0 {
+		if len(h.DataDirectory) <= pe.IMAGE_DIRECTORY_ENTRY_BASERELOC || h.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC].Size == 0 {
+			return 0, false, fmt.Errorf("it has no relocations, so can't be loaded at %#x", base)
+		}
+		if err := relocate(img, h.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC], delta); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := t.Write(base, img); err != nil {
+		return 0, false, fmt.Errorf("Can't write %d bytes of image @ %#x: %v", len(img), base, err)
+	}
+	entry := base + uintptr(h.AddressOfEntryPoint)
+	if f.Machine == pe.IMAGE_FILE_MACHINE_EBC {
+		thunk, err := services.EBCThunk(0, uint64(entry))
+		if err != nil {
+			return 0, false, err
+		}
+		entry = uintptr(thunk)
+	}
+	return entry, driver, nil
+}
+
+// loadDrivers loads the -driver images, then the DXE drivers in the -fv
+// firmware volume, and arranges for them to run before the main image,
+// which r is set up for.
+func loadDrivers(t trace.Trace, r *syscall.PtraceRegs) error {
+	for _, n := range drivers {
+		entry, driver, err := loadDriver(t, n)
+		if err != nil {
+			return fmt.Errorf("%s: %v", n, err)
+		}
+		if err := services.AddDriver(n, nil, nil, entry, driver); err != nil {
+			return fmt.Errorf("%s: %v", n, err)
+		}
+		Debug("Driver %s: entry %#x", n, entry)
+	}
+	if *fv != "" {
+		if err := loadFV(t, *fv); err != nil {
+			return fmt.Errorf("%s: %v", *fv, err)
+		}
+	}
+	return services.StartDrivers(t, r)
+}
@@ -0,0 +1,75 @@
+// +build linux,amd64
+
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"testing"
+)
+
+func TestRelocate(t *testing.T) {
+	img := make([]byte, 0x2000)
+	binary.LittleEndian.PutUint64(img[0x1008:], 0x1000)
+	binary.LittleEndian.PutUint32(img[0x1010:], 0x1100)
+	// One block, for page 0x1000: a DIR64 at 8, a HIGHLOW at 0x10,
+	// and padding.
+	reloc := []byte{
+		0x00, 0x10, 0x00, 0x00,
+		0x0e, 0x00, 0x00, 0x00,
+		0x08, 0xa0,
+		0x10, 0x30,
+		0x00, 0x00,
+	}
+	copy(img[0x1800:], reloc)
+	dir := pe.DataDirectory{VirtualAddress: 0x1800, Size: uint32(len(reloc))}
+	if err := relocate(img, dir, 0x40000000); err != nil {
+		t.Fatalf("relocate: got %v, want nil", err)
+	}
+	if v := binary.LittleEndian.Uint64(img[0x1008:]); v != 0x40001000 {
+		t.Errorf("DIR64: got %#x, want %#x", v, 0x40001000)
+	}
+	if v := binary.LittleEndian.Uint32(img[0x1010:]); v != 0x40001100 {
+		t.Errorf("HIGHLOW: got %#x, want %#x", v, 0x40001100)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		reloc []byte
+	}{
+		{"short block", []byte{0x00, 0x10, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00}},
+		{"past the end", []byte{0x00, 0x20, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0xfc, 0xaf}},
+		{"bad type", []byte{0x00, 0x10, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x50}},
+	} {
+		copy(img[0x1800:], tt.reloc)
+		dir := pe.DataDirectory{VirtualAddress: 0x1800, Size: uint32(len(tt.reloc))}
+		if err := relocate(img, dir, 0x1000); err == nil {
+			t.Errorf("%s: got nil, want err", tt.name)
+		}
+	}
+}
+
+func TestOptionalHeader(t *testing.T) {
+	f := &pe.File{
+		FileHeader: pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_EBC},
+		OptionalHeader: &pe.OptionalHeader32{
+			ImageBase:           0x10000,
+			AddressOfEntryPoint: 0x400,
+			SizeOfImage:         0x2000,
+			Subsystem:           pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER,
+			NumberOfRvaAndSizes: 16,
+		},
+	}
+	h, err := optionalHeader(f)
+	if err != nil {
+		t.Fatalf("EBC: got %v, want nil", err)
+	}
+	if h.ImageBase != 0x10000 || h.AddressOfEntryPoint != 0x400 || h.SizeOfImage != 0x2000 || h.Subsystem != pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER {
+		t.Errorf("EBC: got %+v, want base 0x10000, entry 0x400, size 0x2000, subsystem 11", h)
+	}
+
+	f.Machine = pe.IMAGE_FILE_MACHINE_I386
+	if _, err := optionalHeader(f); err == nil {
+		t.Errorf("I386: got nil, want err")
+	}
+}
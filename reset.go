@@ -0,0 +1,120 @@
+// +build linux,amd64
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/linuxboot/voodoo/services"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// Exit codes when the guest calls ResetSystem. A shutdown with
+// EFI_SUCCESS is a clean exit, 0.
+const (
+	exitResetCold     = 10
+	exitResetWarm     = 11
+	exitResetPlatform = 12
+	// exitResetError is for any reset with an error status.
+	exitResetError = 13
+)
+
+// The environment tells a rebooted voodoo which boot it is, and where
+// the variables are if there is no -vars.
+const (
+	bootEnv = "VOODOO_BOOT"
+	varsEnv = "VOODOO_VARS"
+)
+
+// boot is how many times the guest has been rebooted.
+var boot, _ = strconv.Atoi(os.Getenv(bootEnv))
+
+// loadVars reads the non-volatile variables, from -vars, or from
+// before a reboot. A -vars file that is not there yet is fine.
+func loadVars() error {
+	n := *varsFile
+	if len(n) == 0 {
+		n = os.Getenv(varsEnv)
+	}
+	if len(n) == 0 {
+		return nil
+	}
+	f, err := os.Open(n)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return uefi.LoadVariables(f)
+}
+
+// saveVars writes the non-volatile variables to n.
+func saveVars(n string) {
+	f, err := os.Create(n)
+	if err != nil {
+		log.Printf("Saving variables: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := uefi.SaveVariables(f); err != nil {
+		log.Printf("Saving variables to %s: %v", n, err)
+	}
+}
+
+// reset ends the run when the guest calls ResetSystem. A cold or
+// warm reset runs the image again, while -reboots allows it.
+func reset(r *services.Reset) {
+	fmt.Printf("\n===:%v\n", r)
+	if (r.Type == uefi.EfiResetCold || r.Type == uefi.EfiResetWarm) && boot < *reboots {
+		reboot()
+	}
+	if n := os.Getenv(varsEnv); len(n) > 0 {
+		os.Remove(n)
+	}
+	switch {
+	case r.Status != uefi.EFI_SUCCESS:
+		exit(exitResetError)
+	case r.Type == uefi.EfiResetCold:
+		exit(exitResetCold)
+	case r.Type == uefi.EfiResetWarm:
+		exit(exitResetWarm)
+	case r.Type == uefi.EfiResetShutdown:
+		exit(0)
+	}
+	exit(exitResetPlatform)
+}
+
+// reboot starts voodoo again, from scratch, with the same arguments.
+// Only the non-volatile variables are kept.
+func reboot() {
+	n := *varsFile
+	if len(n) == 0 {
+		n = os.Getenv(varsEnv)
+	}
+	if len(n) == 0 {
+		f, err := os.CreateTemp("", "voodoo-vars")
+		if err != nil {
+			fatalf("Reboot: %v", err)
+		}
+		f.Close()
+		n = f.Name()
+		os.Setenv(varsEnv, n)
+	}
+	// With -vars, the atExit functions save them.
+	if len(*varsFile) == 0 {
+		saveVars(n)
+	}
+	for _, f := range atExit {
+		f()
+	}
+	os.Setenv(bootEnv, strconv.Itoa(boot+1))
+	fmt.Printf("===:Reboot %d\n", boot+1)
+	err := syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+	fatalf("Reboot: %v", err)
+}
@@ -72,36 +72,9 @@ func NewBlockIO(tab []byte, u ServPtr) (Service, error) {
 	// put the ABSOLUTE address into dpp.
 	// 0xffxx0000, since we'll be returning this to the bootloader.
 	dpp := ServPtr(int(u) + 0x2000)
-	// and now for the device path. This stuff is *SO BAD*
-	// This is from the spec.
-	// Table 32-SCSI device path examples
-	for i, b := range []byte{
-		//Byte offset	Byte length	Data	Description
-		0x00: 0x02, //Generic Device Path Header - Type ACPI Device Path
-		0x01: 0x01, //Sub type - ACPI Device Path
-		0x02: 0x0C, //Length - 0x0C bytes
-		0x04: 0x41, //_HID PNP0A03 - 0x41D0 represents a compressed string
-		0x05: 0xD0, // 'PNP' and is in the low-order bytes.
-		0x06: 0x0A, //
-		0x07: 0x03, //
-		// UID @ 8 for 4 bytes of 0s
-		// UID @ 8 for 4 bytes of 0s
-		// UID @ 8 for 4 bytes of 0s
-		// UID @ 8 for 4 bytes of 0s
-		0x0C: 0x01, //Generic Device Path Header - Type Hardware Device Path
-		0x0D: 0x01, //Sub type - PCI
-		0x0E: 0x06, //Length - 0x06 bytes
-		0x10: 0x07, //PCI Function
-		0x11: 0x00, //PCI Device
-		0x12: 0xFF, //Generic Device Path Header - Type End of Hardware Device Path
-		0x13: 0xFF, //Sub type - End of Entire Device Path
-		0x14: 0x04, //Length - 0x04 bytes
-		0x15: 0x00,
-		0x16: 0x00,
-		0x17: 0x00,
-	} {
-		tab[int(index(dpp))+i] = b
-	}
+	// and now for the device path, from the spec,
+	// Table 32-SCSI device path examples: PciRoot(0x0)/Pci(0x0,0x7)
+	copy(tab[index(dpp):], devicepath.Blob(&devicepath.ACPI{HID: devicepath.EFIPNPID(0x0a03)}, &devicepath.PCI{Function: 7}, &devicepath.End{}))
 
 	// Now create a handle for this device.
 	h := newHandle()
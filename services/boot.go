@@ -5,11 +5,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/voodoo/table"
 	"github.com/linuxboot/voodoo/trace"
 	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/devicepath"
 )
 
 // Boot implements Service
@@ -65,29 +67,12 @@ func (r *Boot) Call(f *Fault) error {
 	Debug("Boot services: %s(%#x), arg type %T, args %v", table.BootServicesNames[int(op)], op, f.Inst.Args, f.Inst.Args)
 	switch op {
 	case table.GetMemoryMap:
-		// EFI_STATUS efi_get_memorymap(IN OUT UINTN *MemoryMapSize, IN OUT EFI_MEMORY_DESCRIPTOR *MemoryMap, ...);
-		// Go simple for now. You own 2G. That's all you own.
-		var b = &bytes.Buffer{}
-		if err := binary.Write(b, binary.LittleEndian, &uefi.MemRegion{
-			MType:  uefi.EfiConventionalMemory,
-			PA:     0,
-			VA:     0,
-			Npages: 0x20000000 / 0x1000,
-			Attr:   uefi.All,
-		}); err != nil {
-			log.Fatalf("Can't encode memory: %v", err)
-		}
-		f.Args = trace.Args(f.Proc, f.Regs, 2)
-		Debug("GetMemoryMap: %#x", f.Args)
-		// Just one region.
-		var bb = [8]byte{1}
-		if err := f.Proc.Write(f.Args[0], bb[:]); err != nil {
-			return fmt.Errorf("Can't write %d bytes to %#x: %v", len(bb), dat, err)
-		}
-		if err := f.Proc.Write(f.Args[1], b.Bytes()); err != nil {
-			return fmt.Errorf("Can't write %d bytes to %#x: %v", len(bb), dat, err)
-		}
-		return nil
+		// EFI_STATUS GetMemoryMap(IN OUT UINTN *MemoryMapSize, OUT EFI_MEMORY_DESCRIPTOR *MemoryMap,
+		//	OUT UINTN *MapKey, OUT UINTN *DescriptorSize, OUT UINT32 *DescriptorVersion);
+		return getMemoryMap(f)
+	case table.ExitBootServices:
+		// EFI_STATUS ExitBootServices(IN EFI_HANDLE ImageHandle, IN UINTN MapKey);
+		return exitBootServices(f)
 	case table.AllocatePool:
 		// Status = gBS->AllocatePool (EfiBootServicesData, sizeof (EXAMPLE_DEVICE), (VOID **)&Device);
 		f.Args = trace.Args(f.Proc, f.Regs, 5)
@@ -157,7 +142,14 @@ func (r *Boot) Call(f *Fault) error {
 		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
 			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
 		}
+		// The handle's own protocol, if it has it; else, as we always
+		// have, whatever service has that GUID.
 		d, ok := dispatches[ServBase(g.String())]
+		if h, err := getHandle(hd(f.Args[0])); err == nil {
+			if hp, err := h.Get(&g); err == nil {
+				d, ok = hp, true
+			}
+		}
 		Debug("HandleProtocol: GUID %s %v ok? %v", g, d, ok)
 		if !ok {
 			f.Regs.Rax = uefi.EFI_NOT_FOUND
@@ -174,14 +166,61 @@ func (r *Boot) Call(f *Fault) error {
 
 	// This is just the worst design ever.
 	case table.LocateDevicePath:
+		// EFI_STATUS LocateDevicePath (IN EFI_GUID *Protocol, IN OUT EFI_DEVICE_PATH_PROTOCOL **DevicePath,
+		//   OUT EFI_HANDLE *Device);
+		// Of the handles with Protocol, find the one whose device path is the longest
+		// prefix of *DevicePath, and move *DevicePath past the part that matched.
 		f.Args = trace.Args(f.Proc, f.Regs, 3)
 		Debug("table.LocateDevicePath: args %#x", f.Args)
+		if f.Args[0] == 0 || f.Args[1] == 0 || f.Args[2] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
 		var g guid.GUID
 		if err := f.Proc.Read(f.Args[0], g[:]); err != nil {
-			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[0], err)
+		}
+		dp, err := trace.ReadWord(f.Proc, f.Args[1])
+		if err != nil {
+			return fmt.Errorf("Can't read DevicePath at %#x: %v", f.Args[1], err)
+		}
+		if dp == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		path, err := devicepath.Unmarshal(f.Proc, uintptr(dp))
+		if err != nil {
+			log.Printf("LocateDevicePath: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		Debug("table.LocateDevicePath: GUID %s path %s", g, devicepath.ToText(path))
+		best, size := hd(0), -1
+		for _, h := range allHandlesByGUID(&g) {
+			d, err := hdb[h].Get(devicepath.DevicePathGUID)
+			if err != nil {
+				continue
+			}
+			p, err := devicepath.Unmarshal(f.Proc, uintptr(d.up))
+			if err != nil {
+				log.Printf("LocateDevicePath: handle %#x: %v", h, err)
+				continue
+			}
+			if n, ok := devicepath.Prefix(p, path); ok && n > size {
+				best, size = h, n
+			}
+		}
+		if size < 0 {
+			f.Regs.Rax = uefi.EFI_NOT_FOUND
+			return nil
+		}
+		Debug("table.LocateDevicePath: handle %#x matches %d bytes", best, size)
+		if err := trace.WriteWord(f.Proc, f.Args[2], uint64(best)); err != nil {
+			return fmt.Errorf("Can't write handle to %#x: %v", f.Args[2], err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[1], dp+uint64(size)); err != nil {
+			return fmt.Errorf("Can't write DevicePath to %#x: %v", f.Args[1], err)
 		}
-		Debug("table.LocateDevicePath: GUID %s", g)
-		f.Regs.Rax = uefi.EFI_NOT_FOUND
 		return nil
 
 	case table.PCHandleProtocol:
@@ -198,20 +237,214 @@ func (r *Boot) Call(f *Fault) error {
 
 		return nil
 	case table.ConnectController:
-		// The arguments are rcx, rdx, r9, r8
+		// EFI_STATUS ConnectController (IN EFI_HANDLE ControllerHandle, IN EFI_HANDLE *DriverImageHandle OPTIONAL,
+		//   IN EFI_DEVICE_PATH_PROTOCOL *RemainingDevicePath OPTIONAL, IN BOOLEAN Recursive);
 		f.Args = trace.Args(f.Proc, f.Regs, 4)
 		Debug("ConnectController: %#x", f.Args)
-		// Just pretend it worked.
+		if f.Args[2] != 0 {
+			Debug("ConnectController: remaining path %s", devicePathText(f.Proc, f.Args[2]))
+		}
+		if _, err := getHandle(hd(f.Args[0])); err != nil {
+			Debug("ConnectController: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		// DriverImageHandle is a list, ending in NULL, of drivers to try first.
+		var first []hd
+		for p := f.Args[1]; p != 0; p += table.EfiHandleSize {
+			h, err := trace.ReadWord(f.Proc, p)
+			if err != nil {
+				return fmt.Errorf("Can't read DriverImageHandle at %#x: %v", p, err)
+			}
+			if h == 0 {
+				break
+			}
+			first = append(first, hd(h))
+		}
+		return connectController(f, hd(f.Args[0]), first, uint64(f.Args[2]), uint8(f.Args[3]) != 0, returnToGuest)
+	case table.DisconnectController:
+		// EFI_STATUS DisconnectController (IN EFI_HANDLE ControllerHandle, IN EFI_HANDLE DriverImageHandle OPTIONAL,
+		//   IN EFI_HANDLE ChildHandle OPTIONAL);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		Debug("DisconnectController: %#x", f.Args)
+		for _, h := range f.Args[1:] {
+			if _, err := getHandle(hd(h)); h != 0 && err != nil {
+				Debug("DisconnectController: %v", err)
+				f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+				return nil
+			}
+		}
+		return disconnectController(f, hd(f.Args[0]), hd(f.Args[1]), hd(f.Args[2]), returnToGuest)
+	case table.InstallProtocolInterface:
+		// EFI_STATUS InstallProtocolInterface (IN OUT EFI_HANDLE *Handle, IN EFI_GUID *Protocol,
+		//   IN EFI_INTERFACE_TYPE InterfaceType, IN VOID *Interface);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		if f.Args[0] == 0 || f.Args[1] == 0 || f.Args[2] != uefi.EFI_NATIVE_INTERFACE {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		var g guid.GUID
+		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
+		}
+		return installProtocols(f, f.Args[0], []guid.GUID{g}, []uint64{uint64(f.Args[3])})
+	case table.InstallMultipleProtocolInterfaces:
+		// EFI_STATUS InstallMultipleProtocolInterfaces (IN OUT EFI_HANDLE *Handle, ...);
+		// The ... is pairs of EFI_GUID *Protocol and VOID *Interface, then a NULL.
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		if f.Args[0] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		gs, ifaces, err := protocolArgs(f)
+		if err != nil {
+			return err
+		}
+		return installProtocols(f, f.Args[0], gs, ifaces)
+	case table.UninstallProtocolInterface:
+		// EFI_STATUS UninstallProtocolInterface (IN EFI_HANDLE Handle, IN EFI_GUID *Protocol, IN VOID *Interface);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		h, err := getHandle(hd(f.Args[0]))
+		if err != nil || f.Args[1] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		var g guid.GUID
+		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
+		}
+		return uninstallProtocols(f, h, []guid.GUID{g}, []uint64{uint64(f.Args[2])}, false)
+	case table.UninstallMultipleProtocolInterfaces:
+		// EFI_STATUS UninstallMultipleProtocolInterfaces (IN EFI_HANDLE Handle, ...);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		h, err := getHandle(hd(f.Args[0]))
+		if err != nil {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		gs, ifaces, err := protocolArgs(f)
+		if err != nil {
+			return err
+		}
+		return uninstallProtocols(f, h, gs, ifaces, true)
+	case table.ReinstallProtocolInterface:
+		// EFI_STATUS ReinstallProtocolInterface (IN EFI_HANDLE Handle, IN EFI_GUID *Protocol,
+		//   IN VOID *OldInterface, IN VOID *NewInterface);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		h, err := getHandle(hd(f.Args[0]))
+		if err != nil || f.Args[1] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		var g guid.GUID
+		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
+		}
+		return reinstallProtocol(f, h, &g, uint64(f.Args[2]), uint64(f.Args[3]))
+	case table.CreateEvent, table.CreateEventEx:
+		// EFI_STATUS CreateEvent (IN UINT32 Type, IN EFI_TPL NotifyTpl, IN EFI_EVENT_NOTIFY NotifyFunction OPTIONAL,
+		//   IN VOID *NotifyContext OPTIONAL, OUT EFI_EVENT *Event);
+		// CreateEventEx has an EFI_GUID *EventGroup before the Event.
+		// We don't do groups yet.
+		f.Args = trace.Args(f.Proc, f.Regs, 6)
+		typ, ep := uint32(f.Args[0]), f.Args[4]
+		if op == table.CreateEventEx {
+			ep = f.Args[5]
+		}
+		Debug("CreateEvent: %#x", f.Args)
+		if ep == 0 || (typ&(uefi.EVT_NOTIFY_WAIT|uefi.EVT_NOTIFY_SIGNAL) != 0 && f.Args[2] == 0) {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		e := newEvent(typ, f.Args[1], f.Args[2], f.Args[3])
+		if err := trace.WriteWord(f.Proc, ep, uint64(e.ev)); err != nil {
+			return fmt.Errorf("Can't write event to %#x: %v", ep, err)
+		}
+		return nil
+	case table.SetTimer:
+		// EFI_STATUS SetTimer (IN EFI_EVENT Event, IN EFI_TIMER_DELAY Type, IN UINT64 TriggerTime);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		e, err := getEvent(evt(f.Args[0]))
+		if err != nil {
+			Debug("SetTimer: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		f.Regs.Rax = uint64(e.setTimer(f.Args[1], uint64(f.Args[2])))
 		return nil
 	case table.WaitForEvent:
+		// EFI_STATUS WaitForEvent (IN UINTN NumberOfEvents, IN EFI_EVENT *Event, OUT UINTN *Index);
 		f.Args = trace.Args(f.Proc, f.Regs, 3)
 		Debug("WaitForEvent: %#x", f.Args)
-		// Just pretend it worked.
+		if f.Args[0] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		var evs []*Event
+		for i := uintptr(0); i < f.Args[0]; i++ {
+			ev, err := trace.ReadWord(f.Proc, f.Args[1]+i*8)
+			if err != nil {
+				return fmt.Errorf("Can't read event %d at %#x: %v", i, f.Args[1]+i*8, err)
+			}
+			e, err := getEvent(evt(ev))
+			if err != nil || e.typ&uefi.EVT_NOTIFY_SIGNAL != 0 {
+				Debug("WaitForEvent: event %d, %#x: bad event (%v)", i, ev, err)
+				f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+				if err := trace.WriteWord(f.Proc, f.Args[2], uint64(i)); err != nil {
+					return fmt.Errorf("Can't write index to %#x: %v", f.Args[2], err)
+				}
+				return nil
+			}
+			evs = append(evs, e)
+		}
+		return waitForEvent(f, evs, f.Args[2])
+	case table.SignalEvent:
+		// EFI_STATUS SignalEvent (IN EFI_EVENT Event);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		e, err := getEvent(evt(f.Args[0]))
+		if err != nil {
+			Debug("SignalEvent: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		return e.signal(f, func(f *Fault) error {
+			f.Regs.Rax = uefi.EFI_SUCCESS
+			return nil
+		})
+	case table.CloseEvent:
+		// EFI_STATUS CloseEvent (IN EFI_EVENT Event);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		if _, err := getEvent(evt(f.Args[0])); err != nil {
+			Debug("CloseEvent: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		delete(events, evt(f.Args[0]))
 		return nil
+	case table.CheckEvent:
+		// EFI_STATUS CheckEvent (IN EFI_EVENT Event);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		e, err := getEvent(evt(f.Args[0]))
+		if err != nil || e.typ&uefi.EVT_NOTIFY_SIGNAL != 0 {
+			Debug("CheckEvent: %#x: bad event (%v)", f.Args[0], err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		return fireTimers(f, func(f *Fault) error {
+			return notifyWait(f, []*Event{e}, func(f *Fault) error {
+				f.Regs.Rax = uefi.EFI_SUCCESS
+				if !e.check() {
+					idle()
+					f.Regs.Rax = uefi.EFI_NOT_READY
+					return nil
+				}
+				e.signaled = false
+				return nil
+			})
+		})
 	case table.OpenProtocol:
 		// This one is a serious shitshow.
 		// it's a mess b/c UEFI is a mess.
-		// It's a pretty minimal implementation.
 		//EFI_STATUS
 		//(EFIAPI * EFI_OPEN_PROTOCOL)(
 		//  IN EFI_HANDLE  Handle,
@@ -223,49 +456,82 @@ func (r *Boot) Call(f *Fault) error {
 		//  );
 		f.Args = trace.Args(f.Proc, f.Regs, 6)
 		Debug("OpenProtocol: %#x", f.Args)
+		var g guid.GUID
+		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
+		}
+		// Which handles have to be good depends on the attributes, so
+		// bad ones are nil, and OpenProtocol sorts it out.
+		h, _ := getHandle(hd(f.Args[0]))
+		ah, _ := getHandle(hd(f.Args[3]))
+		ch, _ := getHandle(hd(f.Args[4]))
+		ptr, attr := f.Args[2], f.Args[5]
+		d, err := r.OpenProtocol(f, h, g, ptr, ah, ch, attr)
+		if ptr != 0 && attr != uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL {
+			var up uint64
+			if d != nil {
+				up = uint64(d.up)
+			}
+			if err := trace.WriteWord(f.Proc, ptr, up); err != nil {
+				return fmt.Errorf("Can't write interface to %#x: %v", ptr, err)
+			}
+		}
+		Debug("OpenProtocol: %v, %v", d, err)
+		return efiStatus(f, err)
+	case table.CloseProtocol:
+		// EFI_STATUS CloseProtocol (IN EFI_HANDLE Handle, IN EFI_GUID *Protocol, IN EFI_HANDLE AgentHandle,
+		//   IN EFI_HANDLE ControllerHandle);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		Debug("CloseProtocol: %#x", f.Args)
 		h, err := getHandle(hd(f.Args[0]))
-		if err != nil {
-			Debug("OpenProtocol: No Handle for %#x", f.Args[0])
-			f.Regs.Rax = uefi.EFI_NOT_FOUND
+		_, aerr := getHandle(hd(f.Args[2]))
+		_, cerr := getHandle(hd(f.Args[3]))
+		if err != nil || aerr != nil || (f.Args[3] != 0 && cerr != nil) || f.Args[1] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
 			return nil
 		}
 		var g guid.GUID
 		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
 			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
 		}
-		ptr := f.Args[2]
-		ah, err := getHandle(hd(f.Args[3]))
+		if _, err := h.Get(&g); err != nil || !h.close(&g, hd(f.Args[2]), hd(f.Args[3])) {
+			f.Regs.Rax = uefi.EFI_NOT_FOUND
+		}
+		return nil
+	case table.OpenProtocolInformation:
+		// EFI_STATUS OpenProtocolInformation (IN EFI_HANDLE Handle, IN EFI_GUID *Protocol,
+		//   OUT EFI_OPEN_PROTOCOL_INFORMATION_ENTRY **EntryBuffer, OUT UINTN *EntryCount);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		var g guid.GUID
+		if err := f.Proc.Read(f.Args[1], g[:]); err != nil {
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
+		}
+		h, err := getHandle(hd(f.Args[0]))
+		if err == nil {
+			_, err = h.Get(&g)
+		}
 		if err != nil {
-			Debug("OpenProtocol: No Agent Handle for %#x", f.Args[3])
+			Debug("OpenProtocolInformation: %v", err)
 			f.Regs.Rax = uefi.EFI_NOT_FOUND
 			return nil
 		}
-		ch, err := getHandle(hd(f.Args[4]))
-		if err != nil {
-			Debug("OpenProtocol: No Controller Handle for %#x", f.Args[4])
-			//f.Regs.Rax = uefi.EFI_NOT_FOUND
-			//return nil
+		var b = &bytes.Buffer{}
+		os := h.opens[g.String()]
+		for _, o := range os {
+			binary.Write(b, binary.LittleEndian, []uint64{uint64(o.agent), uint64(o.controller)})
+			binary.Write(b, binary.LittleEndian, []uint32{o.attr, o.count})
 		}
-		attr := f.Args[5]
-		e, err := r.OpenProtocol(f, h, g, ptr, ah, ch, attr)
-		if err != nil {
-			Debug("it's back! ")
-			Debug("Returned %v", err)
-			return err
+		p := uintptr(UEFIAllocate(uintptr(len(os)*openInfoSize), false))
+		if err := f.Proc.Write(p, b.Bytes()); err != nil {
+			return fmt.Errorf("Can't write open protocol information to %#x: %v", p, err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[2], uint64(p)); err != nil {
+			return fmt.Errorf("Can't write EntryBuffer to %#x: %v", f.Args[2], err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[3], uint64(len(os))); err != nil {
+			return fmt.Errorf("Can't write EntryCount to %#x: %v", f.Args[3], err)
 		}
-		Debug("Gets dispatch %v", e)
-		f.Regs.Rax = uefi.EFI_NOT_FOUND
 		return nil
-		// }
-		// var bb [8]byte
-		// Debug("Address is %#x", d.up)
-		// binary.LittleEndian.PutUint64(bb[:], uint64(d.up))
-		// if f.Args[2] != 0 {
-		// 	if err := f.Proc.Write(f.Args[2], bb[:]); err != nil {
-		// 		return fmt.Errorf("Can't write %v to %#x: %v", d, f.Args[2], err)
-		// 	}
-		// }
-		Debug("OpenProtocol: done")
 	case table.LocateProtocol:
 		// Status = gBS->LocateProtocol (GUID,NULL,(VOID **)&ptr);
 		f.Args = trace.Args(f.Proc, f.Regs, 3)
@@ -275,7 +541,13 @@ func (r *Boot) Call(f *Fault) error {
 			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[1], err)
 		}
 		Debug("LocateProtocol: GUID %s", g)
+		// The first handle with it, which is how drivers' protocols are
+		// found; else whatever service has that GUID.
 		d, ok := dispatches[ServBase(g.String())]
+		if hs := allHandlesByGUID(&g); len(hs) > 0 {
+			d, _ = hdb[hs[0]].Get(&g)
+			ok = true
+		}
 		Debug("HandleProtocol: GUID %s %v ok? %v", g, d, ok)
 		if !ok {
 			f.Regs.Rax = uefi.EFI_NOT_FOUND
@@ -289,15 +561,40 @@ func (r *Boot) Call(f *Fault) error {
 		}
 		Debug("OK all done LocateProtocol")
 		return nil
+	case table.Stall:
+		// EFI_STATUS Stall (IN UINTN Microseconds);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		advance(time.Duration(f.Args[0]) * time.Microsecond)
+		return fireTimers(f, func(f *Fault) error {
+			f.Regs.Rax = uefi.EFI_SUCCESS
+			return nil
+		})
+	case table.RaiseTPL:
+		// EFI_TPL RaiseTPL (IN EFI_TPL NewTpl);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		f.Regs.Rax = uint64(tpl)
+		tpl = f.Args[0]
+		return nil
+	case table.RestoreTPL:
+		// VOID RestoreTPL (IN EFI_TPL OldTpl);
+		// Going back down lets the timers that went off meanwhile fire.
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		tpl = f.Args[0]
+		return fireTimers(f, returnToGuest)
 	case table.SetWatchdogTimer:
 		f.Args = trace.Args(f.Proc, f.Regs, 5)
 		Debug("SetWatchdogTimer: %#x", f.Args)
 		// Just pretend it worked.
 		return nil
-	case table.CloseProtocol:
-		f.Args = trace.Args(f.Proc, f.Regs, 4)
-		Debug("CloseProtocol: %#x", f.Args)
-		// Just pretend it worked.
+	case table.InstallConfigurationTable:
+		// EFI_STATUS InstallConfigurationTable (IN EFI_GUID *Guid, IN VOID *Table);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		var g guid.GUID
+		if err := f.Proc.Read(f.Args[0], g[:]); err != nil {
+			return fmt.Errorf("Can't read guid at #%x, err %v", f.Args[0], err)
+		}
+		f.Regs.Rax = uint64(InstallConfigurationTable(f.Proc.Tab(), g, uint64(f.Args[1])))
+		Debug("InstallConfigurationTable(%s, %#x): %#x", g, f.Args[1], f.Regs.Rax)
 		return nil
 
 	case table.RegisterProtocolNotify:
@@ -317,80 +614,60 @@ func (r *Boot) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, c
 	// But it's an Interface, so it has to be great, right?
 	// It's hard to image that, in 1999, when this was implemented, there were so many good
 	// examples out there and we ended up with this.
-	ret := &uefi.EFIError{Val: uefi.EFI_INVALID_PARAMETER}
 	Debug("Boot OpenProtocol: handle %v, protocol GUID%v, ptr %#x, agent handle %v, controller handle %v, attr %#x", h, g, ptr, ah, ch, attr)
 
 	// YES, the API really is one error for a lot of cases. The mind reels.
-
+	ret := &uefi.EFIError{Val: uefi.EFI_INVALID_PARAMETER}
 	if h == nil {
-		panic("Error: handle is nil")
+		ret.Err = fmt.Errorf("No handle")
+		return nil, ret
 	}
-
 	if ptr == 0 && attr != uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL {
-		Debug("ptr == nil && attr != %#x, it is %#x", uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL, attr)
 		ret.Err = fmt.Errorf("ptr == nil && attr != %#x, it is %#x", uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL, attr)
 		return nil, ret
 	}
-	// oh FFS, let's fix up the whole *guid.GUID thing eh?
-	prot, err := h.Get(&g)
-	if err != nil {
-		ret.Err = fmt.Errorf("Error: No protocol for handle %v, protocol %v", h, g)
-		Debug("%v", ret.Err)
-		return nil, ret
-	}
-	Debug("on to the case")
 	switch attr {
-	case uefi.EFI_OPEN_PROTOCOL_BY_HANDLE_PROTOCOL, uefi.EFI_OPEN_PROTOCOL_GET_PROTOCOL, uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL, uefi.EFI_OPEN_PROTOCOL_BY_CHILD_CONTROLLER:
-		Debug("case 1 ...")
-		if ch == h || ch != nil || ah != nil {
-			if ptr != 0 {
-				var bb [8]byte
-				var val uint64 // val := 0 // uint64(h.d.up)
-				Debug("Address is %#x write %#x", ptr, val)
-				binary.LittleEndian.PutUint64(bb[:], val)
-				if err := f.Proc.Write(f.Args[2], bb[:]); err != nil {
-					return nil, fmt.Errorf("Can't write %v to %#x: %v", h, ptr, err)
-				}
-			}
-			return prot, nil
-		}
-		log.Panicf("case 3")
-		// /* Check that the controller handle is valid */
-		// if !efi_search_obj(controller_handle) {
-		// 	return ret
-		// }
-		// if !efi_search_obj(agent_handle) {
-		// 	return ret
-		// }
+	case uefi.EFI_OPEN_PROTOCOL_BY_HANDLE_PROTOCOL, uefi.EFI_OPEN_PROTOCOL_GET_PROTOCOL, uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL:
+	case uefi.EFI_OPEN_PROTOCOL_BY_CHILD_CONTROLLER:
+		if ah == nil || ch == nil || ch == h {
+			ret.Err = fmt.Errorf("BY_CHILD_CONTROLLER: bad agent %v or controller %v", ah, ch)
+			return nil, ret
+		}
 	case uefi.EFI_OPEN_PROTOCOL_BY_DRIVER, uefi.EFI_OPEN_PROTOCOL_BY_DRIVER | uefi.EFI_OPEN_PROTOCOL_EXCLUSIVE:
-		log.Panicf("case 2")
-		/* Check that the controller handle is valid */
-		// if !efi_search_obj(controller_handle) {
-		// 	return ret
-		// }
-		// if !efi_search_obj(agent_handle) {
-		// 	return ret
-		// }
+		if ah == nil || ch == nil {
+			ret.Err = fmt.Errorf("BY_DRIVER: bad agent %v or controller %v", ah, ch)
+			return nil, ret
+		}
 	case uefi.EFI_OPEN_PROTOCOL_EXCLUSIVE:
-		log.Panicf("case 3")
-		/* Check that the agent handle is valid */
-		//if !efi_search_obj(agent_handle) {
-		//			return ret
-		//		}
-
+		if ah == nil {
+			ret.Err = fmt.Errorf("EXCLUSIVE: bad agent")
+			return nil, ret
+		}
 	default:
-		log.Panicf("case 4: attr is %#x", attr)
+		ret.Err = fmt.Errorf("Bad attributes %#x", attr)
 		return nil, ret
 	}
-
-	// ret = efi_search_protocol(handle, protocol, &handler)
-	// if r !=uefi.EFI_SUCCESS {
-	// 	return ret
-	// }
-
-	// ret = efi_protocol_open(handler, protocol_interface, agent_handle,
-	// 	controller_handle, attributes)
-
-	Debug("Things went badly ... %v", ret)
-	return nil, ret
+	// oh FFS, let's fix up the whole *guid.GUID thing eh?
+	prot, err := h.Get(&g)
+	if err != nil {
+		return nil, &uefi.EFIError{Val: uefi.EFI_UNSUPPORTED, Err: err}
+	}
+	if attr == uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL {
+		return prot, nil
+	}
+	// GET_PROTOCOL and BY_HANDLE_PROTOCOL don't need good agent or
+	// controller handles, but they get recorded all the same.
+	var agent, controller hd
+	if ah != nil {
+		agent = ah.hd
+	}
+	if ch != nil {
+		controller = ch.hd
+	}
+	// Even when it's already started, the caller gets the interface.
+	err = h.open(&g, agent, controller, uint32(attr))
+	if e, ok := err.(*uefi.EFIError); ok && e.Val != uefi.EFI_ALREADY_STARTED {
+		return nil, err
+	}
+	return prot, err
 }
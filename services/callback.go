@@ -0,0 +1,131 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/trace"
+)
+
+// Sometimes a service has to call the guest: notify functions,
+// driver entry points, and so on. We can't do that while we are
+// handling the hlt. What we can do is arrange the stack so that the
+// ret after the hlt goes to the guest function, and the guest function
+// returns to a hlt of ours. That hlt is the Callback service.
+// When it is hit, we put the stack back and carry on with whatever
+// the service wanted to do next.
+// The original caller never knows: as far as it can tell, the
+// service call was one very long instruction.
+
+// Callback implements Service
+type Callback struct {
+	u  ServBase
+	up ServPtr
+}
+
+// guestCall is a call to the guest in progress.
+type guestCall struct {
+	// sp is the stack pointer to restore when the call returns.
+	sp uint64
+	// then is what to do next.
+	then func(f *Fault) error
+}
+
+var (
+	_ Service = &Callback{}
+	// callbackRet is where guest functions return to.
+	callbackRet uint64
+	// guestCalls is a stack, since guest functions can call services that call the guest.
+	guestCalls []*guestCall
+)
+
+func init() {
+	RegisterCreator("callback", NewCallback)
+}
+
+// NewCallback returns a Callback Service
+func NewCallback(tab []byte, u ServPtr) (Service, error) {
+	base := int(u) & 0xffffff
+	callbackRet = 0xff400000 + uint64(base)
+	binary.LittleEndian.PutUint64(tab[base:], callbackRet)
+	Debug("callback: guest functions return to %#x", callbackRet)
+	return &Callback{u: u.Base(), up: u}, nil
+}
+
+// callGuest arranges for the guest function fn to be called with args
+// when the current service call returns. The first four args go in
+// registers, the rest on the stack, per the UEFI calling convention.
+// When fn returns, then is called, with f.Regs.Rax set to what fn
+// returned and the stack as it was when callGuest was called.
+// then sets the status for the original caller, or calls callGuest
+// again to chain another call.
+func callGuest(f *Fault, fn uintptr, then func(f *Fault) error, args ...uint64) error {
+	if callbackRet == 0 {
+		return fmt.Errorf("callGuest(%#x): no callback service", fn)
+	}
+	sp := f.Regs.Rsp
+	// Stay well clear of what's there, and make sure that at fn's
+	// entry, after our ret pops fn, the stack is 16-byte aligned
+	// less the return address, as it would be after a call.
+	n := uint64(len(args))
+	if n < 4 {
+		n = 4
+	}
+	nsp := (sp - 0x100 - 8*n) &^ 0xf
+	words := []uint64{uint64(fn), callbackRet, 0, 0, 0, 0}
+	if len(args) > 4 {
+		words = append(words, args[4:]...)
+	}
+	for i, w := range words {
+		if err := trace.WriteWord(f.Proc, uintptr(nsp)+uintptr(i*8), w); err != nil {
+			return fmt.Errorf("callGuest(%#x): writing stack at %#x: %v", fn, nsp+uint64(i*8), err)
+		}
+	}
+	regs := []*uint64{&f.Regs.Rcx, &f.Regs.Rdx, &f.Regs.R8, &f.Regs.R9}
+	for i, a := range args {
+		if i == len(regs) {
+			break
+		}
+		*regs[i] = a
+	}
+	f.Regs.Rsp = nsp
+	guestCalls = append(guestCalls, &guestCall{sp: sp, then: then})
+	Debug("callGuest: %#x(%#x), sp %#x -> %#x", fn, args, sp, nsp)
+	return nil
+}
+
+// Aliases implements Aliases
+func (c *Callback) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (c *Callback) Base() ServBase {
+	return c.u
+}
+
+// Ptr implements service.Ptr
+func (c *Callback) Ptr() ServPtr {
+	return c.up
+}
+
+// Call implements service.Call. It is reached when a guest function
+// called by callGuest returns.
+func (c *Callback) Call(f *Fault) error {
+	if len(guestCalls) == 0 {
+		return fmt.Errorf("return to callback at %#x with no guest call in progress", f.Regs.Rip)
+	}
+	g := guestCalls[len(guestCalls)-1]
+	guestCalls = guestCalls[:len(guestCalls)-1]
+	Debug("callback: guest returns %#x, sp back to %#x", f.Regs.Rax, g.sp)
+	f.Regs.Rsp = g.sp
+	return g.then(f)
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (c *Callback) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// CapsulePolicy says which capsules UpdateCapsule takes, and where
+// they go. We never apply them: they are written to files, for
+// whatever tests the update tooling to look at.
+type CapsulePolicy struct {
+	// Dir is where capsules are written, if it is set.
+	Dir string
+	// MaxSize is the largest capsule taken.
+	MaxSize uint64
+	// Persist is whether capsules that persist across a reset are taken.
+	Persist bool
+	// Immediate is whether capsules that are processed right away,
+	// without a reset, are taken.
+	Immediate bool
+}
+
+var (
+	capsulePolicy = CapsulePolicy{MaxSize: 32 << 20, Persist: true, Immediate: true}
+	// capsules is how many capsules have been written, for file names.
+	capsules int
+)
+
+// SetCapsulePolicy sets the capsule policy.
+func SetCapsulePolicy(p CapsulePolicy) {
+	capsulePolicy = p
+}
+
+// takes says whether the policy takes the capsule.
+func (p *CapsulePolicy) takes(h *uefi.CapsuleHeader) bool {
+	if uint64(h.CapsuleImageSize) > p.MaxSize {
+		return false
+	}
+	if h.Flags&uefi.CAPSULE_FLAGS_PERSIST_ACROSS_RESET != 0 {
+		return p.Persist
+	}
+	return p.Immediate
+}
+
+// readCapsules reads count capsules, from the array of pointers to
+// them at array. It returns an EFI status if they are not acceptable.
+func readCapsules(f *Fault, array uintptr, count uint64) ([]*uefi.CapsuleHeader, [][]byte, uint64, error) {
+	if array == 0 || count == 0 {
+		return nil, nil, uefi.EFI_INVALID_PARAMETER, nil
+	}
+	var hs []*uefi.CapsuleHeader
+	var cs [][]byte
+	for i := uint64(0); i < count; i++ {
+		p, err := trace.ReadWord(f.Proc, array+uintptr(i*8))
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("Can't read capsule pointer %d at %#x: %v", i, array, err)
+		}
+		b := make([]byte, uefi.CapsuleHeaderSize)
+		if err := f.Proc.Read(uintptr(p), b); err != nil {
+			return nil, nil, 0, fmt.Errorf("Can't read capsule header at %#x: %v", p, err)
+		}
+		h, err := uefi.ParseCapsuleHeader(b)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if err := h.Validate(); err != nil {
+			log.Printf("UpdateCapsule: %v", err)
+			return nil, nil, uefi.EFI_INVALID_PARAMETER, nil
+		}
+		if !capsulePolicy.takes(h) {
+			Debug("Capsule %v, flags %#x, %#x bytes: not taken", h.CapsuleGUID, h.Flags, h.CapsuleImageSize)
+			return nil, nil, uefi.EFI_UNSUPPORTED, nil
+		}
+		c := make([]byte, h.CapsuleImageSize)
+		if err := f.Proc.Read(uintptr(p), c); err != nil {
+			return nil, nil, 0, fmt.Errorf("Can't read %#x byte capsule at %#x: %v", len(c), p, err)
+		}
+		hs, cs = append(hs, h), append(cs, c)
+	}
+	return hs, cs, uefi.EFI_SUCCESS, nil
+}
+
+// anyFlag says whether any of the capsules has flag set.
+func anyFlag(hs []*uefi.CapsuleHeader, flag uint32) bool {
+	for _, h := range hs {
+		if h.Flags&flag != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCapsule writes a capsule to a file in the capsule directory.
+func writeCapsule(h *uefi.CapsuleHeader, c []byte) error {
+	if len(capsulePolicy.Dir) == 0 {
+		return nil
+	}
+	n := filepath.Join(capsulePolicy.Dir, fmt.Sprintf("capsule-%d-%v.bin", capsules, h.CapsuleGUID))
+	capsules++
+	if err := os.WriteFile(n, c, 0644); err != nil {
+		return err
+	}
+	log.Printf("UpdateCapsule: capsule %v, flags %#x, %#x bytes, written to %s", h.CapsuleGUID, h.Flags, len(c), n)
+	return nil
+}
+
+// updateCapsule implements UpdateCapsule.
+func updateCapsule(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 3)
+	hs, cs, status, err := readCapsules(f, args[0], uint64(args[1]))
+	if err != nil || status != uefi.EFI_SUCCESS {
+		f.Regs.Rax = status
+		return err
+	}
+	sg := uint64(args[2])
+	if sg == 0 && anyFlag(hs, uefi.CAPSULE_FLAGS_PERSIST_ACROSS_RESET) {
+		log.Printf("UpdateCapsule: capsules that persist across reset need a scatter gather list")
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if sg != 0 {
+		// The list has physical addresses, and the capsules again.
+		// They had better be the same ones.
+		read := func(a uint64, b []byte) error { return f.Proc.Read(uintptr(a), b) }
+		blocks, err := uefi.ScatterGather(read, sg)
+		if err == nil {
+			var sgc [][]byte
+			var n uint64
+			for _, c := range cs {
+				n += uint64(len(c))
+			}
+			sgc, err = uefi.Gather(read, blocks, n)
+			if err == nil && !sameCapsules(cs, sgc) {
+				err = fmt.Errorf("the scatter gather list at %#x does not have the capsules", sg)
+			}
+		}
+		if err != nil {
+			log.Printf("UpdateCapsule: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+	}
+	for i, h := range hs {
+		if err := writeCapsule(h, cs[i]); err != nil {
+			log.Printf("UpdateCapsule: %v", err)
+			f.Regs.Rax = uefi.EFI_DEVICE_ERROR
+			return nil
+		}
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	if anyFlag(hs, uefi.CAPSULE_FLAGS_INITIATE_RESET) {
+		return &Reset{Type: uefi.EfiResetWarm, Status: uefi.EFI_SUCCESS, Data: "capsule update"}
+	}
+	return nil
+}
+
+func sameCapsules(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryCapsuleCapabilities implements QueryCapsuleCapabilities.
+func queryCapsuleCapabilities(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 4)
+	if args[2] == 0 || args[3] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	hs, _, status, err := readCapsules(f, args[0], uint64(args[1]))
+	if err != nil || status != uefi.EFI_SUCCESS {
+		f.Regs.Rax = status
+		return err
+	}
+	if err := trace.WriteWord(f.Proc, args[2], capsulePolicy.MaxSize); err != nil {
+		return fmt.Errorf("Can't write MaximumCapsuleSize at %#x: %v", args[2], err)
+	}
+	// As edk2 does: a warm reset if one is needed, cold otherwise.
+	rt := []byte{uefi.EfiResetCold, 0, 0, 0}
+	if anyFlag(hs, uefi.CAPSULE_FLAGS_PERSIST_ACROSS_RESET) {
+		rt[0] = uefi.EfiResetWarm
+	}
+	if err := f.Proc.Write(args[3], rt); err != nil {
+		return fmt.Errorf("Can't write ResetType at %#x: %v", args[3], err)
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
@@ -7,27 +7,50 @@ import (
 
 	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
 	"github.com/linuxboot/voodoo/uefi"
 )
 
-// Collate implements Service
+// collateLanguages is where the SupportedLanguages string lives, in the
+// Collate service's 64K.
+const collateLanguages = 0x100
+
+// Collate implements Service. There are two of them: Unicode Collation,
+// whose languages are ISO 639-2 codes, and Unicode Collation 2, whose
+// languages are RFC 4646 codes. Otherwise they are the same.
 type Collate struct {
 	u  ServBase
 	up ServPtr
 }
 
 func init() {
-	RegisterGUIDCreator("1D85CD7F-F43D-11D2-9A0C-0090273FC14D", NewCollate)
+	RegisterGUIDCreator(table.CollateGUID, NewCollate)
+	RegisterGUIDCreator(table.Collate2GUID, NewCollate2)
 }
 
 // NewCollate returns a Collate Service
 func NewCollate(tab []byte, u ServPtr) (Service, error) {
 	Debug("New Collate ...")
+	return newCollate(tab, u, "eng")
+}
+
+// NewCollate2 returns a Collate Service for Unicode Collation 2.
+func NewCollate2(tab []byte, u ServPtr) (Service, error) {
+	Debug("New Collate2 ...")
+	return newCollate(tab, u, "en")
+}
+
+func newCollate(tab []byte, u ServPtr, languages string) (Service, error) {
 	base := int(u) & 0xffffff
 
 	for p := range table.CollateServicesNames {
 		x := base + int(p)
 		r := uint64(p) + 0xff400000 + uint64(base)
+		if p == table.CollSupportedLanguages {
+			// Not a function pointer: a pointer to the CHAR8 language codes.
+			r = uint64(u) + collateLanguages
+			copy(tab[base+collateLanguages:], append([]byte(languages), 0))
+		}
 		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
 		Debug("collate: Install %v %#x at off %#x", p, r, x)
 	}
@@ -35,6 +58,32 @@ func NewCollate(tab []byte, u ServPtr) (Service, error) {
 	return &Collate{u: u.Base(), up: u}, nil
 }
 
+// readUCS2 reads a NUL-terminated CHAR16 string. Unlike
+// trace.ReadUTF16String, it keeps the string as it is, even if it is
+// not valid UTF-16.
+func readUCS2(t trace.Trace, p uintptr) ([]uint16, error) {
+	var s []uint16
+	var w [2]byte
+	for {
+		if err := t.Read(p+uintptr(2*len(s)), w[:]); err != nil {
+			return nil, fmt.Errorf("Can't read string at %#x: %v", p, err)
+		}
+		c := binary.LittleEndian.Uint16(w[:])
+		if c == 0 {
+			return s, nil
+		}
+		s = append(s, c)
+	}
+}
+
+// boolean returns an EFI BOOLEAN.
+func boolean(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // Aliases implements Aliases
 func (c *Collate) Aliases() []string {
 	return nil
@@ -56,6 +105,79 @@ func (t *Collate) Call(f *Fault) error {
 	Debug("Collate services: %v(%#x), arg type %T, args %v", table.CollateServicesNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
 	f.Regs.Rax = uefi.EFI_SUCCESS
 	switch op {
+	case table.CollStriColl:
+		// INTN StriColl (IN EFI_UNICODE_COLLATION_PROTOCOL *This, IN CHAR16 *s1, IN CHAR16 *s2);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		s1, err := readUCS2(f.Proc, f.Args[1])
+		if err != nil {
+			return err
+		}
+		s2, err := readUCS2(f.Proc, f.Args[2])
+		if err != nil {
+			return err
+		}
+		f.Regs.Rax = uint64(int64(uefi.StriColl(s1, s2)))
+	case table.CollMetaiMatch:
+		// BOOLEAN MetaiMatch (IN EFI_UNICODE_COLLATION_PROTOCOL *This, IN CHAR16 *String, IN CHAR16 *Pattern);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		s, err := readUCS2(f.Proc, f.Args[1])
+		if err != nil {
+			return err
+		}
+		p, err := readUCS2(f.Proc, f.Args[2])
+		if err != nil {
+			return err
+		}
+		f.Regs.Rax = boolean(uefi.MetaiMatch(s, p))
+	case table.CollStrLwr, table.CollStrUpr:
+		// VOID StrLwr (IN EFI_UNICODE_COLLATION_PROTOCOL *This, IN OUT CHAR16 *Str);
+		// VOID StrUpr (IN EFI_UNICODE_COLLATION_PROTOCOL *This, IN OUT CHAR16 *Str);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		s, err := readUCS2(f.Proc, f.Args[1])
+		if err != nil {
+			return err
+		}
+		if op == table.CollStrLwr {
+			uefi.StrLwr(s)
+		} else {
+			uefi.StrUpr(s)
+		}
+		return writeUCS2(f.Proc, f.Args[1], s)
+	case table.CollFatToStr:
+		// VOID FatToStr (IN EFI_UNICODE_COLLATION_PROTOCOL *This, IN UINTN FatSize, IN CHAR8 *Fat, OUT CHAR16 *String);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		// FatSize is a UINTN, so clamp it before it is an int, which
+		// could be negative. Even long names are shorter than 256.
+		n := 256
+		if f.Args[1] < 256 {
+			n = int(f.Args[1])
+		}
+		fat := make([]byte, n)
+		if err := f.Proc.Read(f.Args[2], fat); err != nil {
+			return fmt.Errorf("Can't read FAT name at %#x: %v", f.Args[2], err)
+		}
+		return writeUCS2(f.Proc, f.Args[3], uefi.FatToStr(fat, n))
+	case table.CollStrToFat:
+		// BOOLEAN StrToFat (IN EFI_UNICODE_COLLATION_PROTOCOL *This, IN CHAR16 *String, IN UINTN FatSize, OUT CHAR8 *Fat);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		s, err := readUCS2(f.Proc, f.Args[1])
+		if err != nil {
+			return err
+		}
+		// The name is never longer than s, and its NUL.
+		n := len(s) + 1
+		if f.Args[2] < uintptr(n) {
+			n = int(f.Args[2])
+		}
+		fat, replaced := uefi.StrToFat(s, n)
+		// There is a NUL only if there is room.
+		if len(fat) < n {
+			fat = append(fat, 0)
+		}
+		if err := f.Proc.Write(f.Args[3], fat); err != nil {
+			return fmt.Errorf("Can't write FAT name to %#x: %v", f.Args[3], err)
+		}
+		f.Regs.Rax = boolean(replaced)
 	default:
 		log.Panicf("unsup collate Call: %#x", op)
 		f.Regs.Rax = uefi.EFI_UNSUPPORTED
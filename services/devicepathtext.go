@@ -0,0 +1,183 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/devicepath"
+)
+
+// DevicePathText implements Service. It is both the Device Path To
+// Text protocol and the Device Path From Text protocol, which differ
+// only in which way they go.
+type DevicePathText struct {
+	u    ServBase
+	up   ServPtr
+	from bool
+}
+
+var _ Service = &DevicePathText{}
+
+func init() {
+	RegisterGUIDCreator(table.DevicePathToTextGUID, NewDevicePathToText)
+	RegisterGUIDCreator(table.DevicePathFromTextGUID, NewDevicePathFromText)
+}
+
+// newDevicePathText installs the functions. The two protocols have the
+// same layout: two functions.
+func newDevicePathText(tab []byte, u ServPtr, from bool) (Service, error) {
+	base := int(u) & 0xffffff
+	for p := range table.DevicePathToTextNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("devicepathtext: Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	return &DevicePathText{u: u.Base(), up: u, from: from}, nil
+}
+
+// NewDevicePathToText returns a DevicePathText Service that converts
+// device paths to text.
+func NewDevicePathToText(tab []byte, u ServPtr) (Service, error) {
+	return newDevicePathText(tab, u, false)
+}
+
+// NewDevicePathFromText returns a DevicePathText Service that converts
+// text to device paths.
+func NewDevicePathFromText(tab []byte, u ServPtr) (Service, error) {
+	return newDevicePathText(tab, u, true)
+}
+
+// devicePathText returns the text form of the device path at p, for
+// debug prints.
+func devicePathText(t trace.Trace, p uintptr) string {
+	paths, err := devicepath.Unmarshal(t, p)
+	if err != nil {
+		return err.Error()
+	}
+	return devicepath.ToText(paths)
+}
+
+// Aliases implements Aliases
+func (d *DevicePathText) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (d *DevicePathText) Base() ServBase {
+	return d.u
+}
+
+// Ptr implements service.Ptr
+func (d *DevicePathText) Ptr() ServPtr {
+	return d.up
+}
+
+// Call implements service.Call. The functions return pointers, which
+// the caller frees with FreePool, or NULL if they fail.
+func (d *DevicePathText) Call(f *Fault) error {
+	op := f.Op
+	name := table.DevicePathToTextNames[uint64(op)]
+	if d.from {
+		name = table.DevicePathFromTextNames[uint64(op)]
+	}
+	Debug("DevicePathText services: %v(%#x), arg type %T, args %v", name, op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = 0
+	switch {
+	case !d.from && op == table.DPConvertDeviceNodeToText:
+		// CHAR16* ConvertDeviceNodeToText (IN CONST EFI_DEVICE_PATH_PROTOCOL* DeviceNode,
+		//   IN BOOLEAN DisplayOnly, IN BOOLEAN AllowShortcuts);
+		// We have only the one form, so DisplayOnly and AllowShortcuts don't matter.
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		if f.Args[0] == 0 {
+			return nil
+		}
+		p, err := devicepath.UnmarshalNode(f.Proc, f.Args[0])
+		if err != nil {
+			log.Printf("ConvertDeviceNodeToText: %v", err)
+			return nil
+		}
+		return d.text(f, p.String())
+	case !d.from && op == table.DPConvertDevicePathToText:
+		// CHAR16* ConvertDevicePathToText (IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePath,
+		//   IN BOOLEAN DisplayOnly, IN BOOLEAN AllowShortcuts);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		if f.Args[0] == 0 {
+			return nil
+		}
+		paths, err := devicepath.Unmarshal(f.Proc, f.Args[0])
+		if err != nil {
+			log.Printf("ConvertDevicePathToText: %v", err)
+			return nil
+		}
+		return d.text(f, devicepath.ToText(paths))
+	case d.from && op == table.DPConvertTextToDeviceNode:
+		// EFI_DEVICE_PATH_PROTOCOL* ConvertTextToDeviceNode (IN CONST CHAR16 *TextDeviceNode);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		if f.Args[0] == 0 {
+			return nil
+		}
+		s, err := trace.ReadUTF16String(f.Proc, f.Args[0])
+		if err != nil {
+			return fmt.Errorf("Can't read device node text at %#x: %v", f.Args[0], err)
+		}
+		p, err := devicepath.NodeFromText(s)
+		if err != nil {
+			log.Printf("ConvertTextToDeviceNode(%q): %v", s, err)
+			return nil
+		}
+		return returnPath(f, devicepath.Blob(p))
+	case d.from && op == table.DPConvertTextToDevicePath:
+		// EFI_DEVICE_PATH_PROTOCOL* ConvertTextToDevicePath (IN CONST CHAR16 *TextDevicePath);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		if f.Args[0] == 0 {
+			return nil
+		}
+		s, err := trace.ReadUTF16String(f.Proc, f.Args[0])
+		if err != nil {
+			return fmt.Errorf("Can't read device path text at %#x: %v", f.Args[0], err)
+		}
+		paths, err := devicepath.FromText(s)
+		if err != nil {
+			log.Printf("ConvertTextToDevicePath(%q): %v", s, err)
+			return nil
+		}
+		return returnPath(f, devicepath.Blob(paths...))
+	default:
+		log.Panicf("unsup devicepathtext Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// text returns s to the guest, as a CHAR16 string.
+func (d *DevicePathText) text(f *Fault, s string) error {
+	p, err := writeString(f, s)
+	if err != nil {
+		return err
+	}
+	f.Regs.Rax = p
+	return nil
+}
+
+// returnPath returns a binary device path, or node, to the guest, in
+// pool memory.
+func returnPath(f *Fault, b []byte) error {
+	p := uint64(UEFIAllocate(uintptr(len(b)), false))
+	if err := f.Proc.Write(uintptr(p), b); err != nil {
+		return fmt.Errorf("Can't write device path to %#x: %v", p, err)
+	}
+	f.Regs.Rax = p
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (d *DevicePathText) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
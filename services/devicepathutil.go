@@ -0,0 +1,205 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/devicepath"
+)
+
+// DevicePathUtilities implements Service
+type DevicePathUtilities struct {
+	u  ServBase
+	up ServPtr
+}
+
+var _ Service = &DevicePathUtilities{}
+
+func init() {
+	RegisterGUIDCreator(table.DevicePathUtilitiesGUID, NewDevicePathUtilities)
+}
+
+// NewDevicePathUtilities returns a DevicePathUtilities Service
+func NewDevicePathUtilities(tab []byte, u ServPtr) (Service, error) {
+	base := int(u) & 0xffffff
+	for p := range table.DevicePathUtilitiesNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("devicepathutil: Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	return &DevicePathUtilities{u: u.Base(), up: u}, nil
+}
+
+// Aliases implements Aliases
+func (d *DevicePathUtilities) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (d *DevicePathUtilities) Base() ServBase {
+	return d.u
+}
+
+// Ptr implements service.Ptr
+func (d *DevicePathUtilities) Ptr() ServPtr {
+	return d.up
+}
+
+// readPaths reads the device paths at ps. A NULL pointer is a nil path.
+func readPaths(f *Fault, ps ...uintptr) ([][]devicepath.Path, error) {
+	var paths [][]devicepath.Path
+	for _, p := range ps {
+		if p == 0 {
+			paths = append(paths, nil)
+			continue
+		}
+		dp, err := devicepath.Unmarshal(f.Proc, p)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, dp)
+	}
+	return paths, nil
+}
+
+// Call implements service.Call. Most of the functions return a new
+// device path, in pool memory, or NULL if something is wrong; a bad
+// device path is the guest's problem, not ours, so it is only logged.
+func (d *DevicePathUtilities) Call(f *Fault) error {
+	op := f.Op
+	name := table.DevicePathUtilitiesNames[uint64(op)]
+	Debug("DevicePathUtilities services: %v(%#x), arg type %T, args %v", name, op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = 0
+	switch op {
+	case table.DPGetDevicePathSize, table.DPDuplicateDevicePath, table.DPIsDevicePathMultiInstance:
+		// UINTN GetDevicePathSize (IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePath);
+		// EFI_DEVICE_PATH_PROTOCOL* DuplicateDevicePath (IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePath);
+		// BOOLEAN IsDevicePathMultiInstance (IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePath);
+		f.Args = trace.Args(f.Proc, f.Regs, 1)
+		if f.Args[0] == 0 {
+			return nil
+		}
+		paths, err := devicepath.Unmarshal(f.Proc, f.Args[0])
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+			return nil
+		}
+		switch op {
+		case table.DPGetDevicePathSize:
+			f.Regs.Rax = uint64(devicepath.Size(paths))
+		case table.DPDuplicateDevicePath:
+			return returnPath(f, devicepath.Blob(paths...))
+		case table.DPIsDevicePathMultiInstance:
+			f.Regs.Rax = boolean(devicepath.IsMultiInstance(paths))
+		}
+	case table.DPAppendDevicePath:
+		// EFI_DEVICE_PATH_PROTOCOL* AppendDevicePath (IN CONST EFI_DEVICE_PATH_PROTOCOL *Src1,
+		//   IN CONST EFI_DEVICE_PATH_PROTOCOL *Src2);
+		// Either, or both, can be NULL.
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		paths, err := readPaths(f, f.Args[0], f.Args[1])
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+			return nil
+		}
+		return returnPath(f, devicepath.Blob(devicepath.Append(paths[0], paths[1])...))
+	case table.DPAppendDeviceNode:
+		// EFI_DEVICE_PATH_PROTOCOL* AppendDeviceNode (IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePath,
+		//   IN CONST EFI_DEVICE_PATH_PROTOCOL *DeviceNode);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		paths, err := readPaths(f, f.Args[0])
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+			return nil
+		}
+		if f.Args[1] == 0 {
+			return returnPath(f, devicepath.Blob(devicepath.Append(paths[0], nil)...))
+		}
+		n, err := devicepath.UnmarshalNode(f.Proc, f.Args[1])
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+			return nil
+		}
+		return returnPath(f, devicepath.Blob(devicepath.AppendNode(paths[0], n)...))
+	case table.DPAppendDevicePathInstance:
+		// EFI_DEVICE_PATH_PROTOCOL* AppendDevicePathInstance (IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePath,
+		//   IN CONST EFI_DEVICE_PATH_PROTOCOL *DevicePathInstance);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		if f.Args[1] == 0 {
+			return nil
+		}
+		paths, err := readPaths(f, f.Args[0], f.Args[1])
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+			return nil
+		}
+		if paths[0] == nil {
+			return returnPath(f, devicepath.Blob(paths[1]...))
+		}
+		return returnPath(f, devicepath.Blob(devicepath.AppendInstance(paths[0], paths[1])...))
+	case table.DPGetNextDevicePathInstance:
+		// EFI_DEVICE_PATH_PROTOCOL* GetNextDevicePathInstance (IN OUT EFI_DEVICE_PATH_PROTOCOL **DevicePathInstance,
+		//   OUT UINTN *DevicePathInstanceSize);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		if f.Args[0] == 0 {
+			return nil
+		}
+		p, err := trace.ReadWord(f.Proc, f.Args[0])
+		if err != nil {
+			return fmt.Errorf("Can't read DevicePathInstance at %#x: %v", f.Args[0], err)
+		}
+		if p == 0 {
+			return nil
+		}
+		paths, err := devicepath.Unmarshal(f.Proc, uintptr(p))
+		if err != nil {
+			log.Printf("%v: %v", name, err)
+			return nil
+		}
+		insts := devicepath.Instances(paths)
+		inst := append(insts[0], &devicepath.End{})
+		n := devicepath.Size(inst)
+		// The next instance is after this one's end node, if there is one.
+		next := p + uint64(n)
+		if len(insts) == 1 {
+			next = 0
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[0], next); err != nil {
+			return fmt.Errorf("Can't write DevicePathInstance at %#x: %v", f.Args[0], err)
+		}
+		if f.Args[1] != 0 {
+			if err := trace.WriteWord(f.Proc, f.Args[1], uint64(n)); err != nil {
+				return fmt.Errorf("Can't write DevicePathInstanceSize at %#x: %v", f.Args[1], err)
+			}
+		}
+		return returnPath(f, devicepath.Blob(inst...))
+	case table.DPCreateDeviceNode:
+		// EFI_DEVICE_PATH_PROTOCOL* CreateDeviceNode (IN UINT8 NodeType, IN UINT8 NodeSubType, IN UINT16 NodeLength);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		n := uint16(f.Args[2])
+		if n < devicepath.HeaderSize {
+			return nil
+		}
+		// The caller fills in the rest, so it is zeros, whatever the type.
+		b := make([]byte, n)
+		b[0], b[1] = uint8(f.Args[0]), uint8(f.Args[1])
+		binary.LittleEndian.PutUint16(b[2:], n)
+		return returnPath(f, b)
+	default:
+		log.Panicf("unsup devicepathutil Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (d *DevicePathUtilities) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
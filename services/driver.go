@@ -0,0 +1,505 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// The UEFI driver model. Guest drivers install an
+// EFI_DRIVER_BINDING_PROTOCOL. ConnectController asks each of them,
+// highest version first, if it supports a controller, and starts the
+// ones that do. A driver that starts opens the controller's protocols
+// BY_DRIVER, and may make child handles, which open the controller's
+// protocols BY_CHILD_CONTROLLER. DisconnectController, and
+// uninstalling a protocol that a driver is using, use those records
+// to know which drivers to stop, and for which children.
+// It is all calls to the guest, so it is all callGuest continuations:
+// each one leaves the status in f.Regs.Rax and calls the next.
+
+// openInfo is an EFI_OPEN_PROTOCOL_INFORMATION_ENTRY.
+type openInfo struct {
+	agent      hd
+	controller hd
+	attr       uint32
+	count      uint32
+}
+
+// openInfoSize is the size of an EFI_OPEN_PROTOCOL_INFORMATION_ENTRY.
+const openInfoSize = 24
+
+// binding is a guest EFI_DRIVER_BINDING_PROTOCOL.
+type binding struct {
+	// this is where it is, the first argument of its functions.
+	this      uintptr
+	supported uintptr
+	start     uintptr
+	stop      uintptr
+	version   uint32
+	image     hd
+	handle    hd
+}
+
+// returnToGuest ends a chain of continuations. The status is set.
+func returnToGuest(f *Fault) error {
+	return nil
+}
+
+// efiStatus sets the guest's status from err. An *uefi.EFIError is
+// the guest's problem; anything else is ours.
+func efiStatus(f *Fault, err error) error {
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(*uefi.EFIError)
+	if !ok {
+		return err
+	}
+	Debug("%v", e.Err)
+	f.Regs.Rax = uint64(e.Val)
+	return nil
+}
+
+// readBinding reads the EFI_DRIVER_BINDING_PROTOCOL at p.
+func readBinding(t trace.Trace, p uintptr) (*binding, error) {
+	var b [0x30]byte
+	if err := t.Read(p, b[:]); err != nil {
+		return nil, fmt.Errorf("Can't read driver binding at %#x: %v", p, err)
+	}
+	w := func(o int) uint64 {
+		return binary.LittleEndian.Uint64(b[o:])
+	}
+	return &binding{
+		this:      p,
+		supported: uintptr(w(0)),
+		start:     uintptr(w(8)),
+		stop:      uintptr(w(0x10)),
+		version:   binary.LittleEndian.Uint32(b[0x18:]),
+		image:     hd(w(0x20)),
+		handle:    hd(w(0x28)),
+	}, nil
+}
+
+// handleBinding returns the driver binding on handle h.
+func handleBinding(t trace.Trace, h hd) (*binding, error) {
+	hh, err := getHandle(h)
+	if err != nil {
+		return nil, err
+	}
+	d, err := hh.Get(uefi.DriverBindingGUID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readBinding(t, uintptr(d.up))
+	if err != nil {
+		return nil, err
+	}
+	// Drivers don't always fill in DriverBindingHandle.
+	if b.handle == 0 {
+		b.handle = h
+	}
+	return b, nil
+}
+
+// bindings returns the driver bindings in the order ConnectController
+// tries them: those for the images, or binding handles, in first, in
+// that order; then the rest, highest version first.
+func bindings(t trace.Trace, first []hd) []*binding {
+	var bs []*binding
+	for _, h := range allHandlesByGUID(uefi.DriverBindingGUID) {
+		b, err := handleBinding(t, h)
+		if err != nil {
+			log.Printf("Driver binding on %#x: %v", h, err)
+			continue
+		}
+		bs = append(bs, b)
+	}
+	rank := func(b *binding) int {
+		for i, h := range first {
+			if h == b.image || h == b.handle {
+				return i
+			}
+		}
+		return len(first)
+	}
+	sort.SliceStable(bs, func(i, j int) bool {
+		if ri, rj := rank(bs[i]), rank(bs[j]); ri != rj {
+			return ri < rj
+		}
+		return bs[i].version > bs[j].version
+	})
+	return bs
+}
+
+// openers returns the agents that have a protocol on h open with any
+// of the attributes attr, in handle order.
+func (h *Handle) openers(attr uint32) []hd {
+	var all []hd
+	seen := map[hd]bool{}
+	for _, os := range h.opens {
+		for _, o := range os {
+			if o.attr&attr != 0 && !seen[o.agent] {
+				seen[o.agent] = true
+				all = append(all, o.agent)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all
+}
+
+// children returns the child handles of h: the controllers that have
+// one of its protocols open BY_CHILD_CONTROLLER. By the spec, a driver's
+// children are those it opened as the agent, but guests, the
+// efi_selftest controllers test among them, open them with the child as
+// the agent; so, like U-Boot, we don't look at who the agent is.
+func (h *Handle) children() []hd {
+	var all []hd
+	seen := map[hd]bool{}
+	for _, os := range h.opens {
+		for _, o := range os {
+			if o.attr&uefi.EFI_OPEN_PROTOCOL_BY_CHILD_CONTROLLER != 0 && !seen[o.controller] {
+				seen[o.controller] = true
+				all = append(all, o.controller)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all
+}
+
+// open records that agent opened g on h for controller, with attr.
+// The checks, and the status, are those of OpenProtocol.
+func (h *Handle) open(g *guid.GUID, agent, controller hd, attr uint32) error {
+	const byDriver, exclusive = uefi.EFI_OPEN_PROTOCOL_BY_DRIVER, uefi.EFI_OPEN_PROTOCOL_EXCLUSIVE
+	k := g.String()
+	for _, o := range h.opens[k] {
+		same := o.agent == agent
+		switch {
+		case o.attr&exclusive != 0 && attr&exclusive != 0 && same,
+			o.attr&byDriver != 0 && o.attr == attr && same:
+			return &uefi.EFIError{Val: uefi.EFI_ALREADY_STARTED, Err: fmt.Errorf("%v is already open by %#x", g, agent)}
+		// The spec says to disconnect the other drivers to get
+		// an exclusive open. We don't go that far.
+		case o.attr&exclusive != 0 && attr&(byDriver|exclusive) != 0,
+			o.attr&byDriver != 0 && attr&(byDriver|exclusive) != 0:
+			return &uefi.EFIError{Val: uefi.EFI_ACCESS_DENIED, Err: fmt.Errorf("%v is open by %#x, attributes %#x", g, o.agent, o.attr)}
+		}
+	}
+	for _, o := range h.opens[k] {
+		if o.agent == agent && o.controller == controller && o.attr == attr {
+			o.count++
+			return nil
+		}
+	}
+	h.opens[k] = append(h.opens[k], &openInfo{agent: agent, controller: controller, attr: attr, count: 1})
+	return nil
+}
+
+// close removes the records of agent opening g on h for controller.
+// It says whether there were any.
+func (h *Handle) close(g *guid.GUID, agent, controller hd) bool {
+	k := g.String()
+	var keep []*openInfo
+	for _, o := range h.opens[k] {
+		if o.agent != agent || o.controller != controller {
+			keep = append(keep, o)
+		}
+	}
+	found := len(keep) != len(h.opens[k])
+	h.opens[k] = keep
+	return found
+}
+
+// remove removes g from h. The spec says a handle with no protocols
+// left is freed, but we keep it: the efi_selftest controllers test
+// installs new children on the handles of the ones it uninstalled, as
+// older U-Boot let it.
+func (h *Handle) remove(g *guid.GUID) {
+	delete(h.protocols, g.String())
+	delete(h.opens, g.String())
+}
+
+// protocolArgs reads the protocol GUID and interface pairs of
+// InstallMultipleProtocolInterfaces and
+// UninstallMultipleProtocolInterfaces, which follow the handle and end
+// with a NULL GUID pointer.
+func protocolArgs(f *Fault) ([]guid.GUID, []uint64, error) {
+	const max = 32
+	var gs []guid.GUID
+	var ifaces []uint64
+	args := trace.Args(f.Proc, f.Regs, 2+2*max)
+	for i := 1; args[i] != 0; i += 2 {
+		if i+1 >= len(args) {
+			return nil, nil, fmt.Errorf("more than %d protocols", max)
+		}
+		var g guid.GUID
+		if err := f.Proc.Read(args[i], g[:]); err != nil {
+			return nil, nil, fmt.Errorf("Can't read guid at %#x: %v", args[i], err)
+		}
+		gs, ifaces = append(gs, g), append(ifaces, uint64(args[i+1]))
+	}
+	return gs, ifaces, nil
+}
+
+// installProtocols installs the guest's interfaces for gs on the handle
+// at hp, making a new handle if it is NULL. It installs all of them or
+// none.
+func installProtocols(f *Fault, hp uintptr, gs []guid.GUID, ifaces []uint64) error {
+	p, err := trace.ReadWord(f.Proc, hp)
+	if err != nil {
+		return fmt.Errorf("Can't read handle at %#x: %v", hp, err)
+	}
+	var h *Handle
+	if p != 0 {
+		if h, err = getHandle(hd(p)); err != nil {
+			Debug("installProtocols: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+	}
+	seen := map[string]bool{}
+	for _, g := range gs {
+		k := g.String()
+		installed := false
+		if h != nil {
+			_, installed = h.protocols[k]
+		}
+		if installed || seen[k] {
+			Debug("installProtocols: %v is already installed on %#x", g, p)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		seen[k] = true
+	}
+	if h == nil {
+		h = newHandle()
+	}
+	for i := range gs {
+		Debug("installProtocols: %#x: %v at %#x", h.hd, gs[i], ifaces[i])
+		h.PutService(&gs[i], nil, ServPtr(ifaces[i]))
+	}
+	if err := trace.WriteWord(f.Proc, hp, uint64(h.hd)); err != nil {
+		return fmt.Errorf("Can't write handle to %#x: %v", hp, err)
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
+
+// connectController connects the drivers that support controller c,
+// and, if recursive, its children, theirs, and so on. remaining is the
+// RemainingDevicePath for c's drivers.
+func connectController(f *Fault, c hd, first []hd, remaining uint64, recursive bool, then func(f *Fault) error) error {
+	bs := bindings(f.Proc, first)
+	status := uint64(uefi.EFI_NOT_FOUND)
+	var children []hd
+	var connect func(f *Fault, i int) error
+	connect = func(f *Fault, i int) error {
+		if i < len(children) {
+			return connectController(f, children[i], nil, 0, true, func(f *Fault) error {
+				return connect(f, i+1)
+			})
+		}
+		f.Regs.Rax = status
+		return then(f)
+	}
+	var try func(f *Fault, i int) error
+	try = func(f *Fault, i int) error {
+		if i < len(bs) {
+			b := bs[i]
+			return callGuest(f, b.supported, func(f *Fault) error {
+				Debug("ConnectController(%#x): driver %#x Supported: %#x", c, b.handle, f.Regs.Rax)
+				if f.Regs.Rax != uefi.EFI_SUCCESS {
+					return try(f, i+1)
+				}
+				return callGuest(f, b.start, func(f *Fault) error {
+					Debug("ConnectController(%#x): driver %#x Start: %#x", c, b.handle, f.Regs.Rax)
+					// As in edk2, it takes a driver that starts.
+					if f.Regs.Rax == uefi.EFI_SUCCESS {
+						status = uefi.EFI_SUCCESS
+					}
+					return try(f, i+1)
+				}, uint64(b.this), uint64(c), remaining)
+			}, uint64(b.this), uint64(c), remaining)
+		}
+		if h, err := getHandle(c); err == nil && recursive {
+			children = h.children()
+		}
+		return connect(f, 0)
+	}
+	return try(f, 0)
+}
+
+// disconnectController stops the drivers managing controller c, or just
+// driver, if it is not 0; and stops them for all of c's children, or
+// just child, if it is not 0.
+func disconnectController(f *Fault, c, driver, child hd, then func(f *Fault) error) error {
+	h, err := getHandle(c)
+	if err != nil {
+		Debug("DisconnectController: %v", err)
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return then(f)
+	}
+	drivers := h.openers(uefi.EFI_OPEN_PROTOCOL_BY_DRIVER)
+	status := uint64(uefi.EFI_SUCCESS)
+	var stop func(f *Fault, i int) error
+	stop = func(f *Fault, i int) error {
+		if i == len(drivers) {
+			f.Regs.Rax = status
+			return then(f)
+		}
+		b, err := handleBinding(f.Proc, drivers[i])
+		if err != nil {
+			log.Printf("DisconnectController(%#x): driver %#x: %v", c, drivers[i], err)
+			return stop(f, i+1)
+		}
+		if driver != 0 && driver != drivers[i] && driver != b.image {
+			return stop(f, i+1)
+		}
+		children, all := h.children(), true
+		if child != 0 {
+			found := false
+			for _, ch := range children {
+				found = found || ch == child
+			}
+			if !found {
+				return stop(f, i+1)
+			}
+			children, all = []hd{child}, len(children) == 1
+		}
+		// Once the children are stopped, and if they all are,
+		// stop the driver managing the controller.
+		stopAll := func(f *Fault) error {
+			if f.Regs.Rax != uefi.EFI_SUCCESS {
+				status = f.Regs.Rax
+				return stop(f, i+1)
+			}
+			if !all {
+				return stop(f, i+1)
+			}
+			return callGuest(f, b.stop, func(f *Fault) error {
+				Debug("DisconnectController(%#x): driver %#x Stop: %#x", c, drivers[i], f.Regs.Rax)
+				if f.Regs.Rax != uefi.EFI_SUCCESS {
+					status = f.Regs.Rax
+				}
+				return stop(f, i+1)
+			}, uint64(b.this), uint64(c), 0, 0)
+		}
+		if len(children) == 0 {
+			f.Regs.Rax = uefi.EFI_SUCCESS
+			return stopAll(f)
+		}
+		buf := uintptr(UEFIAllocate(uintptr(len(children)*table.EfiHandleSize), false))
+		for j, ch := range children {
+			if err := trace.WriteWord(f.Proc, buf+uintptr(j*table.EfiHandleSize), uint64(ch)); err != nil {
+				return fmt.Errorf("Can't write child handle to %#x: %v", buf+uintptr(j*table.EfiHandleSize), err)
+			}
+		}
+		return callGuest(f, b.stop, stopAll, uint64(b.this), uint64(c), uint64(len(children)), uint64(buf))
+	}
+	return stop(f, 0)
+}
+
+// disconnectProtocol disconnects the drivers that have g on h open
+// BY_DRIVER, so that it can be uninstalled or reinstalled. If anyone
+// still has it open after that, it can't be, and the drivers are
+// connected again. then is told which.
+func disconnectProtocol(f *Fault, h *Handle, g *guid.GUID, then func(f *Fault, ok bool) error) error {
+	var agents []hd
+	for _, o := range h.opens[g.String()] {
+		if o.attr&uefi.EFI_OPEN_PROTOCOL_BY_DRIVER != 0 {
+			agents = append(agents, o.agent)
+		}
+	}
+	var disconnect func(f *Fault, i int) error
+	disconnect = func(f *Fault, i int) error {
+		if i < len(agents) {
+			return disconnectController(f, h.hd, agents[i], 0, func(f *Fault) error {
+				return disconnect(f, i+1)
+			})
+		}
+		// Opens for a look don't hold the protocol; the rest do.
+		const look = uefi.EFI_OPEN_PROTOCOL_BY_HANDLE_PROTOCOL | uefi.EFI_OPEN_PROTOCOL_GET_PROTOCOL | uefi.EFI_OPEN_PROTOCOL_TEST_PROTOCOL
+		for _, o := range h.opens[g.String()] {
+			if o.attr&^look != 0 {
+				Debug("disconnectProtocol: %v is still open by %#x, attributes %#x", g, o.agent, o.attr)
+				return connectController(f, h.hd, nil, 0, true, func(f *Fault) error {
+					return then(f, false)
+				})
+			}
+		}
+		return then(f, true)
+	}
+	return disconnect(f, 0)
+}
+
+// uninstallProtocols uninstalls the interfaces ifaces for gs from h,
+// all or none. UninstallMultipleProtocolInterfaces has just the one
+// error for everything.
+func uninstallProtocols(f *Fault, h *Handle, gs []guid.GUID, ifaces []uint64, multiple bool) error {
+	var removed []*dispatch
+	for i := range gs {
+		d, err := h.Get(&gs[i])
+		if err != nil || uint64(d.up) != ifaces[i] {
+			Debug("uninstallProtocols: %#x does not have %v at %#x", h.hd, gs[i], ifaces[i])
+			f.Regs.Rax = uefi.EFI_NOT_FOUND
+			if multiple {
+				f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			}
+			return nil
+		}
+	}
+	var uninstall func(f *Fault, i int) error
+	uninstall = func(f *Fault, i int) error {
+		if i == len(gs) {
+			f.Regs.Rax = uefi.EFI_SUCCESS
+			return nil
+		}
+		return disconnectProtocol(f, h, &gs[i], func(f *Fault, ok bool) error {
+			if ok {
+				d, _ := h.Get(&gs[i])
+				removed = append(removed, d)
+				h.remove(&gs[i])
+				return uninstall(f, i+1)
+			}
+			// Put back the ones we took.
+			for j, d := range removed {
+				h.protocols[gs[j].String()] = d
+			}
+			f.Regs.Rax = uefi.EFI_ACCESS_DENIED
+			if multiple {
+				f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			}
+			return nil
+		})
+	}
+	return uninstall(f, 0)
+}
+
+// reinstallProtocol replaces the interface for g on h with iface, and
+// connects the drivers again, so they see the new one.
+func reinstallProtocol(f *Fault, h *Handle, g *guid.GUID, old, iface uint64) error {
+	d, err := h.Get(g)
+	if err != nil || uint64(d.up) != old {
+		Debug("reinstallProtocol: %#x does not have %v at %#x", h.hd, g, old)
+		f.Regs.Rax = uefi.EFI_NOT_FOUND
+		return nil
+	}
+	return disconnectProtocol(f, h, g, func(f *Fault, ok bool) error {
+		if !ok {
+			f.Regs.Rax = uefi.EFI_ACCESS_DENIED
+			return nil
+		}
+		h.protocols[g.String()] = &dispatch{s: d.s, up: ServPtr(iface)}
+		return connectController(f, h.hd, nil, 0, true, func(f *Fault) error {
+			f.Regs.Rax = uefi.EFI_SUCCESS
+			return nil
+		})
+	})
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// testDriver is a guest driver. It supports a controller if supports
+// is set; Start opens testGUID on it BY_DRIVER, unless broken is set,
+// and Stop closes that, and the children's opens, unless stuck is set.
+// calls records what was called.
+type testDriver struct {
+	version  uint32
+	supports bool
+	broken   bool
+	stuck    bool
+	h        hd
+	calls    *[]string
+}
+
+// install puts the driver's binding in guest memory at p, on a new
+// handle, and its functions in fns.
+func (d *testDriver) install(f *Fault, p uintptr, fns map[uint64]func(f *Fault) uint64) {
+	h := newHandle()
+	d.h = h.hd
+	supported, start, stop := uint64(p+0x100), uint64(p+0x108), uint64(p+0x110)
+	var b [0x30]byte
+	binary.LittleEndian.PutUint64(b[0:], supported)
+	binary.LittleEndian.PutUint64(b[8:], start)
+	binary.LittleEndian.PutUint64(b[0x10:], stop)
+	binary.LittleEndian.PutUint32(b[0x18:], d.version)
+	binary.LittleEndian.PutUint64(b[0x20:], uint64(d.h))
+	binary.LittleEndian.PutUint64(b[0x28:], uint64(d.h))
+	f.Proc.Write(p, b[:])
+	h.PutService(uefi.DriverBindingGUID, nil, ServPtr(p))
+	call := func(s string) {
+		*d.calls = append(*d.calls, fmt.Sprintf("v%d %s", d.version, s))
+	}
+	fns[supported] = func(f *Fault) uint64 {
+		call("Supported")
+		if !d.supports {
+			return uefi.EFI_UNSUPPORTED
+		}
+		return uefi.EFI_SUCCESS
+	}
+	fns[start] = func(f *Fault) uint64 {
+		call("Start")
+		if d.broken {
+			return uefi.EFI_DEVICE_ERROR
+		}
+		c, _ := getHandle(hd(f.Regs.Rdx))
+		c.open(testGUID, d.h, c.hd, uefi.EFI_OPEN_PROTOCOL_BY_DRIVER)
+		return uefi.EFI_SUCCESS
+	}
+	fns[stop] = func(f *Fault) uint64 {
+		args := trace.Args(f.Proc, f.Regs, 4)
+		c, _ := getHandle(hd(args[1]))
+		if args[2] != 0 {
+			call(fmt.Sprintf("Stop %d", args[2]))
+			for i := uintptr(0); i < args[2]; i++ {
+				ch, _ := trace.ReadWord(f.Proc, args[3]+i*table.EfiHandleSize)
+				c.close(testGUID, d.h, hd(ch))
+			}
+			return uefi.EFI_SUCCESS
+		}
+		call("Stop")
+		if !d.stuck {
+			c.close(testGUID, d.h, c.hd)
+		}
+		return uefi.EFI_SUCCESS
+	}
+}
+
+// controller returns a new handle with testGUID at iface.
+func controller(iface ServPtr) *Handle {
+	h := newHandle()
+	h.PutService(testGUID, nil, iface)
+	return h
+}
+
+func TestInstallProtocols(t *testing.T) {
+	const g, g2, hp = 0x1000, 0x1010, 0x1100
+	f := newFault(0)
+	f.Proc.Write(g, testGUID[:])
+	f.Proc.Write(g2, otherGUID[:])
+	handle := func() *Handle {
+		p, _ := trace.ReadWord(f.Proc, hp)
+		h, err := getHandle(hd(p))
+		if err != nil {
+			t.Fatalf("*Handle is %#x: %v", p, err)
+		}
+		return h
+	}
+	// A NULL *Handle gets a new handle.
+	if s := bootCall(t, f, nil, table.InstallProtocolInterface, hp, g, uefi.EFI_NATIVE_INTERFACE, 0x5000); s != uefi.EFI_SUCCESS {
+		t.Fatalf("InstallProtocolInterface on NULL: got %#x, want EFI_SUCCESS", s)
+	}
+	h := handle()
+	if d, err := h.Get(testGUID); err != nil || d.up != 0x5000 {
+		t.Errorf("InstallProtocolInterface on NULL: got %v, %v, want interface 0x5000", d, err)
+	}
+	if s := bootCall(t, f, nil, table.InstallProtocolInterface, hp, g, uefi.EFI_NATIVE_INTERFACE, 0x6000); s != uefi.EFI_INVALID_PARAMETER {
+		t.Errorf("InstallProtocolInterface again: got %#x, want EFI_INVALID_PARAMETER", s)
+	}
+	if s := bootCall(t, f, nil, table.InstallProtocolInterface, hp, g2, uefi.EFI_NATIVE_INTERFACE, 0x6000); s != uefi.EFI_SUCCESS {
+		t.Errorf("InstallProtocolInterface of another: got %#x, want EFI_SUCCESS", s)
+	}
+	if handle() != h {
+		t.Errorf("InstallProtocolInterface of another: got handle %#x, want %#x", handle().hd, h.hd)
+	}
+
+	trace.WriteWord(f.Proc, hp, 0)
+	if s := bootCall(t, f, nil, table.InstallMultipleProtocolInterfaces, hp, g, 0x5000, g2, 0x6000, 0); s != uefi.EFI_SUCCESS {
+		t.Fatalf("InstallMultipleProtocolInterfaces on NULL: got %#x, want EFI_SUCCESS", s)
+	}
+	if h2 := handle(); h2 == h || len(h2.protocols) != 2 {
+		t.Errorf("InstallMultipleProtocolInterfaces on NULL: got handle %#x with %v, want a new one with 2", h2.hd, h2.protocols)
+	}
+	// All or nothing: no new handle for a duplicate.
+	trace.WriteWord(f.Proc, hp, 0)
+	n := len(hdb)
+	if s := bootCall(t, f, nil, table.InstallMultipleProtocolInterfaces, hp, g, 0x5000, g, 0x6000, 0); s != uefi.EFI_INVALID_PARAMETER {
+		t.Errorf("InstallMultipleProtocolInterfaces of a duplicate: got %#x, want EFI_INVALID_PARAMETER", s)
+	}
+	if p, _ := trace.ReadWord(f.Proc, hp); p != 0 || len(hdb) != n {
+		t.Errorf("InstallMultipleProtocolInterfaces of a duplicate: *Handle %#x, %d handles, want 0 and %d", p, len(hdb), n)
+	}
+}
+
+func TestUninstallProtocol(t *testing.T) {
+	const g, g2 = 0x1000, 0x1010
+	f := newFault(0)
+	f.Proc.Write(g, testGUID[:])
+	f.Proc.Write(g2, otherGUID[:])
+	fns := map[uint64]func(f *Fault) uint64{}
+	var calls []string
+	d := &testDriver{version: 1, supports: true, calls: &calls}
+	d.install(f, 0x2000, fns)
+	c := controller(0x5000)
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(c.hd), 0, 0, 0); s != uefi.EFI_SUCCESS {
+		t.Fatalf("ConnectController: got %#x, want EFI_SUCCESS", s)
+	}
+
+	if s := bootCall(t, f, fns, table.UninstallProtocolInterface, uint64(c.hd), g, 0x6000); s != uefi.EFI_NOT_FOUND {
+		t.Errorf("UninstallProtocolInterface of the wrong interface: got %#x, want EFI_NOT_FOUND", s)
+	}
+	if s := bootCall(t, f, fns, table.UninstallMultipleProtocolInterfaces, uint64(c.hd), g, 0x5000, g2, 0x6000, 0); s != uefi.EFI_INVALID_PARAMETER {
+		t.Errorf("UninstallMultipleProtocolInterfaces of one not there: got %#x, want EFI_INVALID_PARAMETER", s)
+	}
+	if _, err := c.Get(testGUID); err != nil {
+		t.Fatalf("Failed uninstalls removed the protocol: %v", err)
+	}
+
+	// A driver that does not close it on Stop keeps it, and is
+	// started again.
+	d.stuck, calls = true, nil
+	if s := bootCall(t, f, fns, table.UninstallProtocolInterface, uint64(c.hd), g, 0x5000); s != uefi.EFI_ACCESS_DENIED {
+		t.Errorf("UninstallProtocolInterface in use: got %#x, want EFI_ACCESS_DENIED", s)
+	}
+	if want := []string{"v1 Stop", "v1 Supported", "v1 Start"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("UninstallProtocolInterface in use: got calls %q, want %q", calls, want)
+	}
+	if _, err := c.Get(testGUID); err != nil {
+		t.Fatalf("UninstallProtocolInterface in use: removed the protocol: %v", err)
+	}
+
+	d.stuck, calls = false, nil
+	if s := bootCall(t, f, fns, table.UninstallProtocolInterface, uint64(c.hd), g, 0x5000); s != uefi.EFI_SUCCESS {
+		t.Errorf("UninstallProtocolInterface: got %#x, want EFI_SUCCESS", s)
+	}
+	if want := []string{"v1 Stop"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("UninstallProtocolInterface: got calls %q, want %q", calls, want)
+	}
+	if _, err := c.Get(testGUID); err == nil {
+		t.Errorf("UninstallProtocolInterface: the protocol is still there")
+	}
+}
+
+func TestReinstallProtocol(t *testing.T) {
+	const g = 0x1000
+	f := newFault(0)
+	f.Proc.Write(g, testGUID[:])
+	fns := map[uint64]func(f *Fault) uint64{}
+	var calls []string
+	d := &testDriver{version: 1, supports: true, calls: &calls}
+	d.install(f, 0x2000, fns)
+	c := controller(0x5000)
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(c.hd), 0, 0, 0); s != uefi.EFI_SUCCESS {
+		t.Fatalf("ConnectController: got %#x, want EFI_SUCCESS", s)
+	}
+
+	calls = nil
+	if s := bootCall(t, f, fns, table.ReinstallProtocolInterface, uint64(c.hd), g, 0x6000, 0x7000); s != uefi.EFI_NOT_FOUND {
+		t.Errorf("ReinstallProtocolInterface of the wrong interface: got %#x, want EFI_NOT_FOUND", s)
+	}
+	if s := bootCall(t, f, fns, table.ReinstallProtocolInterface, uint64(c.hd), g, 0x5000, 0x7000); s != uefi.EFI_SUCCESS {
+		t.Errorf("ReinstallProtocolInterface: got %#x, want EFI_SUCCESS", s)
+	}
+	if d, err := c.Get(testGUID); err != nil || d.up != 0x7000 {
+		t.Errorf("ReinstallProtocolInterface: got %v, %v, want interface 0x7000", d, err)
+	}
+	// The driver is stopped, then connected again, to see the new one.
+	if want := []string{"v1 Stop", "v1 Supported", "v1 Start"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("ReinstallProtocolInterface: got calls %q, want %q", calls, want)
+	}
+}
+
+func TestConnectController(t *testing.T) {
+	const first = 0x1000
+	f := newFault(0)
+	fns := map[uint64]func(f *Fault) uint64{}
+	var calls []string
+	var ds []*testDriver
+	for i, supports := range []bool{true, false, true} {
+		d := &testDriver{version: uint32(i + 1), supports: supports, calls: &calls}
+		d.install(f, uintptr(0x2000+i*0x200), fns)
+		ds = append(ds, d)
+	}
+	c := controller(0x5000)
+	if s := bootCall(t, f, fns, table.ConnectController, 0x1234, 0, 0, 0); s != uefi.EFI_INVALID_PARAMETER {
+		t.Errorf("ConnectController of no handle: got %#x, want EFI_INVALID_PARAMETER", s)
+	}
+	// Highest version first.
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(c.hd), 0, 0, 0); s != uefi.EFI_SUCCESS {
+		t.Errorf("ConnectController: got %#x, want EFI_SUCCESS", s)
+	}
+	if want := []string{"v3 Supported", "v3 Start", "v2 Supported", "v1 Supported", "v1 Start"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("ConnectController: got calls %q, want %q", calls, want)
+	}
+	// DriverImageHandle first.
+	calls = nil
+	trace.WriteWord(f.Proc, first, uint64(ds[0].h))
+	trace.WriteWord(f.Proc, first+8, 0)
+	bootCall(t, f, fns, table.ConnectController, uint64(newHandle().hd), first, 0, 0)
+	if want := []string{"v1 Supported", "v1 Start", "v3 Supported", "v3 Start", "v2 Supported"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("ConnectController with DriverImageHandle: got calls %q, want %q", calls, want)
+	}
+	// Supported is not enough: some Start has to work.
+	calls = nil
+	ds[0].broken, ds[2].broken = true, true
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(newHandle().hd), 0, 0, 0); s != uefi.EFI_NOT_FOUND {
+		t.Errorf("ConnectController with Start failing: got %#x, want EFI_NOT_FOUND", s)
+	}
+	if want := []string{"v3 Supported", "v3 Start", "v2 Supported", "v1 Supported", "v1 Start"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("ConnectController with Start failing: got calls %q, want %q", calls, want)
+	}
+	ds[0].broken = false
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(newHandle().hd), 0, 0, 0); s != uefi.EFI_SUCCESS {
+		t.Errorf("ConnectController with one Start failing: got %#x, want EFI_SUCCESS", s)
+	}
+	ds[0].supports, ds[2].supports = false, false
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(newHandle().hd), 0, 0, 0); s != uefi.EFI_NOT_FOUND {
+		t.Errorf("ConnectController with no driver: got %#x, want EFI_NOT_FOUND", s)
+	}
+}
+
+func TestDisconnectController(t *testing.T) {
+	f := newFault(0)
+	fns := map[uint64]func(f *Fault) uint64{}
+	var calls []string
+	d := &testDriver{version: 1, supports: true, calls: &calls}
+	d.install(f, 0x2000, fns)
+	c := controller(0x5000)
+	if s := bootCall(t, f, fns, table.ConnectController, uint64(c.hd), 0, 0, 0); s != uefi.EFI_SUCCESS {
+		t.Fatalf("ConnectController: got %#x, want EFI_SUCCESS", s)
+	}
+	// The driver's children, as its Start would have made them.
+	var children []hd
+	for i := 0; i < 2; i++ {
+		ch := newHandle()
+		c.open(testGUID, d.h, ch.hd, uefi.EFI_OPEN_PROTOCOL_BY_CHILD_CONTROLLER)
+		children = append(children, ch.hd)
+	}
+
+	calls = nil
+	if s := bootCall(t, f, fns, table.DisconnectController, uint64(c.hd), 0, 0x1234); s != uefi.EFI_INVALID_PARAMETER {
+		t.Errorf("DisconnectController of no child handle: got %#x, want EFI_INVALID_PARAMETER", s)
+	}
+	// Just the one child: the driver keeps the controller.
+	if s := bootCall(t, f, fns, table.DisconnectController, uint64(c.hd), 0, uint64(children[0])); s != uefi.EFI_SUCCESS {
+		t.Errorf("DisconnectController of a child: got %#x, want EFI_SUCCESS", s)
+	}
+	if want := []string{"v1 Stop 1"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("DisconnectController of a child: got calls %q, want %q", calls, want)
+	}
+	if got := c.children(); !reflect.DeepEqual(got, children[1:]) {
+		t.Errorf("DisconnectController of a child: children are %#x, want %#x", got, children[1:])
+	}
+	calls = nil
+	if s := bootCall(t, f, fns, table.DisconnectController, uint64(c.hd), uint64(d.h), 0); s != uefi.EFI_SUCCESS {
+		t.Errorf("DisconnectController: got %#x, want EFI_SUCCESS", s)
+	}
+	if want := []string{"v1 Stop 1", "v1 Stop"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("DisconnectController: got calls %q, want %q", calls, want)
+	}
+	if o := c.openers(uefi.EFI_OPEN_PROTOCOL_BY_DRIVER | uefi.EFI_OPEN_PROTOCOL_BY_CHILD_CONTROLLER); len(o) != 0 {
+		t.Errorf("DisconnectController: %#x still have the controller open", o)
+	}
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/ebc"
+)
+
+// EBC images run in the interpreter in uefi/ebc. Native code gets to
+// EBC code through a thunk, which, here, is just another function of
+// the EBC service: a hlt like any other. When the thunk is called, we
+// start a VM at the EBC entry point with the native arguments, and
+// run it until it returns, with what it returns in rax.
+// When EBC code calls native code, such as a boot service, the VM
+// stops, and we call the native function with callGuest, and carry on
+// with the VM when it returns. Native code can call EBC code while it
+// is at it, so VMs are a stack, as the guest calls are.
+
+// EBC implements Service. It is the EFI_EBC_PROTOCOL.
+type EBC struct {
+	u  ServBase
+	up ServPtr
+}
+
+// ebcThunk is a thunk for the EBC function at entry, in image.
+type ebcThunk struct {
+	entry uint64
+	image uint64
+}
+
+const (
+	// ebcThunkBase is the op of the first thunk, past the
+	// protocol functions. Thunks are 8 apart, up to the end of the
+	// service's region.
+	ebcThunkBase = 0x100
+	// ebcStackPages is the size of the VM stacks, which all VMs
+	// share, one below another.
+	ebcStackPages = 64
+)
+
+var (
+	_ Service = &EBC{}
+	// ebcThunks are the thunks, by op.
+	ebcThunks []ebcThunk
+	// ebcVMs is the VMs that are running, the innermost last.
+	ebcVMs []*ebc.VM
+	// ebcStack is the bottom of the VM stacks, once they are allocated.
+	ebcStack uint64
+	// ebcICacheFlush is the function registered by
+	// RegisterICacheFlush. We never call it: there is no code to flush.
+	ebcICacheFlush uint64
+)
+
+func init() {
+	RegisterGUIDCreator(table.EBCGUID, NewEBC)
+}
+
+// NewEBC returns an EBC Service
+func NewEBC(tab []byte, u ServPtr) (Service, error) {
+	base := int(u) & 0xffffff
+	for p := range table.EBCServiceNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("ebc: Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	return &EBC{u: u.Base(), up: u}, nil
+}
+
+// Aliases implements Aliases
+func (e *EBC) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (e *EBC) Base() ServBase {
+	return e.u
+}
+
+// Ptr implements service.Ptr
+func (e *EBC) Ptr() ServPtr {
+	return e.up
+}
+
+// thunk returns a thunk for the EBC function at entry, in image.
+// Asking again for the same function gets the same thunk.
+func (e *EBC) thunk(image, entry uint64) (uint64, error) {
+	addr := func(i int) uint64 {
+		return 0xff400000 + uint64(int(e.up)&0xffffff) + ebcThunkBase + uint64(i)*8
+	}
+	for i, t := range ebcThunks {
+		if t.entry == entry && t.image == image {
+			return addr(i), nil
+		}
+	}
+	if ServPtr(ebcThunkBase+(len(ebcThunks)+1)*8) > allocAmt {
+		return 0, fmt.Errorf("EBC thunk for %#x: no more thunks", entry)
+	}
+	ebcThunks = append(ebcThunks, ebcThunk{entry: entry, image: image})
+	a := addr(len(ebcThunks) - 1)
+	Debug("ebc: thunk %#x for %#x, image %#x", a, entry, image)
+	return a, nil
+}
+
+// entry returns the EBC function a thunk address is for.
+func (e *EBC) entry(addr uint64) (uint64, bool) {
+	b, op := splitBaseOp(uintptr(addr))
+	if b != e.u || op < ebcThunkBase || int(op-ebcThunkBase)/8 >= len(ebcThunks) {
+		return 0, false
+	}
+	return ebcThunks[int(op-ebcThunkBase)/8].entry, true
+}
+
+// EBCThunk returns a native function pointer for the EBC function at
+// entry, in image, which may be 0 if there is no handle yet. It is how
+// EBC images' entry points get called.
+func EBCThunk(image, entry uint64) (uint64, error) {
+	d, ok := dispatches[ServBase(table.EBCGUID)]
+	if !ok {
+		return 0, fmt.Errorf("EBC thunk for %#x: no EBC service", entry)
+	}
+	return d.s.(*EBC).thunk(image, entry)
+}
+
+// Call implements service.Call
+func (e *EBC) Call(f *Fault) error {
+	op := f.Op
+	if op >= ebcThunkBase {
+		return e.call(f)
+	}
+	Debug("EBC services: %v(%#x), arg type %T, args %v", table.EBCServiceNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	switch op {
+	case table.EBCCreateThunk:
+		// EFI_STATUS CreateThunk (IN EFI_EBC_PROTOCOL *This, IN EFI_HANDLE ImageHandle,
+		//   IN VOID *EbcEntryPoint, OUT VOID **Thunk);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		entry, ptr := uint64(f.Args[2]), f.Args[3]
+		// EBC code is 2-byte aligned.
+		if entry&1 != 0 || ptr == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		a, err := e.thunk(uint64(f.Args[1]), entry)
+		if err != nil {
+			log.Printf("EBC CreateThunk: %v", err)
+			f.Regs.Rax = uefi.EFI_OUT_OF_RESOURCES
+			return nil
+		}
+		if err := trace.WriteWord(f.Proc, ptr, a); err != nil {
+			return fmt.Errorf("Can't write thunk at %#x: %v", ptr, err)
+		}
+	case table.EBCUnloadImage:
+		// EFI_STATUS UnloadImage (IN EFI_EBC_PROTOCOL *This, IN EFI_HANDLE ImageHandle);
+		// The thunks stay, since something might still call them,
+		// but they no longer belong to the image.
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		for i := range ebcThunks {
+			if ebcThunks[i].image == uint64(f.Args[1]) {
+				ebcThunks[i].image = 0
+				f.Regs.Rax = uefi.EFI_SUCCESS
+			}
+		}
+	case table.EBCRegisterICacheFlush:
+		// EFI_STATUS RegisterICacheFlush (IN EFI_EBC_PROTOCOL *This, IN EBC_ICACHE_FLUSH Flush);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		ebcICacheFlush = uint64(f.Args[1])
+	case table.EBCGetVersion:
+		// EFI_STATUS GetVersion (IN EFI_EBC_PROTOCOL *This, IN OUT UINT64 *Version);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		if f.Args[1] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[1], ebc.Version); err != nil {
+			return fmt.Errorf("Can't write version at %#x: %v", f.Args[1], err)
+		}
+	default:
+		log.Panicf("unsup ebc Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// call is a call to a thunk: it runs the EBC function in a new VM.
+func (e *EBC) call(f *Fault) error {
+	i := int(f.Op-ebcThunkBase) / 8
+	if i >= len(ebcThunks) {
+		return fmt.Errorf("EBC thunk %#x: no such thunk", f.Op)
+	}
+	entry := ebcThunks[i].entry
+	if ebcStack == 0 {
+		ebcStack = uint64(UEFIAllocate(ebcStackPages, true))
+	}
+	// A VM called from native code called from another VM gets the
+	// stack below it, with room for the native code's spills.
+	sp := ebcStack + ebcStackPages*4096
+	if n := len(ebcVMs); n > 0 {
+		sp = ebcVMs[n-1].R[0] - 0x100
+	}
+	if sp < ebcStack+0x1000 {
+		return fmt.Errorf("EBC call to %#x: out of stack", entry)
+	}
+	var args []uint64
+	for _, a := range trace.Args(f.Proc, f.Regs, ebc.NativeArgs) {
+		args = append(args, uint64(a))
+	}
+	Debug("EBC: call %#x(%#x), sp %#x", entry, args[:4], sp)
+	vm := ebc.New(f.Proc, entry, sp, args)
+	vm.Thunk = e.entry
+	vm.CreateThunk = func(entry uint64) (uint64, error) {
+		return e.thunk(0, entry)
+	}
+	ebcVMs = append(ebcVMs, vm)
+	return runEBC(f, vm)
+}
+
+// runEBC runs vm until it returns, calling native code for it as
+// needed.
+func runEBC(f *Fault, vm *ebc.VM) error {
+	c, err := vm.Run()
+	if err != nil {
+		return fmt.Errorf("EBC: %v", err)
+	}
+	if c == nil {
+		ebcVMs = ebcVMs[:len(ebcVMs)-1]
+		f.Regs.Rax = vm.R[7]
+		Debug("EBC: returned %#x", vm.R[7])
+		return nil
+	}
+	Debug("EBC: native call %#x(%#x)", c.Fn, c.Args)
+	return callGuest(f, uintptr(c.Fn), func(f *Fault) error {
+		vm.Return(f.Regs.Rax)
+		return runEBC(f, vm)
+	}, c.Args...)
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (e *EBC) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
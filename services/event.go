@@ -0,0 +1,375 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/linuxboot/voodoo/console"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// Events are like handles: opaque values we hand out.
+// Most of them are signaled by the guest, or by timers. Some,
+// like WaitForKey, are signaled by something outside: they have
+// a ready function we call to see if they are.
+
+// evt is an EFI_EVENT.
+type evt uint64
+
+// Event is an EFI event.
+type Event struct {
+	ev      evt
+	typ     uint32
+	tpl     uintptr
+	notify  uintptr
+	context uintptr
+	// signaled is the event's state.
+	signaled bool
+	// ready, if set, says whether the event's outside source
+	// has something, e.g. a key.
+	ready func() bool
+	// trigger is when the timer next fires, 0 if it is not set.
+	trigger time.Duration
+	period  time.Duration
+}
+
+var (
+	evbase = uint64(0xe7e7e7e700000000)
+	events = map[evt]*Event{}
+	start  = time.Now()
+	// keyboard is where keys come from. It is also what
+	// WaitForEvent waits on, since it is the only thing
+	// outside the guest that signals events.
+	keyboard = console.NewKeyboard()
+	// script, if set, types keys into the keyboard.
+	script *console.Script
+	// With virtual time, time only passes when the guest waits for it:
+	// in WaitForEvent, Stall, or polling for keys that aren't there.
+	// Runs are then the same every time.
+	virtualTime bool
+	vnow        time.Duration
+	// tpl is the task priority level. Timer notify functions only
+	// run while it is below theirs.
+	tpl uintptr = uefi.TPL_APPLICATION
+)
+
+// pollQuantum is how much virtual time a poll that finds nothing costs,
+// so that guests that spin on ReadKeyStroke see time pass.
+const pollQuantum = time.Millisecond
+
+// SetKeyboard sets the keyboard used by the text input services.
+// It must be called before NewSystemtable.
+func SetKeyboard(k *console.Keyboard) {
+	keyboard = k
+}
+
+// SetScript sets a script to type keys. It uses the clock timers use.
+// It must be called after SetConsole and SetKeyboard.
+func SetScript(steps []console.Step) {
+	script = console.NewScript(steps, keyboard, screen, now)
+}
+
+// SetVirtualTime turns virtual time on or off.
+func SetVirtualTime(on bool) {
+	virtualTime = on
+}
+
+// now is the time, as timers see it.
+func now() time.Duration {
+	if virtualTime {
+		return vnow
+	}
+	return time.Since(start)
+}
+
+// advance lets d pass: virtual time moves on, or we sleep.
+func advance(d time.Duration) {
+	if virtualTime {
+		vnow += d
+		return
+	}
+	time.Sleep(d)
+}
+
+// idle is called when a poll finds nothing.
+func idle() {
+	if virtualTime {
+		vnow += pollQuantum
+	}
+}
+
+// poll runs the script, if there is one.
+func poll() {
+	if script != nil {
+		script.Run()
+	}
+}
+
+func newEvent(typ uint32, tpl, notify, context uintptr) *Event {
+	evbase++
+	e := &Event{ev: evt(evbase), typ: typ, tpl: tpl, notify: notify, context: context}
+	events[e.ev] = e
+	return e
+}
+
+func getEvent(ev evt) (*Event, error) {
+	e, ok := events[ev]
+	if !ok {
+		return nil, fmt.Errorf("No event for %#x", ev)
+	}
+	return e, nil
+}
+
+// check updates the event from its sources, and returns whether it is signaled.
+// Notify timers are left to fireTimers, which calls their notify functions.
+func (e *Event) check() bool {
+	poll()
+	if e.ready != nil && e.ready() {
+		e.signaled = true
+	}
+	if !e.notifyTimer() && e.expire() {
+		e.signaled = true
+	}
+	return e.signaled
+}
+
+// notifyTimer says whether e is a timer with a notify function to call
+// when it goes off.
+func (e *Event) notifyTimer() bool {
+	return e.typ&uefi.EVT_TIMER != 0 && e.typ&uefi.EVT_NOTIFY_SIGNAL != 0 && e.notify != 0
+}
+
+// expire says whether e's timer has gone off. If so, it is set again if
+// it is periodic, and cancelled if not.
+func (e *Event) expire() bool {
+	if e.trigger == 0 || now() < e.trigger {
+		return false
+	}
+	e.trigger = 0
+	if e.period != 0 {
+		e.trigger = now() + e.period
+	}
+	return true
+}
+
+// setTimer implements SetTimer. t is in 100ns units, as in UEFI.
+func (e *Event) setTimer(typ uintptr, t uint64) uintptr {
+	if e.typ&uefi.EVT_TIMER == 0 {
+		return uefi.EFI_INVALID_PARAMETER
+	}
+	d := time.Duration(t) * 100 * time.Nanosecond
+	switch typ {
+	case uefi.TimerCancel:
+		e.trigger, e.period = 0, 0
+	case uefi.TimerRelative:
+		// Zero means the next tick, which is now for us.
+		e.trigger, e.period = now()+d+1, 0
+	case uefi.TimerPeriodic:
+		if d == 0 {
+			// Every tick. We don't have ticks, so pick something.
+			d = time.Millisecond
+		}
+		e.trigger, e.period = now()+d, d
+	default:
+		return uefi.EFI_INVALID_PARAMETER
+	}
+	return uefi.EFI_SUCCESS
+}
+
+// signal signals e. If it is a notify signal event, and was not
+// signaled already, its notify function is called, and, as it has
+// been notified, it goes back to not signaled. Then it calls then.
+func (e *Event) signal(f *Fault, then func(f *Fault) error) error {
+	if e.signaled {
+		return then(f)
+	}
+	e.signaled = true
+	if e.typ&uefi.EVT_NOTIFY_SIGNAL == 0 || e.notify == 0 {
+		return then(f)
+	}
+	// VOID EFIAPI NotifyFunction(IN EFI_EVENT Event, IN VOID *Context);
+	return callGuest(f, e.notify, func(f *Fault) error {
+		e.signaled = false
+		return then(f)
+	}, uint64(e.ev), uint64(e.context))
+}
+
+// signalAll signals the events of type typ, e.g. the ones for
+// ExitBootServices, and calls their notify functions, in the order the
+// events were created. Then it calls then.
+func signalAll(f *Fault, typ uint32, then func(f *Fault) error) error {
+	var evs []*Event
+	for _, e := range events {
+		if e.typ == typ {
+			evs = append(evs, e)
+		}
+	}
+	sort.Slice(evs, func(i, j int) bool { return evs[i].ev < evs[j].ev })
+	var next func(f *Fault) error
+	next = func(f *Fault) error {
+		if len(evs) == 0 {
+			return then(f)
+		}
+		e := evs[0]
+		evs = evs[1:]
+		return e.signal(f, next)
+	}
+	return next(f)
+}
+
+// dueTimers returns the notify timers that have gone off, and may be
+// notified at the current TPL, in the order they were created.
+func dueTimers() []*Event {
+	var due []*Event
+	for _, e := range events {
+		if e.notifyTimer() && e.tpl > tpl && e.trigger != 0 && now() >= e.trigger {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ev < due[j].ev })
+	return due
+}
+
+// fireTimers signals the notify timers that have gone off, calling their
+// notify functions, at their TPL, as the timer interrupt would. We have
+// no interrupt, so the services the guest polls with call it: WaitForEvent,
+// Stall, CheckEvent, ReadKeyStroke and RestoreTPL. The keyboard is
+// polled from the timer interrupt too, so then the key notify functions
+// run, and then it calls then.
+func fireTimers(f *Fault, then func(f *Fault) error) error {
+	due := dueTimers()
+	var next func(f *Fault) error
+	next = func(f *Fault) error {
+		if len(due) == 0 {
+			return notifyKeys(f, then)
+		}
+		e := due[0]
+		due = due[1:]
+		e.expire()
+		old := tpl
+		tpl = e.tpl
+		return e.signal(f, func(f *Fault) error {
+			tpl = old
+			return next(f)
+		})
+	}
+	return next(f)
+}
+
+// notifyWait calls the notify functions of the notify wait events in
+// evs that are not signaled, as CheckEvent and WaitForEvent do, since
+// they are what may signal them. Then it calls then.
+func notifyWait(f *Fault, evs []*Event, then func(f *Fault) error) error {
+	var todo []*Event
+	for _, e := range evs {
+		if e.typ&uefi.EVT_NOTIFY_WAIT != 0 && e.notify != 0 && !e.check() {
+			todo = append(todo, e)
+		}
+	}
+	var next func(f *Fault) error
+	next = func(f *Fault) error {
+		if len(todo) == 0 {
+			return then(f)
+		}
+		e := todo[0]
+		todo = todo[1:]
+		return callGuest(f, e.notify, next, uint64(e.ev), uint64(e.context))
+	}
+	return next(f)
+}
+
+// waitForEvent implements WaitForEvent: it waits until one of evs is
+// signaled, and writes its index to ip. If some are notify wait events,
+// only their notify functions may signal them, so, rather than block,
+// we let a little time pass, and call them again, until one is.
+// Notify timers that go off while we wait are notified.
+func waitForEvent(f *Fault, evs []*Event, ip uintptr) error {
+	return fireTimers(f, func(f *Fault) error {
+		return notifyWait(f, evs, func(f *Fault) error {
+			i := signaled(evs)
+			if i < 0 {
+				for _, e := range evs {
+					if e.typ&uefi.EVT_NOTIFY_WAIT != 0 && e.notify != 0 {
+						advance(pollQuantum)
+						return waitForEvent(f, evs, ip)
+					}
+				}
+				if i = wait(evs); i < 0 {
+					return waitForEvent(f, evs, ip)
+				}
+			}
+			if err := trace.WriteWord(f.Proc, ip, uint64(i)); err != nil {
+				return fmt.Errorf("Can't write index to %#x: %v", ip, err)
+			}
+			f.Regs.Rax = uefi.EFI_SUCCESS
+			return nil
+		})
+	})
+}
+
+// signaled returns the index of the first of evs that is signaled,
+// and puts it back in the not signaled state, or -1 if none is.
+func signaled(evs []*Event) int {
+	for i, e := range evs {
+		if e.check() {
+			e.signaled = false
+			return i
+		}
+	}
+	return -1
+}
+
+// wait waits until one of the events is signaled, and returns its index.
+// The event is put back in the not signaled state. If a notify timer
+// goes off, or a key comes in for a key notify function, first, it
+// returns -1, so that they can be notified.
+func wait(evs []*Event) int {
+	for {
+		if i := signaled(evs); i >= 0 {
+			return i
+		}
+		if len(dueTimers()) > 0 || keysDue() {
+			return -1
+		}
+		timers := append([]*Event{}, evs...)
+		for _, e := range events {
+			if e.notifyTimer() && e.tpl > tpl {
+				timers = append(timers, e)
+			}
+		}
+		// next is when the first thing we know of will happen.
+		var next time.Duration
+		deadline := false
+		soonest := func(t time.Duration) {
+			if !deadline || t-now() < next {
+				next, deadline = t-now(), true
+			}
+		}
+		for _, e := range timers {
+			if e.trigger != 0 {
+				soonest(e.trigger)
+			}
+		}
+		if script != nil {
+			if until, ok := script.Next(); ok {
+				soonest(until)
+			}
+		}
+		// In virtual time, if we know when something will happen,
+		// skip to it, however far off. Otherwise, only the host can
+		// wake us up, so look again every so often.
+		if next < 0 {
+			next = 0
+		}
+		if virtualTime && deadline {
+			vnow += next
+			continue
+		}
+		if !deadline || next > 10*time.Millisecond {
+			next = 10 * time.Millisecond
+		}
+		keyboard.Wait(next)
+	}
+}
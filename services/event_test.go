@@ -0,0 +1,86 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+func TestNotifyTimer(t *testing.T) {
+	const ep, ip, evp, notify, context = 0x1000, 0x1008, 0x1010, 0x3000, 0xc0
+	f := newFault(0)
+	events, vnow, tpl = map[evt]*Event{}, 0, uefi.TPL_APPLICATION
+	SetVirtualTime(true)
+	defer SetVirtualTime(false)
+	var notified []time.Duration
+	fns := map[uint64]func(f *Fault) uint64{
+		notify: func(f *Fault) uint64 {
+			if f.Regs.Rdx != context {
+				t.Errorf("notify: got context %#x, want %#x", f.Regs.Rdx, context)
+			}
+			if tpl != uefi.TPL_CALLBACK {
+				t.Errorf("notify: got TPL %d, want %d", tpl, uefi.TPL_CALLBACK)
+			}
+			notified = append(notified, now())
+			return 0
+		},
+	}
+	if s := bootCall(t, f, fns, table.CreateEvent, uefi.EVT_TIMER|uefi.EVT_NOTIFY_SIGNAL, uefi.TPL_CALLBACK, notify, context, ep); s != uefi.EFI_SUCCESS {
+		t.Fatalf("CreateEvent: got %#x, want EFI_SUCCESS", s)
+	}
+	ev, _ := trace.ReadWord(f.Proc, ep)
+	// Every 10ms, in 100ns units.
+	if s := bootCall(t, f, fns, table.SetTimer, ev, uefi.TimerPeriodic, 100000); s != uefi.EFI_SUCCESS {
+		t.Fatalf("SetTimer: got %#x, want EFI_SUCCESS", s)
+	}
+
+	// The guest is not waiting for the timer, just stalling.
+	if s := bootCall(t, f, fns, table.Stall, 5000); s != uefi.EFI_SUCCESS || len(notified) != 0 {
+		t.Errorf("Stall before the timer: got %#x, %d notifies, want EFI_SUCCESS, none", s, len(notified))
+	}
+	if s := bootCall(t, f, fns, table.Stall, 5000); s != uefi.EFI_SUCCESS || len(notified) != 1 {
+		t.Errorf("Stall to the timer: got %#x, %d notifies, want EFI_SUCCESS, 1", s, len(notified))
+	}
+
+	// Not above its TPL; then RestoreTPL lets it go.
+	bootCall(t, f, fns, table.RaiseTPL, uefi.TPL_NOTIFY)
+	if old := f.Regs.Rax; old != uefi.TPL_APPLICATION {
+		t.Errorf("RaiseTPL: got old TPL %d, want %d", old, uefi.TPL_APPLICATION)
+	}
+	bootCall(t, f, fns, table.Stall, 10000)
+	if len(notified) != 1 {
+		t.Errorf("Stall at TPL_NOTIFY: got %d notifies, want 1", len(notified))
+	}
+	bootCall(t, f, fns, table.RestoreTPL, uefi.TPL_APPLICATION)
+	if len(notified) != 2 || tpl != uefi.TPL_APPLICATION {
+		t.Errorf("RestoreTPL: got %d notifies, TPL %d, want 2, %d", len(notified), tpl, uefi.TPL_APPLICATION)
+	}
+
+	// While the guest waits for something else, the timer keeps firing.
+	if s := bootCall(t, f, fns, table.CreateEvent, uefi.EVT_TIMER, 0, 0, 0, evp); s != uefi.EFI_SUCCESS {
+		t.Fatalf("CreateEvent: got %#x, want EFI_SUCCESS", s)
+	}
+	other, _ := trace.ReadWord(f.Proc, evp)
+	bootCall(t, f, fns, table.SetTimer, other, uefi.TimerRelative, 350000)
+	n, start := len(notified), now()
+	if s := bootCall(t, f, fns, table.WaitForEvent, 1, evp, ip); s != uefi.EFI_SUCCESS {
+		t.Fatalf("WaitForEvent: got %#x, want EFI_SUCCESS", s)
+	}
+	if got := len(notified) - n; got != 3 {
+		t.Errorf("WaitForEvent of 35ms: got %d notifies at %v, want 3", got, notified[n:])
+	}
+	if d := now() - start; d < 35*time.Millisecond {
+		t.Errorf("WaitForEvent returned after %v, want 35ms", d)
+	}
+
+	// Cancelled, it stops.
+	bootCall(t, f, fns, table.SetTimer, ev, uefi.TimerCancel, 0)
+	n = len(notified)
+	bootCall(t, f, fns, table.Stall, 50000)
+	if len(notified) != n {
+		t.Errorf("Stall after TimerCancel: got %d notifies, want none", len(notified)-n)
+	}
+}
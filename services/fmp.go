@@ -0,0 +1,355 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"unicode/utf16"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/fmp"
+)
+
+// FMP implements Service. It is the Firmware Management Protocol for
+// fake firmware devices, whose images are host files.
+type FMP struct {
+	u  ServBase
+	up ServPtr
+}
+
+var (
+	_ Service = &FMP{}
+	// fmpConfig is the devices. If it is nil, there is no FMP handle.
+	fmpConfig *fmp.Config
+	// fmpProgress is the Completion percentages SetImage reports to
+	// the Progress function before it writes the image. It reports 100
+	// after.
+	fmpProgress = []uint64{1, 25, 50, 75}
+)
+
+func init() {
+	RegisterGUIDCreator(table.FMPGUID, NewFMP)
+}
+
+// SetFirmwareDevices sets the firmware devices the FMP presents.
+// It must be called before NewSystemtable.
+func SetFirmwareDevices(c *fmp.Config) {
+	fmpConfig = c
+}
+
+// NewFMP returns an FMP Service
+func NewFMP(tab []byte, u ServPtr) (Service, error) {
+	Debug("fmp services table u is %#x", u)
+	base := int(u) & 0xffffff
+	for p := range table.FMPServiceNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	return &FMP{u: u.Base(), up: u}, nil
+}
+
+// writeString allocates a CHAR16 string in the guest and writes s to it.
+// The caller frees it with FreePool, if it is the caller's.
+func writeString(f *Fault, s string) (uint64, error) {
+	u := utf16.Encode([]rune(s))
+	p := uint64(UEFIAllocate(uintptr(2*len(u)+2), false))
+	if err := writeUCS2(f.Proc, uintptr(p), u); err != nil {
+		return 0, err
+	}
+	return p, nil
+}
+
+// writeUCS2 writes s, and a terminating NUL, to p.
+func writeUCS2(t trace.Trace, p uintptr, s []uint16) error {
+	b := make([]byte, 2*len(s)+2)
+	for i, c := range s {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	if err := t.Write(p, b); err != nil {
+		return fmt.Errorf("Can't write string to %#x: %v", p, err)
+	}
+	return nil
+}
+
+// device returns the device for a 1-based image index, or nil.
+func device(index uintptr) *fmp.Device {
+	i := int(uint8(index))
+	if fmpConfig == nil || i < 1 || i > len(fmpConfig.Devices) {
+		return nil
+	}
+	return fmpConfig.Devices[i-1]
+}
+
+// readImage reads the image a caller hands us for d. If it is bigger
+// than d takes, it returns nil, and the caller returns
+// EFI_INVALID_PARAMETER.
+func readImage(f *Fault, d *fmp.Device, p uintptr, n uint64) ([]byte, error) {
+	if n > d.MaxSize {
+		log.Printf("FMP: %s: %#x byte image is bigger than %#x", d.Name, n, d.MaxSize)
+		return nil, nil
+	}
+	b := make([]byte, n)
+	if err := f.Proc.Read(p, b); err != nil {
+		return nil, fmt.Errorf("Can't read %#x byte image at %#x: %v", n, p, err)
+	}
+	return b, nil
+}
+
+// getImageInfo implements GetImageInfo.
+func (m *FMP) getImageInfo(f *Fault) error {
+	a := f.Args
+	if a[1] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	size, err := trace.ReadWord(f.Proc, a[1])
+	if err != nil {
+		return fmt.Errorf("Can't read ImageInfoSize at %#x: %v", a[1], err)
+	}
+	need := uint64(len(fmpConfig.Devices) * fmp.DescriptorSize)
+	if size < need {
+		if err := trace.WriteWord(f.Proc, a[1], need); err != nil {
+			return fmt.Errorf("Can't write ImageInfoSize at %#x: %v", a[1], err)
+		}
+		f.Regs.Rax = uefi.EFI_BUFFER_TOO_SMALL
+		return nil
+	}
+	for _, p := range a[2:8] {
+		if p == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+	}
+	for i, d := range fmpConfig.Devices {
+		name, err := writeString(f, d.Name)
+		if err != nil {
+			return err
+		}
+		vname, err := writeString(f, d.VersionName)
+		if err != nil {
+			return err
+		}
+		var n uint64
+		if b, err := d.ReadImage(); err == nil {
+			n = uint64(len(b))
+		} else {
+			log.Printf("FMP: %s: %v", d.Name, err)
+		}
+		p := a[2] + uintptr(i*fmp.DescriptorSize)
+		if err := f.Proc.Write(p, d.Descriptor(uint8(i+1), n, name, vname)); err != nil {
+			return fmt.Errorf("Can't write image descriptor at %#x: %v", p, err)
+		}
+	}
+	pname, err := writeString(f, fmpConfig.PackageVersionName)
+	if err != nil {
+		return err
+	}
+	for _, w := range []struct {
+		p    uintptr
+		v    uint64
+		size int
+	}{
+		{a[1], need, 8},
+		{a[3], fmp.DescriptorVersion, 4},
+		{a[4], uint64(len(fmpConfig.Devices)), 1},
+		{a[5], fmp.DescriptorSize, 8},
+		{a[6], uint64(fmpConfig.PackageVersion), 4},
+		{a[7], pname, 8},
+	} {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], w.v)
+		if err := f.Proc.Write(w.p, b[:w.size]); err != nil {
+			return fmt.Errorf("Can't write image info at %#x: %v", w.p, err)
+		}
+	}
+	return nil
+}
+
+// getImage implements GetImage.
+func (m *FMP) getImage(f *Fault) error {
+	a := f.Args
+	d := device(a[1])
+	if d == nil || a[3] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	b, err := d.ReadImage()
+	if err != nil {
+		log.Printf("FMP: GetImage: %s: %v", d.Name, err)
+		f.Regs.Rax = uefi.EFI_DEVICE_ERROR
+		return nil
+	}
+	size, err := trace.ReadWord(f.Proc, a[3])
+	if err != nil {
+		return fmt.Errorf("Can't read ImageSize at %#x: %v", a[3], err)
+	}
+	if err := trace.WriteWord(f.Proc, a[3], uint64(len(b))); err != nil {
+		return fmt.Errorf("Can't write ImageSize at %#x: %v", a[3], err)
+	}
+	if size < uint64(len(b)) {
+		f.Regs.Rax = uefi.EFI_BUFFER_TOO_SMALL
+		return nil
+	}
+	if a[2] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if err := f.Proc.Write(a[2], b); err != nil {
+		return fmt.Errorf("Can't write %#x byte image to %#x: %v", len(b), a[2], err)
+	}
+	return nil
+}
+
+// setImage implements SetImage. If there is a Progress function, it
+// is called as the update goes on.
+func (m *FMP) setImage(f *Fault) error {
+	a := f.Args
+	d := device(a[1])
+	if d == nil || a[2] == 0 || a[3] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	image, err := readImage(f, d, a[2], uint64(a[3]))
+	if err != nil || image == nil {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return err
+	}
+	progress, abort := a[5], a[6]
+	if ok, _ := d.Check(image); ok != fmp.IMAGE_UPDATABLE_VALID {
+		// Update does not write it, but records the attempt.
+		err := d.Update(image)
+		log.Printf("FMP: SetImage: %v", err)
+		if abort != 0 {
+			p, err := writeString(f, err.Error())
+			if err != nil {
+				return err
+			}
+			if err := trace.WriteWord(f.Proc, abort, p); err != nil {
+				return fmt.Errorf("Can't write AbortReason at %#x: %v", abort, err)
+			}
+		}
+		f.Regs.Rax = uefi.EFI_ABORTED
+		return nil
+	}
+	status := uint64(uefi.EFI_SUCCESS)
+	done := func(f *Fault) error {
+		f.Regs.Rax = status
+		return nil
+	}
+	update := func(f *Fault) error {
+		if err := d.Update(image); err != nil {
+			log.Printf("FMP: SetImage: %s: %v", d.Name, err)
+			status = uefi.EFI_DEVICE_ERROR
+			return done(f)
+		}
+		log.Printf("FMP: SetImage: %s is now version %d (%s)", d.Name, d.Version, d.VersionName)
+		if progress == 0 {
+			return done(f)
+		}
+		return callGuest(f, progress, done, 100)
+	}
+	if progress == 0 {
+		return update(f)
+	}
+	steps := fmpProgress
+	var next func(f *Fault) error
+	next = func(f *Fault) error {
+		if len(steps) == 0 {
+			return update(f)
+		}
+		c := steps[0]
+		steps = steps[1:]
+		return callGuest(f, progress, next, c)
+	}
+	return next(f)
+}
+
+// checkImage implements CheckImage.
+func (m *FMP) checkImage(f *Fault) error {
+	a := f.Args
+	d := device(a[1])
+	if d == nil || a[2] == 0 || a[4] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	image, err := readImage(f, d, a[2], uint64(a[3]))
+	if err != nil || image == nil {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return err
+	}
+	ok, _ := d.Check(image)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], ok)
+	if err := f.Proc.Write(a[4], b[:]); err != nil {
+		return fmt.Errorf("Can't write ImageUpdatable at %#x: %v", a[4], err)
+	}
+	return nil
+}
+
+// Aliases implements Aliases
+func (m *FMP) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (m *FMP) Base() ServBase {
+	return m.u
+}
+
+// Ptr implements service.Ptr
+func (m *FMP) Ptr() ServPtr {
+	return m.up
+}
+
+// Call implements service.Call
+func (m *FMP) Call(f *Fault) error {
+	op := f.Op
+	Debug("FMP services: %v(%#x), arg type %T, args %v", table.FMPServiceNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	if fmpConfig == nil {
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+		return nil
+	}
+	switch op {
+	case table.FMPGetImageInfo:
+		// EFI_STATUS GetImageInfo (IN EFI_FIRMWARE_MANAGEMENT_PROTOCOL *This, IN OUT UINTN *ImageInfoSize,
+		//   IN OUT EFI_FIRMWARE_IMAGE_DESCRIPTOR *ImageInfo, OUT UINT32 *DescriptorVersion, OUT UINT8 *DescriptorCount,
+		//   OUT UINTN *DescriptorSize, OUT UINT32 *PackageVersion, OUT CHAR16 **PackageVersionName);
+		f.Args = trace.Args(f.Proc, f.Regs, 8)
+		return m.getImageInfo(f)
+	case table.FMPGetImage:
+		// EFI_STATUS GetImage (IN EFI_FIRMWARE_MANAGEMENT_PROTOCOL *This, IN UINT8 ImageIndex,
+		//   IN OUT VOID *Image, IN OUT UINTN *ImageSize);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		return m.getImage(f)
+	case table.FMPSetImage:
+		// EFI_STATUS SetImage (IN EFI_FIRMWARE_MANAGEMENT_PROTOCOL *This, IN UINT8 ImageIndex,
+		//   IN CONST VOID *Image, IN UINTN ImageSize, IN CONST VOID *VendorCode,
+		//   IN EFI_FIRMWARE_MANAGEMENT_UPDATE_IMAGE_PROGRESS Progress, OUT CHAR16 **AbortReason);
+		f.Args = trace.Args(f.Proc, f.Regs, 7)
+		return m.setImage(f)
+	case table.FMPCheckImage:
+		// EFI_STATUS CheckImage (IN EFI_FIRMWARE_MANAGEMENT_PROTOCOL *This, IN UINT8 ImageIndex,
+		//   IN CONST VOID *Image, IN UINTN ImageSize, OUT UINT32 *ImageUpdatable);
+		f.Args = trace.Args(f.Proc, f.Regs, 5)
+		return m.checkImage(f)
+	case table.FMPGetPackageInfo, table.FMPSetPackageInfo:
+		// The package version is whatever the config says.
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	default:
+		log.Panicf("unsup fmp Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (m *FMP) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
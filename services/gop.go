@@ -0,0 +1,197 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/console"
+	"github.com/linuxboot/voodoo/graphics"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+const (
+	// The mode struct and the info for the current mode live in the GOP service's 64K.
+	gopMode = 0x100
+	gopInfo = 0x200
+	// frameBufferBase is where the framebuffer is in guest memory.
+	// It is above what GetMemoryMap hands out, and below the DXE data,
+	// and there is room for the biggest mode.
+	frameBufferBase = 0x30000000
+)
+
+// GOP implements Service
+type GOP struct {
+	u  ServBase
+	up ServPtr
+}
+
+var (
+	_ Service = &GOP{}
+	// gopModeNumber is the mode the GOP starts in.
+	gopModeNumber = 1
+	fb            = &graphics.Framebuffer{Base: frameBufferBase}
+)
+
+func init() {
+	RegisterGUIDCreator(table.GOPGUID, NewGOP)
+}
+
+// SetGOPMode sets the mode the GOP starts in, an index into graphics.Modes.
+// It must be called before NewSystemtable.
+func SetGOPMode(n int) error {
+	if n < 0 || n >= len(graphics.Modes) {
+		return fmt.Errorf("GOP mode %d: there are only %d modes", n, len(graphics.Modes))
+	}
+	gopModeNumber = n
+	return nil
+}
+
+// Framebuffer returns the GOP framebuffer, in its current mode.
+func Framebuffer() *graphics.Framebuffer {
+	return fb
+}
+
+// NewGOP returns a GOP Service
+func NewGOP(tab []byte, u ServPtr) (Service, error) {
+	Debug("gop services table u is %#x", u)
+	base := int(u) & 0xffffff
+	for p := range table.GOPServiceNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	// Mode is not a function, it is a pointer to the mode struct.
+	binary.LittleEndian.PutUint64(tab[base+table.GOPMode:], uint64(u)+gopMode)
+	g := &GOP{u: u.Base(), up: u}
+	g.setMode(gopModeNumber)
+	g.mode(tab)
+	return g, nil
+}
+
+// setMode sets the framebuffer size for a mode.
+func (g *GOP) setMode(n int) {
+	gopModeNumber = n
+	fb.Width, fb.Height = graphics.Modes[n].Width, graphics.Modes[n].Height
+}
+
+// modeInfo returns the EFI_GRAPHICS_OUTPUT_MODE_INFORMATION for a mode.
+func modeInfo(n int) []byte {
+	m := graphics.Modes[n]
+	b := make([]byte, table.GOPInfoSize)
+	binary.LittleEndian.PutUint32(b[table.GOPInfoHorizontalResolution:], uint32(m.Width))
+	binary.LittleEndian.PutUint32(b[table.GOPInfoVerticalResolution:], uint32(m.Height))
+	binary.LittleEndian.PutUint32(b[table.GOPInfoPixelFormat:], table.PixelBlueGreenRedReserved8BitPerColor)
+	binary.LittleEndian.PutUint32(b[table.GOPInfoPixelsPerScanLine:], uint32(m.Width))
+	return b
+}
+
+// mode writes the EFI_GRAPHICS_OUTPUT_PROTOCOL_MODE struct, and the
+// info for the current mode, that the guest sees.
+func (g *GOP) mode(tab []byte) {
+	x := tab[index(g.up)+gopMode:]
+	binary.LittleEndian.PutUint32(x[table.GOPModeMaxMode:], uint32(len(graphics.Modes)))
+	binary.LittleEndian.PutUint32(x[table.GOPModeMode:], uint32(gopModeNumber))
+	binary.LittleEndian.PutUint64(x[table.GOPModeInfo:], uint64(g.up)+gopInfo)
+	binary.LittleEndian.PutUint64(x[table.GOPModeSizeOfInfo:], table.GOPInfoSize)
+	binary.LittleEndian.PutUint64(x[table.GOPModeFrameBufferBase:], uint64(fb.Base))
+	binary.LittleEndian.PutUint64(x[table.GOPModeFrameBufferSize:], uint64(fb.Size()))
+	copy(tab[index(g.up)+gopInfo:], modeInfo(gopModeNumber))
+}
+
+// Aliases implements Aliases
+func (g *GOP) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (g *GOP) Base() ServBase {
+	return g.u
+}
+
+// Ptr implements service.Ptr
+func (g *GOP) Ptr() ServPtr {
+	return g.up
+}
+
+// Call implements service.Call
+func (g *GOP) Call(f *Fault) error {
+	op := f.Op
+	Debug("GOP services: %v(%#x), arg type %T, args %v", table.GOPServiceNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	switch op {
+	case table.GOPQueryMode:
+		// EFI_STATUS QueryMode (IN EFI_GRAPHICS_OUTPUT_PROTOCOL *This, IN UINT32 ModeNumber,
+		//   OUT UINTN *SizeOfInfo, OUT EFI_GRAPHICS_OUTPUT_MODE_INFORMATION **Info);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		n := int(uint32(f.Args[1]))
+		if n >= len(graphics.Modes) || f.Args[2] == 0 || f.Args[3] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		// The caller frees it with FreePool.
+		p := uintptr(UEFIAllocate(table.GOPInfoSize, false))
+		if err := f.Proc.Write(p, modeInfo(n)); err != nil {
+			return fmt.Errorf("Can't write mode info to %#x: %v", p, err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[2], table.GOPInfoSize); err != nil {
+			return fmt.Errorf("Can't write info size to %#x: %v", f.Args[2], err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[3], uint64(p)); err != nil {
+			return fmt.Errorf("Can't write info pointer to %#x: %v", f.Args[3], err)
+		}
+	case table.GOPSetMode:
+		// EFI_STATUS SetMode (IN EFI_GRAPHICS_OUTPUT_PROTOCOL *This, IN UINT32 ModeNumber);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		n := int(uint32(f.Args[1]))
+		if n >= len(graphics.Modes) {
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+			return nil
+		}
+		g.setMode(n)
+		if err := fb.Clear(f.Proc); err != nil {
+			return fmt.Errorf("Can't clear framebuffer: %v", err)
+		}
+		g.mode(f.Proc.Tab())
+		// The text has to fit. If it does not, go back to 80x25, which always does.
+		if !fb.Fits(console.Modes[screen.Mode]) {
+			if err := screen.SetMode(0); err != nil {
+				return err
+			}
+			conOut.mode(f.Proc.Tab())
+		}
+		gcon.Redraw()
+		if err := gcon.Draw(f.Proc); err != nil {
+			return fmt.Errorf("Can't draw the console on the GOP: %v", err)
+		}
+	case table.GOPBlt:
+		// EFI_STATUS Blt (IN EFI_GRAPHICS_OUTPUT_PROTOCOL *This, IN OUT EFI_GRAPHICS_OUTPUT_BLT_PIXEL *BltBuffer OPTIONAL,
+		//   IN EFI_GRAPHICS_OUTPUT_BLT_OPERATION BltOperation, IN UINTN SourceX, IN UINTN SourceY,
+		//   IN UINTN DestinationX, IN UINTN DestinationY, IN UINTN Width, IN UINTN Height, IN UINTN Delta OPTIONAL);
+		f.Args = trace.Args(f.Proc, f.Regs, 10)
+		a := f.Args
+		op := int(a[2])
+		if a[1] == 0 && op != graphics.VideoToVideo {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		if err := fb.Blt(f.Proc, a[1], op, uint64(a[3]), uint64(a[4]), uint64(a[5]), uint64(a[6]), uint64(a[7]), uint64(a[8]), uint64(a[9])); err != nil {
+			Debug("Blt: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		}
+	default:
+		log.Panicf("unsup gop Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (g *GOP) OpenProtocol(f *Fault, h *Handle, gd guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/linuxboot/fiano/pkg/guid"
 )
@@ -20,6 +21,9 @@ type Handle struct {
 	// convenience: remember our name.
 	hd        hd
 	protocols map[string]*dispatch
+	// opens records who has opened each protocol, and how, for the
+	// driver model.
+	opens map[string][]*openInfo
 }
 
 // Get gets a dispatch given a GUID.
@@ -68,7 +72,7 @@ func newHD() hd {
 var hdb = map[hd]*Handle{}
 
 func newHandle() *Handle {
-	nh := &Handle{hd: newHD(), protocols: make(map[string]*dispatch)}
+	nh := &Handle{hd: newHD(), protocols: make(map[string]*dispatch), opens: make(map[string][]*openInfo)}
 	hdb[nh.hd] = nh
 	return nh
 }
@@ -81,12 +85,15 @@ func getHandle(hd hd) (*Handle, error) {
 	return h, nil
 }
 
+// allHandlesByGUID returns the handles that have a protocol, in the
+// order they were made.
 func allHandlesByGUID(g *guid.GUID) []hd {
 	var all []hd
 	for _, h := range hdb {
-		if _, err := h.Get(g); err != nil {
+		if _, err := h.Get(g); err == nil {
 			all = append(all, h.hd)
 		}
 	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
 	return all
 }
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/devicepath"
+)
+
+var (
+	testGUID  = guid.MustParse("8E5A1CB6-3C69-4E2E-9D1E-4F1B0F6A2C01")
+	otherGUID = guid.MustParse("8E5A1CB6-3C69-4E2E-9D1E-4F1B0F6A2C02")
+)
+
+// putPath puts the text device path s in guest memory at p.
+func putPath(t *testing.T, m trace.Trace, p uintptr, s string) {
+	t.Helper()
+	paths, err := devicepath.FromText(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Write(p, devicepath.Blob(paths...))
+}
+
+func TestLocateHandle(t *testing.T) {
+	const g, size, buf = 0x1000, 0x1100, 0x1200
+	f := newFault(table.LocateHandle, uint64(table.ByProtocol), g, 0, size, buf)
+	f.Proc.Write(g, testGUID[:])
+	var want []hd
+	for _, gs := range [][]*guid.GUID{{testGUID}, {otherGUID}, {otherGUID, testGUID}, nil} {
+		h := newHandle()
+		for _, g := range gs {
+			h.PutService(g, nil, 0x1234)
+			if g == testGUID {
+				want = append(want, h.hd)
+			}
+		}
+	}
+	if err := (&Boot{}).Call(f); err != nil {
+		t.Fatalf("LocateHandle: got %v, want nil", err)
+	}
+	if f.Regs.Rax != uefi.EFI_SUCCESS {
+		t.Fatalf("LocateHandle: got %#x, want EFI_SUCCESS", f.Regs.Rax)
+	}
+	if n, _ := trace.ReadWord(f.Proc, size); n != uint64(len(want)*table.EfiHandleSize) {
+		t.Errorf("LocateHandle: size is %d, want %d", n, len(want)*table.EfiHandleSize)
+	}
+	for i, h := range want {
+		if got, _ := trace.ReadWord(f.Proc, buf+uintptr(i*table.EfiHandleSize)); got != uint64(h) {
+			t.Errorf("LocateHandle: handle %d is %#x, want %#x", i, got, h)
+		}
+	}
+}
+
+func TestLocateDevicePath(t *testing.T) {
+	const g, dpp, dev, path = 0x1000, 0x1100, 0x1200, 0x2000
+	for _, tt := range []struct {
+		name   string
+		path   string
+		status uint64
+		// want is the handle that should be found, by its index in
+		// the handles below, if any, and size how far the path moves.
+		want int
+		size uint64
+	}{
+		{"longest prefix", "PciRoot(0x0)/Pci(0x1,0x0)/Scsi(0x1,0x0)", uefi.EFI_SUCCESS, 1, 12 + 6},
+		{"whole path", "PciRoot(0x0)/Pci(0x2,0x0)", uefi.EFI_SUCCESS, 2, 12 + 6},
+		{"short prefix", "PciRoot(0x0)/Pci(0x3,0x0)", uefi.EFI_SUCCESS, 0, 12},
+		{"no prefix", "PciRoot(0x1)/Pci(0x1,0x0)", uefi.EFI_NOT_FOUND, -1, 0},
+	} {
+		f := newFault(table.LocateDevicePath, g, dpp, dev)
+		f.Proc.Write(g, testGUID[:])
+		var hs []hd
+		for i, h := range []struct {
+			path string
+			g    *guid.GUID
+		}{
+			{"PciRoot(0x0)", testGUID},
+			{"PciRoot(0x0)/Pci(0x1,0x0)", testGUID},
+			{"PciRoot(0x0)/Pci(0x2,0x0)", testGUID},
+			// Longer, but without the protocol.
+			{"PciRoot(0x0)/Pci(0x1,0x0)/Scsi(0x1,0x0)", otherGUID},
+		} {
+			hh := newHandle()
+			p := uintptr(0x10000 + i*0x100)
+			putPath(t, f.Proc, p, h.path)
+			hh.PutService(devicepath.DevicePathGUID, nil, ServPtr(p))
+			hh.PutService(h.g, nil, 0x1234)
+			hs = append(hs, hh.hd)
+		}
+		putPath(t, f.Proc, path, tt.path)
+		trace.WriteWord(f.Proc, dpp, path)
+		if err := (&Boot{}).Call(f); err != nil {
+			t.Fatalf("%s: got %v, want nil", tt.name, err)
+		}
+		if f.Regs.Rax != tt.status {
+			t.Errorf("%s: got %#x, want %#x", tt.name, f.Regs.Rax, tt.status)
+			continue
+		}
+		if h, _ := trace.ReadWord(f.Proc, dev); tt.want >= 0 && h != uint64(hs[tt.want]) {
+			t.Errorf("%s: got handle %#x, want %#x", tt.name, h, hs[tt.want])
+		}
+		if p, _ := trace.ReadWord(f.Proc, dpp); p != path+tt.size {
+			t.Errorf("%s: device path moved to %#x, want %#x", tt.name, p, path+tt.size)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/knownguids"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/depex"
+)
+
+// Driver images are loaded before the main image, and their entry
+// points run first. A boot service or runtime driver whose entry point
+// returns EFI_SUCCESS stays resident: its image handle, and the
+// protocols it installed, are there for the images after it. Anything
+// else is unloaded when its entry point returns, which, since we never
+// free memory, just means its image handle goes away.
+//
+// Which driver runs next is up to its dependency expression, as for
+// a DXE dispatcher: the first, in the order they were added, whose
+// expression is true given the protocols installed so far. Drivers
+// with BEFORE or AFTER expressions run just before or after the one
+// they name. Drivers with no expression can always run, so they run
+// in order. When none can run, that's it, and the ones left are
+// reported, with what they are waiting for.
+
+// driverImage is an image to run before the main one.
+type driverImage struct {
+	name string
+	// file is the file GUID, for drivers from a firmware volume.
+	file     *guid.GUID
+	depex    *depex.Expr
+	entry    uintptr
+	resident bool
+	h        *Handle
+	// queued is set once it is scheduled to run.
+	queued bool
+	// ran is set once its entry point returns status.
+	ran    bool
+	status uint64
+}
+
+var (
+	driverImages []*driverImage
+	// driverQueue is the drivers scheduled to run, in order.
+	driverQueue []*driverImage
+)
+
+// AddDriver adds an image, with its entry point at entry, to run
+// before the main image. If resident is set, it is a driver, not an
+// application, and stays if it succeeds. Drivers from a firmware
+// volume have a file GUID and, maybe, a dependency expression; for
+// others, both are nil.
+func AddDriver(name string, file *guid.GUID, e *depex.Expr, entry uintptr, resident bool) error {
+	if e == nil {
+		var err error
+		if e, err = depex.Parse(nil); err != nil {
+			return err
+		}
+	}
+	driverImages = append(driverImages, &driverImage{name: name, file: file, depex: e, entry: entry, resident: resident})
+	Debug("AddDriver: %s, file %v, %v, entry %#x, resident %v", name, file, e.Kind, entry, resident)
+	return nil
+}
+
+// installed says whether there is a protocol, on some handle, or as
+// one of our own services.
+func installed(g *guid.GUID) bool {
+	if len(allHandlesByGUID(g)) > 0 {
+		return true
+	}
+	_, ok := dispatches[ServBase(g.String())]
+	return ok
+}
+
+// schedule queues d, with the drivers that go just before and after it.
+func schedule(d *driverImage) {
+	d.queued = true
+	order := func(k depex.Kind) {
+		if d.file == nil {
+			return
+		}
+		for _, o := range driverImages {
+			if !o.queued && o.depex.Kind == k && o.depex.GUID == *d.file {
+				schedule(o)
+			}
+		}
+	}
+	order(depex.Before)
+	driverQueue = append(driverQueue, d)
+	order(depex.After)
+}
+
+// nextDriver returns the next driver to run, or nil if none can.
+func nextDriver() *driverImage {
+	if len(driverQueue) == 0 {
+		for _, d := range driverImages {
+			if d.queued || d.depex.Kind != depex.Protocols {
+				continue
+			}
+			if ok, _ := d.depex.Eval(installed); ok {
+				schedule(d)
+				break
+			}
+		}
+	}
+	if len(driverQueue) == 0 {
+		return nil
+	}
+	d := driverQueue[0]
+	driverQueue = driverQueue[1:]
+	return d
+}
+
+// start creates the image handle for d, which is about to run.
+func (d *driverImage) start() error {
+	d.h = newHandle()
+	return d.h.Put(uefi.LoadedImageGUID)
+}
+
+// returned is called when the image's entry point returns status.
+func (d *driverImage) returned(status uint64) {
+	d.ran, d.status = true, status
+	if d.resident && status == uefi.EFI_SUCCESS {
+		Debug("%s: stays resident, handle %#x", d.name, d.h.hd)
+		return
+	}
+	if status != uefi.EFI_SUCCESS {
+		log.Printf("%s: entry point returned %#x, unloading it", d.name, status)
+	}
+	delete(hdb, d.h.hd)
+}
+
+// guidName is g, with its name if we know it.
+func guidName(g *guid.GUID) string {
+	if n, ok := knownguids.GUIDs[*g]; ok {
+		return fmt.Sprintf("%s(%v)", n, g)
+	}
+	return g.String()
+}
+
+// waiting says what d, which did not run, is waiting for.
+func (d *driverImage) waiting() string {
+	e := d.depex
+	switch e.Kind {
+	case depex.Before, depex.After:
+		return fmt.Sprintf("%v %s, which did not run", e.Kind, guidName(&e.GUID))
+	case depex.OnRequest:
+		return "scheduled on request, and nothing asked"
+	}
+	ok, missing := e.Eval(installed)
+	if ok {
+		// It could run now, but nothing was left to install it.
+		return "nothing: it could run now"
+	}
+	if len(missing) == 0 {
+		return "nothing it can get: its DEPEX is false"
+	}
+	var n []string
+	for i := range missing {
+		n = append(n, guidName(&missing[i]))
+	}
+	return strings.Join(n, ", ")
+}
+
+// reportDrivers logs what drivers ran, and what the rest are waiting for.
+// Only drivers from a firmware volume make it worth doing.
+func reportDrivers() {
+	fv := false
+	for _, d := range driverImages {
+		fv = fv || d.file != nil
+	}
+	if !fv {
+		return
+	}
+	var ran, left []*driverImage
+	for _, d := range driverImages {
+		if d.ran {
+			ran = append(ran, d)
+		} else {
+			left = append(left, d)
+		}
+	}
+	log.Printf("Driver dispatch: %d of %d drivers ran", len(ran), len(driverImages))
+	for _, d := range ran {
+		s := "resident"
+		if !d.resident || d.status != uefi.EFI_SUCCESS {
+			s = fmt.Sprintf("returned %#x, unloaded", d.status)
+		}
+		log.Printf("\tran %s: %s", d.name, s)
+	}
+	for _, d := range left {
+		log.Printf("\tblocked %s: waiting for %s", d.name, d.waiting())
+	}
+}
+
+// StartDrivers arranges for the driver images to run before the main
+// image, whose entry point, stack, and arguments are in r. When no
+// more drivers can run, the main image starts, just as it would have.
+func StartDrivers(t trace.Trace, r *syscall.PtraceRegs) error {
+	if len(driverImages) == 0 {
+		return nil
+	}
+	entry, sp, ih, st := r.Rip, r.Rsp, r.Rcx, r.Rdx
+	var run func(f *Fault) error
+	run = func(f *Fault) error {
+		d := nextDriver()
+		if d == nil {
+			reportDrivers()
+			// Return to the main image's entry point, with the stack
+			// it would have had if called first.
+			if err := trace.WriteWord(f.Proc, uintptr(sp-8), entry); err != nil {
+				return fmt.Errorf("Can't write entry point at %#x: %v", sp-8, err)
+			}
+			f.Regs.Rsp, f.Regs.Rcx, f.Regs.Rdx = sp-8, ih, st
+			Debug("StartDrivers: drivers done, on to %#x", entry)
+			return nil
+		}
+		if err := d.start(); err != nil {
+			return fmt.Errorf("%s: %v", d.name, err)
+		}
+		Debug("StartDrivers: %s at %#x, handle %#x", d.name, d.entry, d.h.hd)
+		return callGuest(f, d.entry, func(f *Fault) error {
+			d.returned(f.Regs.Rax)
+			return run(f)
+		}, uint64(d.h.hd), st)
+	}
+	// callGuest sets up the stack for the ret after a service's hlt.
+	// There is no service call here, so do the ret ourselves.
+	f := &Fault{Proc: t, Regs: r}
+	if err := run(f); err != nil {
+		return err
+	}
+	fn, err := trace.ReadWord(t, uintptr(r.Rsp))
+	if err != nil {
+		return fmt.Errorf("Can't read the first driver's entry at %#x: %v", r.Rsp, err)
+	}
+	r.Rip, r.Rsp = fn, r.Rsp+8
+	return nil
+}
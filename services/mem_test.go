@@ -0,0 +1,118 @@
+package services
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"golang.org/x/arch/x86/x86asm"
+	"golang.org/x/sys/unix"
+)
+
+// mem is a trace.Trace for tests: guest memory, and nothing else.
+// What was never written reads as zeros.
+type mem map[uintptr]byte
+
+var _ trace.Trace = mem{}
+
+func (m mem) Event() unix.SignalfdSiginfo { return unix.SignalfdSiginfo{} }
+func (m mem) NewProc(id int) error        { return nil }
+
+func (m mem) ReadWord(addr uintptr) (uint64, error) {
+	return trace.ReadWord(m, addr)
+}
+
+func (m mem) Read(addr uintptr, b []byte) error {
+	for i := range b {
+		b[i] = m[addr+uintptr(i)]
+	}
+	return nil
+}
+
+func (m mem) Write(addr uintptr, b []byte) error {
+	for i, v := range b {
+		m[addr+uintptr(i)] = v
+	}
+	return nil
+}
+
+func (m mem) GetRegs() (*syscall.PtraceRegs, error) { return &syscall.PtraceRegs{}, nil }
+func (m mem) SetRegs(*syscall.PtraceRegs) error     { return nil }
+func (m mem) SingleStep(bool) error                 { return nil }
+func (m mem) Run() error                            { return nil }
+func (m mem) Tab() []byte                           { return memTab }
+
+// memTab is the services table of the guest, which is not in mem:
+// Tab is how services write to it.
+var memTab []byte
+
+// Map implements mapper. Addresses in mem are what they are: the
+// mappings are only checked for by what uses them.
+func (m mem) Map(va, pa, n uint64) error { return nil }
+
+// newFault returns a Fault for a call of op with args, on a guest
+// with nothing but empty memory, and no handles.
+func newFault(op Func, args ...uint64) *Fault {
+	hdb = map[hd]*Handle{}
+	guestCalls = nil
+	memTab = make([]byte, tableSize)
+	callbackRet = 0xff4f0000
+	SetAllocBase(0x800000)
+	f := &Fault{Proc: mem{}, Regs: &syscall.PtraceRegs{Rsp: 0x100000}, Inst: &x86asm.Inst{}}
+	setCall(f, op, args...)
+	return f
+}
+
+// setCall sets f up for a call of op with args, with the memory and
+// handles of the calls before it.
+func setCall(f *Fault, op Func, args ...uint64) {
+	f.Op, f.Regs.Rax = op, 0
+	regs := []*uint64{&f.Regs.Rcx, &f.Regs.Rdx, &f.Regs.R8, &f.Regs.R9}
+	for _, r := range regs {
+		*r = 0
+	}
+	for i, a := range args {
+		if i < len(regs) {
+			*regs[i] = a
+			continue
+		}
+		trace.WriteWord(f.Proc, uintptr(f.Regs.Rsp)+0x28+uintptr(i-4)*8, a)
+	}
+}
+
+// bootCall calls the boot service op with args, and plays the guest,
+// with fns, for the guest calls it makes. It returns the status.
+func bootCall(t *testing.T, f *Fault, fns map[uint64]func(f *Fault) uint64, op Func, args ...uint64) uint64 {
+	t.Helper()
+	setCall(f, op, args...)
+	if err := (&Boot{}).Call(f); err != nil {
+		t.Fatalf("%s: got %v, want nil", table.BootServicesNames[int(op)], err)
+	}
+	runGuest(t, f, fns)
+	return f.Regs.Rax
+}
+
+// runGuest plays the guest for the guest calls that services make,
+// until there are none left. fns are the guest functions, by address;
+// each gets the Fault as the function would see it, and returns its
+// status.
+func runGuest(t *testing.T, f *Fault, fns map[uint64]func(f *Fault) uint64) {
+	t.Helper()
+	for len(guestCalls) > 0 {
+		fn, err := trace.ReadWord(f.Proc, uintptr(f.Regs.Rsp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, ok := fns[fn]
+		if !ok {
+			t.Fatalf("call to %#x: no such guest function", fn)
+		}
+		// The ret to fn pops it.
+		f.Regs.Rsp += 8
+		f.Regs.Rax = g(f)
+		if err := (&Callback{}).Call(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// Reset is the error Call returns when the guest calls ResetSystem,
+// which does not return. What to do about it is up to whoever runs
+// the guest: stop, or start over.
+type Reset struct {
+	Type   int
+	Status uintptr
+	// Data is the string at the start of the ResetData, if any.
+	Data string
+	// Platform is the GUID after the string, for EfiResetPlatformSpecific.
+	Platform *guid.GUID
+}
+
+var resetTypes = []string{
+	uefi.EfiResetCold:             "EfiResetCold",
+	uefi.EfiResetWarm:             "EfiResetWarm",
+	uefi.EfiResetShutdown:         "EfiResetShutdown",
+	uefi.EfiResetPlatformSpecific: "EfiResetPlatformSpecific",
+}
+
+// TypeName returns the name of the reset type.
+func (r *Reset) TypeName() string {
+	if r.Type < len(resetTypes) {
+		return resetTypes[r.Type]
+	}
+	return fmt.Sprintf("EFI_RESET_TYPE(%d)", r.Type)
+}
+
+func (r *Reset) Error() string {
+	s := fmt.Sprintf("ResetSystem(%s, %#x)", r.TypeName(), r.Status)
+	if len(r.Data) > 0 {
+		s += fmt.Sprintf(": %q", r.Data)
+	}
+	if r.Platform != nil {
+		s += fmt.Sprintf(" [%v]", r.Platform)
+	}
+	return s
+}
+
+// resetData decodes ResetData: a NUL terminated string, then, for a
+// platform specific reset, a GUID. Anything else is left alone.
+func resetData(typ int, b []byte) (string, *guid.GUID) {
+	var s []uint16
+	i := 0
+	for ; i+1 < len(b); i += 2 {
+		c := uint16(b[i]) | uint16(b[i+1])<<8
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+	i += 2
+	var g *guid.GUID
+	if typ == uefi.EfiResetPlatformSpecific && i+len(guid.GUID{}) <= len(b) {
+		g = &guid.GUID{}
+		copy(g[:], b[i:])
+	}
+	return string(utf16.Decode(s)), g
+}
+
+// resetSystem implements ResetSystem.
+func resetSystem(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 4)
+	r := &Reset{Type: int(uint32(args[0])), Status: args[1]}
+	if args[2] != 0 && args[3] != 0 {
+		// Don't believe sizes that are more than a page or so.
+		n := args[2]
+		if n > 4096 {
+			n = 4096
+		}
+		b := make([]byte, n)
+		if err := f.Proc.Read(args[3], b); err != nil {
+			return fmt.Errorf("Can't read %d bytes of ResetData at %#x: %v", n, args[3], err)
+		}
+		r.Data, r.Platform = resetData(r.Type, b)
+	}
+	return r
+}
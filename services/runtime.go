@@ -1,16 +1,13 @@
 package services
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"runtime/debug"
-	"time"
 
 	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/voodoo/table"
-	"github.com/linuxboot/voodoo/trace"
 	"github.com/linuxboot/voodoo/uefi"
 )
 
@@ -63,71 +60,46 @@ func (r *Runtime) Call(f *Fault) error {
 	Debug("runtimeservices Call: %s(%#x), arg type %T, args %v", t, op, f.Inst.Args, f.Inst.Args)
 	switch op {
 	case table.RTGetVariable:
-		args := trace.Args(f.Proc, f.Regs, 5)
-		Debug("table.RTGetVariable args %#x", args)
-		ptr := args[0]
-		n, err := trace.ReadStupidString(f.Proc, ptr)
-		if err != nil {
-			return fmt.Errorf("Can't read StupidString at #%x, err %v", ptr, err)
-		}
-		var g guid.GUID
-		if err := f.Proc.Read(args[1], g[:]); err != nil {
-			return fmt.Errorf("Can't read guid at #%x, err %v", args[1], err)
-		}
-		Debug("PCHandleProtocol: find %s %s", n, g)
-		f.Regs.Rax = uefi.EFI_SUCCESS
-		v, err := uefi.ReadVariable(n, g)
-		if err != nil {
-			f.Regs.Rax = uefi.EFI_NOT_FOUND
-			if err := f.Proc.SetRegs(f.Regs); err != nil {
-				return err
-			}
-		}
-		Debug("%s:%s: v is %v", n, g, v)
+		// EFI_STATUS GetVariable(IN CHAR16 *VariableName, IN EFI_GUID *VendorGuid, OUT UINT32 *Attributes OPTIONAL,
+		//	IN OUT UINTN *DataSize, OUT VOID *Data OPTIONAL);
+		return getVariable(f)
 	case table.RTSetVariable:
-		f.Regs.Rax = uefi.EFI_SUCCESS
-		// whatever.
+		// EFI_STATUS SetVariable(IN CHAR16 *VariableName, IN EFI_GUID *VendorGuid, IN UINT32 Attributes,
+		//	IN UINTN DataSize, IN VOID *Data);
+		return setVariable(f)
 	case table.RTGetTime:
-		args := trace.Args(f.Proc, f.Regs, 2)
-		Debug("table.RTGetTime args %#x", args)
-		now := time.Now()
-		if args[0] != 0 {
-			var b = &bytes.Buffer{}
-			if err := binary.Write(b, binary.LittleEndian, &table.EfiTime{
-				Year:       uint16(now.Year()),
-				Month:      uint8(now.Month()),
-				Day:        uint8(now.Day()),
-				Hour:       uint8(now.Hour()),
-				Minute:     uint8(now.Minute()),
-				Second:     uint8(now.Second()),
-				Nanosecond: uint32(now.Nanosecond()),
-				//Timezone: now.Timezone(),
-				Daylight: 1, // uefi.EFI_TIME_ADJUST_DAYLIGHT, //now.Daylight()?
-				//        if (tm.tm_isdst > 0)
-				// time->daylight |= EFI_TIME_IN_DAYLIGHT;
-				Timezone: 0, //uefi.EFI_UNSPECIFIED_TIMEZONE,
-			}); err != nil {
-				log.Fatalf("Can't encode memory: %v", err)
-			}
-			if err := f.Proc.Write(args[0], b.Bytes()); err != nil {
-				return fmt.Errorf("Can't write %d bytes to %#x: %v", b.Len(), dat, err)
-			}
-		}
-		if args[1] != 0 {
-			// Set reasonable dummy values  -- most appropriate for UEFI
-			var b = &bytes.Buffer{}
-			if err := binary.Write(b, binary.LittleEndian, &table.EfiTimeCap{
-				Resolution: 1,         // 1 Hz
-				Accuracy:   100000000, // 100 ppm
-				SetsToZero: 0,
-			}); err != nil {
-				log.Fatalf("Can't encode memory: %v", err)
-			}
-			if err := f.Proc.Write(args[1], b.Bytes()); err != nil {
-				return fmt.Errorf("Can't write %d bytes to %#x: %v", b.Len(), dat, err)
-			}
-		}
-		f.Regs.Rax = uefi.EFI_SUCCESS
+		// EFI_STATUS GetTime(OUT EFI_TIME *Time, OUT EFI_TIME_CAPABILITIES *Capabilities OPTIONAL);
+		return getTime(f)
+	case table.RTSetTime:
+		// EFI_STATUS SetTime(IN EFI_TIME *Time);
+		return setTime(f)
+	case table.RTGetWakeupTime:
+		// EFI_STATUS GetWakeupTime(OUT BOOLEAN *Enabled, OUT BOOLEAN *Pending, OUT EFI_TIME *Time);
+		return getWakeupTime(f)
+	case table.RTSetWakeupTime:
+		// EFI_STATUS SetWakeupTime(IN BOOLEAN Enable, IN EFI_TIME *Time OPTIONAL);
+		return setWakeupTime(f)
+
+	case table.RTSetVirtualAddressMap:
+		// EFI_STATUS SetVirtualAddressMap(IN UINTN MemoryMapSize, IN UINTN DescriptorSize,
+		//	IN UINT32 DescriptorVersion, IN EFI_MEMORY_DESCRIPTOR *VirtualMap);
+		return setVirtualAddressMap(f)
+	case table.RTConvertPointer:
+		// EFI_STATUS ConvertPointer(IN UINTN DebugDisposition, IN VOID **Address);
+		return convertPointer(f)
+	case table.RTResetSystem:
+		// VOID ResetSystem(IN EFI_RESET_TYPE ResetType, IN EFI_STATUS ResetStatus, IN UINTN DataSize,
+		//	IN VOID *ResetData OPTIONAL);
+		return resetSystem(f)
+
+	case table.RTUpdateCapsule:
+		// EFI_STATUS UpdateCapsule(IN EFI_CAPSULE_HEADER **CapsuleHeaderArray, IN UINTN CapsuleCount,
+		//	IN EFI_PHYSICAL_ADDRESS ScatterGatherList OPTIONAL);
+		return updateCapsule(f)
+	case table.RTQueryCapsuleCapabilities:
+		// EFI_STATUS QueryCapsuleCapabilities(IN EFI_CAPSULE_HEADER **CapsuleHeaderArray, IN UINTN CapsuleCount,
+		//	OUT UINT64 *MaximumCapsuleSize, OUT EFI_RESET_TYPE *ResetType);
+		return queryCapsuleCapabilities(f)
 
 	default:
 		log.Panicf("fix me: %s(%#x): %s", table.RuntimeServicesNames[uint64(op)], op, string(debug.Stack()))
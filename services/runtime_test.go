@@ -1,25 +1,25 @@
 package services
 
 import (
-	"syscall"
 	"testing"
 
 	"github.com/linuxboot/voodoo/table"
 	"github.com/linuxboot/voodoo/uefi"
-	"golang.org/x/arch/x86/x86asm"
 )
 
 func TestNew(t *testing.T) {
-	r, err := NewRuntime(servBaseName(0x1abcde))
+	r, err := NewRuntime(make([]byte, 1<<24), ServPtr(0xff1a0000))
 	if err != nil {
 		t.Fatalf("NewRuntime: got %v, want nil", err)
 	}
-	f := &Fault{Args: []uintptr{1, 2, 3}, Regs: &syscall.PtraceRegs{}, Inst: &x86asm.Inst{Args: x86asm.Args{}}, Op: table.RTSetVariable, Asm: "CALL x"}
+	// SetVariable with no name.
+	f := newFault(table.RTSetVariable, 0, 0x1000, 0, 0, 0)
+	f.Asm = "CALL x"
 
 	if err := r.Call(f); err != nil {
 		t.Fatalf("Call with bad value: got %v, want nil", err)
 	}
-	if f.Regs.Rax != uefi.EFI_SUCCESS {
-		t.Fatalf("Call with bad value: got f.Regs.Rax %v, want %v", f.Regs.Rax, uefi.EFI_SUCCESS)
+	if f.Regs.Rax != uefi.EFI_INVALID_PARAMETER {
+		t.Fatalf("Call with bad value: got f.Regs.Rax %#x, want %#x", f.Regs.Rax, uint64(uefi.EFI_INVALID_PARAMETER))
 	}
 }
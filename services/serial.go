@@ -0,0 +1,293 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/devices"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+const (
+	// The SERIAL_IO_MODE lives in the serial service's 64K.
+	serialMode = 0x100
+	// serialRevision is EFI_SERIAL_IO_PROTOCOL_REVISION.
+	serialRevision = 0x00010000
+	// serialFifoDepth is what a 16550 has.
+	serialFifoDepth = 16
+	// serialMax is the most a Read moves in one call, and the most a
+	// Write reads from the guest at a time. The size is the guest's.
+	serialMax = 4096
+	// serialControls are the controls SetControl can set.
+	serialControls = uefi.EFI_SERIAL_DATA_TERMINAL_READY | uefi.EFI_SERIAL_REQUEST_TO_SEND |
+		uefi.EFI_SERIAL_HARDWARE_LOOPBACK_ENABLE | uefi.EFI_SERIAL_SOFTWARE_LOOPBACK_ENABLE |
+		uefi.EFI_SERIAL_HARDWARE_FLOW_CONTROL_ENABLE
+)
+
+// SerialIO implements Service. It is EFI_SERIAL_IO_PROTOCOL on top
+// of the UART, so the guest can use either, or both.
+type SerialIO struct {
+	u  ServBase
+	up ServPtr
+	// The SERIAL_IO_MODE fields.
+	timeout   uint32
+	baud      uint64
+	fifoDepth uint32
+	dataBits  uint32
+	parity    uint32
+	stopBits  uint32
+	// control has the controls that are not in the UART's MCR.
+	control uint32
+}
+
+var (
+	_ Service = &SerialIO{}
+	// uart is COM1.
+	uart *devices.UART
+)
+
+func init() {
+	RegisterGUIDCreator(table.SerialIOGUID, NewSerialIO)
+}
+
+// SetSerial sets the UART the Serial IO protocol uses.
+// It must be called before NewSystemtable.
+func SetSerial(u *devices.UART) {
+	uart = u
+}
+
+// NewSerialIO returns a SerialIO Service
+func NewSerialIO(tab []byte, u ServPtr) (Service, error) {
+	Debug("serial services table u is %#x", u)
+	base := int(u) & 0xffffff
+	binary.LittleEndian.PutUint64(tab[base+table.SerialIORevision:], serialRevision)
+	for p := range table.SerialIOServiceNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	// Mode is not a function, it is a pointer to the mode struct.
+	binary.LittleEndian.PutUint64(tab[base+table.SerialIOMode:], uint64(u)+serialMode)
+	if uart == nil {
+		uart = devices.NewUART(nil)
+	}
+	s := &SerialIO{u: u.Base(), up: u}
+	if st := s.setAttributes(0, 0, 0, 0, 0, 0); st != uefi.EFI_SUCCESS {
+		return nil, fmt.Errorf("Setting default serial attributes: status %#x", st)
+	}
+	s.mode(tab)
+	return s, nil
+}
+
+// setAttributes checks and sets the line attributes, with 0 meaning
+// the default for each, and programs the UART to match.
+func (s *SerialIO) setAttributes(baud uint64, fifoDepth, timeout, parity, dataBits, stopBits uint32) uint64 {
+	if baud == 0 {
+		baud = 115200
+	}
+	if fifoDepth == 0 {
+		fifoDepth = 1
+	}
+	if timeout == 0 {
+		timeout = 1000000
+	}
+	if parity == uefi.DefaultParity {
+		parity = uefi.NoParity
+	}
+	if dataBits == 0 {
+		dataBits = 8
+	}
+	if stopBits == uefi.DefaultStopBits {
+		stopBits = uefi.OneStopBit
+	}
+	if baud > 115200 || fifoDepth > serialFifoDepth || timeout > 100000000 ||
+		parity > uefi.SpaceParity || dataBits < 5 || dataBits > 8 || stopBits > uefi.TwoStopBits {
+		return uefi.EFI_INVALID_PARAMETER
+	}
+	// As on a 16550, 1.5 stop bits go with 5 data bits, and 2 with more.
+	if (stopBits == uefi.OneFiveStopBits && dataBits != 5) || (stopBits == uefi.TwoStopBits && dataBits == 5) {
+		return uefi.EFI_INVALID_PARAMETER
+	}
+	s.baud, s.fifoDepth, s.timeout, s.parity, s.dataBits, s.stopBits = baud, fifoDepth, timeout, parity, dataBits, stopBits
+	lcr := uint8(dataBits - 5)
+	if stopBits != uefi.OneStopBit {
+		lcr |= 0x04
+	}
+	lcr |= map[uint32]uint8{uefi.NoParity: 0, uefi.OddParity: 0x08, uefi.EvenParity: 0x18, uefi.MarkParity: 0x28, uefi.SpaceParity: 0x38}[parity]
+	uart.SetLine(int(baud), lcr)
+	return uefi.EFI_SUCCESS
+}
+
+// getControl returns the control bits.
+func (s *SerialIO) getControl() uint32 {
+	c := s.control
+	mcr := uart.Control()
+	msr := uart.In(devices.MSR)
+	for _, b := range []struct {
+		reg, bit uint8
+		c        uint32
+	}{
+		{mcr, devices.MCRDTR, uefi.EFI_SERIAL_DATA_TERMINAL_READY},
+		{mcr, devices.MCRRTS, uefi.EFI_SERIAL_REQUEST_TO_SEND},
+		{mcr, devices.MCRLoop, uefi.EFI_SERIAL_HARDWARE_LOOPBACK_ENABLE},
+		{msr, devices.MSRCTS, uefi.EFI_SERIAL_CLEAR_TO_SEND},
+		{msr, devices.MSRDSR, uefi.EFI_SERIAL_DATA_SET_READY},
+		{msr, devices.MSRRI, uefi.EFI_SERIAL_RING_INDICATE},
+		{msr, devices.MSRDCD, uefi.EFI_SERIAL_CARRIER_DETECT},
+	} {
+		if b.reg&b.bit != 0 {
+			c |= b.c
+		}
+	}
+	if uart.Pending() == 0 {
+		c |= uefi.EFI_SERIAL_INPUT_BUFFER_EMPTY
+	}
+	// Output goes out as soon as it is written.
+	return c | uefi.EFI_SERIAL_OUTPUT_BUFFER_EMPTY
+}
+
+// mode writes the SERIAL_IO_MODE struct the guest sees.
+func (s *SerialIO) mode(tab []byte) {
+	x := tab[index(s.up)+serialMode:]
+	binary.LittleEndian.PutUint32(x[table.SerialModeControlMask:], serialControls|
+		uefi.EFI_SERIAL_CLEAR_TO_SEND|uefi.EFI_SERIAL_DATA_SET_READY|uefi.EFI_SERIAL_RING_INDICATE|
+		uefi.EFI_SERIAL_CARRIER_DETECT|uefi.EFI_SERIAL_INPUT_BUFFER_EMPTY|uefi.EFI_SERIAL_OUTPUT_BUFFER_EMPTY)
+	binary.LittleEndian.PutUint32(x[table.SerialModeTimeout:], s.timeout)
+	binary.LittleEndian.PutUint64(x[table.SerialModeBaudRate:], s.baud)
+	binary.LittleEndian.PutUint32(x[table.SerialModeReceiveFifoDepth:], s.fifoDepth)
+	binary.LittleEndian.PutUint32(x[table.SerialModeDataBits:], s.dataBits)
+	binary.LittleEndian.PutUint32(x[table.SerialModeParity:], s.parity)
+	binary.LittleEndian.PutUint32(x[table.SerialModeStopBits:], s.stopBits)
+}
+
+// Aliases implements Aliases
+func (s *SerialIO) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (s *SerialIO) Base() ServBase {
+	return s.u
+}
+
+// Ptr implements service.Ptr
+func (s *SerialIO) Ptr() ServPtr {
+	return s.up
+}
+
+// Call implements service.Call
+func (s *SerialIO) Call(f *Fault) error {
+	op := f.Op
+	Debug("SerialIO services: %v(%#x), arg type %T, args %v", table.SerialIOServiceNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	switch op {
+	case table.SerialIOReset:
+		// EFI_STATUS Reset (IN EFI_SERIAL_IO_PROTOCOL *This);
+		uart.Reset()
+		s.control = 0
+		f.Regs.Rax = s.setAttributes(s.baud, s.fifoDepth, s.timeout, s.parity, s.dataBits, s.stopBits)
+	case table.SerialIOSetAttributes:
+		// EFI_STATUS SetAttributes (IN EFI_SERIAL_IO_PROTOCOL *This, IN UINT64 BaudRate, IN UINT32 ReceiveFifoDepth,
+		//   IN UINT32 Timeout, IN EFI_PARITY_TYPE Parity, IN UINT8 DataBits, IN EFI_STOP_BITS_TYPE StopBits);
+		f.Args = trace.Args(f.Proc, f.Regs, 7)
+		a := f.Args
+		f.Regs.Rax = s.setAttributes(uint64(a[1]), uint32(a[2]), uint32(a[3]), uint32(a[4]), uint32(uint8(a[5])), uint32(a[6]))
+	case table.SerialIOSetControl:
+		// EFI_STATUS SetControl (IN EFI_SERIAL_IO_PROTOCOL *This, IN UINT32 Control);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		c := uint32(f.Args[1])
+		if c&^serialControls != 0 {
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+			break
+		}
+		var mcr uint8
+		for _, b := range []struct {
+			c   uint32
+			bit uint8
+		}{
+			{uefi.EFI_SERIAL_DATA_TERMINAL_READY, devices.MCRDTR},
+			{uefi.EFI_SERIAL_REQUEST_TO_SEND, devices.MCRRTS},
+			{uefi.EFI_SERIAL_HARDWARE_LOOPBACK_ENABLE, devices.MCRLoop},
+		} {
+			if c&b.c != 0 {
+				mcr |= b.bit
+			}
+		}
+		uart.SetControl(mcr | uart.Control()&(devices.MCROUT1|devices.MCROUT2))
+		s.control = c & (uefi.EFI_SERIAL_SOFTWARE_LOOPBACK_ENABLE | uefi.EFI_SERIAL_HARDWARE_FLOW_CONTROL_ENABLE)
+	case table.SerialIOGetControl:
+		// EFI_STATUS GetControl (IN EFI_SERIAL_IO_PROTOCOL *This, OUT UINT32 *Control);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], s.getControl())
+		if err := f.Proc.Write(f.Args[1], b[:]); err != nil {
+			return fmt.Errorf("Can't write serial control to %#x: %v", f.Args[1], err)
+		}
+	case table.SerialIOWrite:
+		// EFI_STATUS Write (IN EFI_SERIAL_IO_PROTOCOL *This, IN OUT UINTN *BufferSize, IN VOID *Buffer);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		n, err := f.Proc.ReadWord(f.Args[1])
+		if err != nil {
+			return fmt.Errorf("Can't read buffer size at %#x: %v", f.Args[1], err)
+		}
+		// It all goes, however big, so BufferSize stays as it is.
+		loopback := s.control&uefi.EFI_SERIAL_SOFTWARE_LOOPBACK_ENABLE != 0
+		for off := uint64(0); off < n; off += serialMax {
+			m := n - off
+			if m > serialMax {
+				m = serialMax
+			}
+			b := make([]byte, m)
+			if err := f.Proc.Read(f.Args[2]+uintptr(off), b); err != nil {
+				return fmt.Errorf("Can't read %d bytes at %#x: %v", len(b), f.Args[2]+uintptr(off), err)
+			}
+			if loopback {
+				// Software loopback never gets to the UART.
+				Debug("SerialIO: loopback %q", b)
+				continue
+			}
+			uart.Write(b)
+		}
+	case table.SerialIORead:
+		// EFI_STATUS Read (IN EFI_SERIAL_IO_PROTOCOL *This, IN OUT UINTN *BufferSize, OUT VOID *Buffer);
+		f.Args = trace.Args(f.Proc, f.Regs, 3)
+		n, err := f.Proc.ReadWord(f.Args[1])
+		if err != nil {
+			return fmt.Errorf("Can't read buffer size at %#x: %v", f.Args[1], err)
+		}
+		poll()
+		m := n
+		if m > serialMax {
+			m = serialMax
+		}
+		b := make([]byte, m)
+		got := uart.Read(b)
+		if err := f.Proc.Write(f.Args[2], b[:got]); err != nil {
+			return fmt.Errorf("Can't write %d bytes to %#x: %v", got, f.Args[2], err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[1], uint64(got)); err != nil {
+			return fmt.Errorf("Can't write buffer size to %#x: %v", f.Args[1], err)
+		}
+		if uint64(got) < n {
+			// A real one would wait the timeout, so let that time pass.
+			idle()
+			f.Regs.Rax = uefi.EFI_TIMEOUT
+		}
+	default:
+		log.Panicf("unsup serial Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	s.mode(f.Proc.Tab())
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (s *SerialIO) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
@@ -0,0 +1,35 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/linuxboot/voodoo/devices"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+func TestSerialIOWrite(t *testing.T) {
+	const sp, buf = 0x1000, 0x10000
+	var out bytes.Buffer
+	uart = devices.NewUART(&out)
+	defer func() { uart = nil }()
+	// More than serialMax, and not a multiple of it.
+	b := bytes.Repeat([]byte("0123456789"), 1000)
+	f := newFault(table.SerialIOWrite, 0, sp, buf)
+	f.Proc.Write(buf, b)
+	trace.WriteWord(f.Proc, sp, uint64(len(b)))
+	if err := (&SerialIO{}).Call(f); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	if f.Regs.Rax != uefi.EFI_SUCCESS {
+		t.Errorf("Write: got %#x, want EFI_SUCCESS", f.Regs.Rax)
+	}
+	if n, _ := trace.ReadWord(f.Proc, sp); n != uint64(len(b)) {
+		t.Errorf("Write: BufferSize is %d, want %d", n, len(b))
+	}
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Errorf("Write: the UART got %d bytes, want %d", out.Len(), len(b))
+	}
+}
@@ -190,7 +190,9 @@ func AddrToService(addr uintptr) (Service, error) {
 // right-shifted or changed in any other way.
 func Dispatch(f *Fault) error {
 	Debug("Dispatch %s", f.Asm)
-	a := uintptr(f.Info.Addr)
+	// After SetVirtualAddressMap, runtime services are called at
+	// their virtual addresses.
+	a := physical(uintptr(f.Info.Addr))
 	b, op := splitBaseOp(a)
 	d, ok := dispatches[b]
 	if !ok {
@@ -8,12 +8,12 @@ func TestSplit(t *testing.T) {
 		b ServBase
 		o Func
 	}{
-		{0xfedca, ServBase(0xf0000), 0xedca},
+		{0xfedca, ServBase("SB0xf0000"), 0xedc8},
 	}
 	for _, tt := range tests {
 		b, o := splitBaseOp(tt.a)
 		if b != tt.b || o != tt.o {
-			t.Errorf("split of %#x: got (%#x,%#x), want (#%x,%#x)", tt.a, b, o, tt.b, tt.o)
+			t.Errorf("split of %#x: got (%v,%#x), want (%v,%#x)", tt.a, b, o, tt.b, tt.o)
 		}
 	}
 }
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/smbios"
+)
+
+const (
+	// The entry point and structure table live in the SMBIOS service's 64K.
+	smbiosEntryPoint = 0x100
+	smbiosTable      = 0x1000
+	smbiosTableMax   = int(allocAmt) - smbiosTable
+)
+
+// SMBIOS implements Service
+type SMBIOS struct {
+	u    ServBase
+	up   ServPtr
+	recs []*smbios.Record
+	// producers remembers who added what. It's the handle the
+	// caller gave us, and we hand it back in GetNext.
+	producers map[uint16]uint64
+}
+
+var (
+	_ Service = &SMBIOS{}
+	// smbiosConfig is the platform we describe.
+	smbiosConfig = smbios.Default()
+)
+
+func init() {
+	RegisterGUIDCreator(table.SMBIOSGUID, NewSMBIOS)
+}
+
+// SetSMBIOS sets the platform description used to build the SMBIOS table.
+// It must be called before NewSystemtable.
+func SetSMBIOS(c *smbios.Config) {
+	smbiosConfig = c
+}
+
+// NewSMBIOS returns an SMBIOS Service. It builds the structure table
+// from the platform description and installs it as the SMBIOS3
+// configuration table.
+func NewSMBIOS(tab []byte, u ServPtr) (Service, error) {
+	Debug("New SMBIOS ...")
+	base := int(u) & 0xffffff
+	for p := range table.SMBIOSServiceNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		if p == table.SMBIOSMajorVersion {
+			// Not a function pointer: the version bytes, and padding.
+			r = smbios.Major | smbios.Minor<<8
+		}
+		binary.LittleEndian.PutUint64(tab[x:], r)
+		Debug("smbios: Install %#x at off %#x", r, x)
+	}
+
+	recs, err := smbiosConfig.Records()
+	if err != nil {
+		return nil, err
+	}
+	s := &SMBIOS{u: u.Base(), up: u, recs: recs, producers: map[uint16]uint64{}}
+	if err := s.write(tab); err != nil {
+		return nil, err
+	}
+	if st := InstallConfigurationTable(tab, *uefi.SMBIOS3TableGUID, uint64(u)+smbiosEntryPoint); st != uefi.EFI_SUCCESS {
+		return nil, fmt.Errorf("Installing SMBIOS3 table: %#x", st)
+	}
+	return s, nil
+}
+
+// write writes the structure table and the entry point that points to it.
+func (s *SMBIOS) write(tab []byte) error {
+	b := smbios.Table(s.recs)
+	if len(b) > smbiosTableMax {
+		return fmt.Errorf("SMBIOS table is %d bytes, max is %d", len(b), smbiosTableMax)
+	}
+	base := int(index(s.up))
+	copy(tab[base+smbiosTable:], b)
+	copy(tab[base+smbiosEntryPoint:], smbios.EntryPoint(uint64(s.up)+smbiosTable, uint32(len(b))))
+	return nil
+}
+
+// find returns the index of the record with handle h, or -1.
+func (s *SMBIOS) find(h uint16) int {
+	for i, r := range s.recs {
+		if r.Handle == h {
+			return i
+		}
+	}
+	return -1
+}
+
+// newHandle returns the lowest handle not in use.
+func (s *SMBIOS) newHandle() uint16 {
+	var h uint16
+	for s.find(h) >= 0 {
+		h++
+	}
+	return h
+}
+
+// addr returns the guest address of record i in the table.
+func (s *SMBIOS) addr(i int) uint64 {
+	var off int
+	for _, r := range s.recs[:i] {
+		off += len(r.Marshal())
+	}
+	return uint64(s.up) + smbiosTable + uint64(off)
+}
+
+// insert adds r before the end-of-table record, which must stay last.
+func (s *SMBIOS) insert(r *smbios.Record) {
+	i := len(s.recs)
+	if i > 0 && s.recs[i-1].Type == smbios.TypeEnd {
+		i--
+	}
+	s.recs = append(s.recs[:i], append([]*smbios.Record{r}, s.recs[i:]...)...)
+}
+
+// readRecord reads an SMBIOS record from the guest. We don't know how
+// long it is until we find the double NUL at the end of the strings.
+func readRecord(t trace.Trace, addr uintptr) (*smbios.Record, error) {
+	var b []byte
+	var chunk [256]byte
+	for len(b) < smbiosTableMax {
+		if err := t.Read(addr+uintptr(len(b)), chunk[:]); err != nil {
+			return nil, err
+		}
+		b = append(b, chunk[:]...)
+		if len(b) < int(b[1]) || bytes.Index(b[b[1]:], []byte{0, 0}) < 0 {
+			continue
+		}
+		r, _, err := smbios.Unmarshal(b)
+		return r, err
+	}
+	return nil, fmt.Errorf("SMBIOS record at %#x: no end in %d bytes", addr, len(b))
+}
+
+// Aliases implements Aliases
+func (s *SMBIOS) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (s *SMBIOS) Base() ServBase {
+	return s.u
+}
+
+// Ptr implements service.Ptr
+func (s *SMBIOS) Ptr() ServPtr {
+	return s.up
+}
+
+// Call implements service.Call
+func (s *SMBIOS) Call(f *Fault) error {
+	op := f.Op
+	Debug("SMBIOS services: %v(%#x), arg type %T, args %v", table.SMBIOSServiceNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	switch op {
+	case table.SMBIOSAdd:
+		// EFI_STATUS Add (IN CONST EFI_SMBIOS_PROTOCOL *This, IN EFI_HANDLE ProducerHandle OPTIONAL,
+		//   IN OUT EFI_SMBIOS_HANDLE *SmbiosHandle, IN EFI_SMBIOS_TABLE_HEADER *Record);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		if f.Args[2] == 0 || f.Args[3] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		var hb [2]byte
+		if err := f.Proc.Read(f.Args[2], hb[:]); err != nil {
+			return fmt.Errorf("Can't read SMBIOS handle at %#x: %v", f.Args[2], err)
+		}
+		r, err := readRecord(f.Proc, f.Args[3])
+		if err != nil {
+			Debug("SMBIOS Add: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		h := binary.LittleEndian.Uint16(hb[:])
+		switch {
+		case h == smbios.HandleReserved:
+			h = s.newHandle()
+		case s.find(h) >= 0:
+			f.Regs.Rax = uefi.EFI_ALREADY_STARTED
+			return nil
+		}
+		r.Handle = h
+		s.insert(r)
+		if err := s.write(f.Proc.Tab()); err != nil {
+			Debug("SMBIOS Add: %v", err)
+			i := s.find(h)
+			s.recs = append(s.recs[:i], s.recs[i+1:]...)
+			f.Regs.Rax = uefi.EFI_OUT_OF_RESOURCES
+			return nil
+		}
+		s.producers[h] = uint64(f.Args[1])
+		binary.LittleEndian.PutUint16(hb[:], h)
+		if err := f.Proc.Write(f.Args[2], hb[:]); err != nil {
+			return fmt.Errorf("Can't write SMBIOS handle to %#x: %v", f.Args[2], err)
+		}
+		Debug("SMBIOS Add: %v", r)
+	case table.SMBIOSUpdateString:
+		// EFI_STATUS UpdateString (IN CONST EFI_SMBIOS_PROTOCOL *This, IN EFI_SMBIOS_HANDLE *SmbiosHandle,
+		//   IN UINTN *StringNumber, IN CHAR8 *String);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		var hb [2]byte
+		if err := f.Proc.Read(f.Args[1], hb[:]); err != nil {
+			return fmt.Errorf("Can't read SMBIOS handle at %#x: %v", f.Args[1], err)
+		}
+		h := binary.LittleEndian.Uint16(hb[:])
+		n, err := trace.ReadWord(f.Proc, f.Args[2])
+		if err != nil {
+			return fmt.Errorf("Can't read string number at %#x: %v", f.Args[2], err)
+		}
+		str, err := trace.ReadCString(f.Proc, f.Args[3])
+		if err != nil {
+			return err
+		}
+		i := s.find(h)
+		if i < 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		if err := s.recs[i].SetString(int(n), str); err != nil {
+			Debug("SMBIOS UpdateString: %v", err)
+			f.Regs.Rax = uefi.EFI_NOT_FOUND
+			return nil
+		}
+		if err := s.write(f.Proc.Tab()); err != nil {
+			Debug("SMBIOS UpdateString: %v", err)
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+		}
+	case table.SMBIOSRemove:
+		// EFI_STATUS Remove (IN CONST EFI_SMBIOS_PROTOCOL *This, IN EFI_SMBIOS_HANDLE SmbiosHandle);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		h := uint16(f.Args[1])
+		i := s.find(h)
+		// The end-of-table record is ours, and must stay.
+		if i < 0 || s.recs[i].Type == smbios.TypeEnd {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		s.recs = append(s.recs[:i], s.recs[i+1:]...)
+		delete(s.producers, h)
+		if err := s.write(f.Proc.Tab()); err != nil {
+			return err
+		}
+	case table.SMBIOSGetNext:
+		// EFI_STATUS GetNext (IN CONST EFI_SMBIOS_PROTOCOL *This, IN OUT EFI_SMBIOS_HANDLE *SmbiosHandle,
+		//   IN EFI_SMBIOS_TYPE *Type OPTIONAL, OUT EFI_SMBIOS_TABLE_HEADER **Record,
+		//   OUT EFI_HANDLE *ProducerHandle OPTIONAL);
+		f.Args = trace.Args(f.Proc, f.Regs, 5)
+		var hb [2]byte
+		if err := f.Proc.Read(f.Args[1], hb[:]); err != nil {
+			return fmt.Errorf("Can't read SMBIOS handle at %#x: %v", f.Args[1], err)
+		}
+		h := binary.LittleEndian.Uint16(hb[:])
+		start := 0
+		if h != smbios.HandleReserved {
+			if start = s.find(h); start < 0 {
+				f.Regs.Rax = uefi.EFI_NOT_FOUND
+				return nil
+			}
+			start++
+		}
+		want := -1
+		if f.Args[2] != 0 {
+			var t [1]byte
+			if err := f.Proc.Read(f.Args[2], t[:]); err != nil {
+				return fmt.Errorf("Can't read SMBIOS type at %#x: %v", f.Args[2], err)
+			}
+			want = int(t[0])
+		}
+		next := -1
+		for i := start; i < len(s.recs); i++ {
+			if want < 0 || int(s.recs[i].Type) == want {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			binary.LittleEndian.PutUint16(hb[:], smbios.HandleReserved)
+			if err := f.Proc.Write(f.Args[1], hb[:]); err != nil {
+				return fmt.Errorf("Can't write SMBIOS handle to %#x: %v", f.Args[1], err)
+			}
+			f.Regs.Rax = uefi.EFI_NOT_FOUND
+			return nil
+		}
+		binary.LittleEndian.PutUint16(hb[:], s.recs[next].Handle)
+		if err := f.Proc.Write(f.Args[1], hb[:]); err != nil {
+			return fmt.Errorf("Can't write SMBIOS handle to %#x: %v", f.Args[1], err)
+		}
+		if err := trace.WriteWord(f.Proc, f.Args[3], s.addr(next)); err != nil {
+			return fmt.Errorf("Can't write SMBIOS record pointer to %#x: %v", f.Args[3], err)
+		}
+		if f.Args[4] != 0 {
+			if err := trace.WriteWord(f.Proc, f.Args[4], s.producers[s.recs[next].Handle]); err != nil {
+				return fmt.Errorf("Can't write producer handle to %#x: %v", f.Args[4], err)
+			}
+		}
+	default:
+		log.Panicf("unsupported SMBIOS Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (s *SMBIOS) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/uefi"
+	"github.com/linuxboot/voodoo/uefi/smbios"
+)
+
+// newTestSMBIOS returns an SMBIOS service with the default platform,
+// at the start of the services table.
+func newTestSMBIOS(t *testing.T) *SMBIOS {
+	t.Helper()
+	recs, err := smbios.Default().Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SMBIOS{up: 0xff000000, recs: recs, producers: map[uint16]uint64{}}
+}
+
+func TestSMBIOSUpdateString(t *testing.T) {
+	const hp, np, sp = 0x1000, 0x1100, 0x1200
+	f := newFault(table.SMBIOSUpdateString, 0, hp, np, sp)
+	s := newTestSMBIOS(t)
+	r := s.recs[0]
+	// The handle is a UINT16; what follows it is not ours to read.
+	f.Proc.Write(hp, []byte{byte(r.Handle), byte(r.Handle >> 8), 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa})
+	f.Proc.Write(np, []byte{1})
+	f.Proc.Write(sp, []byte("voodoo\x00"))
+	if err := s.Call(f); err != nil {
+		t.Fatalf("UpdateString: got %v, want nil", err)
+	}
+	if f.Regs.Rax != uefi.EFI_SUCCESS {
+		t.Fatalf("UpdateString: got %#x, want EFI_SUCCESS", f.Regs.Rax)
+	}
+	if r.Strings[0] != "voodoo" {
+		t.Errorf("UpdateString: string 1 is %q, want %q", r.Strings[0], "voodoo")
+	}
+}
+
+func TestSMBIOSRemove(t *testing.T) {
+	s := newTestSMBIOS(t)
+	n := len(s.recs)
+	end := s.recs[n-1]
+	if end.Type != smbios.TypeEnd {
+		t.Fatalf("last record: got type %d, want %d", end.Type, smbios.TypeEnd)
+	}
+	f := newFault(table.SMBIOSRemove, 0, uint64(end.Handle))
+	if err := s.Call(f); err != nil {
+		t.Fatalf("Remove: got %v, want nil", err)
+	}
+	if f.Regs.Rax != uefi.EFI_INVALID_PARAMETER || len(s.recs) != n {
+		t.Errorf("Remove of the end-of-table record: got %#x, %d records, want EFI_INVALID_PARAMETER, %d", f.Regs.Rax, len(s.recs), n)
+	}
+	setCall(f, table.SMBIOSRemove, 0, uint64(s.recs[0].Handle))
+	if err := s.Call(f); err != nil {
+		t.Fatalf("Remove: got %v, want nil", err)
+	}
+	if f.Regs.Rax != uefi.EFI_SUCCESS || len(s.recs) != n-1 {
+		t.Errorf("Remove: got %#x, %d records, want EFI_SUCCESS, %d", f.Regs.Rax, len(s.recs), n-1)
+	}
+}
@@ -19,8 +19,19 @@ type SystemTable struct {
 var (
 	st         = &SystemTable{}
 	_  Service = &SystemTable{}
+	// configTable is the 64K that holds the EFI_CONFIGURATION_TABLE array.
+	// That's room for thousands of entries. Nobody has that many.
+	configTable   ServPtr
+	configEntries []configEntry
 )
 
+// configEntry is one EFI_CONFIGURATION_TABLE entry.
+// The pointer is whatever the installer gave us; we never look at it.
+type configEntry struct {
+	g guid.GUID
+	p uint64
+}
+
 func init() {
 }
 
@@ -52,6 +63,17 @@ func NewSystemtable(tab []byte) (uint64, uint64, error) {
 		log.Panicf("LoadedImageProtocol service: %v", err)
 	}
 	Debug("Set up LoadedImageService %v at %#08x", uefi.LoadedImageProtocol, li)
+
+	// The configuration table has to be there before the services,
+	// since some of them (e.g. SMBIOS) install tables.
+	configTable = bumpAllocate(uintptr(allocAmt), "configuration table")
+	writeConfigTable(tab)
+
+	// Guest functions we call return to the callback service.
+	if _, err := Base(tab, "callback"); err != nil {
+		log.Fatal(err)
+	}
+
 	for _, t := range []struct {
 		n                 string
 		systemTableOffset uint64
@@ -90,9 +112,10 @@ func NewSystemtable(tab []byte) (uint64, uint64, error) {
 	}
 
 	h := newHandle()
-	// ConsoleSupportTest_SimpleTextInputExProtocolTestGUID ... wtf
-	// who designs this stuff.
-	if err := h.Put(uefi.ConInGUID, uefi.ConsoleSupportTest_SimpleTextInputExProtocolTestGUID); err != nil {
+	if err := h.Put(uefi.ConInGUID); err != nil {
+		log.Fatal(err)
+	}
+	if err := h.Put(uefi.ConsoleSupportTest_SimpleTextInputExProtocolTestGUID); err != nil {
 		log.Fatal(err)
 	}
 	binary.LittleEndian.PutUint64(tab[table.ConInHandle+uint64(x):], uint64(h.hd))
@@ -101,6 +124,10 @@ func NewSystemtable(tab []byte) (uint64, uint64, error) {
 	if err := h.Put(uefi.ConOutGUID); err != nil {
 		log.Fatal(err)
 	}
+	// As on real machines, the GOP is on the console out handle.
+	if err := h.Put(uefi.GOPGUID); err != nil {
+		log.Fatal(err)
+	}
 	binary.LittleEndian.PutUint64(tab[table.ConOutHandle+uint64(x):], uint64(h.hd))
 
 	h = newHandle()
@@ -109,10 +136,88 @@ func NewSystemtable(tab []byte) (uint64, uint64, error) {
 	}
 	binary.LittleEndian.PutUint64(tab[table.StdErrHandle+uint64(x):], uint64(h.hd))
 
+	h = newHandle()
+	if err := h.Put(uefi.SerialIOGUID); err != nil {
+		log.Fatal(err)
+	}
+
+	h = newHandle()
+	if err := h.Put(uefi.UnicodeCollationGUID); err != nil {
+		log.Fatal(err)
+	}
+	if err := h.Put(uefi.UnicodeCollation2GUID); err != nil {
+		log.Fatal(err)
+	}
+
+	h = newHandle()
+	if err := h.Put(uefi.DevicePathToTextGUID); err != nil {
+		log.Fatal(err)
+	}
+	if err := h.Put(uefi.DevicePathFromTextGUID); err != nil {
+		log.Fatal(err)
+	}
+	if err := h.Put(uefi.DevicePathUtilitiesGUID); err != nil {
+		log.Fatal(err)
+	}
+
+	h = newHandle()
+	if err := h.Put(uefi.EBCGUID); err != nil {
+		log.Fatal(err)
+	}
+
+	if fmpConfig != nil {
+		h = newHandle()
+		if err := h.Put(uefi.FMPGUID); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Now try the one function we know about.
 	return uint64(u), uint64(ih.hd), nil
 }
 
+// writeConfigTable writes the configuration table array and points the
+// system table at it.
+func writeConfigTable(tab []byte) {
+	x := index(st.up)
+	c := index(configTable)
+	for i, e := range configEntries {
+		o := c + uint32(i*table.ConfigurationTableSize)
+		copy(tab[o:], e.g[:])
+		binary.LittleEndian.PutUint64(tab[o+16:], e.p)
+	}
+	binary.LittleEndian.PutUint64(tab[x+table.NumberOfTableEntries:], uint64(len(configEntries)))
+	binary.LittleEndian.PutUint64(tab[x+table.ConfigurationTable:], uint64(configTable))
+}
+
+// InstallConfigurationTable adds, replaces, or, if p is 0, removes
+// the configuration table for a GUID. It returns an EFI status,
+// since the boot service of the same name just hands it back.
+func InstallConfigurationTable(tab []byte, g guid.GUID, p uint64) uintptr {
+	for i, e := range configEntries {
+		if e.g != g {
+			continue
+		}
+		if p == 0 {
+			configEntries = append(configEntries[:i], configEntries[i+1:]...)
+		} else {
+			configEntries[i].p = p
+		}
+		writeConfigTable(tab)
+		return uefi.EFI_SUCCESS
+	}
+	if p == 0 {
+		return uefi.EFI_NOT_FOUND
+	}
+	if (len(configEntries)+1)*table.ConfigurationTableSize > int(allocAmt) {
+		return uefi.EFI_OUT_OF_RESOURCES
+	}
+	Debug("InstallConfigurationTable: %s at %#x", g, p)
+	configEntries = append(configEntries, configEntry{g: g, p: p})
+	writeConfigTable(tab)
+	return uefi.EFI_SUCCESS
+}
+
 // Aliases implements Aliases
 func (s *SystemTable) Aliases() []string {
 	return nil
@@ -4,10 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/console"
 	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
 	"github.com/linuxboot/voodoo/uefi"
 )
 
@@ -15,13 +16,12 @@ import (
 type TextIn struct {
 	u  ServBase
 	up ServPtr
+	// waitForKey is signaled when there is a key.
+	waitForKey *Event
 }
 
 var _ Service = &TextIn{}
 
-// TODO: probably get rid of these aliases?
-var tiAliases = []string{uefi.ConsoleSupportTest_SimpleTextInputExProtocolTest}
-
 func init() {
 	RegisterCreator(uefi.ConInGUID.String(), NewTextIn)
 }
@@ -36,12 +36,26 @@ func NewTextIn(tab []byte, u ServPtr) (Service, error) {
 		Debug("Install %#x at off %#x", r, x)
 		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
 	}
-	return &TextIn{u: ServBase(u.String()), up: u}, nil
+	// WaitForKey is not a function, it is an event.
+	e := newEvent(uefi.EVT_NOTIFY_WAIT, uefi.TPL_NOTIFY, 0, 0)
+	e.ready = func() bool { return keyboard.Pending() }
+	binary.LittleEndian.PutUint64(tab[base+table.STInWaitForKey:], uint64(e.ev))
+	return &TextIn{u: ServBase(u.String()), up: u, waitForKey: e}, nil
+}
+
+// inputKey returns an EFI_INPUT_KEY for k.
+func inputKey(k console.Key) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint16(b[:], k.Scan)
+	if k.Char <= 0xffff {
+		binary.LittleEndian.PutUint16(b[2:], uint16(k.Char))
+	}
+	return b[:]
 }
 
 // Aliases implements Aliases
 func (t *TextIn) Aliases() []string {
-	return tiAliases
+	return nil
 }
 
 // Base implements service.Base
@@ -61,18 +75,21 @@ func (t *TextIn) Call(f *Fault) error {
 	f.Regs.Rax = uefi.EFI_SUCCESS
 	switch op {
 	case table.STInReset:
+		// EFI_STATUS Reset (IN EFI_SIMPLE_TEXT_INPUT_PROTOCOL *This, IN BOOLEAN ExtendedVerification);
+		keyboard.Reset()
+		t.waitForKey.signaled = false
 	case table.STInReadKeyStroke:
-		var b [1]byte
-		if _, err := os.Stdin.Read(b[:]); err != nil {
-			log.Printf("StdinRead fails: %v", err)
-		}
-	case table.STInWaitForKey:
-		var b [1]byte
-		if _, err := os.Stdin.Read(b[:]); err != nil {
-			log.Printf("StdinRead fails: %v", err)
-		}
+		// EFI_STATUS ReadKeyStroke (IN EFI_SIMPLE_TEXT_INPUT_PROTOCOL *This, OUT EFI_INPUT_KEY *Key);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		p := f.Args[1]
+		return readKey(f, func(f *Fault, k console.Key) error {
+			if err := f.Proc.Write(p, inputKey(k)); err != nil {
+				return fmt.Errorf("Can't write key to %#x: %v", p, err)
+			}
+			return nil
+		})
 	default:
-		log.Panicf("unsup textout Call: %#x", op)
+		log.Panicf("unsup textin Call: %#x", op)
 		f.Regs.Rax = uefi.EFI_UNSUPPORTED
 	}
 	return nil
@@ -0,0 +1,273 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/console"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// TextInEx implements Service
+type TextInEx struct {
+	u  ServBase
+	up ServPtr
+	// waitForKeyEx is signaled when there is a key.
+	waitForKeyEx *Event
+}
+
+// keyNotify is a function registered with RegisterKeyNotify.
+type keyNotify struct {
+	handle uint64
+	key    [keyDataSize]byte
+	fn     uintptr
+}
+
+// keyDataSize is the size of EFI_KEY_DATA: an EFI_INPUT_KEY, then
+// the EFI_KEY_STATE, a UINT32 shift state and a UINT8 toggle state.
+const keyDataSize = 12
+
+var (
+	_ Service = &TextInEx{}
+	// keyNotifies are called, in the order they were registered,
+	// when a matching key comes in.
+	keyNotifies []*keyNotify
+	notifybase  = uint64(0x6e0f1f1e00000000)
+	// toggleState is what SetState set.
+	toggleState uint8 = uefi.EFI_TOGGLE_STATE_VALID
+	// keyData is where notify functions get their EFI_KEY_DATA.
+	keyData ServPtr
+)
+
+func init() {
+	RegisterGUIDCreator(uefi.ConsoleSupportTest_SimpleTextInputExProtocolTest, NewTextInEx)
+}
+
+// NewTextInEx returns a TextInEx Service
+func NewTextInEx(tab []byte, u ServPtr) (Service, error) {
+	Debug("textinex services table u is %#x", u)
+	base := int(u) & 0xffffff
+	for p := range table.SimpleTextInExServicesNames {
+		x := base + int(p)
+		r := uint64(p) + 0xff400000 + uint64(base)
+		Debug("Install %#x at off %#x", r, x)
+		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
+	}
+	// WaitForKeyEx is not a function, it is an event.
+	e := newEvent(uefi.EVT_NOTIFY_WAIT, uefi.TPL_NOTIFY, 0, 0)
+	e.ready = func() bool { return keyboard.Pending() }
+	binary.LittleEndian.PutUint64(tab[base+table.STInExWaitForKeyEx:], uint64(e.ev))
+	keyData = u + table.STInExKeyData
+	return &TextInEx{u: u.Base(), up: u, waitForKeyEx: e}, nil
+}
+
+// keyState returns the EFI_KEY_DATA for k.
+func keyState(k console.Key) [keyDataSize]byte {
+	var b [keyDataSize]byte
+	copy(b[:], inputKey(k))
+	shift := uint32(uefi.EFI_SHIFT_STATE_VALID)
+	if k.Shift {
+		shift |= uefi.EFI_LEFT_SHIFT_PRESSED
+	}
+	if k.Ctrl {
+		shift |= uefi.EFI_LEFT_CONTROL_PRESSED
+	}
+	if k.Alt {
+		shift |= uefi.EFI_LEFT_ALT_PRESSED
+	}
+	binary.LittleEndian.PutUint32(b[4:], shift)
+	b[8] = toggleState
+	return b
+}
+
+// match says whether a key, as EFI_KEY_DATA, is one n wants.
+// As in edk2, the states only count if they are marked valid.
+func (n *keyNotify) match(b [keyDataSize]byte) bool {
+	if binary.LittleEndian.Uint32(n.key[:]) != binary.LittleEndian.Uint32(b[:]) {
+		return false
+	}
+	if s := binary.LittleEndian.Uint32(n.key[4:]); s&uefi.EFI_SHIFT_STATE_VALID != 0 && s != binary.LittleEndian.Uint32(b[4:]) {
+		return false
+	}
+	if t := n.key[8]; t&uefi.EFI_TOGGLE_STATE_VALID != 0 && t != b[8] {
+		return false
+	}
+	return true
+}
+
+// readKey takes a key from the keyboard, and calls then with it.
+// If there is no key, the status is EFI_NOT_READY. Guests poll with it,
+// so notify timers that went off, and key notify functions for keys
+// that came in, run first.
+func readKey(f *Fault, then func(f *Fault, k console.Key) error) error {
+	return fireTimers(f, func(f *Fault) error {
+		return popKey(f, then)
+	})
+}
+
+// popKey is readKey, once the notify functions have run.
+func popKey(f *Fault, then func(f *Fault, k console.Key) error) error {
+	k, ok := keyboard.Pop()
+	if !ok {
+		idle()
+		f.Regs.Rax = uefi.EFI_NOT_READY
+		return nil
+	}
+	Debug("readKey: %v", k)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return then(f, k)
+}
+
+// keysDue says whether keys came in that notify functions may want,
+// and that they may be called for at the current TPL.
+func keysDue() bool {
+	return len(keyNotifies) > 0 && tpl < uefi.TPL_CALLBACK && keyboard.Arriving()
+}
+
+// notifyKeys calls the notify functions that want the keys that came in
+// since it last ran, one after the other. The keyboard driver does this
+// when it gets a key, whether or not the key is ever read, at
+// TPL_CALLBACK; so it waits while the TPL is that or above. Then it
+// calls then.
+func notifyKeys(f *Fault, then func(f *Fault) error) error {
+	poll()
+	if !keysDue() {
+		return then(f)
+	}
+	type call struct {
+		fn uintptr
+		kd [keyDataSize]byte
+	}
+	var calls []call
+	for _, k := range keyboard.Arrived() {
+		kd := keyState(k)
+		for _, n := range keyNotifies {
+			if n.match(kd) {
+				calls = append(calls, call{fn: n.fn, kd: kd})
+			}
+		}
+	}
+	old := tpl
+	tpl = uefi.TPL_CALLBACK
+	var next func(f *Fault) error
+	next = func(f *Fault) error {
+		if len(calls) == 0 {
+			tpl = old
+			return then(f)
+		}
+		c := calls[0]
+		calls = calls[1:]
+		Debug("notifyKeys: %#x for %#x", c.fn, c.kd)
+		// The notify function could change it, so write it every time.
+		copy(f.Proc.Tab()[index(keyData):], c.kd[:])
+		return callGuest(f, c.fn, next, uint64(keyData))
+	}
+	return next(f)
+}
+
+// Aliases implements Aliases
+func (t *TextInEx) Aliases() []string {
+	return nil
+}
+
+// Base implements service.Base
+func (t *TextInEx) Base() ServBase {
+	return t.u
+}
+
+// Ptr implements service.Ptr
+func (t *TextInEx) Ptr() ServPtr {
+	return t.up
+}
+
+// Call implements service.Call
+func (t *TextInEx) Call(f *Fault) error {
+	op := f.Op
+	Debug("TextInEx services: %v(%#x), arg type %T, args %v", table.SimpleTextInExServicesNames[uint64(op)], op, f.Inst.Args, f.Inst.Args)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	switch op {
+	case table.STInExReset:
+		// EFI_STATUS Reset (IN EFI_SIMPLE_TEXT_INPUT_EX_PROTOCOL *This, IN BOOLEAN ExtendedVerification);
+		keyboard.Reset()
+		t.waitForKeyEx.signaled = false
+	case table.STInExReadKeyStrokeEx:
+		// EFI_STATUS ReadKeyStrokeEx (IN EFI_SIMPLE_TEXT_INPUT_EX_PROTOCOL *This, OUT EFI_KEY_DATA *KeyData);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		if f.Args[1] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		p := f.Args[1]
+		return readKey(f, func(f *Fault, k console.Key) error {
+			kd := keyState(k)
+			if err := f.Proc.Write(p, kd[:]); err != nil {
+				return fmt.Errorf("Can't write key data to %#x: %v", p, err)
+			}
+			return nil
+		})
+	case table.STInExSetState:
+		// EFI_STATUS SetState (IN EFI_SIMPLE_TEXT_INPUT_EX_PROTOCOL *This, IN EFI_KEY_TOGGLE_STATE *KeyToggleState);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		var b [1]byte
+		if err := f.Proc.Read(f.Args[1], b[:]); err != nil {
+			return fmt.Errorf("Can't read toggle state at %#x: %v", f.Args[1], err)
+		}
+		if b[0]&uefi.EFI_TOGGLE_STATE_VALID == 0 {
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+			return nil
+		}
+		toggleState = b[0]
+	case table.STInExRegisterKeyNotify:
+		// EFI_STATUS RegisterKeyNotify (IN EFI_SIMPLE_TEXT_INPUT_EX_PROTOCOL *This, IN EFI_KEY_DATA *KeyData,
+		//   IN EFI_KEY_NOTIFY_FUNCTION KeyNotificationFunction, OUT VOID **NotifyHandle);
+		f.Args = trace.Args(f.Proc, f.Regs, 4)
+		if f.Args[1] == 0 || f.Args[2] == 0 || f.Args[3] == 0 {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		n := &keyNotify{fn: f.Args[2]}
+		if err := f.Proc.Read(f.Args[1], n.key[:]); err != nil {
+			return fmt.Errorf("Can't read key data at %#x: %v", f.Args[1], err)
+		}
+		// Registering the same thing twice gets the same handle.
+		for _, o := range keyNotifies {
+			if o.fn == n.fn && o.key == n.key {
+				n = o
+			}
+		}
+		if n.handle == 0 {
+			notifybase++
+			n.handle = notifybase
+			keyNotifies = append(keyNotifies, n)
+		}
+		Debug("RegisterKeyNotify: %#x for %#x, handle %#x", n.fn, n.key, n.handle)
+		if err := trace.WriteWord(f.Proc, f.Args[3], n.handle); err != nil {
+			return fmt.Errorf("Can't write notify handle to %#x: %v", f.Args[3], err)
+		}
+	case table.STInExUnregisterKeyNotify:
+		// EFI_STATUS UnregisterKeyNotify (IN EFI_SIMPLE_TEXT_INPUT_EX_PROTOCOL *This, IN VOID *NotificationHandle);
+		f.Args = trace.Args(f.Proc, f.Regs, 2)
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		for i, n := range keyNotifies {
+			if n.handle == uint64(f.Args[1]) {
+				keyNotifies = append(keyNotifies[:i], keyNotifies[i+1:]...)
+				f.Regs.Rax = uefi.EFI_SUCCESS
+				break
+			}
+		}
+	default:
+		log.Panicf("unsup textinex Call: %#x", op)
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+	}
+	return nil
+}
+
+// OpenProtocol implements service.OpenProtocol
+func (t *TextInEx) OpenProtocol(f *Fault, h *Handle, g guid.GUID, ptr uintptr, ah, ch *Handle, attr uintptr) (*dispatch, error) {
+	log.Panicf("here we are")
+	return nil, fmt.Errorf("not yet")
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/linuxboot/voodoo/console"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// textInExCall calls the SimpleTextInputEx service op with args, and
+// plays the guest, with fns, for the guest calls it makes. It returns
+// the status.
+func textInExCall(t *testing.T, f *Fault, fns map[uint64]func(f *Fault) uint64, op Func, args ...uint64) uint64 {
+	t.Helper()
+	setCall(f, op, args...)
+	if err := (&TextInEx{}).Call(f); err != nil {
+		t.Fatalf("%s: got %v, want nil", table.SimpleTextInExServicesNames[uint64(op)], err)
+	}
+	runGuest(t, f, fns)
+	return f.Regs.Rax
+}
+
+// keyDataOf returns EFI_KEY_DATA with a key and states.
+func keyDataOf(scan uint16, char rune, shift uint32, toggle uint8) [keyDataSize]byte {
+	var b [keyDataSize]byte
+	binary.LittleEndian.PutUint16(b[:], scan)
+	binary.LittleEndian.PutUint16(b[2:], uint16(char))
+	binary.LittleEndian.PutUint32(b[4:], shift)
+	b[8] = toggle
+	return b
+}
+
+func TestKeyState(t *testing.T) {
+	toggleState = uefi.EFI_TOGGLE_STATE_VALID
+	const valid = uefi.EFI_SHIFT_STATE_VALID
+	for _, tt := range []struct {
+		k    console.Key
+		want [keyDataSize]byte
+	}{
+		{console.Key{Char: 'a'}, keyDataOf(0, 'a', valid, uefi.EFI_TOGGLE_STATE_VALID)},
+		{console.Key{Char: 'A', Shift: true}, keyDataOf(0, 'A', valid|uefi.EFI_LEFT_SHIFT_PRESSED, uefi.EFI_TOGGLE_STATE_VALID)},
+		{console.Key{Char: 'c', Ctrl: true}, keyDataOf(0, 'c', valid|uefi.EFI_LEFT_CONTROL_PRESSED, uefi.EFI_TOGGLE_STATE_VALID)},
+		{console.Key{Scan: console.ScanUp, Alt: true}, keyDataOf(console.ScanUp, 0, valid|uefi.EFI_LEFT_ALT_PRESSED, uefi.EFI_TOGGLE_STATE_VALID)},
+	} {
+		if got := keyState(tt.k); got != tt.want {
+			t.Errorf("keyState(%v): got %#x, want %#x", tt.k, got, tt.want)
+		}
+	}
+}
+
+func TestKeyNotify(t *testing.T) {
+	const kdp, fnp, hp, sp = 0x1000, 0x1100, 0x1200, 0x1300
+	const notifyA, notifyShiftB, notifyCaps = 0x3000, 0x3008, 0x3010
+	f := newFault(0)
+	events, tpl = map[evt]*Event{}, uefi.TPL_APPLICATION
+	keyboard, keyNotifies, toggleState = console.NewKeyboard(), nil, uefi.EFI_TOGGLE_STATE_VALID
+	keyData = 0xff000100
+	var got []rune
+	var seen [keyDataSize]byte
+	note := func(f *Fault) uint64 {
+		if f.Regs.Rcx != uint64(keyData) {
+			t.Errorf("notify: got key data at %#x, want %#x", f.Regs.Rcx, keyData)
+		}
+		if tpl != uefi.TPL_CALLBACK {
+			t.Errorf("notify: got TPL %d, want %d", tpl, uefi.TPL_CALLBACK)
+		}
+		copy(seen[:], memTab[index(keyData):])
+		got = append(got, rune(binary.LittleEndian.Uint16(seen[2:])))
+		return 0
+	}
+	fns := map[uint64]func(f *Fault) uint64{notifyA: note, notifyShiftB: note, notifyCaps: note}
+
+	// No states: any a. Valid shift state: only B with shift.
+	// Valid toggle state: only C with caps lock.
+	for _, r := range []struct {
+		fn uint64
+		kd [keyDataSize]byte
+	}{
+		{notifyA, keyDataOf(0, 'a', 0, 0)},
+		{notifyShiftB, keyDataOf(0, 'B', uefi.EFI_SHIFT_STATE_VALID|uefi.EFI_LEFT_SHIFT_PRESSED, 0)},
+		{notifyCaps, keyDataOf(0, 'C', 0, uefi.EFI_TOGGLE_STATE_VALID|uefi.EFI_CAPS_LOCK_ACTIVE)},
+	} {
+		f.Proc.Write(kdp, r.kd[:])
+		if s := textInExCall(t, f, fns, table.STInExRegisterKeyNotify, 0, kdp, r.fn, hp); s != uefi.EFI_SUCCESS {
+			t.Fatalf("RegisterKeyNotify(%#x): got %#x, want EFI_SUCCESS", r.fn, s)
+		}
+	}
+
+	// Keys come in; the guest only stalls, and the notifies run anyway.
+	keyboard.Push(console.Key{Char: 'a'}, console.Key{Char: 'B'}, console.Key{Char: 'B', Shift: true}, console.Key{Char: 'C', Shift: true})
+	bootCall(t, f, fns, table.Stall, 0)
+	if string(got) != "aB" {
+		t.Errorf("Stall: got notifies for %q, want %q", string(got), "aB")
+	}
+	if want := keyDataOf(0, 'B', uefi.EFI_SHIFT_STATE_VALID|uefi.EFI_LEFT_SHIFT_PRESSED, uefi.EFI_TOGGLE_STATE_VALID); seen != want {
+		t.Errorf("notify: got key data %#x, want %#x", seen, want)
+	}
+
+	// Reading them does not notify again.
+	got = nil
+	if s := textInExCall(t, f, fns, table.STInExReadKeyStrokeEx, 0, fnp); s != uefi.EFI_SUCCESS {
+		t.Fatalf("ReadKeyStrokeEx: got %#x, want EFI_SUCCESS", s)
+	}
+	var kd [keyDataSize]byte
+	f.Proc.Read(fnp, kd[:])
+	if want := keyDataOf(0, 'a', uefi.EFI_SHIFT_STATE_VALID, uefi.EFI_TOGGLE_STATE_VALID); kd != want {
+		t.Errorf("ReadKeyStrokeEx: got %#x, want %#x", kd, want)
+	}
+	if len(got) != 0 {
+		t.Errorf("ReadKeyStrokeEx: got notifies for %q, want none", string(got))
+	}
+
+	// SetState needs a valid state; with caps lock, C matches.
+	f.Proc.Write(sp, []byte{uefi.EFI_CAPS_LOCK_ACTIVE})
+	if s := textInExCall(t, f, fns, table.STInExSetState, 0, sp); s != uefi.EFI_UNSUPPORTED {
+		t.Errorf("SetState without EFI_TOGGLE_STATE_VALID: got %#x, want EFI_UNSUPPORTED", s)
+	}
+	f.Proc.Write(sp, []byte{uefi.EFI_TOGGLE_STATE_VALID | uefi.EFI_CAPS_LOCK_ACTIVE})
+	if s := textInExCall(t, f, fns, table.STInExSetState, 0, sp); s != uefi.EFI_SUCCESS {
+		t.Errorf("SetState: got %#x, want EFI_SUCCESS", s)
+	}
+	keyboard.Push(console.Key{Char: 'C', Shift: true})
+	bootCall(t, f, fns, table.Stall, 0)
+	if string(got) != "C" {
+		t.Errorf("Stall with caps lock: got notifies for %q, want %q", string(got), "C")
+	}
+	if seen[8] != uefi.EFI_TOGGLE_STATE_VALID|uefi.EFI_CAPS_LOCK_ACTIVE {
+		t.Errorf("notify: got toggle state %#x, want %#x", seen[8], uefi.EFI_TOGGLE_STATE_VALID|uefi.EFI_CAPS_LOCK_ACTIVE)
+	}
+
+	// Not at TPL_CALLBACK; RestoreTPL lets them run.
+	got = nil
+	bootCall(t, f, fns, table.RaiseTPL, uefi.TPL_CALLBACK)
+	keyboard.Push(console.Key{Char: 'a'})
+	bootCall(t, f, fns, table.Stall, 0)
+	if len(got) != 0 {
+		t.Errorf("Stall at TPL_CALLBACK: got notifies for %q, want none", string(got))
+	}
+	bootCall(t, f, fns, table.RestoreTPL, uefi.TPL_APPLICATION)
+	if string(got) != "a" {
+		t.Errorf("RestoreTPL: got notifies for %q, want %q", string(got), "a")
+	}
+
+	// Unregistered, it is not called.
+	got = nil
+	h, _ := trace.ReadWord(f.Proc, hp)
+	if s := textInExCall(t, f, fns, table.STInExUnregisterKeyNotify, 0, h); s != uefi.EFI_SUCCESS {
+		t.Errorf("UnregisterKeyNotify: got %#x, want EFI_SUCCESS", s)
+	}
+	keyboard.Push(console.Key{Char: 'C', Shift: true})
+	bootCall(t, f, fns, table.Stall, 0)
+	if len(got) != 0 {
+		t.Errorf("Stall after UnregisterKeyNotify: got notifies for %q, want none", string(got))
+	}
+}
@@ -1,24 +1,17 @@
 package services
 
 import (
-	"encoding/binary"
 	"fmt"
 	"log"
 
 	"github.com/linuxboot/fiano/pkg/guid"
-	"github.com/linuxboot/voodoo/table"
 )
 
-// TextMode implements Service
+// TextMode implements Service. It is only there to reserve space for
+// the SIMPLE_TEXT_OUTPUT_MODE struct, which TextOut keeps up to date.
 type TextMode struct {
-	u         ServBase
-	up        ServPtr
-	max       uint32
-	mode      uint32
-	attribute uint32
-	col       uint32
-	row       uint32
-	vis       uint32
+	u  ServBase
+	up ServPtr
 }
 
 var _ Service = &TextMode{}
@@ -30,14 +23,6 @@ func init() {
 // NewTextMode returns a TextMode Service
 func NewTextMode(tab []byte, u ServPtr) (Service, error) {
 	Debug("NewTextMode %#x", u)
-	base := int(u) & 0xffffff
-	for p := range table.SimpleTextModeServicesNames {
-		x := base + int(p)
-		r := uint64(p) + 0xff400000 + uint64(base)
-		Debug("Install %#x at off %#x", r, x)
-		binary.LittleEndian.PutUint64(tab[x:], uint64(r))
-	}
-
 	return &TextMode{u: u.Base(), up: u}, nil
 }
 
@@ -57,8 +42,7 @@ func (t *TextMode) Ptr() ServPtr {
 }
 
 // Call implements service.Call
-// we don't care about textout mode. It's stupid.
-// just ignore and move on.
+// The mode is data, not functions, so there is nothing to call.
 func (t *TextMode) Call(f *Fault) error {
 	log.Panicf("No TextMode Calls allowed")
 	return nil
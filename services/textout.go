@@ -4,8 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/console"
+	"github.com/linuxboot/voodoo/graphics"
 	"github.com/linuxboot/voodoo/table"
 	"github.com/linuxboot/voodoo/trace"
 	"github.com/linuxboot/voodoo/uefi"
@@ -17,14 +20,30 @@ type TextOut struct {
 	up  ServPtr
 	t   ServBase
 	tup ServPtr
+	s   *console.Screen
 }
 
-var _ Service = &TextOut{}
+var (
+	_ Service = &TextOut{}
+	// screen is the console. If it is not set by SetConsole,
+	// output is plain text on stdout.
+	screen *console.Screen
+	// conOut is the TextOut, for the GOP, which can change its mode.
+	conOut *TextOut
+	// gcon draws the screen on the GOP framebuffer.
+	gcon *graphics.TextConsole
+)
 
 func init() {
 	RegisterCreator(uefi.ConOutGUID.String(), NewTextOut)
 }
 
+// SetConsole sets the screen used by TextOut.
+// It must be called before NewSystemtable.
+func SetConsole(s *console.Screen) {
+	screen = s
+}
+
 // NewTextOut returns a TextOut Service
 func NewTextOut(tab []byte, u ServPtr) (Service, error) {
 	Debug("textout services table u is %#x", u)
@@ -41,8 +60,33 @@ func NewTextOut(tab []byte, u ServPtr) (Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	Debug("NewTextOut: TextMode base is %#x %#x", tm, ServBase(tm))
-	return &TextOut{u: u.Base(), up: u, t: tm.Base(), tup: tm}, nil
+	Debug("NewTextOut: TextMode base is %#x %s", tm, tm.Base())
+	// Mode is not a function, it is a pointer to the mode struct.
+	binary.LittleEndian.PutUint64(tab[base+table.STOutMode:], uint64(tm))
+	if screen == nil {
+		screen = console.New(os.Stdout, false)
+	}
+	t := &TextOut{u: u.Base(), up: u, t: tm.Base(), tup: tm, s: screen}
+	t.mode(tab)
+	conOut = t
+	gcon = graphics.NewTextConsole(fb, screen)
+	return t, nil
+}
+
+// mode writes the SIMPLE_TEXT_OUTPUT_MODE struct the guest sees.
+func (t *TextOut) mode(tab []byte) {
+	x := tab[index(t.tup):]
+	binary.LittleEndian.PutUint32(x[table.STModeMaxMode:], uint32(len(console.Modes)))
+	binary.LittleEndian.PutUint32(x[table.STModeMode:], uint32(t.s.Mode))
+	binary.LittleEndian.PutUint32(x[table.STModeAttribute:], uint32(t.s.Attr))
+	binary.LittleEndian.PutUint32(x[table.STModeCursorColumn:], uint32(t.s.Col))
+	binary.LittleEndian.PutUint32(x[table.STModeCursorRow:], uint32(t.s.Row))
+	var vis uint32
+	if t.s.CursorVisible {
+		vis = 1
+	}
+	// CursorVisible is a BOOLEAN; write the padding too.
+	binary.LittleEndian.PutUint32(x[table.STModeCursorVisible:], vis)
 }
 
 // Aliases implements Aliases
@@ -67,31 +111,79 @@ func (t *TextOut) Call(f *Fault) error {
 	f.Regs.Rax = uefi.EFI_SUCCESS
 	switch op {
 	case table.STOutReset:
-		return nil
+		// EFI_STATUS Reset (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN BOOLEAN ExtendedVerification);
+		t.s.Reset()
 	case table.STOutEnableCursor:
-		return nil
+		// EFI_STATUS EnableCursor (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN BOOLEAN Visible);
+		args := trace.Args(f.Proc, f.Regs, 2)
+		t.s.EnableCursor(uint8(args[1]) != 0)
 	case table.STOutOutputString:
-		args := trace.Args(f.Proc, f.Regs, 6)
+		// EFI_STATUS OutputString (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN CHAR16 *String);
+		args := trace.Args(f.Proc, f.Regs, 2)
 		Debug("StOutOutputString args %#x", args)
-		n, err := trace.ReadStupidString(f.Proc, uintptr(args[1]))
+		n, err := trace.ReadUTF16String(f.Proc, uintptr(args[1]))
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%s", n)
-		if err := f.Proc.SetRegs(f.Regs); err != nil {
-			return err
+		t.s.WriteString(n)
+	case table.STOutTestString:
+		// EFI_STATUS TestString (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN CHAR16 *String);
+		// We can show anything.
+	case table.STOutQueryMode:
+		// EFI_STATUS QueryMode (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN UINTN ModeNumber,
+		//   OUT UINTN *Columns, OUT UINTN *Rows);
+		args := trace.Args(f.Proc, f.Regs, 4)
+		if args[1] >= uintptr(len(console.Modes)) || !fb.Fits(console.Modes[args[1]]) {
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+			break
+		}
+		m := console.Modes[args[1]]
+		if err := trace.WriteWord(f.Proc, args[2], uint64(m.Cols)); err != nil {
+			return fmt.Errorf("Can't write columns to %#x: %v", args[2], err)
+		}
+		if err := trace.WriteWord(f.Proc, args[3], uint64(m.Rows)); err != nil {
+			return fmt.Errorf("Can't write rows to %#x: %v", args[3], err)
+		}
+	case table.STOutSetMode:
+		// EFI_STATUS SetMode (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN UINTN ModeNumber);
+		args := trace.Args(f.Proc, f.Regs, 2)
+		if args[1] < uintptr(len(console.Modes)) && !fb.Fits(console.Modes[args[1]]) {
+			Debug("SetMode: text mode %d does not fit on the GOP", args[1])
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+			break
+		}
+		if err := t.s.SetMode(int(args[1])); err != nil {
+			Debug("SetMode: %v", err)
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
 		}
-		return nil
 	case table.STOutSetAttribute:
-		Debug("Fuck STOutSetAttribute")
-	case table.STOutMode:
-		if err := retval(f, uintptr(t.tup)); err != nil {
-			log.Panic(err)
+		// EFI_STATUS SetAttribute (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN UINTN Attribute);
+		args := trace.Args(f.Proc, f.Regs, 2)
+		if args[1] > console.MaxAttribute {
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
+			break
+		}
+		if err := t.s.SetAttribute(uint8(args[1])); err != nil {
+			return err
+		}
+	case table.STOutClearScreen:
+		// EFI_STATUS ClearScreen (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This);
+		t.s.Clear()
+	case table.STOutSetCursorPosition:
+		// EFI_STATUS SetCursorPosition (IN EFI_SIMPLE_TEXT_OUTPUT_PROTOCOL *This, IN UINTN Column, IN UINTN Row);
+		args := trace.Args(f.Proc, f.Regs, 3)
+		if err := t.s.SetCursor(int(args[1]), int(args[2])); err != nil {
+			Debug("SetCursorPosition: %v", err)
+			f.Regs.Rax = uefi.EFI_UNSUPPORTED
 		}
 	default:
 		log.Panicf("unsup textout Call: %#x", op)
 		f.Regs.Rax = uefi.EFI_UNSUPPORTED
 	}
+	t.mode(f.Proc.Tab())
+	if err := gcon.Draw(f.Proc); err != nil {
+		return fmt.Errorf("Can't draw the console on the GOP: %v", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/linuxboot/voodoo/devices"
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+var (
+	// rtc is the clock GetTime and SetTime use. It is the one on the
+	// CMOS ports, if there is one, so guests see the same time both ways.
+	rtc = devices.NewRTC(devices.HostClock)
+	// The RTC does not keep the time zone and daylight saving flags,
+	// so they are here.
+	timeZone int16 = uefi.EFI_UNSPECIFIED_TIMEZONE
+	daylight uint8
+	// wakeup is the wakeup time, as last set.
+	wakeup   table.EfiTime
+	wakeupOn bool
+)
+
+// SetRTC sets the RTC the runtime time services use.
+func SetRTC(r *devices.RTC) {
+	rtc = r
+}
+
+// Elapsed is how long the guest has run, by the clock timers use.
+// With virtual time, it is virtual too.
+func Elapsed() time.Duration {
+	return now()
+}
+
+// efiTime converts t to an EFI_TIME.
+func efiTime(t time.Time) *table.EfiTime {
+	return &table.EfiTime{
+		Year:       uint16(t.Year()),
+		Month:      uint8(t.Month()),
+		Day:        uint8(t.Day()),
+		Hour:       uint8(t.Hour()),
+		Minute:     uint8(t.Minute()),
+		Second:     uint8(t.Second()),
+		Nanosecond: uint32(t.Nanosecond()),
+		Timezone:   timeZone,
+		Daylight:   daylight,
+	}
+}
+
+// validTime says whether the fields of an EFI_TIME are in range, as
+// the UEFI spec gives them.
+func validTime(t *table.EfiTime) bool {
+	if t.Year < 1900 || t.Year > 9999 || t.Month < 1 || t.Month > 12 || t.Day < 1 {
+		return false
+	}
+	// Day 0 of the next month is the last of this one.
+	if int(t.Day) > time.Date(int(t.Year), time.Month(t.Month)+1, 0, 0, 0, 0, 0, time.UTC).Day() {
+		return false
+	}
+	if t.Hour > 23 || t.Minute > 59 || t.Second > 59 || t.Nanosecond > 999999999 {
+		return false
+	}
+	if t.Timezone != uefi.EFI_UNSPECIFIED_TIMEZONE && (t.Timezone < -1440 || t.Timezone > 1440) {
+		return false
+	}
+	return t.Daylight&^(uefi.EFI_TIME_ADJUST_DAYLIGHT|uefi.EFI_TIME_IN_DAYLIGHT) == 0
+}
+
+// goTime converts an EFI_TIME to a time.Time, as the RTC keeps it.
+func goTime(t *table.EfiTime) time.Time {
+	return time.Date(int(t.Year), time.Month(t.Month), int(t.Day), int(t.Hour), int(t.Minute), int(t.Second), int(t.Nanosecond), time.UTC)
+}
+
+// readTime reads an EFI_TIME from the guest.
+func readTime(f *Fault, addr uintptr) (*table.EfiTime, error) {
+	var t table.EfiTime
+	b := make([]byte, binary.Size(&t))
+	if err := f.Proc.Read(addr, b); err != nil {
+		return nil, fmt.Errorf("Can't read EFI_TIME at %#x: %v", addr, err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &t); err != nil {
+		return nil, fmt.Errorf("Can't decode EFI_TIME at %#x: %v", addr, err)
+	}
+	return &t, nil
+}
+
+// writeTime writes an EFI_TIME to the guest.
+func writeTime(f *Fault, addr uintptr, t *table.EfiTime) error {
+	var b = &bytes.Buffer{}
+	if err := binary.Write(b, binary.LittleEndian, t); err != nil {
+		return fmt.Errorf("Can't encode EFI_TIME: %v", err)
+	}
+	if err := f.Proc.Write(addr, b.Bytes()); err != nil {
+		return fmt.Errorf("Can't write %d bytes to %#x: %v", b.Len(), addr, err)
+	}
+	return nil
+}
+
+// writeBool writes a BOOLEAN to the guest.
+func writeBool(f *Fault, addr uintptr, v bool) error {
+	var b [1]byte
+	if v {
+		b[0] = 1
+	}
+	if err := f.Proc.Write(addr, b[:]); err != nil {
+		return fmt.Errorf("Can't write BOOLEAN to %#x: %v", addr, err)
+	}
+	return nil
+}
+
+// withinADay says whether the wakeup time t is no more than a day
+// from now. The RTC alarm has no date, so it can't be further off.
+func withinADay(t time.Time) bool {
+	n := rtc.Now()
+	return !t.Before(n.Add(-time.Second)) && !t.After(n.Add(24*time.Hour))
+}
+
+// getTime implements GetTime.
+func getTime(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 2)
+	if args[0] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if err := writeTime(f, args[0], efiTime(rtc.Now())); err != nil {
+		return err
+	}
+	if args[1] != 0 {
+		var b = &bytes.Buffer{}
+		if err := binary.Write(b, binary.LittleEndian, &table.EfiTimeCap{
+			Resolution: 1,         // 1 Hz
+			Accuracy:   100000000, // 100 ppm
+			SetsToZero: 0,
+		}); err != nil {
+			return fmt.Errorf("Can't encode EFI_TIME_CAPABILITIES: %v", err)
+		}
+		if err := f.Proc.Write(args[1], b.Bytes()); err != nil {
+			return fmt.Errorf("Can't write %d bytes to %#x: %v", b.Len(), args[1], err)
+		}
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
+
+// setTime implements SetTime.
+func setTime(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 1)
+	if args[0] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	t, err := readTime(f, args[0])
+	if err != nil {
+		return err
+	}
+	if !validTime(t) {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	rtc.Set(goTime(t))
+	timeZone, daylight = t.Timezone, t.Daylight
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
+
+// getWakeupTime implements GetWakeupTime.
+func getWakeupTime(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 3)
+	if args[0] == 0 || args[1] == 0 || args[2] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	pending := wakeupOn && !rtc.Now().Before(goTime(&wakeup))
+	if err := writeBool(f, args[0], wakeupOn); err != nil {
+		return err
+	}
+	if err := writeBool(f, args[1], pending); err != nil {
+		return err
+	}
+	t := wakeup
+	if t.Year == 0 {
+		// Never set: report now, which is at least a valid time.
+		t = *efiTime(rtc.Now())
+	}
+	if err := writeTime(f, args[2], &t); err != nil {
+		return err
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
+
+// setWakeupTime implements SetWakeupTime.
+func setWakeupTime(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 2)
+	enable := args[0]&0xff != 0
+	if !enable {
+		wakeupOn = false
+		rtc.SetAlarm(int(wakeup.Hour), int(wakeup.Minute), int(wakeup.Second), false)
+		f.Regs.Rax = uefi.EFI_SUCCESS
+		return nil
+	}
+	if args[1] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	t, err := readTime(f, args[1])
+	if err != nil {
+		return err
+	}
+	if !validTime(t) || !withinADay(goTime(t)) {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	wakeup, wakeupOn = *t, true
+	rtc.SetAlarm(int(t.Hour), int(t.Minute), int(t.Second), true)
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
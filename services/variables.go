@@ -0,0 +1,121 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// maxVariableSize is the most data a variable can have. Real firmware
+// has a limit, often much smaller; we have one so a bad DataSize does
+// not take the host down with it.
+const maxVariableSize = 1 << 20
+
+// readNameGUID reads a variable name and vendor GUID from the guest.
+func readNameGUID(f *Fault, np, gp uintptr) (string, guid.GUID, error) {
+	var g guid.GUID
+	n, err := trace.ReadStupidString(f.Proc, np)
+	if err != nil {
+		return "", g, fmt.Errorf("Can't read StupidString at #%x, err %v", np, err)
+	}
+	if err := f.Proc.Read(gp, g[:]); err != nil {
+		return "", g, fmt.Errorf("Can't read guid at #%x, err %v", gp, err)
+	}
+	return n, g, nil
+}
+
+// getVariable implements GetVariable.
+func getVariable(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 5)
+	Debug("table.RTGetVariable args %#x", args)
+	if args[0] == 0 || args[1] == 0 || args[3] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	n, g, err := readNameGUID(f, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	v, err := uefi.ReadVariable(n, g)
+	Debug("%s:%s: v is %v", n, g, v)
+	if err != nil {
+		f.Regs.Rax = uefi.EFI_NOT_FOUND
+		return nil
+	}
+	var b [8]byte
+	if err := f.Proc.Read(args[3], b[:]); err != nil {
+		return fmt.Errorf("Can't read DataSize at %#x: %v", args[3], err)
+	}
+	size := binary.LittleEndian.Uint64(b[:])
+	binary.LittleEndian.PutUint64(b[:], uint64(len(v.Data)))
+	if err := f.Proc.Write(args[3], b[:]); err != nil {
+		return fmt.Errorf("Can't write DataSize at %#x: %v", args[3], err)
+	}
+	if size < uint64(len(v.Data)) {
+		f.Regs.Rax = uefi.EFI_BUFFER_TOO_SMALL
+		return nil
+	}
+	if args[4] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if err := f.Proc.Write(args[4], v.Data); err != nil {
+		return fmt.Errorf("Can't write %d bytes to %#x: %v", len(v.Data), args[4], err)
+	}
+	if args[2] != 0 {
+		binary.LittleEndian.PutUint32(b[:], uint32(v.Attr))
+		if err := f.Proc.Write(args[2], b[:4]); err != nil {
+			return fmt.Errorf("Can't write Attributes at %#x: %v", args[2], err)
+		}
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
+
+// setVariable implements SetVariable.
+func setVariable(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 5)
+	Debug("table.RTSetVariable args %#x", args)
+	if args[0] == 0 || args[1] == 0 || (args[3] != 0 && args[4] == 0) {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	n, g, err := readNameGUID(f, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	attr := args[2] & 0xffffffff
+	// Runtime access needs boot service access too.
+	if attr&uefi.EFI_VARIABLE_RUNTIME_ACCESS != 0 && attr&uefi.EFI_VARIABLE_BOOTSERVICE_ACCESS == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if attr&(uefi.EFI_VARIABLE_AUTHENTICATED_WRITE_ACCESS|uefi.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS) != 0 {
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+		return nil
+	}
+	if args[3] > maxVariableSize {
+		Debug("SetVariable: %d bytes is more than %d", args[3], maxVariableSize)
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	data := make([]byte, args[3])
+	if len(data) > 0 {
+		if err := f.Proc.Read(args[4], data); err != nil {
+			return fmt.Errorf("Can't read %d bytes at %#x: %v", len(data), args[4], err)
+		}
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	if err := uefi.WriteVariable(n, g, attr, data); err != nil {
+		Debug("SetVariable %s:%s: %v", n, g, err)
+		// Deleting what is not there, or changing the attributes.
+		f.Regs.Rax = uefi.EFI_NOT_FOUND
+		if _, rerr := uefi.ReadVariable(n, g); rerr == nil {
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// After ExitBootServices, an OS loader can give the runtime services
+// virtual addresses, with SetVirtualAddressMap. The runtime services
+// are in the service tables, which the memory map shows as runtime
+// code. We map them where the OS wants them, on top of the one to one
+// mapping of the low 4G, which stays. Calls to the new addresses hlt
+// there, as they did at the old ones, and Dispatch turns the address
+// back into the physical one to find the service.
+
+// tableSize is the size of the service tables at protocolBase.
+const tableSize = 0x800000
+
+// maxMapSize is the biggest memory map SetVirtualAddressMap takes.
+// Ours has a few entries; a real one, a few hundred.
+const maxMapSize = 1 << 20
+
+// descriptorSize is the size of the EFI_MEMORY_DESCRIPTORs we hand out.
+var descriptorSize = binary.Size(uefi.MemRegion{})
+
+var (
+	// bootServicesExited is set by ExitBootServices.
+	bootServicesExited bool
+	// virtualMap is the map SetVirtualAddressMap was given: only the
+	// descriptors for runtime memory. Empty until it is called.
+	virtualMap []uefi.MemRegion
+)
+
+// mapper is a Trace that can add page table mappings.
+type mapper interface {
+	Map(va, pa, n uint64) error
+}
+
+// memoryMap returns the memory map.
+func memoryMap() []uefi.MemRegion {
+	return []uefi.MemRegion{
+		// Go simple for now. You own 2G. That's all you own.
+		{MType: uefi.EfiConventionalMemory, Npages: 0x20000000 / 0x1000, Attr: uefi.All},
+		// The service tables, at protocolBase.
+		{MType: uefi.EfiRuntimeServicesCode, PA: 0xff000000, Npages: tableSize / 0x1000, Attr: uefi.RequiresRuntimeMapping | uefi.WB},
+	}
+}
+
+// mapKey returns the key for the memory map. It changes when memory is allocated.
+func mapKey() uint64 {
+	malloc.Lock()
+	defer malloc.Unlock()
+	return uint64(allocBase)
+}
+
+// physical returns the physical address for a after SetVirtualAddressMap,
+// if it is in memory that was given a virtual address.
+func physical(a uintptr) uintptr {
+	for _, d := range virtualMap {
+		if uint64(a) >= uint64(d.VA) && uint64(a) < uint64(d.VA)+d.Npages*0x1000 {
+			return uintptr(uint64(d.PA) + uint64(a) - uint64(d.VA))
+		}
+	}
+	return a
+}
+
+// virtual returns the virtual address for the physical address a,
+// if SetVirtualAddressMap gave it one.
+func virtual(a uint64) (uint64, bool) {
+	for _, d := range virtualMap {
+		if a >= uint64(d.PA) && a < uint64(d.PA)+d.Npages*0x1000 {
+			return uint64(d.VA) + a - uint64(d.PA), true
+		}
+	}
+	return a, false
+}
+
+// getMemoryMap implements GetMemoryMap.
+func getMemoryMap(f *Fault) error {
+	f.Args = trace.Args(f.Proc, f.Regs, 5)
+	Debug("GetMemoryMap: %#x", f.Args)
+	if f.Args[0] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	var b = &bytes.Buffer{}
+	if err := binary.Write(b, binary.LittleEndian, memoryMap()); err != nil {
+		return fmt.Errorf("Can't encode memory map: %v", err)
+	}
+	size, err := trace.ReadWord(f.Proc, f.Args[0])
+	if err != nil {
+		return fmt.Errorf("Can't read MemoryMapSize at %#x: %v", f.Args[0], err)
+	}
+	if err := trace.WriteWord(f.Proc, f.Args[0], uint64(b.Len())); err != nil {
+		return fmt.Errorf("Can't write MemoryMapSize at %#x: %v", f.Args[0], err)
+	}
+	if size < uint64(b.Len()) {
+		f.Regs.Rax = uefi.EFI_BUFFER_TOO_SMALL
+		return nil
+	}
+	if f.Args[1] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if err := f.Proc.Write(f.Args[1], b.Bytes()); err != nil {
+		return fmt.Errorf("Can't write %d bytes to %#x: %v", b.Len(), f.Args[1], err)
+	}
+	for _, w := range []struct {
+		p uintptr
+		v uint64
+		n int
+	}{
+		{f.Args[2], mapKey(), 8},
+		{f.Args[3], uint64(descriptorSize), 8},
+		{f.Args[4], uefi.MemoryDescriptorVersion, 4},
+	} {
+		if w.p == 0 {
+			continue
+		}
+		var bb [8]byte
+		binary.LittleEndian.PutUint64(bb[:], w.v)
+		if err := f.Proc.Write(w.p, bb[:w.n]); err != nil {
+			return fmt.Errorf("Can't write %d bytes to %#x: %v", w.n, w.p, err)
+		}
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
+
+// exitBootServices implements ExitBootServices.
+func exitBootServices(f *Fault) error {
+	f.Args = trace.Args(f.Proc, f.Regs, 2)
+	if bootServicesExited {
+		log.Printf("ExitBootServices: called again, after it succeeded")
+	}
+	if uint64(f.Args[1]) != mapKey() {
+		Debug("ExitBootServices: map key %#x, want %#x", f.Args[1], mapKey())
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	bootServicesExited = true
+	return signalAll(f, uefi.EVT_SIGNAL_EXIT_BOOT_SERVICES, func(f *Fault) error {
+		f.Regs.Rax = uefi.EFI_SUCCESS
+		return nil
+	})
+}
+
+// readDescriptors reads n bytes of EFI_MEMORY_DESCRIPTORs, each size bytes, at p.
+func readDescriptors(f *Fault, p uintptr, n, size uint64) ([]uefi.MemRegion, error) {
+	b := make([]byte, n)
+	if err := f.Proc.Read(p, b); err != nil {
+		return nil, fmt.Errorf("Can't read memory map at %#x: %v", p, err)
+	}
+	var ds []uefi.MemRegion
+	for i := uint64(0); i+size <= n; i += size {
+		var d uefi.MemRegion
+		if err := binary.Read(bytes.NewReader(b[i:i+size]), binary.LittleEndian, &d); err != nil {
+			return nil, fmt.Errorf("Can't decode memory descriptor at %#x: %v", p+uintptr(i), err)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// setVirtualAddressMap implements SetVirtualAddressMap.
+func setVirtualAddressMap(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 4)
+	switch {
+	case !bootServicesExited:
+		log.Printf("SetVirtualAddressMap: called before ExitBootServices")
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+		return nil
+	case len(virtualMap) > 0:
+		log.Printf("SetVirtualAddressMap: called again; it can only be called once")
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+		return nil
+	}
+	n, size, version := uint64(args[0]), uint64(args[1]), uint32(args[2])
+	if version != uefi.MemoryDescriptorVersion || size < uint64(descriptorSize) || n%size != 0 || n > maxMapSize || args[3] == 0 {
+		log.Printf("SetVirtualAddressMap: bad map: size %#x, descriptor size %#x, version %d, at %#x", n, size, version, args[3])
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	ds, err := readDescriptors(f, args[3], n, size)
+	if err != nil {
+		return err
+	}
+	var vm []uefi.MemRegion
+	for _, d := range ds {
+		if d.Attr&uefi.RequiresRuntimeMapping == 0 {
+			continue
+		}
+		if uint64(d.VA)%0x1000 != 0 {
+			log.Printf("SetVirtualAddressMap: %#x is not page aligned", d.VA)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+		vm = append(vm, d)
+	}
+	// Every runtime range of ours needs an address.
+	for _, m := range memoryMap() {
+		if m.Attr&uefi.RequiresRuntimeMapping == 0 {
+			continue
+		}
+		found := false
+		for _, d := range vm {
+			found = found || (d.PA == m.PA && d.Npages == m.Npages)
+		}
+		if !found {
+			log.Printf("SetVirtualAddressMap: no virtual address for runtime memory at %#x", m.PA)
+			f.Regs.Rax = uefi.EFI_NO_MAPPING
+			return nil
+		}
+	}
+	mp, ok := f.Proc.(mapper)
+	if !ok {
+		return fmt.Errorf("SetVirtualAddressMap: %T can't map pages", f.Proc)
+	}
+	for _, d := range vm {
+		Debug("SetVirtualAddressMap: %#x pages at %#x -> %#x", d.Npages, d.PA, d.VA)
+		if err := mp.Map(uint64(d.VA), uint64(d.PA), d.Npages*0x1000); err != nil {
+			log.Printf("SetVirtualAddressMap: %v", err)
+			f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+			return nil
+		}
+	}
+	virtualMap = vm
+	// The notify functions convert their pointers, with ConvertPointer.
+	// Then we convert ours.
+	return signalAll(f, uefi.EVT_SIGNAL_VIRTUAL_ADDRESS_CHANGE, func(f *Fault) error {
+		convertTables(f.Proc.Tab())
+		f.Regs.Rax = uefi.EFI_SUCCESS
+		return nil
+	})
+}
+
+// convertTables converts the pointers in the system table and the
+// runtime services table to the virtual addresses.
+func convertTables(tab []byte) {
+	convert := func(x uint64) {
+		p := binary.LittleEndian.Uint64(tab[x:])
+		if v, ok := virtual(p); ok {
+			binary.LittleEndian.PutUint64(tab[x:], v)
+		}
+	}
+	rt, ok := BasePtr("runtime")
+	if ok {
+		for p := range table.RuntimeServicesNames {
+			convert(uint64(index(rt)) + p)
+		}
+	}
+	for _, p := range []uint64{table.FirmwareVendor, table.RuntimeServices, table.ConfigurationTable} {
+		convert(uint64(index(protocolBase)) + p)
+	}
+}
+
+// convertPointer implements ConvertPointer.
+func convertPointer(f *Fault) error {
+	args := trace.Args(f.Proc, f.Regs, 2)
+	if args[1] == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		return nil
+	}
+	if len(virtualMap) == 0 {
+		log.Printf("ConvertPointer: called before SetVirtualAddressMap")
+		f.Regs.Rax = uefi.EFI_UNSUPPORTED
+		return nil
+	}
+	p, err := trace.ReadWord(f.Proc, args[1])
+	if err != nil {
+		return fmt.Errorf("Can't read pointer at %#x: %v", args[1], err)
+	}
+	if p == 0 {
+		f.Regs.Rax = uefi.EFI_INVALID_PARAMETER
+		if args[0]&uefi.EFI_OPTIONAL_PTR != 0 {
+			f.Regs.Rax = uefi.EFI_SUCCESS
+		}
+		return nil
+	}
+	v, ok := virtual(p)
+	if !ok {
+		log.Printf("ConvertPointer: %#x is not in runtime memory", p)
+		f.Regs.Rax = uefi.EFI_NOT_FOUND
+		return nil
+	}
+	if err := trace.WriteWord(f.Proc, args[1], v); err != nil {
+		return fmt.Errorf("Can't write pointer at %#x: %v", args[1], err)
+	}
+	f.Regs.Rax = uefi.EFI_SUCCESS
+	return nil
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/linuxboot/voodoo/table"
+	"github.com/linuxboot/voodoo/trace"
+	"github.com/linuxboot/voodoo/uefi"
+)
+
+// runtimeCall calls the runtime service op with args, and returns the status.
+func runtimeCall(t *testing.T, f *Fault, op Func, args ...uint64) uint64 {
+	t.Helper()
+	setCall(f, op, args...)
+	if err := (&Runtime{}).Call(f); err != nil {
+		t.Fatalf("%s: got %v, want nil", table.RuntimeServicesNames[uint64(op)], err)
+	}
+	runGuest(t, f, nil)
+	return f.Regs.Rax
+}
+
+func TestSetVirtualAddressMap(t *testing.T) {
+	const mp, pp, va = 0x1000, 0x2000, 0xffffffff80000000
+	f := newFault(0)
+	events, bootServicesExited, virtualMap = map[evt]*Event{}, false, nil
+	defer func() { bootServicesExited, virtualMap = false, nil }()
+	// The map the OS gives back: ours, with a virtual address for
+	// the service tables.
+	m := memoryMap()
+	m[1].VA = va
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, m); err != nil {
+		t.Fatal(err)
+	}
+	f.Proc.Write(mp, b.Bytes())
+	svam := func() uint64 {
+		return runtimeCall(t, f, table.RTSetVirtualAddressMap, uint64(b.Len()), uint64(descriptorSize), uefi.MemoryDescriptorVersion, mp)
+	}
+	convert := func(disp, p uint64) (uint64, uint64) {
+		trace.WriteWord(f.Proc, pp, p)
+		s := runtimeCall(t, f, table.RTConvertPointer, disp, pp)
+		p, _ = trace.ReadWord(f.Proc, pp)
+		return s, p
+	}
+
+	if s := svam(); s != uefi.EFI_UNSUPPORTED {
+		t.Errorf("SetVirtualAddressMap before ExitBootServices: got %#x, want EFI_UNSUPPORTED", s)
+	}
+	if s, _ := convert(0, 0xff001000); s != uefi.EFI_UNSUPPORTED {
+		t.Errorf("ConvertPointer before SetVirtualAddressMap: got %#x, want EFI_UNSUPPORTED", s)
+	}
+	if s := bootCall(t, f, nil, table.ExitBootServices, 0, mapKey()); s != uefi.EFI_SUCCESS {
+		t.Fatalf("ExitBootServices: got %#x, want EFI_SUCCESS", s)
+	}
+	// A runtime pointer in the system table, to be converted.
+	binary.LittleEndian.PutUint64(memTab[index(protocolBase)+table.FirmwareVendor:], 0xff000100)
+	if s := svam(); s != uefi.EFI_SUCCESS {
+		t.Fatalf("SetVirtualAddressMap: got %#x, want EFI_SUCCESS", s)
+	}
+	if p := binary.LittleEndian.Uint64(memTab[index(protocolBase)+table.FirmwareVendor:]); p != va+0x100 {
+		t.Errorf("FirmwareVendor: got %#x, want %#x", p, uint64(va+0x100))
+	}
+	if p := physical(va + 0x1234); p != 0xff001234 {
+		t.Errorf("physical(%#x): got %#x, want 0xff001234", uint64(va+0x1234), p)
+	}
+	if s := svam(); s != uefi.EFI_UNSUPPORTED {
+		t.Errorf("SetVirtualAddressMap again: got %#x, want EFI_UNSUPPORTED", s)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		disp, p   uint64
+		status, v uint64
+	}{
+		{"runtime pointer", 0, 0xff001234, uefi.EFI_SUCCESS, va + 0x1234},
+		{"optional NULL", uefi.EFI_OPTIONAL_PTR, 0, uefi.EFI_SUCCESS, 0},
+		{"NULL", 0, 0, uefi.EFI_INVALID_PARAMETER, 0},
+		{"boot services memory", 0, 0x1000, uefi.EFI_NOT_FOUND, 0x1000},
+		{"no descriptor", uefi.EFI_OPTIONAL_PTR, 0x100000000, uefi.EFI_NOT_FOUND, 0x100000000},
+	} {
+		s, v := convert(tt.disp, tt.p)
+		if s != tt.status || v != tt.v {
+			t.Errorf("ConvertPointer(%s): got %#x, %#x, want %#x, %#x", tt.name, s, v, tt.status, tt.v)
+		}
+	}
+}
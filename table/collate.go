@@ -1,5 +1,10 @@
 package table
 
+const (
+	CollateGUID  = "1D85CD7F-F43D-11D2-9A0C-0090273FC14D"
+	Collate2GUID = "A4C751FC-23AE-4C3E-92E9-4964CF63F349"
+)
+
 const (
 	CollStriColl           = 0
 	CollMetaiMatch         = 0x8
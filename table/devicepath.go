@@ -0,0 +1,50 @@
+package table
+
+const (
+	DevicePathToTextGUID   = "8B843E20-8132-4852-90CC-551A4E4A7F1C"
+	DevicePathFromTextGUID = "05C99A21-C70F-4AD2-8A5F-35DF3343F51E"
+)
+
+const (
+	DPConvertDeviceNodeToText = 0
+	DPConvertDevicePathToText = 0x8
+)
+
+var DevicePathToTextNames = map[uint64]*val{
+	DPConvertDeviceNodeToText: {N: "ConvertDeviceNodeToText"},
+	DPConvertDevicePathToText: {N: "ConvertDevicePathToText"},
+}
+
+const (
+	DPConvertTextToDeviceNode = 0
+	DPConvertTextToDevicePath = 0x8
+)
+
+var DevicePathFromTextNames = map[uint64]*val{
+	DPConvertTextToDeviceNode: {N: "ConvertTextToDeviceNode"},
+	DPConvertTextToDevicePath: {N: "ConvertTextToDevicePath"},
+}
+
+const DevicePathUtilitiesGUID = "0379BE4E-D706-437D-B037-EDB82FB772A4"
+
+const (
+	DPGetDevicePathSize         = 0
+	DPDuplicateDevicePath       = 0x8
+	DPAppendDevicePath          = 0x10
+	DPAppendDeviceNode          = 0x18
+	DPAppendDevicePathInstance  = 0x20
+	DPGetNextDevicePathInstance = 0x28
+	DPIsDevicePathMultiInstance = 0x30
+	DPCreateDeviceNode          = 0x38
+)
+
+var DevicePathUtilitiesNames = map[uint64]*val{
+	DPGetDevicePathSize:         {N: "GetDevicePathSize"},
+	DPDuplicateDevicePath:       {N: "DuplicateDevicePath"},
+	DPAppendDevicePath:          {N: "AppendDevicePath"},
+	DPAppendDeviceNode:          {N: "AppendDeviceNode"},
+	DPAppendDevicePathInstance:  {N: "AppendDevicePathInstance"},
+	DPGetNextDevicePathInstance: {N: "GetNextDevicePathInstance"},
+	DPIsDevicePathMultiInstance: {N: "IsDevicePathMultiInstance"},
+	DPCreateDeviceNode:          {N: "CreateDeviceNode"},
+}
@@ -0,0 +1,17 @@
+package table
+
+const EBCGUID = "13AC6DD1-73D0-11D4-B06B-00AA00BD6DE7"
+
+const (
+	EBCCreateThunk         = 0
+	EBCUnloadImage         = 0x8
+	EBCRegisterICacheFlush = 0x10
+	EBCGetVersion          = 0x18
+)
+
+var EBCServiceNames = map[uint64]*val{
+	EBCCreateThunk:         {N: "CreateThunk"},
+	EBCUnloadImage:         {N: "UnloadImage"},
+	EBCRegisterICacheFlush: {N: "RegisterICacheFlush"},
+	EBCGetVersion:          {N: "GetVersion"},
+}
@@ -0,0 +1,21 @@
+package table
+
+const FMPGUID = "86C77A67-0B97-4633-A187-49104D0685C7"
+
+const (
+	FMPGetImageInfo   = 0
+	FMPGetImage       = 0x8
+	FMPSetImage       = 0x10
+	FMPCheckImage     = 0x18
+	FMPGetPackageInfo = 0x20
+	FMPSetPackageInfo = 0x28
+)
+
+var FMPServiceNames = map[uint64]*val{
+	FMPGetImageInfo:   {N: "GetImageInfo"},
+	FMPGetImage:       {N: "GetImage"},
+	FMPSetImage:       {N: "SetImage"},
+	FMPCheckImage:     {N: "CheckImage"},
+	FMPGetPackageInfo: {N: "GetPackageInfo"},
+	FMPSetPackageInfo: {N: "SetPackageInfo"},
+}
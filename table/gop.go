@@ -0,0 +1,40 @@
+package table
+
+const GOPGUID = "9042A9DE-23DC-4A38-96FB-7ADED080516A"
+
+const (
+	GOPQueryMode = 0
+	GOPSetMode   = 0x8
+	GOPBlt       = 0x10
+	GOPMode      = 0x18
+)
+
+var GOPServiceNames = map[uint64]*val{
+	GOPQueryMode: {N: "QueryMode"},
+	GOPSetMode:   {N: "SetMode"},
+	GOPBlt:       {N: "Blt"},
+}
+
+// EFI_GRAPHICS_OUTPUT_PROTOCOL_MODE
+const (
+	GOPModeMaxMode         = 0
+	GOPModeMode            = 0x4
+	GOPModeInfo            = 0x8
+	GOPModeSizeOfInfo      = 0x10
+	GOPModeFrameBufferBase = 0x18
+	GOPModeFrameBufferSize = 0x20
+)
+
+// EFI_GRAPHICS_OUTPUT_MODE_INFORMATION
+const (
+	GOPInfoVersion              = 0
+	GOPInfoHorizontalResolution = 0x4
+	GOPInfoVerticalResolution   = 0x8
+	GOPInfoPixelFormat          = 0xc
+	GOPInfoPixelInformation     = 0x10
+	GOPInfoPixelsPerScanLine    = 0x20
+	GOPInfoSize                 = 0x24
+)
+
+// PixelBlueGreenRedReserved8BitPerColor is the only pixel format we do.
+const PixelBlueGreenRedReserved8BitPerColor = 1
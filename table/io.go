@@ -38,6 +38,26 @@ var SimpleTextInServicesNames = map[uint64]*val{
 	STInWaitForKey:    {N: "WaitForKey"},
 }
 
+const (
+	STInExReset               = 0
+	STInExReadKeyStrokeEx     = 0x8
+	STInExWaitForKeyEx        = 0x10
+	STInExSetState            = 0x18
+	STInExRegisterKeyNotify   = 0x20
+	STInExUnregisterKeyNotify = 0x28
+	// KeyData is where we put the EFI_KEY_DATA for key notify functions.
+	STInExKeyData = 0x100
+)
+
+var SimpleTextInExServicesNames = map[uint64]*val{
+	STInExReset:               {N: "Reset"},
+	STInExReadKeyStrokeEx:     {N: "ReadKeyStrokeEx"},
+	STInExWaitForKeyEx:        {N: "WaitForKeyEx"},
+	STInExSetState:            {N: "SetState"},
+	STInExRegisterKeyNotify:   {N: "RegisterKeyNotify"},
+	STInExUnregisterKeyNotify: {N: "UnregisterKeyNotify"},
+}
+
 const (
 	STModeMaxMode       = 0
 	STModeMode          = 0x4
@@ -0,0 +1,34 @@
+package table
+
+const SerialIOGUID = "BB25CF6F-F1D4-11D2-9A0C-0090273FC1FD"
+
+const (
+	SerialIORevision      = 0
+	SerialIOReset         = 0x8
+	SerialIOSetAttributes = 0x10
+	SerialIOSetControl    = 0x18
+	SerialIOGetControl    = 0x20
+	SerialIOWrite         = 0x28
+	SerialIORead          = 0x30
+	SerialIOMode          = 0x38
+)
+
+var SerialIOServiceNames = map[uint64]*val{
+	SerialIOReset:         {N: "Reset"},
+	SerialIOSetAttributes: {N: "SetAttributes"},
+	SerialIOSetControl:    {N: "SetControl"},
+	SerialIOGetControl:    {N: "GetControl"},
+	SerialIOWrite:         {N: "Write"},
+	SerialIORead:          {N: "Read"},
+}
+
+// SERIAL_IO_MODE
+const (
+	SerialModeControlMask      = 0
+	SerialModeTimeout          = 0x4
+	SerialModeBaudRate         = 0x8
+	SerialModeReceiveFifoDepth = 0x10
+	SerialModeDataBits         = 0x14
+	SerialModeParity           = 0x18
+	SerialModeStopBits         = 0x1c
+)
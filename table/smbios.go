@@ -0,0 +1,24 @@
+package table
+
+const SMBIOSGUID = "03583FF6-CB36-4940-947E-B9B39F4AFAF7"
+
+const (
+	SMBIOSAdd          = 0
+	SMBIOSUpdateString = 0x8
+	SMBIOSRemove       = 0x10
+	SMBIOSGetNext      = 0x18
+	SMBIOSMajorVersion = 0x20
+	SMBIOSMinorVersion = 0x21
+)
+
+var SMBIOSServiceNames = map[uint64]*val{
+	SMBIOSAdd:          {N: "Add"},
+	SMBIOSUpdateString: {N: "UpdateString"},
+	SMBIOSRemove:       {N: "Remove"},
+	SMBIOSGetNext:      {N: "GetNext"},
+	SMBIOSMajorVersion: {N: "MajorVersion"},
+}
+
+// ConfigurationTableSize is the size of an EFI_CONFIGURATION_TABLE entry:
+// a GUID and a pointer.
+const ConfigurationTableSize = 24
@@ -0,0 +1,64 @@
+// +build linux,amd64
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// restoreTerm puts stdin back the way it was, if rawStdin changed it.
+// exit calls it, with the other atExit functions; anything else on
+// the way out, such as a log.Fatal, has to call it first, or use
+// fatal and fatalf, which do.
+var restoreTerm = func() {}
+
+// rawStdin puts stdin, if it is a terminal, in raw mode, so
+// we see keys as they are pressed, escape sequences and all.
+func rawStdin() error {
+	fd := int(os.Stdin.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		// Not a terminal. Nothing to do.
+		return nil
+	}
+	t := *old
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	// Keep ISIG, so ^C still gets us out, and OPOST, so our own
+	// log output still has its carriage returns.
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &t); err != nil {
+		return err
+	}
+	restoreTerm = func() { unix.IoctlSetTermios(fd, unix.TCSETS, old) }
+	// ^C, and the like, would leave the terminal raw. Put it back,
+	// then let the signal do what it would have.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGQUIT)
+	go func() {
+		s := <-c
+		restoreTerm()
+		signal.Reset()
+		unix.Kill(unix.Getpid(), s.(unix.Signal))
+	}()
+	return nil
+}
+
+// fatal is log.Fatal, with the terminal put back first.
+func fatal(v ...interface{}) {
+	restoreTerm()
+	log.Fatal(v...)
+}
+
+// fatalf is log.Fatalf, with the terminal put back first.
+func fatalf(format string, v ...interface{}) {
+	restoreTerm()
+	log.Fatalf(format, v...)
+}
@@ -6,33 +6,29 @@ import (
 	"io"
 	"reflect"
 	"syscall"
+	"unicode/utf16"
 
 	"golang.org/x/arch/x86/x86asm"
 	"golang.org/x/sys/unix"
 )
 
-// Args returns the top nargs args, going down the stack if needed. The max is 6.
-// This is UEFI calling convention.
+// Args returns the top nargs args, going down the stack if needed.
+// This is UEFI calling convention: four in registers, the rest on the
+// stack above the return address and the 32-byte shadow space.
 func Args(t Trace, r *syscall.PtraceRegs, nargs int) []uintptr {
 	sp := uintptr(r.Rsp)
-	switch nargs {
-	case 6:
-		w1, _ := t.ReadWord(sp + 0x28)
-		w2, _ := t.ReadWord(sp + 0x30)
-		return []uintptr{uintptr(r.Rcx), uintptr(r.Rdx), uintptr(r.R8), uintptr(r.R9), uintptr(w1), uintptr(w2)}
-	case 5:
-		w1, _ := t.ReadWord(sp + 0x28)
-		return []uintptr{uintptr(r.Rcx), uintptr(r.Rdx), uintptr(r.R8), uintptr(r.R9), uintptr(w1)}
-	case 4:
-		return []uintptr{uintptr(r.Rcx), uintptr(r.Rdx), uintptr(r.R8), uintptr(r.R9)}
-	case 3:
-		return []uintptr{uintptr(r.Rcx), uintptr(r.Rdx), uintptr(r.R8)}
-	case 2:
-		return []uintptr{uintptr(r.Rcx), uintptr(r.Rdx)}
-	case 1:
-		return []uintptr{uintptr(r.Rcx)}
+	args := []uintptr{uintptr(r.Rcx), uintptr(r.Rdx), uintptr(r.R8), uintptr(r.R9)}
+	if nargs <= len(args) {
+		if nargs < 0 {
+			nargs = 0
+		}
+		return args[:nargs]
+	}
+	for i := len(args); i < nargs; i++ {
+		w, _ := t.ReadWord(sp + 0x28 + uintptr(i-4)*8)
+		args = append(args, uintptr(w))
 	}
-	return []uintptr{}
+	return args
 }
 
 // Pointer returns the data pointed to by args[arg]
@@ -297,6 +293,43 @@ func ReadStupidString(t Trace, address uintptr) (string, error) {
 	return s, nil
 }
 
+// ReadUTF16String reads a UEFI string as UTF-16, keeping the
+// characters ReadStupidString would mangle, e.g. box drawing.
+func ReadUTF16String(t Trace, address uintptr) (string, error) {
+	var s []uint16
+	var w [2]byte
+	for {
+		if err := t.Read(address, w[:]); err != nil {
+			return "", err
+		}
+		c := binary.LittleEndian.Uint16(w[:])
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+		address += 2
+	}
+	return string(utf16.Decode(s)), nil
+}
+
+// ReadCString reads a NUL-terminated string of bytes, as used
+// by the few parts of UEFI, like SMBIOS, that stayed ASCII.
+func ReadCString(t Trace, address uintptr) (string, error) {
+	var s []byte
+	var c [1]byte
+	for {
+		if err := t.Read(address, c[:]); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			break
+		}
+		s = append(s, c[0])
+		address++
+	}
+	return string(s), nil
+}
+
 // Header prints out a header register.
 func Header(w io.Writer) error {
 	var l string
@@ -420,8 +453,12 @@ func Inst(t Trace) (*x86asm.Inst, *syscall.PtraceRegs, string, error) {
 			return nil, nil, "", io.EOF
 		}
 		var call [6]byte
+		// When a guest function returns to the callback service,
+		// there was no call, and what is on the stack is whatever the
+		// function left in its shadow space. Just use the pc, the hlt.
 		if err := t.Read(uintptr(cpc-6), call[:]); err != nil {
-			return nil, nil, "", fmt.Errorf("Can' read PC at #%x, err %v", pc, err)
+			Debug("No call before %#x (%v), using pc %#x", cpc, err, pc)
+			cpc = pc
 		}
 
 		// It's simple, if call[0] is 0xff, it's 5 bytes, else if call[2] is 0xff, it's 3,
@@ -65,6 +65,8 @@ type Tracee struct {
 	// and data. The function pointers point to a hlt;ret instruction pair
 	// as shown below.
 	tab []byte
+	// ptNext is the next free page for page tables Map adds.
+	ptNext uint64
 }
 
 func (t *Tracee) String() string {
@@ -258,7 +260,6 @@ func (t *Tracee) Detach() error {
 }
 
 // ReadWord reads the given word from the inferior's address space.
-// Only allowed to read from Region 0 for now.
 func (t *Tracee) ReadWord(address uintptr) (uint64, error) {
 	var word [8]byte
 	if err := t.Read(address, word[:]); err != nil {
@@ -269,14 +270,9 @@ func (t *Tracee) ReadWord(address uintptr) (uint64, error) {
 }
 
 // Read grabs memory starting at the given address, for len(data) bytes.
+// The address is virtual, as the guest sees it.
 func (t *Tracee) Read(address uintptr, data []byte) error {
-	r := t.regions[0]
-	last := r.gpa + uint64(len(r.data))
-	if address > uintptr(last) {
-		return fmt.Errorf("Address %#x is out of range", address)
-	}
-	copy(data, r.data[address:])
-	return nil
+	return t.access(address, data, false)
 }
 
 // WriteWord writes the given word into the inferior's address space.
@@ -286,15 +282,10 @@ func (t *Tracee) WriteWord(address uintptr, word uint64) error {
 	return t.Write(address, b[:])
 }
 
+// Write writes data to memory starting at the given address.
+// The address is virtual, as the guest sees it.
 func (t *Tracee) Write(address uintptr, data []byte) error {
-	r := t.regions[0]
-	last := r.gpa + uint64(len(r.data))
-	if address+uintptr(len(data)) > uintptr(last) {
-		return fmt.Errorf("Address %#x is out of range", address)
-	}
-	copy(r.data[address:], data)
-
-	return nil
+	return t.access(address, data, true)
 }
 
 // GetSiginfo reads the signal information for the signal that stopped the inferior.  Only
@@ -72,6 +72,9 @@ type cpu struct {
 	fd    uintptr
 	m     []byte
 	VMRun VMRun
+	// io is the last IO exit, and mmio the last MMIO exit.
+	io   xio
+	mmio xmmio
 	// We have to read the CPUIDs from the vmfd,
 	// and then set them into the vcpu
 	idInfo *CPUIDInfo
@@ -1193,6 +1196,18 @@ func (x *xmmio) String() string {
 	return fmt.Sprintf("Addr %#x Len %#x Write %#x", x.Addr, x.Len, x.Write)
 }
 
+// mmioData is where the data for an MMIO exit is in kvm_run:
+// after the VMRun, and the address.
+const mmioData = 32 + 8
+
+// MMIO returns the address and size of the last MMIO exit, whether
+// it is a write, and the data. For a read, the data is where KVM wants
+// the value, in kvm_run, and the next Run finishes the read with it.
+func (t *Tracee) MMIO() (addr uint64, size int, write bool, data []byte) {
+	x := t.cpu.mmio
+	return x.Addr, int(x.Len), x.Write != 0, t.cpu.m[mmioData : mmioData+int(x.Len)]
+}
+
 const (
 	xioIn  = 0
 	xioOut = 1
@@ -1233,6 +1248,16 @@ func (x *xio) String() string {
 	return fmt.Sprintf("[%#x]%s%s %#04x", x.Off, op, size, x.Port)
 }
 
+// IO returns the port, access size and count of the last IO exit,
+// whether it is an out, and the data. For an in, the data is where KVM
+// wants the value, in kvm_run, and the next Run finishes the in with it.
+// The count is more than one for string IO with a rep prefix.
+func (t *Tracee) IO() (port uint16, size, count int, out bool, data []byte) {
+	x := t.cpu.io
+	n := uint64(x.Size) * uint64(x.Count)
+	return x.Port, int(x.Size), int(x.Count), x.Dir == xioOut, t.cpu.m[x.Off : x.Off+n]
+}
+
 type shutdown struct {
 	Stype uint32
 	Flags uint64
@@ -1303,6 +1328,7 @@ func (t *Tracee) readInfo() error {
 			log.Panicf("Read in run failed -- can't happen")
 		}
 		sig.Addr = uint64(x.Port)
+		t.cpu.io = x
 		Debug("ExitIO: Addr '%#x' %s", sig.Addr, x.String())
 	case ExitMmio:
 		var x xmmio
@@ -1310,6 +1336,7 @@ func (t *Tracee) readInfo() error {
 			log.Panicf("Read in run failed -- can't happen")
 		}
 		sig.Addr = x.Addr
+		t.cpu.mmio = x
 		Debug("ExitMMiO: Addr '%#x' %s", sig.Addr, x.String())
 	case ExitShutdown:
 		var x shutdown
@@ -0,0 +1,180 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The guest runs on our page tables, at PageTableBase, which map the
+// low 4G one to one with 2M pages. They take the first six pages
+// there; Map takes new page table pages from the ones after that,
+// up to the last page, which has the reset vector.
+const (
+	pageSize      = 0x1000
+	largePageSize = 0x200000
+	ptFirstFree   = PageTableBase + 0x6000
+	ptLimit       = PageTableBase + 0xf000
+	// pteAddr is the physical address in a page table entry.
+	pteAddr = 0x000ffffffffff000
+)
+
+// region returns the memory at physical address pa, to the end of
+// the region it is in.
+func (t *Tracee) region(pa uint64) ([]byte, error) {
+	for _, r := range t.regions {
+		if pa >= r.gpa && pa < r.gpa+uint64(len(r.data)) {
+			return r.data[pa-r.gpa:], nil
+		}
+	}
+	return nil, fmt.Errorf("Address %#x is out of range", pa)
+}
+
+// entry returns the page table entry at pa.
+func (t *Tracee) entry(pa uint64) (uint64, error) {
+	b, err := t.region(pa)
+	if err != nil || len(b) < 8 {
+		return 0, fmt.Errorf("Page table entry at %#x is out of range", pa)
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (t *Tracee) setEntry(pa, e uint64) error {
+	b, err := t.region(pa)
+	if err != nil || len(b) < 8 {
+		return fmt.Errorf("Page table entry at %#x is out of range", pa)
+	}
+	binary.LittleEndian.PutUint64(b, e)
+	return nil
+}
+
+// translate walks our page tables to find the physical address for va.
+// A guest that loads its own page tables won't see what we do here.
+func (t *Tracee) translate(va uint64) (uint64, error) {
+	table := uint64(PageTableBase)
+	for level, shift := 4, uint(39); ; level, shift = level-1, shift-9 {
+		e, err := t.entry(table + ((va>>shift)&0x1ff)*8)
+		if err != nil {
+			return 0, err
+		}
+		if e&PDE64_PRESENT == 0 {
+			return 0, fmt.Errorf("Address %#x is not mapped", va)
+		}
+		if level == 1 || (level < 4 && e&PDE64_PS != 0) {
+			mask := uint64(1)<<shift - 1
+			return e&pteAddr&^mask | va&mask, nil
+		}
+		table = e & pteAddr
+	}
+}
+
+// access reads or writes guest memory at virtual address va, a page
+// at a time, since pages next to each other need not be.
+func (t *Tracee) access(va uintptr, data []byte, write bool) error {
+	for len(data) > 0 {
+		pa, err := t.translate(uint64(va))
+		if err != nil {
+			return err
+		}
+		m, err := t.region(pa)
+		if err != nil {
+			return err
+		}
+		n := pageSize - int(va%pageSize)
+		if n > len(data) {
+			n = len(data)
+		}
+		if n > len(m) {
+			return fmt.Errorf("Address %#x is out of range", va)
+		}
+		if write {
+			copy(m, data[:n])
+		} else {
+			copy(data, m[:n])
+		}
+		va += uintptr(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// newTable returns a zeroed page for a page table.
+func (t *Tracee) newTable() (uint64, error) {
+	if t.ptNext == 0 {
+		t.ptNext = ptFirstFree
+	}
+	if t.ptNext >= ptLimit {
+		return 0, fmt.Errorf("Out of page table pages")
+	}
+	p := t.ptNext
+	t.ptNext += pageSize
+	b, err := t.region(p)
+	if err != nil {
+		return 0, err
+	}
+	for i := range b[:pageSize] {
+		b[i] = 0
+	}
+	return p, nil
+}
+
+// Map maps n bytes at virtual address va to physical address pa, in 4K
+// pages, or 2M pages where both addresses are 2M aligned. The low 4G are
+// mapped one to one already, so mappings there must be to the same
+// address. Map does not remove mappings; it only adds them.
+func (t *Tracee) Map(va, pa, n uint64) error {
+	if va%pageSize != 0 || pa%pageSize != 0 || n%pageSize != 0 {
+		return fmt.Errorf("Map(%#x, %#x, %#x): not page aligned", va, pa, n)
+	}
+	if va < 1<<32 {
+		if va != pa || va+n > 1<<32 {
+			return fmt.Errorf("Map(%#x, %#x, %#x): the low 4G are mapped one to one", va, pa, n)
+		}
+		return nil
+	}
+	for n > 0 {
+		level, size := 1, uint64(pageSize)
+		if va%largePageSize == 0 && pa%largePageSize == 0 && n >= largePageSize {
+			level, size = 2, largePageSize
+		}
+		if err := t.mapPage(va, pa, level); err != nil {
+			return err
+		}
+		va, pa, n = va+size, pa+size, n-size
+	}
+	return nil
+}
+
+// mapPage maps one page, 4K at level 1 or 2M at level 2, adding
+// tables as needed.
+func (t *Tracee) mapPage(va, pa uint64, level int) error {
+	const rw = PDE64_PRESENT | PDE64_RW | PDE64_ACCESSED | PDE64_DIRTY
+	table := uint64(PageTableBase)
+	for l, shift := 4, uint(39); ; l, shift = l-1, shift-9 {
+		ea := table + ((va>>shift)&0x1ff)*8
+		if l == level {
+			e := pa | rw
+			if level == 2 {
+				e |= PDE64_PS
+			}
+			return t.setEntry(ea, e)
+		}
+		e, err := t.entry(ea)
+		if err != nil {
+			return err
+		}
+		if e&PDE64_PRESENT != 0 && e&PDE64_PS != 0 {
+			return fmt.Errorf("Map %#x: it is in a large page that is already mapped", va)
+		}
+		if e&PDE64_PRESENT == 0 {
+			p, err := t.newTable()
+			if err != nil {
+				return err
+			}
+			e = p | rw
+			if err := t.setEntry(ea, e); err != nil {
+				return err
+			}
+		}
+		table = e & pteAddr
+	}
+}
@@ -0,0 +1,56 @@
+package kvm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestMap checks Map and virtual addresses without a VM: just memory
+// at 0, and empty page tables at PageTableBase.
+func TestMap(t *testing.T) {
+	low := make([]byte, 0x400000)
+	tr := &Tracee{regions: []*Region{
+		{gpa: 0, data: low},
+		{gpa: PageTableBase, data: make([]byte, 0x10000)},
+	}}
+	if err := tr.Read(0x1000, make([]byte, 8)); err == nil {
+		t.Errorf("Read with no mappings: got nil, want err")
+	}
+	for _, m := range []struct {
+		va, pa, n uint64
+	}{
+		{0xffffffff80001000, 0x3000, 0x2000},
+		{0x7f0000200000, 0x200000, 0x200000},
+	} {
+		if err := tr.Map(m.va, m.pa, m.n); err != nil {
+			t.Fatalf("Map(%#x, %#x, %#x): got %v, want nil", m.va, m.pa, m.n, err)
+		}
+	}
+	// Across a page boundary, to the next page.
+	want := []byte("hello, virtual world")
+	if err := tr.Write(0xffffffff80001ff8, want); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+	if !bytes.Equal(low[0x3ff8:0x3ff8+len(want)], want) {
+		t.Errorf("Write: physical memory is %q, want %q", low[0x3ff8:0x3ff8+len(want)], want)
+	}
+	got := make([]byte, len(want))
+	if err := tr.Read(0xffffffff80001ff8, got); err != nil {
+		t.Fatalf("Read: got %v, want nil", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Read: got %q, want %q", got, want)
+	}
+	// In the 2M page.
+	low[0x212345] = 0x5a
+	var b [1]byte
+	if err := tr.Read(0x7f0000212345, b[:]); err != nil || b[0] != 0x5a {
+		t.Errorf("Read from 2M page: got %#x, %v, want 0x5a, nil", b[0], err)
+	}
+	if err := tr.Map(0x1000, 0x2000, 0x1000); err == nil {
+		t.Errorf("Map in the low 4G to a different address: got nil, want err")
+	}
+	if err := tr.Map(0xffffffff80000800, 0, 0x1000); err == nil {
+		t.Errorf("Map of an unaligned address: got nil, want err")
+	}
+}
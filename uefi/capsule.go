@@ -0,0 +1,129 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+// Capsule header flags. The low 16 bits are the capsule GUID's business.
+const (
+	CAPSULE_FLAGS_PERSIST_ACROSS_RESET  = 0x00010000
+	CAPSULE_FLAGS_POPULATE_SYSTEM_TABLE = 0x00020000
+	CAPSULE_FLAGS_INITIATE_RESET        = 0x00040000
+)
+
+// CapsuleHeader is an EFI_CAPSULE_HEADER.
+type CapsuleHeader struct {
+	CapsuleGUID      guid.GUID
+	HeaderSize       uint32
+	Flags            uint32
+	CapsuleImageSize uint32
+}
+
+// CapsuleHeaderSize is the size of an EFI_CAPSULE_HEADER.
+var CapsuleHeaderSize = binary.Size(CapsuleHeader{})
+
+// ParseCapsuleHeader decodes the EFI_CAPSULE_HEADER at the start of b.
+func ParseCapsuleHeader(b []byte) (*CapsuleHeader, error) {
+	var h CapsuleHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("capsule header: %v", err)
+	}
+	return &h, nil
+}
+
+// Validate checks the sizes and flags, as UpdateCapsule must.
+func (h *CapsuleHeader) Validate() error {
+	if h.HeaderSize < uint32(CapsuleHeaderSize) || h.HeaderSize > h.CapsuleImageSize {
+		return fmt.Errorf("capsule %v: header size %#x, image size %#x", h.CapsuleGUID, h.HeaderSize, h.CapsuleImageSize)
+	}
+	if h.Flags&CAPSULE_FLAGS_POPULATE_SYSTEM_TABLE != 0 && h.Flags&CAPSULE_FLAGS_PERSIST_ACROSS_RESET == 0 {
+		return fmt.Errorf("capsule %v: flags %#x: POPULATE_SYSTEM_TABLE without PERSIST_ACROSS_RESET", h.CapsuleGUID, h.Flags)
+	}
+	if h.Flags&CAPSULE_FLAGS_INITIATE_RESET != 0 && h.Flags&CAPSULE_FLAGS_PERSIST_ACROSS_RESET == 0 {
+		return fmt.Errorf("capsule %v: flags %#x: INITIATE_RESET without PERSIST_ACROSS_RESET", h.CapsuleGUID, h.Flags)
+	}
+	return nil
+}
+
+// CapsuleBlock is an EFI_CAPSULE_BLOCK_DESCRIPTOR. If Length is 0,
+// Address is the ContinuationPointer to more descriptors, or 0 at the
+// end of the list. Otherwise it is the DataBlock.
+type CapsuleBlock struct {
+	Length  uint64
+	Address uint64
+}
+
+// maxBlocks bounds how many descriptors ScatterGather follows, so that
+// a list that loops does not go on forever.
+const maxBlocks = 1 << 16
+
+// ScatterGather follows a scatter gather list of capsule block
+// descriptors at sg, using read to read guest physical memory, and
+// returns the data blocks it describes, in order.
+func ScatterGather(read func(addr uint64, b []byte) error, sg uint64) ([]CapsuleBlock, error) {
+	var blocks []CapsuleBlock
+	for n := 0; sg != 0; n++ {
+		if n == maxBlocks {
+			return nil, fmt.Errorf("scatter gather list: more than %d descriptors", maxBlocks)
+		}
+		var b [16]byte
+		if err := read(sg, b[:]); err != nil {
+			return nil, fmt.Errorf("scatter gather list at %#x: %v", sg, err)
+		}
+		d := CapsuleBlock{Length: binary.LittleEndian.Uint64(b[:]), Address: binary.LittleEndian.Uint64(b[8:])}
+		if d.Length == 0 {
+			sg = d.Address
+			continue
+		}
+		if d.Address == 0 {
+			return nil, fmt.Errorf("scatter gather list at %#x: %#x bytes at 0", sg, d.Length)
+		}
+		blocks = append(blocks, d)
+		sg += uint64(len(b))
+	}
+	return blocks, nil
+}
+
+// Gather reads the data the blocks describe, and splits it into
+// capsules, which follow each other in it. It reads no more than max
+// bytes, which is all the capsules should need: what is past that is
+// padding, or the guest's mistake.
+func Gather(read func(addr uint64, b []byte) error, blocks []CapsuleBlock, max uint64) ([][]byte, error) {
+	var data []byte
+	for _, d := range blocks {
+		left := max - uint64(len(data))
+		if left == 0 {
+			break
+		}
+		n := d.Length
+		if n > left {
+			n = left
+		}
+		b := make([]byte, n)
+		if err := read(d.Address, b); err != nil {
+			return nil, fmt.Errorf("capsule block at %#x: %v", d.Address, err)
+		}
+		data = append(data, b...)
+	}
+	var capsules [][]byte
+	// Blocks can be padded at the end.
+	for len(bytes.Trim(data, "\x00")) > 0 {
+		h, err := ParseCapsuleHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.Validate(); err != nil {
+			return nil, err
+		}
+		if uint64(h.CapsuleImageSize) > uint64(len(data)) {
+			return nil, fmt.Errorf("capsule %v: image size %#x, but only %#x bytes in the blocks", h.CapsuleGUID, h.CapsuleImageSize, len(data))
+		}
+		capsules = append(capsules, data[:h.CapsuleImageSize])
+		data = data[h.CapsuleImageSize:]
+	}
+	return capsules, nil
+}
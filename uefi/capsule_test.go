@@ -0,0 +1,112 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+// mem is guest memory for tests, from address 0.
+type mem []byte
+
+func (m mem) read(addr uint64, b []byte) error {
+	if addr+uint64(len(b)) > uint64(len(m)) {
+		return fmt.Errorf("%#x is out of range", addr)
+	}
+	copy(b, m[addr:])
+	return nil
+}
+
+func capsule(flags uint32, payload string) []byte {
+	var b bytes.Buffer
+	h := CapsuleHeader{
+		CapsuleGUID:      *guid.MustParse("6DCBD5ED-E82D-4C44-BDA1-7194199AD92A"),
+		HeaderSize:       uint32(CapsuleHeaderSize),
+		Flags:            flags,
+		CapsuleImageSize: uint32(CapsuleHeaderSize + len(payload)),
+	}
+	binary.Write(&b, binary.LittleEndian, &h)
+	b.WriteString(payload)
+	return b.Bytes()
+}
+
+func TestCapsuleValidate(t *testing.T) {
+	for _, tt := range []struct {
+		flags uint32
+		ok    bool
+	}{
+		{0, true},
+		{CAPSULE_FLAGS_PERSIST_ACROSS_RESET, true},
+		{CAPSULE_FLAGS_PERSIST_ACROSS_RESET | CAPSULE_FLAGS_INITIATE_RESET | CAPSULE_FLAGS_POPULATE_SYSTEM_TABLE, true},
+		{CAPSULE_FLAGS_POPULATE_SYSTEM_TABLE, false},
+		{CAPSULE_FLAGS_INITIATE_RESET, false},
+	} {
+		h, err := ParseCapsuleHeader(capsule(tt.flags, "x"))
+		if err != nil {
+			t.Fatalf("ParseCapsuleHeader: got %v, want nil", err)
+		}
+		if err := h.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate with flags %#x: got %v, want ok %v", tt.flags, err, tt.ok)
+		}
+	}
+	h, _ := ParseCapsuleHeader(capsule(0, ""))
+	h.HeaderSize = 8
+	if err := h.Validate(); err == nil {
+		t.Errorf("Validate with a short header: got nil, want err")
+	}
+}
+
+func TestScatterGather(t *testing.T) {
+	m := make(mem, 0x10000)
+	c1, c2 := capsule(0, "first capsule"), capsule(CAPSULE_FLAGS_PERSIST_ACROSS_RESET, "second")
+	all := append(append([]byte{}, c1...), c2...)
+	// Split the two capsules across three blocks, out of order in
+	// memory, with the descriptors in two lists.
+	copy(m[0x3000:], all[:10])
+	copy(m[0x1000:], all[10:40])
+	copy(m[0x2000:], all[40:])
+	put := func(at uint64, ds ...uint64) {
+		for i, d := range ds {
+			binary.LittleEndian.PutUint64(m[at+uint64(i)*8:], d)
+		}
+	}
+	put(0x100, 10, 0x3000, 30, 0x1000, 0, 0x200)
+	put(0x200, uint64(len(all)-40), 0x2000, 0, 0)
+
+	blocks, err := ScatterGather(m.read, 0x100)
+	if err != nil {
+		t.Fatalf("ScatterGather: got %v, want nil", err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("ScatterGather: got %d blocks, want 3", len(blocks))
+	}
+	capsules, err := Gather(m.read, blocks, uint64(len(all)))
+	if err != nil {
+		t.Fatalf("Gather: got %v, want nil", err)
+	}
+	if len(capsules) != 2 || !bytes.Equal(capsules[0], c1) || !bytes.Equal(capsules[1], c2) {
+		t.Errorf("Gather: got %q, want %q and %q", capsules, c1, c2)
+	}
+	// A huge block, after the capsules, is not read.
+	blocks = append(blocks, CapsuleBlock{Length: 1 << 62, Address: 0x8000})
+	if capsules, err := Gather(m.read, blocks, uint64(len(all))); err != nil || len(capsules) != 2 {
+		t.Errorf("Gather with a huge last block: got (%d capsules, %v), want (2, nil)", len(capsules), err)
+	}
+	// Nor is anything past max.
+	if capsules, err := Gather(m.read, blocks, uint64(len(c1))); err != nil || len(capsules) != 1 {
+		t.Errorf("Gather of the first capsule: got (%d capsules, %v), want (1, nil)", len(capsules), err)
+	}
+
+	// A list that loops.
+	put(0x400, 0, 0x400)
+	if _, err := ScatterGather(m.read, 0x400); err == nil {
+		t.Errorf("ScatterGather of a loop: got nil, want err")
+	}
+	// A block that is too short for its capsule.
+	if _, err := Gather(m.read, []CapsuleBlock{{Length: 30, Address: 0x1000}}, 1<<20); err == nil {
+		t.Errorf("Gather of a short block: got nil, want err")
+	}
+}
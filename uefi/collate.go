@@ -0,0 +1,181 @@
+package uefi
+
+import "unicode"
+
+// The string functions of the Unicode Collation protocols. They work on
+// UCS-2 strings, without the terminating NUL. Only characters in the
+// Basic Multilingual Plane change case; surrogates are left alone.
+
+// toUpper returns the upper case of a UCS-2 character.
+func toUpper(c uint16) uint16 {
+	if c >= 0xd800 && c < 0xe000 {
+		return c
+	}
+	u := unicode.ToUpper(rune(c))
+	if u > 0xffff {
+		return c
+	}
+	return uint16(u)
+}
+
+// toLower returns the lower case of a UCS-2 character.
+func toLower(c uint16) uint16 {
+	if c >= 0xd800 && c < 0xe000 {
+		return c
+	}
+	l := unicode.ToLower(rune(c))
+	if l > 0xffff {
+		return c
+	}
+	return uint16(l)
+}
+
+// StriColl compares two strings without regard to case, as StriColl
+// does. It returns 0 if they are equal, less than 0 if s1 is lexically
+// less than s2, and greater than 0 if it is greater.
+func StriColl(s1, s2 []uint16) int {
+	for i := 0; ; i++ {
+		var c1, c2 uint16
+		if i < len(s1) {
+			c1 = toUpper(s1[i])
+		}
+		if i < len(s2) {
+			c2 = toUpper(s2[i])
+		}
+		if c1 != c2 || c1 == 0 {
+			return int(c1) - int(c2)
+		}
+	}
+}
+
+// MetaiMatch says whether s matches pattern, without regard to case.
+// In the pattern, * matches zero or more characters, ? any one
+// character, and [chars] any one of the chars, which may include
+// ranges, as in [a-z].
+func MetaiMatch(s, pattern []uint16) bool {
+	for len(pattern) > 0 {
+		p := pattern[0]
+		pattern = pattern[1:]
+		switch p {
+		case '*':
+			// Try every split, shortest first.
+			for i := 0; i <= len(s); i++ {
+				if MetaiMatch(s[i:], pattern) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			c := toUpper(s[0])
+			s = s[1:]
+			var ok bool
+			var prev uint16
+			for {
+				if len(pattern) == 0 {
+					// An unterminated set matches nothing.
+					return false
+				}
+				p := pattern[0]
+				pattern = pattern[1:]
+				if p == ']' {
+					break
+				}
+				if p == '-' && prev != 0 && len(pattern) > 0 && pattern[0] != ']' {
+					hi := toUpper(pattern[0])
+					pattern = pattern[1:]
+					if c >= prev && c <= hi {
+						ok = true
+					}
+					prev = 0
+					continue
+				}
+				prev = toUpper(p)
+				if c == prev {
+					ok = true
+				}
+			}
+			if !ok {
+				return false
+			}
+		default:
+			if len(s) == 0 || toUpper(s[0]) != toUpper(p) {
+				return false
+			}
+			s = s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// StrLwr converts s to lower case, in place.
+func StrLwr(s []uint16) {
+	for i, c := range s {
+		s[i] = toLower(c)
+	}
+}
+
+// StrUpr converts s to upper case, in place.
+func StrUpr(s []uint16) {
+	for i, c := range s {
+		s[i] = toUpper(c)
+	}
+}
+
+// FatToStr converts at most fatSize characters of an 8.3 FAT file name,
+// in the OEM character set, to a string. It stops at a NUL. We take the
+// OEM character set to be Latin-1, as edk2's English driver does.
+func FatToStr(fat []byte, fatSize int) []uint16 {
+	var s []uint16
+	for i := 0; i < fatSize && i < len(fat) && fat[i] != 0; i++ {
+		s = append(s, uint16(fat[i]))
+	}
+	return s
+}
+
+// fatValid says whether a character can be in a FAT 8.3 name.
+func fatValid(c uint16) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	case c > 0x7f:
+		return false
+	}
+	for _, v := range "$%'-_@~`!(){}^#&" {
+		if c == uint16(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// StrToFat converts s to an upper case FAT 8.3 name of at most fatSize
+// characters. Spaces and periods are dropped, and characters FAT does
+// not allow become '_'. It returns the name, and whether any
+// character was replaced.
+func StrToFat(s []uint16, fatSize int) ([]byte, bool) {
+	var fat []byte
+	var replaced bool
+	for _, c := range s {
+		if len(fat) == fatSize {
+			break
+		}
+		if c == '.' || c == ' ' {
+			continue
+		}
+		if !fatValid(c) {
+			fat = append(fat, '_')
+			replaced = true
+			continue
+		}
+		fat = append(fat, byte(toUpper(c)))
+	}
+	return fat, replaced
+}
@@ -0,0 +1,94 @@
+package uefi
+
+import (
+	"testing"
+	"unicode/utf16"
+)
+
+func u(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+func TestStriColl(t *testing.T) {
+	for _, tt := range []struct {
+		s1, s2 string
+		want   int
+	}{
+		{"Hello World", "hello world", 0},
+		{"Hello World", "Hello", 1},
+		{"Hello", "Hello World", -1},
+		{"abc", "ABD", -1},
+		{"ÄÖÜ", "äöü", 0},
+		{"", "", 0},
+	} {
+		got := StriColl(u(tt.s1), u(tt.s2))
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("StriColl(%q, %q): got %d, want sign of %d", tt.s1, tt.s2, got, tt.want)
+		}
+	}
+}
+
+func TestMetaiMatch(t *testing.T) {
+	for _, tt := range []struct {
+		s, p string
+		want bool
+	}{
+		{"Hello World", "*", true},
+		{"Hello World", "hello world", true},
+		{"Hello World", "H*", true},
+		{"Hello World", "*d", true},
+		{"Hello World", "*?rld", true},
+		{"Hello World", "?ELLO*", true},
+		{"Hello World", "[a-h]ello*", true},
+		{"Hello World", "[ABC]ello*", false},
+		{"Hello World", "[xyzh]ello World", true},
+		{"Hello World", "Hello", false},
+		{"Hello World", "Hello World?", false},
+		{"Hello World", "*x*", false},
+		{"", "*", true},
+		{"", "?", false},
+		{"a-b", "a[-]b", true},
+		{"abc", "a[b", false},
+	} {
+		if got := MetaiMatch(u(tt.s), u(tt.p)); got != tt.want {
+			t.Errorf("MetaiMatch(%q, %q): got %v, want %v", tt.s, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestStrLwrUpr(t *testing.T) {
+	s := u("Hello World ÄÖ")
+	StrUpr(s)
+	if got := string(utf16.Decode(s)); got != "HELLO WORLD ÄÖ" {
+		t.Errorf("StrUpr: got %q, want %q", got, "HELLO WORLD ÄÖ")
+	}
+	StrLwr(s)
+	if got := string(utf16.Decode(s)); got != "hello world äö" {
+		t.Errorf("StrLwr: got %q, want %q", got, "hello world äö")
+	}
+}
+
+func TestFat(t *testing.T) {
+	if got := string(utf16.Decode(FatToStr([]byte("U-Boot\x00xx"), 5))); got != "U-Boo" {
+		t.Errorf("FatToStr(U-Boot, 5): got %q, want %q", got, "U-Boo")
+	}
+	if got := string(utf16.Decode(FatToStr([]byte("U-Boot\x00xx"), 9))); got != "U-Boot" {
+		t.Errorf("FatToStr(U-Boot, 9): got %q, want %q", got, "U-Boot")
+	}
+	for _, tt := range []struct {
+		s        string
+		n        int
+		want     string
+		replaced bool
+	}{
+		{"U -Boo.t", 6, "U-BOOT", false},
+		{"U -Boo.t", 3, "U-B", false},
+		{"U\\Boot", 6, "U_BOOT", true},
+		{"a+b", 8, "A_B", true},
+	} {
+		fat, r := StrToFat(u(tt.s), tt.n)
+		if string(fat) != tt.want || r != tt.replaced {
+			t.Errorf("StrToFat(%q, %d): got %q, %v, want %q, %v", tt.s, tt.n, fat, r, tt.want, tt.replaced)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package depex evaluates the dependency expressions of DXE drivers,
+// from their DEPEX sections, as fiano parses them. An expression is
+// either BEFORE or AFTER another driver, which is about order, not
+// protocols; or a postfix expression over which protocols are
+// installed, which might start with SOR, schedule on request.
+package depex
+
+import (
+	"fmt"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// Kind is what sort of expression it is.
+type Kind int
+
+// Kinds of expression.
+const (
+	// Protocols is the usual kind: the driver can run when the
+	// expression is true.
+	Protocols Kind = iota
+	// Before means the driver runs just before the one named.
+	Before
+	// After means the driver runs just after the one named.
+	After
+	// OnRequest means the driver only runs when something asks for
+	// it with the Schedule service, and the expression is true.
+	OnRequest
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Protocols:
+		return "protocols"
+	case Before:
+		return "BEFORE"
+	case After:
+		return "AFTER"
+	case OnRequest:
+		return "SOR"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Expr is a dependency expression.
+type Expr struct {
+	Kind Kind
+	// GUID is the file GUID of the driver for Before and After.
+	GUID guid.GUID
+	// ops is the postfix expression, for Protocols and OnRequest.
+	ops []uefi.DepExOp
+}
+
+// Parse checks ops and returns the expression. No ops, for a driver
+// with no DEPEX section, is an expression that is always true.
+func Parse(ops []uefi.DepExOp) (*Expr, error) {
+	e := &Expr{}
+	if len(ops) == 0 {
+		return e, nil
+	}
+	switch ops[0].OpCode {
+	case "BEFORE", "AFTER":
+		if ops[0].GUID == nil {
+			return nil, fmt.Errorf("%s has no GUID", ops[0].OpCode)
+		}
+		if len(ops) != 2 || ops[1].OpCode != "END" {
+			return nil, fmt.Errorf("%s %s: has to be followed by END, and nothing else", ops[0].OpCode, ops[0].GUID)
+		}
+		e.Kind, e.GUID = Before, *ops[0].GUID
+		if ops[0].OpCode == "AFTER" {
+			e.Kind = After
+		}
+		return e, nil
+	case "SOR":
+		e.Kind = OnRequest
+		ops = ops[1:]
+	}
+	// Run it once with everything installed to check the ops.
+	if _, _, err := eval(ops, func(*guid.GUID) bool { return true }); err != nil {
+		return nil, err
+	}
+	e.ops = ops
+	return e, nil
+}
+
+// Eval evaluates a Protocols or OnRequest expression, with installed
+// saying whether there is a protocol. If it is false, it also returns
+// the protocols it pushed that are not installed, which is usually
+// what it is waiting for. Before and After expressions are always true.
+func (e *Expr) Eval(installed func(*guid.GUID) bool) (bool, []guid.GUID) {
+	ok, missing, _ := eval(e.ops, installed)
+	if ok {
+		return true, nil
+	}
+	return false, missing
+}
+
+func eval(ops []uefi.DepExOp, installed func(*guid.GUID) bool) (bool, []guid.GUID, error) {
+	if len(ops) == 0 {
+		return true, nil, nil
+	}
+	var (
+		stack   []bool
+		missing []guid.GUID
+		seen    = map[guid.GUID]bool{}
+	)
+	pop := func(op string) (bool, error) {
+		if len(stack) == 0 {
+			return false, fmt.Errorf("%s: stack is empty", op)
+		}
+		b := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return b, nil
+	}
+	for i, op := range ops {
+		switch op.OpCode {
+		case "PUSH":
+			if op.GUID == nil {
+				return false, nil, fmt.Errorf("PUSH at %d has no GUID", i)
+			}
+			b := installed(op.GUID)
+			if !b && !seen[*op.GUID] {
+				seen[*op.GUID] = true
+				missing = append(missing, *op.GUID)
+			}
+			stack = append(stack, b)
+		case "TRUE":
+			stack = append(stack, true)
+		case "FALSE":
+			stack = append(stack, false)
+		case "NOT":
+			b, err := pop(op.OpCode)
+			if err != nil {
+				return false, nil, err
+			}
+			stack = append(stack, !b)
+		case "AND", "OR":
+			a, err := pop(op.OpCode)
+			if err != nil {
+				return false, nil, err
+			}
+			b, err := pop(op.OpCode)
+			if err != nil {
+				return false, nil, err
+			}
+			if op.OpCode == "AND" {
+				stack = append(stack, a && b)
+			} else {
+				stack = append(stack, a || b)
+			}
+		case "END":
+			if i != len(ops)-1 {
+				return false, nil, fmt.Errorf("END at %d of %d ops", i, len(ops))
+			}
+			if len(stack) != 1 {
+				return false, nil, fmt.Errorf("END: %d values on the stack, not 1", len(stack))
+			}
+			return stack[0], missing, nil
+		case "BEFORE", "AFTER", "SOR":
+			return false, nil, fmt.Errorf("%s at %d: it can only be first", op.OpCode, i)
+		default:
+			return false, nil, fmt.Errorf("unknown op %q at %d", op.OpCode, i)
+		}
+	}
+	return false, nil, fmt.Errorf("no END")
+}
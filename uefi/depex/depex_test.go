@@ -0,0 +1,86 @@
+package depex
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+var (
+	a = guid.MustParse("11111111-1111-1111-1111-111111111111")
+	b = guid.MustParse("22222222-2222-2222-2222-222222222222")
+	c = guid.MustParse("33333333-3333-3333-3333-333333333333")
+)
+
+func op(s string, g ...*guid.GUID) uefi.DepExOp {
+	if len(g) == 0 {
+		return uefi.DepExOp{OpCode: s}
+	}
+	return uefi.DepExOp{OpCode: s, GUID: g[0]}
+}
+
+// only has the protocol a.
+func only(g *guid.GUID) bool {
+	return *g == *a
+}
+
+func TestEval(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		ops     []uefi.DepExOp
+		kind    Kind
+		ok      bool
+		missing []guid.GUID
+	}{
+		{"none", nil, Protocols, true, nil},
+		{"true", []uefi.DepExOp{op("TRUE"), op("END")}, Protocols, true, nil},
+		{"false", []uefi.DepExOp{op("FALSE"), op("END")}, Protocols, false, nil},
+		{"push", []uefi.DepExOp{op("PUSH", a), op("END")}, Protocols, true, nil},
+		{"missing", []uefi.DepExOp{op("PUSH", b), op("END")}, Protocols, false, []guid.GUID{*b}},
+		{"and", []uefi.DepExOp{op("PUSH", a), op("PUSH", b), op("AND"), op("PUSH", c), op("PUSH", b), op("AND"), op("AND"), op("END")}, Protocols, false, []guid.GUID{*b, *c}},
+		{"or", []uefi.DepExOp{op("PUSH", b), op("PUSH", a), op("OR"), op("END")}, Protocols, true, nil},
+		{"not", []uefi.DepExOp{op("PUSH", b), op("NOT"), op("END")}, Protocols, true, nil},
+		{"sor", []uefi.DepExOp{op("SOR"), op("PUSH", a), op("END")}, OnRequest, true, nil},
+		{"before", []uefi.DepExOp{op("BEFORE", b), op("END")}, Before, true, nil},
+		{"after", []uefi.DepExOp{op("AFTER", b), op("END")}, After, true, nil},
+	} {
+		e, err := Parse(tt.ops)
+		if err != nil {
+			t.Errorf("%s: Parse: got %v, want nil", tt.name, err)
+			continue
+		}
+		if e.Kind != tt.kind {
+			t.Errorf("%s: Kind: got %v, want %v", tt.name, e.Kind, tt.kind)
+		}
+		if (e.Kind == Before || e.Kind == After) && e.GUID != *b {
+			t.Errorf("%s: GUID: got %v, want %v", tt.name, e.GUID, b)
+		}
+		ok, missing := e.Eval(only)
+		if ok != tt.ok || !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("%s: Eval: got (%v, %v), want (%v, %v)", tt.name, ok, missing, tt.ok, tt.missing)
+		}
+	}
+}
+
+func TestParseBad(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ops  []uefi.DepExOp
+	}{
+		{"no end", []uefi.DepExOp{op("TRUE")}},
+		{"empty stack", []uefi.DepExOp{op("AND"), op("END")}},
+		{"two left", []uefi.DepExOp{op("TRUE"), op("TRUE"), op("END")}},
+		{"after end", []uefi.DepExOp{op("TRUE"), op("END"), op("TRUE")}},
+		{"push no guid", []uefi.DepExOp{op("PUSH"), op("END")}},
+		{"before no guid", []uefi.DepExOp{op("BEFORE"), op("END")}},
+		{"before more", []uefi.DepExOp{op("BEFORE", a), op("PUSH", b), op("END")}},
+		{"sor late", []uefi.DepExOp{op("TRUE"), op("SOR"), op("END")}},
+		{"unknown", []uefi.DepExOp{op("XOR"), op("END")}},
+	} {
+		if e, err := Parse(tt.ops); err == nil {
+			t.Errorf("%s: Parse: got (%v, nil), want error", tt.name, e)
+		}
+	}
+}
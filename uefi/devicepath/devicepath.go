@@ -16,9 +16,10 @@
 package devicepath
 
 import (
+	"encoding/binary"
 	"fmt"
 	"strings"
-	"unsafe"
+	"unicode/utf16"
 
 	"github.com/linuxboot/fiano/pkg/guid"
 )
@@ -32,6 +33,12 @@ const (
 	SubTypeEnd  = 0xff
 )
 
+// HeaderSize is the size of a Header.
+const HeaderSize = 4
+
+// MaxNodeSize is the biggest a node can be, since Length is 16 bits.
+const MaxNodeSize = 0xffff
+
 // Header is the common Device Path header.
 type Header struct {
 	Type    uint8
@@ -39,10 +46,13 @@ type Header struct {
 	Length  uint16
 }
 
+// Path is a device path node. String returns the node in the text form
+// of the UEFI spec, chapter 10.6.
 type Path interface {
 	Header() Header
 	// Blob return []byte so that they can easily be concatenated.
 	Blob() []byte
+	String() string
 }
 
 // MAC is a MAC address
@@ -52,6 +62,7 @@ type MACAddress struct {
 
 const (
 	TypeDevice    = 0x01
+	SubTypePCI    = 0x01
 	SubTypeMemory = 0x03
 	SubTypeVendor = 0x04
 )
@@ -60,19 +71,67 @@ func hdrBlob(h Header) []byte {
 	return []byte{h.Type, h.SubType, uint8(h.Length), uint8(h.Length >> 8)}
 }
 
+// node returns the blob for a node of type t and subtype s with data d.
+// If it is more than MaxNodeSize, the length is wrong; NodeFromText,
+// where such nodes come from, checks.
+func node(t, s uint8, d ...[]byte) []byte {
+	var b []byte
+	for _, x := range d {
+		b = append(b, x...)
+	}
+	return append(hdrBlob(Header{Type: t, SubType: s, Length: uint16(HeaderSize + len(b))}), b...)
+}
+
+// header returns the header of a blob made by node.
+func header(b []byte) Header {
+	return Header{Type: b[0], SubType: b[1], Length: binary.LittleEndian.Uint16(b[2:])}
+}
+
+func le16(v uint16) []byte {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	return b[:]
+}
+
+func le32(v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func le64(v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
 // End is an end of device path.
 type End struct{}
 
 var _ Path = &End{}
 
 func (e *End) Header() Header {
-	return Header{Type: TypeEnd, SubType: SubTypeEnd, Length: uint16(unsafe.Sizeof(Header{}))}
+	return Header{Type: TypeEnd, SubType: SubTypeEnd, Length: HeaderSize}
 }
 
 func (e *End) Blob() []byte {
 	return hdrBlob(e.Header())
 }
 
+// EndInstance ends one instance of a multi-instance device path.
+// Another instance follows it.
+type EndInstance struct{}
+
+var _ Path = &EndInstance{}
+
+func (e *EndInstance) Header() Header {
+	return Header{Type: TypeEnd, SubType: InstanceEnd, Length: HeaderSize}
+}
+
+func (e *EndInstance) Blob() []byte {
+	return hdrBlob(e.Header())
+}
+
 // Root is a pre-filled-in Root record.
 // Do we need it? u-boot did but who knows.
 type Root struct{}
@@ -80,16 +139,31 @@ type Root struct{}
 var _ Path = &Root{}
 
 func (r *Root) Header() Header {
-	return Header{Type: TypeDevice, SubType: SubTypeVendor, Length: uint16(unsafe.Sizeof(Vendor{}))}
+	return header(r.Blob())
 }
 
 func (r *Root) Blob() []byte {
-	return append(hdrBlob(r.Header()), RootGUID[:]...)
+	return node(TypeDevice, SubTypeVendor, RootGUID[:])
+}
+
+// PCI is a PCI device and function.
+type PCI struct {
+	Function uint8
+	Device   uint8
+}
+
+var _ Path = &PCI{}
+
+func (p *PCI) Header() Header {
+	return header(p.Blob())
+}
+
+func (p *PCI) Blob() []byte {
+	return node(TypeDevice, SubTypePCI, []byte{p.Function, p.Device})
 }
 
 // Memory is for memory
 type Memory struct {
-	h     Header
 	Type  uint32
 	Start uint64
 	End   uint64
@@ -98,21 +172,30 @@ type Memory struct {
 var _ Path = &Memory{}
 
 func (m *Memory) Header() Header {
-	return m.h
+	return header(m.Blob())
 }
 
 func (m *Memory) Blob() []byte {
-	return []byte{}
+	return node(TypeDevice, SubTypeMemory, le32(m.Type), le64(m.Start), le64(m.End))
 }
 
 // Vendor is for vendor data.
 type Vendor struct {
-	h    Header
 	GUID guid.GUID
 
 	Data []uint8
 }
 
+var _ Path = &Vendor{}
+
+func (v *Vendor) Header() Header {
+	return header(v.Blob())
+}
+
+func (v *Vendor) Blob() []byte {
+	return node(TypeDevice, SubTypeVendor, v.GUID[:], v.Data)
+}
+
 const (
 	TypeACPI    = 2
 	SubTypeACPI = 1
@@ -130,11 +213,20 @@ func EFIPNPID(ID int) uint32 {
 
 // an ACPI path
 type ACPI struct {
-	h   Header
 	HID uint32
 	UID uint32
 }
 
+var _ Path = &ACPI{}
+
+func (a *ACPI) Header() Header {
+	return header(a.Blob())
+}
+
+func (a *ACPI) Blob() []byte {
+	return node(TypeACPI, SubTypeACPI, le32(a.HID), le32(a.UID))
+}
+
 // This section is called"UEFI doesn't understand storage abstractions"
 const (
 	TypeMessaging   = 3
@@ -148,7 +240,6 @@ const (
 )
 
 type ATAPI struct {
-	h                Header
 	PrimarySecondary uint8
 	// Cringe.
 	// SlaveMaster uint8
@@ -156,8 +247,17 @@ type ATAPI struct {
 	LUN        uint16
 }
 
+var _ Path = &ATAPI{}
+
+func (a *ATAPI) Header() Header {
+	return header(a.Blob())
+}
+
+func (a *ATAPI) Blob() []byte {
+	return node(TypeMessaging, SubTypeATAPI, []byte{a.PrimarySecondary, a.TargetHost}, le16(a.LUN))
+}
+
 type SCSI struct {
-	h        Header
 	TargetID uint16
 	LUN      uint16
 }
@@ -165,27 +265,44 @@ type SCSI struct {
 var _ Path = &SCSI{}
 
 func (s *SCSI) Header() Header {
-	return Header{Type: TypeMessaging, SubType: SubTypeSCSI, Length: uint16(unsafe.Sizeof(SCSI{}))}
+	return header(s.Blob())
 }
 
 func (s *SCSI) Blob() []byte {
-	return append(hdrBlob(s.Header()), uint8(s.TargetID), uint8(s.TargetID>>8), uint8(s.LUN), uint8(s.LUN>>8))
+	return node(TypeMessaging, SubTypeSCSI, le16(s.TargetID), le16(s.LUN))
 }
 
 type USB struct {
-	h            Header
 	ParentPort   uint8
 	USBInterface uint8
 }
 
+var _ Path = &USB{}
+
+func (u *USB) Header() Header {
+	return header(u.Blob())
+}
+
+func (u *USB) Blob() []byte {
+	return node(TypeMessaging, SubTypeUSB, []byte{u.ParentPort, u.USBInterface})
+}
+
 type MAC struct {
-	h      Header
 	MAC    MACAddress
 	IFType uint8
 }
 
+var _ Path = &MAC{}
+
+func (m *MAC) Header() Header {
+	return header(m.Blob())
+}
+
+func (m *MAC) Blob() []byte {
+	return node(TypeMessaging, SubTypeMAC, m.MAC.Addr[:], []byte{m.IFType})
+}
+
 type USBClass struct {
-	h              Header
 	VID            uint16
 	DID            uint16
 	Class          uint8
@@ -193,151 +310,145 @@ type USBClass struct {
 	DeviceProtocol uint8
 }
 
-type MMC struct {
-	h          Header
-	SlotNumber uint8
-}
-
-const (
-	TypeMedia        = 4
-	SubTypeHardDrive = 1
-	SubTypeCDROM     = 2
-	SubTypeFile      = 4
-)
+var _ Path = &USBClass{}
 
-type HardDrive struct {
-	h                  Header
-	Partition          uint32
-	PartitionStart     uint64
-	PartitionEnd       uint64
-	PartitionSignature [16]uint8
-	PartmapType        uint8
-	SignatureType      uint8
+func (u *USBClass) Header() Header {
+	return header(u.Blob())
 }
 
-type CDROM struct {
-	h              Header
-	BootEntry      uint32
-	PartitionStart uint64
-	PartitionEnd   uint64
+func (u *USBClass) Blob() []byte {
+	return node(TypeMessaging, SubTypeUSBClass, le16(u.VID), le16(u.DID), []byte{u.Class, u.SubClass, u.DeviceProtocol})
 }
 
-type FILE struct {
-	h Header
-	// oh god UEFI.
-	// String. uint16.
-	str []uint16
+// SD is an SD card slot.
+type SD struct {
+	SlotNumber uint8
 }
 
-const (
-	DEVICE_PATH_GUID = "09576E91-6D3F-11D2-8E39-00A0C969723B"
-	U_BOOT_GUID      = "e61d73b9-a384-4acc-aeab-82e828f3628b"
-)
-
-var (
-	DevicePathGUID = guid.MustParse(DEVICE_PATH_GUID)
-	RootGUID       = guid.MustParse(U_BOOT_GUID)
-)
+var _ Path = &SD{}
 
-var _ Path = &Vendor{}
+func (s *SD) Header() Header {
+	return header(s.Blob())
+}
 
-func (v *Vendor) Header() Header {
-	return v.h
+func (s *SD) Blob() []byte {
+	return node(TypeMessaging, SubTypeMSGSD, []byte{s.SlotNumber})
 }
 
-func (v *Vendor) Blob() []byte {
-	return []byte{}
+// MMC is an eMMC slot.
+type MMC struct {
+	SlotNumber uint8
 }
 
-var _ Path = &ACPI{}
+var _ Path = &MMC{}
 
-func (a *ACPI) Header() Header {
-	return a.h
+func (m *MMC) Header() Header {
+	return header(m.Blob())
 }
 
-func (a *ACPI) Blob() []byte {
-	return []byte{}
+func (m *MMC) Blob() []byte {
+	return node(TypeMessaging, SubTypeMSGMMC, []byte{m.SlotNumber})
 }
 
-var _ Path = &ATAPI{}
-
-func (a *ATAPI) Header() Header {
-	return a.h
-}
+const (
+	TypeMedia        = 4
+	SubTypeHardDrive = 1
+	SubTypeCDROM     = 2
+	SubTypeFile      = 4
+)
 
-func (a *ATAPI) Blob() []byte {
-	return []byte{}
-}
+// Partition map and signature types, for HardDrive.
+const (
+	PartmapMBR = 1
+	PartmapGPT = 2
 
-var _ Path = &USB{}
+	SignatureNone = 0
+	SignatureMBR  = 1
+	SignatureGUID = 2
+)
 
-func (u *USB) Header() Header {
-	return u.h
+type HardDrive struct {
+	Partition          uint32
+	PartitionStart     uint64
+	PartitionSize      uint64
+	PartitionSignature [16]uint8
+	PartmapType        uint8
+	SignatureType      uint8
 }
 
-func (u *USB) Blob() []byte {
-	return []byte{}
-}
+var _ Path = &HardDrive{}
 
-var _ Path = &MAC{}
+func (h *HardDrive) Header() Header {
+	return header(h.Blob())
+}
 
-func (m *MAC) Header() Header {
-	return m.h
+func (h *HardDrive) Blob() []byte {
+	return node(TypeMedia, SubTypeHardDrive, le32(h.Partition), le64(h.PartitionStart), le64(h.PartitionSize),
+		h.PartitionSignature[:], []byte{h.PartmapType, h.SignatureType})
 }
 
-func (m *MAC) Blob() []byte {
-	return []byte{}
+type CDROM struct {
+	BootEntry      uint32
+	PartitionStart uint64
+	PartitionSize  uint64
 }
 
-var _ Path = &USBClass{}
+var _ Path = &CDROM{}
 
-func (u *USBClass) Header() Header {
-	return u.h
+func (c *CDROM) Header() Header {
+	return header(c.Blob())
 }
 
-func (u *USBClass) Blob() []byte {
-	return []byte{}
+func (c *CDROM) Blob() []byte {
+	return node(TypeMedia, SubTypeCDROM, le32(c.BootEntry), le64(c.PartitionStart), le64(c.PartitionSize))
 }
 
-var _ Path = &MMC{}
-
-func (m *MMC) Header() Header {
-	return m.h
+type FILE struct {
+	// oh god UEFI.
+	// String. uint16.
+	Name string
 }
 
-func (m *MMC) Blob() []byte {
-	return []byte{}
-}
+var _ Path = &FILE{}
 
-var _ Path = &HardDrive{}
+func (f *FILE) Header() Header {
+	return header(f.Blob())
+}
 
-func (h *HardDrive) Header() Header {
-	return h.h
+func (f *FILE) Blob() []byte {
+	var b []byte
+	for _, c := range append(utf16.Encode([]rune(f.Name)), 0) {
+		b = append(b, le16(c)...)
+	}
+	return node(TypeMedia, SubTypeFile, b)
 }
 
-func (h *HardDrive) Blob() []byte {
-	return []byte{}
+// Raw is a node of a type we don't know, kept as it is.
+type Raw struct {
+	Type    uint8
+	SubType uint8
+	Data    []byte
 }
 
-var _ Path = &CDROM{}
+var _ Path = &Raw{}
 
-func (c *CDROM) Header() Header {
-	return c.h
+func (r *Raw) Header() Header {
+	return header(r.Blob())
 }
 
-func (c *CDROM) Blob() []byte {
-	return []byte{}
+func (r *Raw) Blob() []byte {
+	return node(r.Type, r.SubType, r.Data)
 }
 
-var _ Path = &FILE{}
-
-func (f *FILE) Header() Header {
-	return f.h
-}
+const (
+	DEVICE_PATH_GUID = "09576E91-6D3F-11D2-8E39-00A0C969723B"
+	U_BOOT_GUID      = "e61d73b9-a384-4acc-aeab-82e828f3628b"
+)
 
-func (f *FILE) Blob() []byte {
-	return []byte{}
-}
+var (
+	DevicePathGUID = guid.MustParse(DEVICE_PATH_GUID)
+	RootGUID       = guid.MustParse(U_BOOT_GUID)
+)
 
 // TypeNames provides a name for a Device Path Type
 var TypeNames = map[uint8]string{
@@ -381,13 +492,15 @@ func (h *Header) String() string {
 }
 
 // Marshal marshals a string to a []Path, returning an error if any.
-// The string is of the form a/b@parm@parm@parm/d
+// The string is of the form a/b@parm@parm@parm/d, where the elements
+// are either our own short names, e.g. scsi, or nodes in the UEFI
+// text form, e.g. Pci(0x1,0x0). A Root comes first.
 func Marshal(s string) ([]Path, error) {
 	paths := []Path{&Root{}}
 	if len(s) == 0 {
 		return paths, nil
 	}
-	ops := strings.Split(s, "/")
+	ops := splitText(s, '/')
 	Debug("Marshal: %d paths %v", len(ops), ops)
 	for i, el := range ops {
 		args := strings.Split(el, "@")
@@ -399,7 +512,13 @@ func Marshal(s string) ([]Path, error) {
 		case "scsi":
 			p = &SCSI{}
 		default:
-			return nil, fmt.Errorf("Unknown path type %q", args[0])
+			if !strings.HasSuffix(el, ")") {
+				return nil, fmt.Errorf("Unknown path type %q", args[0])
+			}
+			var err error
+			if p, err = NodeFromText(el); err != nil {
+				return nil, err
+			}
 		}
 		paths = append(paths, p)
 	}
@@ -413,3 +532,160 @@ func Blob(paths ...Path) []byte {
 	}
 	return b
 }
+
+// decode decodes the data of a node with header h.
+func decode(h Header, d []byte) (Path, error) {
+	// want checks a node that is always the same size has n bytes of
+	// data, and atLeast checks one with a variable part has at least n.
+	want := func(n int) error {
+		if len(d) != n {
+			return fmt.Errorf("%v node: length %d, want %d", &h, HeaderSize+len(d), HeaderSize+n)
+		}
+		return nil
+	}
+	atLeast := func(n int) error {
+		if len(d) < n {
+			return fmt.Errorf("%v node: length %d, want at least %d", &h, HeaderSize+len(d), HeaderSize+n)
+		}
+		return nil
+	}
+	u16 := func(o int) uint16 { return binary.LittleEndian.Uint16(d[o:]) }
+	u32 := func(o int) uint32 { return binary.LittleEndian.Uint32(d[o:]) }
+	u64 := func(o int) uint64 { return binary.LittleEndian.Uint64(d[o:]) }
+	switch {
+	case h.Type == TypeEnd && h.SubType == SubTypeEnd:
+		if err := want(0); err != nil {
+			return nil, err
+		}
+		return &End{}, nil
+	case h.Type == TypeEnd && h.SubType == InstanceEnd:
+		if err := want(0); err != nil {
+			return nil, err
+		}
+		return &EndInstance{}, nil
+	case h.Type == TypeEnd:
+		return nil, fmt.Errorf("%v node: end subtype %#x, want %#x or %#x", &h, h.SubType, SubTypeEnd, InstanceEnd)
+	case h.Type == TypeDevice && h.SubType == SubTypePCI:
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		return &PCI{Function: d[0], Device: d[1]}, nil
+	case h.Type == TypeDevice && h.SubType == SubTypeMemory:
+		if err := want(20); err != nil {
+			return nil, err
+		}
+		return &Memory{Type: u32(0), Start: u64(4), End: u64(12)}, nil
+	case h.Type == TypeDevice && h.SubType == SubTypeVendor:
+		if err := atLeast(16); err != nil {
+			return nil, err
+		}
+		v := &Vendor{Data: append([]byte{}, d[16:]...)}
+		copy(v.GUID[:], d)
+		return v, nil
+	case h.Type == TypeACPI && h.SubType == SubTypeACPI:
+		if err := want(8); err != nil {
+			return nil, err
+		}
+		return &ACPI{HID: u32(0), UID: u32(4)}, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeATAPI:
+		if err := want(4); err != nil {
+			return nil, err
+		}
+		return &ATAPI{PrimarySecondary: d[0], TargetHost: d[1], LUN: u16(2)}, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeSCSI:
+		if err := want(4); err != nil {
+			return nil, err
+		}
+		return &SCSI{TargetID: u16(0), LUN: u16(2)}, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeUSB:
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		return &USB{ParentPort: d[0], USBInterface: d[1]}, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeMAC:
+		if err := want(33); err != nil {
+			return nil, err
+		}
+		m := &MAC{IFType: d[32]}
+		copy(m.MAC.Addr[:], d)
+		return m, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeUSBClass:
+		if err := want(7); err != nil {
+			return nil, err
+		}
+		return &USBClass{VID: u16(0), DID: u16(2), Class: d[4], SubClass: d[5], DeviceProtocol: d[6]}, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeMSGSD:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		return &SD{SlotNumber: d[0]}, nil
+	case h.Type == TypeMessaging && h.SubType == SubTypeMSGMMC:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		return &MMC{SlotNumber: d[0]}, nil
+	case h.Type == TypeMedia && h.SubType == SubTypeHardDrive:
+		if err := want(38); err != nil {
+			return nil, err
+		}
+		hd := &HardDrive{Partition: u32(0), PartitionStart: u64(4), PartitionSize: u64(12), PartmapType: d[36], SignatureType: d[37]}
+		copy(hd.PartitionSignature[:], d[20:])
+		return hd, nil
+	case h.Type == TypeMedia && h.SubType == SubTypeCDROM:
+		if err := want(20); err != nil {
+			return nil, err
+		}
+		return &CDROM{BootEntry: u32(0), PartitionStart: u64(4), PartitionSize: u64(12)}, nil
+	case h.Type == TypeMedia && h.SubType == SubTypeFile:
+		if len(d)%2 != 0 {
+			return nil, fmt.Errorf("%v node: length %d: a file path is CHAR16s, so it must be even", &h, h.Length)
+		}
+		var s []uint16
+		for i := 0; i < len(d); i += 2 {
+			c := u16(i)
+			if c == 0 {
+				break
+			}
+			s = append(s, c)
+		}
+		return &FILE{Name: string(utf16.Decode(s))}, nil
+	}
+	return &Raw{Type: h.Type, SubType: h.SubType, Data: append([]byte{}, d...)}, nil
+}
+
+// ParseNode decodes the node at the start of b. It returns the node,
+// and its length.
+func ParseNode(b []byte) (Path, int, error) {
+	if len(b) < HeaderSize {
+		return nil, 0, fmt.Errorf("device path: %d bytes is too short for a node", len(b))
+	}
+	h := header(b)
+	if h.Length < HeaderSize || int(h.Length) > len(b) {
+		return nil, 0, fmt.Errorf("device path: node %v: bad length", &h)
+	}
+	p, err := decode(h, b[HeaderSize:h.Length])
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, int(h.Length), nil
+}
+
+// Parse decodes the binary device path in b, up to and including the
+// End node. Nodes of types we don't know are Raw.
+func Parse(b []byte) ([]Path, error) {
+	var paths []Path
+	for off := 0; ; {
+		if off == len(b) {
+			return nil, fmt.Errorf("device path: no end node")
+		}
+		p, n, err := ParseNode(b[off:])
+		if err != nil {
+			return nil, fmt.Errorf("at offset %d: %v", off, err)
+		}
+		paths = append(paths, p)
+		off += n
+		if _, ok := p.(*End); ok {
+			return paths, nil
+		}
+	}
+}
@@ -11,7 +11,7 @@ func TestType(t *testing.T) {
 		p   Path
 		out []byte
 	}{
-		{p: &Root{}, out: append([]byte{0x01, 0x04, 0x30, 0x00}, RootGUID[:]...)},
+		{p: &Root{}, out: append([]byte{0x01, 0x04, 0x14, 0x00}, RootGUID[:]...)},
 		{p: &End{}, out: []byte{0x7f, 0xff, 0x04, 0x00}},
 	} {
 		b := tt.p.Blob()
@@ -29,9 +29,9 @@ func TestPaths(t *testing.T) {
 		err error
 		out []byte
 	}{
-		{p: "", err: nil, out: []byte{0x01, 0x04, 0x30, 0x00, 0xb9, 0x73, 0x1d, 0xe6, 0x84, 0xa3, 0xcc, 0x4a, 0xae, 0xab, 0x82, 0xe8, 0x28, 0xf3, 0x62, 0x8b}},
+		{p: "", err: nil, out: []byte{0x01, 0x04, 0x14, 0x00, 0xb9, 0x73, 0x1d, 0xe6, 0x84, 0xa3, 0xcc, 0x4a, 0xae, 0xab, 0x82, 0xe8, 0x28, 0xf3, 0x62, 0x8b}},
 		{p: "blarg", err: fmt.Errorf("Unknown path type \"blarg\""), out: []byte{}},
-		{p: "scsi", err: nil, out: []byte{0x01, 0x04, 0x30, 0x00, 0xb9, 0x73, 0x1d, 0xe6, 0x84, 0xa3, 0xcc, 0x4a, 0xae, 0xab, 0x82, 0xe8, 0x28, 0xf3, 0x62, 0x8b, 0x03, 0x02, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{p: "scsi", err: nil, out: []byte{0x01, 0x04, 0x14, 0x00, 0xb9, 0x73, 0x1d, 0xe6, 0x84, 0xa3, 0xcc, 0x4a, 0xae, 0xab, 0x82, 0xe8, 0x28, 0xf3, 0x62, 0x8b, 0x03, 0x02, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00}},
 	} {
 		p, err := Marshal(tt.p)
 		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) {
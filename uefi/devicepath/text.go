@@ -0,0 +1,383 @@
+package devicepath
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+// The text forms are those of the UEFI spec, chapter 10.6, as edk2's
+// DevicePathToText prints them. FromText takes what ToText makes, and
+// numbers in decimal as well as hex.
+
+func (e *End) String() string {
+	return ""
+}
+
+func (e *EndInstance) String() string {
+	return ","
+}
+
+func (r *Root) String() string {
+	return fmt.Sprintf("VenHw(%v)", RootGUID)
+}
+
+func (p *PCI) String() string {
+	return fmt.Sprintf("Pci(%#x,%#x)", p.Device, p.Function)
+}
+
+func (m *Memory) String() string {
+	return fmt.Sprintf("MemoryMapped(%#x,%#x,%#x)", m.Type, m.Start, m.End)
+}
+
+func (v *Vendor) String() string {
+	if len(v.Data) == 0 {
+		return fmt.Sprintf("VenHw(%v)", v.GUID)
+	}
+	return fmt.Sprintf("VenHw(%v,%x)", v.GUID, v.Data)
+}
+
+// acpiNames are the ACPI nodes with a text form of their own, by _HID.
+var acpiNames = map[uint32]string{
+	EFIPNPID(0x0a03): "PciRoot",
+	EFIPNPID(0x0a08): "PcieRoot",
+	EFIPNPID(0x0604): "Floppy",
+	EFIPNPID(0x0301): "Keyboard",
+	EFIPNPID(0x0501): "Serial",
+	EFIPNPID(0x0401): "ParallelPort",
+}
+
+// eisaID returns the text form of a compressed EISA ID, e.g. PNP0A03.
+func eisaID(id uint32) string {
+	c := func(shift uint) byte { return byte((id>>shift)&0x1f) + '@' }
+	return fmt.Sprintf("%c%c%c%04X", c(10), c(5), c(0), id>>16)
+}
+
+// parseEISAID parses an EISA ID like PNP0A03.
+func parseEISAID(s string) (uint32, bool) {
+	if len(s) != 7 {
+		return 0, false
+	}
+	var id uint32
+	for i := 0; i < 3; i++ {
+		if s[i] < 'A' || s[i] > 'Z' {
+			return 0, false
+		}
+		id = id<<5 | uint32(s[i]-'@')
+	}
+	n, err := strconv.ParseUint(s[3:], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return id | uint32(n)<<16, true
+}
+
+func (a *ACPI) String() string {
+	if n, ok := acpiNames[a.HID]; ok {
+		return fmt.Sprintf("%s(%#x)", n, a.UID)
+	}
+	if a.HID&0xffff == 0x41d0 {
+		return fmt.Sprintf("Acpi(%s,%#x)", eisaID(a.HID), a.UID)
+	}
+	return fmt.Sprintf("Acpi(%#x,%#x)", a.HID, a.UID)
+}
+
+func (a *ATAPI) String() string {
+	ps, sm := "Primary", "Master"
+	if a.PrimarySecondary != 0 {
+		ps = "Secondary"
+	}
+	if a.TargetHost != 0 {
+		sm = "Slave"
+	}
+	return fmt.Sprintf("Ata(%s,%s,%#x)", ps, sm, a.LUN)
+}
+
+func (s *SCSI) String() string {
+	return fmt.Sprintf("Scsi(%#x,%#x)", s.TargetID, s.LUN)
+}
+
+func (u *USB) String() string {
+	return fmt.Sprintf("USB(%#x,%#x)", u.ParentPort, u.USBInterface)
+}
+
+// macSize is how much of the address matters: 6 bytes for Ethernet,
+// IfType 0 or 1, all of it otherwise.
+func (m *MAC) macSize() int {
+	if m.IFType <= 1 {
+		return 6
+	}
+	return len(m.MAC.Addr)
+}
+
+func (m *MAC) String() string {
+	return fmt.Sprintf("MAC(%x,%#x)", m.MAC.Addr[:m.macSize()], m.IFType)
+}
+
+func (u *USBClass) String() string {
+	return fmt.Sprintf("UsbClass(%#x,%#x,%#x,%#x,%#x)", u.VID, u.DID, u.Class, u.SubClass, u.DeviceProtocol)
+}
+
+func (s *SD) String() string {
+	return fmt.Sprintf("SD(%d)", s.SlotNumber)
+}
+
+func (m *MMC) String() string {
+	return fmt.Sprintf("eMMC(%d)", m.SlotNumber)
+}
+
+func (h *HardDrive) String() string {
+	var sig string
+	switch h.SignatureType {
+	case SignatureMBR:
+		sig = fmt.Sprintf("MBR,0x%08x", binary.LittleEndian.Uint32(h.PartitionSignature[:]))
+	case SignatureGUID:
+		sig = fmt.Sprintf("GPT,%v", guid.GUID(h.PartitionSignature))
+	default:
+		sig = fmt.Sprintf("%d,0", h.SignatureType)
+	}
+	return fmt.Sprintf("HD(%d,%s,%#x,%#x)", h.Partition, sig, h.PartitionStart, h.PartitionSize)
+}
+
+func (c *CDROM) String() string {
+	return fmt.Sprintf("CDROM(%#x,%#x,%#x)", c.BootEntry, c.PartitionStart, c.PartitionSize)
+}
+
+func (f *FILE) String() string {
+	return f.Name
+}
+
+func (r *Raw) String() string {
+	return fmt.Sprintf("Path(%d,%d,%x)", r.Type, r.SubType, r.Data)
+}
+
+// ToText returns the text form of a device path. Instances are
+// separated by commas, and the End node is not shown.
+func ToText(paths []Path) string {
+	var b strings.Builder
+	sep := ""
+	for _, p := range paths {
+		switch p.(type) {
+		case *End:
+			return b.String()
+		case *EndInstance:
+			b.WriteString(p.String())
+			sep = ""
+			continue
+		}
+		b.WriteString(sep)
+		b.WriteString(p.String())
+		sep = "/"
+	}
+	return b.String()
+}
+
+// splitText splits s at sep, except inside parentheses.
+func splitText(s string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// FromText parses the text form of a device path. The nodes of each
+// instance are separated by slashes, and the instances by commas. It
+// returns the nodes, with an EndInstance between instances and an End
+// at the end, so that Blob makes a device path of them.
+func FromText(s string) ([]Path, error) {
+	var paths []Path
+	for i, inst := range splitText(s, ',') {
+		if i > 0 {
+			paths = append(paths, &EndInstance{})
+		}
+		for _, el := range splitText(inst, '/') {
+			if len(el) == 0 {
+				continue
+			}
+			p, err := NodeFromText(el)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, p)
+		}
+	}
+	return append(paths, &End{}), nil
+}
+
+// num parses a number, in hex if it starts with 0x, else in decimal.
+// An empty string is 0, as args left out are.
+func num(s string, bits int) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return strconv.ParseUint(s[2:], 16, bits)
+	}
+	return strconv.ParseUint(s, 10, bits)
+}
+
+// NodeFromText parses the text form of one device path node. Text
+// that is not of the form Name(args) is a file path. Nodes too big
+// for their 16-bit length, such as very long file paths, are errors.
+func NodeFromText(s string) (Path, error) {
+	p, err := nodeFromText(s)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(p.Blob()); n > MaxNodeSize {
+		return nil, fmt.Errorf("%.32s...: node is %d bytes, more than %d", s, n, MaxNodeSize)
+	}
+	return p, nil
+}
+
+func nodeFromText(s string) (Path, error) {
+	open := strings.IndexByte(s, '(')
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return &FILE{Name: s}, nil
+	}
+	name, args := s[:open], splitText(s[open+1:len(s)-1], ',')
+	var err error
+	// arg returns arg i as a number, or 0 if there is no arg i. The
+	// first error sticks.
+	arg := func(i, bits int) uint64 {
+		if i >= len(args) || err != nil {
+			return 0
+		}
+		var n uint64
+		if n, err = num(args[i], bits); err != nil {
+			err = fmt.Errorf("%s: arg %d: %v", s, i, err)
+		}
+		return n
+	}
+	str := func(i int) string {
+		if i >= len(args) {
+			return ""
+		}
+		return strings.TrimSpace(args[i])
+	}
+	gid := func(i int) guid.GUID {
+		if err != nil {
+			return guid.GUID{}
+		}
+		g, gerr := guid.Parse(str(i))
+		if gerr != nil {
+			err = fmt.Errorf("%s: arg %d: %v", s, i, gerr)
+			return guid.GUID{}
+		}
+		return *g
+	}
+	data := func(i int) []byte {
+		if err != nil {
+			return nil
+		}
+		b, herr := hex.DecodeString(str(i))
+		if herr != nil {
+			err = fmt.Errorf("%s: arg %d: %v", s, i, herr)
+		}
+		return b
+	}
+
+	var p Path
+	switch name {
+	case "Pci":
+		p = &PCI{Device: uint8(arg(0, 8)), Function: uint8(arg(1, 8))}
+	case "MemoryMapped":
+		p = &Memory{Type: uint32(arg(0, 32)), Start: arg(1, 64), End: arg(2, 64)}
+	case "VenHw":
+		v := &Vendor{GUID: gid(0), Data: data(1)}
+		if len(v.Data) == 0 {
+			v.Data = nil
+		}
+		p = v
+	case "Acpi":
+		hid, ok := parseEISAID(str(0))
+		if !ok {
+			hid = uint32(arg(0, 32))
+		}
+		p = &ACPI{HID: hid, UID: uint32(arg(1, 32))}
+	case "Ata":
+		a := &ATAPI{LUN: uint16(arg(2, 16))}
+		switch str(0) {
+		case "Primary":
+		case "Secondary":
+			a.PrimarySecondary = 1
+		default:
+			a.PrimarySecondary = uint8(arg(0, 8))
+		}
+		switch str(1) {
+		case "Master":
+		case "Slave":
+			a.TargetHost = 1
+		default:
+			a.TargetHost = uint8(arg(1, 8))
+		}
+		p = a
+	case "Scsi":
+		p = &SCSI{TargetID: uint16(arg(0, 16)), LUN: uint16(arg(1, 16))}
+	case "USB":
+		p = &USB{ParentPort: uint8(arg(0, 8)), USBInterface: uint8(arg(1, 8))}
+	case "MAC":
+		m := &MAC{}
+		a := data(0)
+		if len(a) > len(m.MAC.Addr) {
+			return nil, fmt.Errorf("%s: %d byte address, max is %d", s, len(a), len(m.MAC.Addr))
+		}
+		copy(m.MAC.Addr[:], a)
+		m.IFType = uint8(arg(1, 8))
+		p = m
+	case "UsbClass":
+		p = &USBClass{VID: uint16(arg(0, 16)), DID: uint16(arg(1, 16)), Class: uint8(arg(2, 8)), SubClass: uint8(arg(3, 8)), DeviceProtocol: uint8(arg(4, 8))}
+	case "SD":
+		p = &SD{SlotNumber: uint8(arg(0, 8))}
+	case "eMMC":
+		p = &MMC{SlotNumber: uint8(arg(0, 8))}
+	case "HD":
+		h := &HardDrive{Partition: uint32(arg(0, 32)), PartitionStart: arg(3, 64), PartitionSize: arg(4, 64)}
+		switch str(1) {
+		case "MBR":
+			h.PartmapType, h.SignatureType = PartmapMBR, SignatureMBR
+			binary.LittleEndian.PutUint32(h.PartitionSignature[:], uint32(arg(2, 32)))
+		case "GPT":
+			h.PartmapType, h.SignatureType = PartmapGPT, SignatureGUID
+			h.PartitionSignature = gid(2)
+		default:
+			h.SignatureType = uint8(arg(1, 8))
+		}
+		p = h
+	case "CDROM":
+		p = &CDROM{BootEntry: uint32(arg(0, 32)), PartitionStart: arg(1, 64), PartitionSize: arg(2, 64)}
+	case "Path":
+		p = &Raw{Type: uint8(arg(0, 8)), SubType: uint8(arg(1, 8)), Data: data(2)}
+	default:
+		// A name with a text form of its own is an ACPI node.
+		for hid, n := range acpiNames {
+			if n == name {
+				p = &ACPI{HID: hid, UID: uint32(arg(0, 32))}
+			}
+		}
+		if p == nil {
+			return nil, fmt.Errorf("Unknown device path node %q", name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
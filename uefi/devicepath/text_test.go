@@ -0,0 +1,89 @@
+package devicepath
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	for _, tt := range []string{
+		`PciRoot(0x0)/Pci(0x1,0x0)/HD(1,GPT,0D7C5A1C-3B3C-4E4B-8A5F-2D6E1A9C7B01,0x800,0x100000)/\EFI\BOOT\BOOTX64.EFI`,
+		`PcieRoot(0x1)/Pci(0x1c,0x2)/Ata(Secondary,Slave,0x0)`,
+		`Acpi(PNP0A05,0x3)/Scsi(0x2,0x1)`,
+		`Acpi(0x12345678,0x0)`,
+		`Floppy(0x0),Keyboard(0x0),Serial(0x1),ParallelPort(0x0)`,
+		`MemoryMapped(0xb,0xffc00000,0xffffffff)`,
+		`VenHw(E61D73B9-A384-4ACC-AEAB-82E828F3628B)/VenHw(E61D73B9-A384-4ACC-AEAB-82E828F3628B,0102ff)`,
+		`PciRoot(0x0)/Pci(0x14,0x0)/USB(0x3,0x0)/UsbClass(0x46d,0xc52b,0x3,0x1,0x1)`,
+		`PciRoot(0x0)/Pci(0x3,0x0)/MAC(525400123456,0x1)`,
+		`SD(1)/eMMC(0)`,
+		`HD(2,MBR,0x1234abcd,0x3f,0x1000)/CDROM(0x0,0x10,0x2000)`,
+		`Path(1,9,abcdef)`,
+	} {
+		p, err := FromText(tt)
+		if err != nil {
+			t.Errorf("FromText(%q): got %v, want nil", tt, err)
+			continue
+		}
+		if s := ToText(p); s != tt {
+			t.Errorf("ToText(FromText(%q)): got %q", tt, s)
+		}
+		b := Blob(p...)
+		q, err := Parse(b)
+		if err != nil {
+			t.Errorf("Parse(%q): got %v, want nil", tt, err)
+			continue
+		}
+		if s := ToText(q); s != tt {
+			t.Errorf("ToText(Parse(%q)): got %q", tt, s)
+		}
+		if !bytes.Equal(Blob(q...), b) {
+			t.Errorf("Blob(Parse(%q)): got %#02x, want %#02x", tt, Blob(q...), b)
+		}
+	}
+}
+
+func TestFromText(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		out []byte
+	}{
+		{in: "Pci(1,0)", out: []byte{0x01, 0x01, 0x06, 0x00, 0x00, 0x01, 0x7f, 0xff, 0x04, 0x00}},
+		{in: "PciRoot(0)", out: []byte{0x02, 0x01, 0x0c, 0x00, 0xd0, 0x41, 0x03, 0x0a, 0, 0, 0, 0, 0x7f, 0xff, 0x04, 0x00}},
+		{in: "Scsi(1,2),Scsi(3)", out: []byte{0x03, 0x02, 0x08, 0x00, 0x01, 0x00, 0x02, 0x00, 0x7f, 0x01, 0x04, 0x00,
+			0x03, 0x02, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00, 0x7f, 0xff, 0x04, 0x00}},
+		{in: `\a`, out: []byte{0x04, 0x04, 0x0a, 0x00, '\\', 0, 'a', 0, 0, 0, 0x7f, 0xff, 0x04, 0x00}},
+		{in: "", out: []byte{0x7f, 0xff, 0x04, 0x00}},
+	} {
+		p, err := FromText(tt.in)
+		if err != nil {
+			t.Errorf("FromText(%q): got %v, want nil", tt.in, err)
+			continue
+		}
+		if b := Blob(p...); !bytes.Equal(b, tt.out) {
+			t.Errorf("FromText(%q): got %#02x, want %#02x", tt.in, b, tt.out)
+		}
+	}
+	long := `\` + strings.Repeat("a", MaxNodeSize/2)
+	big := "Path(1,1," + strings.Repeat("00", MaxNodeSize-HeaderSize+1) + ")"
+	for _, bad := range []string{"Pci(0x100,0)", "Bogus(1)", "VenHw(nope)", "HD(1,GPT,xyz,0,0)", "MAC(zz,0)", long, big} {
+		if _, err := FromText(bad); err == nil {
+			t.Errorf("FromText(%q): got nil, want err", bad)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x01, 0x01, 0x06, 0x00, 0x00, 0x01},
+		{0x01, 0x01, 0x02, 0x00, 0x7f, 0xff, 0x04, 0x00},
+		{0x01, 0x01, 0x40, 0x00, 0x7f, 0xff, 0x04, 0x00},
+		{0x01, 0x01, 0x05, 0x00, 0x00, 0x7f, 0xff, 0x04, 0x00},
+	} {
+		if p, err := Parse(b); err == nil {
+			t.Errorf("Parse(%#02x): got %v, nil, want err", b, p)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package devicepath
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Reader reads guest memory. A trace.Trace is one.
+type Reader interface {
+	Read(address uintptr, data []byte) error
+}
+
+// MaxSize bounds the size of a device path Unmarshal reads, so that a
+// path with no end does not go on forever.
+const MaxSize = 0x10000
+
+// Error is a malformed device path, or one that can't be read.
+type Error struct {
+	// Addr is where the path starts, and Offset where in it the
+	// problem is.
+	Addr   uintptr
+	Offset int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("device path at %#x: offset %#x: %v", e.Addr, e.Offset, e.Err)
+}
+
+// Unmarshal reads the device path at addr from r, node by node, so that
+// it never reads past the End node. It returns the nodes, with an
+// EndInstance between instances and the End node last, as FromText
+// does. A node with a length that is wrong for its type, an end node
+// that is neither, or a path with no End in MaxSize bytes is an *Error.
+func Unmarshal(r Reader, addr uintptr) ([]Path, error) {
+	var paths []Path
+	for off := 0; ; {
+		noEnd := &Error{Addr: addr, Offset: off, Err: fmt.Errorf("no end node in %#x bytes", MaxSize)}
+		if off+HeaderSize > MaxSize {
+			return nil, noEnd
+		}
+		var h [HeaderSize]byte
+		if err := r.Read(addr+uintptr(off), h[:]); err != nil {
+			return nil, &Error{Addr: addr, Offset: off, Err: err}
+		}
+		n := int(binary.LittleEndian.Uint16(h[2:]))
+		if n < HeaderSize {
+			hd := header(h[:])
+			return nil, &Error{Addr: addr, Offset: off, Err: fmt.Errorf("%v node: length %d is shorter than its header", &hd, n)}
+		}
+		if off+n > MaxSize {
+			return nil, noEnd
+		}
+		b := make([]byte, n)
+		if err := r.Read(addr+uintptr(off), b); err != nil {
+			return nil, &Error{Addr: addr, Offset: off, Err: err}
+		}
+		p, _, err := ParseNode(b)
+		if err != nil {
+			return nil, &Error{Addr: addr, Offset: off, Err: err}
+		}
+		paths = append(paths, p)
+		off += n
+		if _, ok := p.(*End); ok {
+			return paths, nil
+		}
+	}
+}
+
+// Instances splits a device path into its instances, each without its
+// end node.
+func Instances(paths []Path) [][]Path {
+	var insts [][]Path
+	var cur []Path
+	for _, p := range paths {
+		switch p.(type) {
+		case *End:
+			return append(insts, cur)
+		case *EndInstance:
+			insts, cur = append(insts, cur), nil
+		default:
+			cur = append(cur, p)
+		}
+	}
+	return append(insts, cur)
+}
+
+// UnmarshalNode reads the one node at addr from r.
+func UnmarshalNode(r Reader, addr uintptr) (Path, error) {
+	var h [HeaderSize]byte
+	if err := r.Read(addr, h[:]); err != nil {
+		return nil, &Error{Addr: addr, Err: err}
+	}
+	n := int(binary.LittleEndian.Uint16(h[2:]))
+	if n < HeaderSize {
+		hd := header(h[:])
+		return nil, &Error{Addr: addr, Err: fmt.Errorf("%v node: length %d is shorter than its header", &hd, n)}
+	}
+	b := make([]byte, n)
+	if err := r.Read(addr, b); err != nil {
+		return nil, &Error{Addr: addr, Err: err}
+	}
+	p, _, err := ParseNode(b)
+	if err != nil {
+		return nil, &Error{Addr: addr, Err: err}
+	}
+	return p, nil
+}
@@ -0,0 +1,74 @@
+package devicepath
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// mem is guest memory for tests, from address 0x1000.
+type mem []byte
+
+func (m mem) Read(addr uintptr, b []byte) error {
+	if addr < 0x1000 || addr-0x1000+uintptr(len(b)) > uintptr(len(m)) {
+		return fmt.Errorf("%#x is out of range", addr)
+	}
+	copy(b, m[addr-0x1000:])
+	return nil
+}
+
+func TestUnmarshal(t *testing.T) {
+	const text = `PciRoot(0x0)/Pci(0x1f,0x2)/Scsi(0x0,0x0),PciRoot(0x0)/Pci(0x1,0x0)/\EFI\BOOT\BOOTX64.EFI`
+	p, err := FromText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Anything after the End node must not be read.
+	m := mem(Blob(p...))
+	paths, err := Unmarshal(m, 0x1000)
+	if err != nil {
+		t.Fatalf("Unmarshal: got %v, want nil", err)
+	}
+	if s := ToText(paths); s != text {
+		t.Errorf("Unmarshal: got %q, want %q", s, text)
+	}
+	insts := Instances(paths)
+	if len(insts) != 2 || len(insts[0]) != 3 || len(insts[1]) != 3 {
+		t.Fatalf("Instances: got %v, want 2 instances of 3 nodes", insts)
+	}
+	if f, ok := insts[1][2].(*FILE); !ok || f.Name != `\EFI\BOOT\BOOTX64.EFI` {
+		t.Errorf("Instances: last node is %#v, want the file", insts[1][2])
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	loop := make(mem, MaxSize+8)
+	for i := 0; i+6 <= len(loop); i += 6 {
+		copy(loop[i:], []byte{0x01, 0x01, 0x06, 0x00, 0x00, 0x00})
+	}
+	for _, tt := range []struct {
+		name string
+		m    mem
+		want string
+	}{
+		{"short node", mem{0x01, 0x01, 0x02, 0x00, 0x7f, 0xff, 0x04, 0x00}, "offset 0x0: TypeDevice:1:2 node: length 2 is shorter than its header"},
+		{"wrong length", mem{0x02, 0x01, 0x08, 0x00, 0, 0, 0, 0, 0x7f, 0xff, 0x04, 0x00}, "offset 0x0: TypeACPI:1:8 node: length 8, want 12"},
+		{"odd file", mem{0x04, 0x04, 0x07, 0x00, 'a', 0, 0, 0x7f, 0xff, 0x04, 0x00}, "must be even"},
+		{"long end", mem{0x01, 0x01, 0x06, 0x00, 0, 0, 0x7f, 0xff, 0x06, 0x00, 0, 0}, "offset 0x6: TypeEnd:255:6 node: length 6, want 4"},
+		{"bad end", mem{0x7f, 0x02, 0x04, 0x00}, "end subtype 0x2"},
+		{"past memory", mem{0x01, 0x01, 0x06, 0x00, 0, 0}, "offset 0x6: 0x1006 is out of range"},
+		{"no end", loop, "no end node"},
+	} {
+		_, err := Unmarshal(tt.m, 0x1000)
+		if err == nil {
+			t.Errorf("%s: got nil, want err", tt.name)
+			continue
+		}
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("%s: got %T, want *Error", tt.name, err)
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %q, want it to contain %q", tt.name, err, tt.want)
+		}
+	}
+}
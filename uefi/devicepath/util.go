@@ -0,0 +1,67 @@
+package devicepath
+
+import "bytes"
+
+// The Device Path Utilities protocol, on device paths as FromText and
+// Unmarshal return them: nodes, with an EndInstance between instances
+// and an End last.
+
+// withoutEnd returns paths without its End node, if it has one.
+func withoutEnd(paths []Path) []Path {
+	if n := len(paths); n > 0 {
+		if _, ok := paths[n-1].(*End); ok {
+			return paths[:n-1]
+		}
+	}
+	return paths
+}
+
+// Size returns the size of the binary device path, End node included.
+func Size(paths []Path) int {
+	return len(Blob(paths...))
+}
+
+// Append returns the device path of a followed by b. If a has more
+// than one instance, b follows the last of them.
+func Append(a, b []Path) []Path {
+	p := append([]Path{}, withoutEnd(a)...)
+	return append(append(p, withoutEnd(b)...), &End{})
+}
+
+// AppendNode returns the device path with n added at the end.
+func AppendNode(paths []Path, n Path) []Path {
+	return Append(paths, []Path{n})
+}
+
+// AppendInstance returns the device path with inst as another instance.
+func AppendInstance(paths, inst []Path) []Path {
+	p := append(append([]Path{}, withoutEnd(paths)...), &EndInstance{})
+	return append(append(p, withoutEnd(inst)...), &End{})
+}
+
+// IsMultiInstance says whether the device path has more than one instance.
+func IsMultiInstance(paths []Path) bool {
+	for _, p := range paths {
+		if _, ok := p.(*EndInstance); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix says whether the first instance of prefix is the start of the
+// first instance of paths, node by node, and if so returns the size of
+// the part of paths it matches. LocateDevicePath uses it to find the
+// handle closest to a device.
+func Prefix(prefix, paths []Path) (int, bool) {
+	p, q := Instances(prefix)[0], Instances(paths)[0]
+	if len(p) > len(q) {
+		return 0, false
+	}
+	for i := range p {
+		if !bytes.Equal(p[i].Blob(), q[i].Blob()) {
+			return 0, false
+		}
+	}
+	return len(Blob(p...)), true
+}
@@ -0,0 +1,66 @@
+package devicepath
+
+import "testing"
+
+func TestUtil(t *testing.T) {
+	text := func(s string) []Path {
+		p, err := FromText(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	a, b := text("PciRoot(0x0)/Pci(0x1,0x0)"), text("Scsi(0x1,0x0)")
+	if n := Size(a); n != 12+6+4 {
+		t.Errorf("Size(%v): got %d, want %d", ToText(a), n, 12+6+4)
+	}
+	for _, tt := range []struct {
+		name string
+		got  []Path
+		want string
+	}{
+		{"Append", Append(a, b), "PciRoot(0x0)/Pci(0x1,0x0)/Scsi(0x1,0x0)"},
+		{"Append to nothing", Append(nil, b), "Scsi(0x1,0x0)"},
+		{"AppendNode", AppendNode(a, &USB{ParentPort: 2}), "PciRoot(0x0)/Pci(0x1,0x0)/USB(0x2,0x0)"},
+		{"AppendInstance", AppendInstance(a, b), "PciRoot(0x0)/Pci(0x1,0x0),Scsi(0x1,0x0)"},
+		{"Append to instances", Append(AppendInstance(a, b), text("USB(0x1,0x0)")), "PciRoot(0x0)/Pci(0x1,0x0),Scsi(0x1,0x0)/USB(0x1,0x0)"},
+	} {
+		if s := ToText(tt.got); s != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, s, tt.want)
+		}
+		if _, ok := tt.got[len(tt.got)-1].(*End); !ok {
+			t.Errorf("%s: does not end with End", tt.name)
+		}
+	}
+	if IsMultiInstance(a) || !IsMultiInstance(AppendInstance(a, b)) {
+		t.Errorf("IsMultiInstance: got %v and %v, want false and true", IsMultiInstance(a), IsMultiInstance(AppendInstance(a, b)))
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	path, err := FromText(`PciRoot(0x0)/Pci(0x1,0x0)/Scsi(0x1,0x0)/\a,PciRoot(0x0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		prefix string
+		size   int
+		ok     bool
+	}{
+		{"PciRoot(0x0)/Pci(0x1,0x0)", 12 + 6, true},
+		{"PciRoot(0x0)/Pci(0x1,0x0)/Scsi(0x1,0x0)", 12 + 6 + 8, true},
+		{"PciRoot(0x0)/Pci(0x1,0x0),Pci(0x2,0x0)", 12 + 6, true},
+		{"", 0, true},
+		{"PciRoot(0x0)/Pci(0x2,0x0)", 0, false},
+		{"Pci(0x1,0x0)", 0, false},
+		{`PciRoot(0x0)/Pci(0x1,0x0)/Scsi(0x1,0x0)/\a/\b`, 0, false},
+	} {
+		p, err := FromText(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, ok := Prefix(p, path); n != tt.size || ok != tt.ok {
+			t.Errorf("Prefix(%q): got %d, %v, want %d, %v", tt.prefix, n, ok, tt.size, tt.ok)
+		}
+	}
+}
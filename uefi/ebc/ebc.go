@@ -0,0 +1,733 @@
+// Package ebc is an interpreter for EFI Byte Code, the UEFI virtual
+// machine. It runs in guest memory, through Memory, and knows nothing
+// about how it got there. When EBC code calls native code, Run stops
+// and returns the call; whoever is running the VM makes it, then
+// calls Return with what it returned, and Run again.
+//
+// Calls between native and EBC code work as they do in EDK2, which is
+// what EBC compilers expect. A call from native code pushes NativeArgs
+// arguments, then a return address that RET knows to stop at. A call
+// to native code passes what is on the EBC stack, from R0 up to the
+// caller's frame, as the arguments.
+package ebc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Memory is the memory the VM runs in.
+type Memory interface {
+	Read(addr uintptr, b []byte) error
+	Write(addr uintptr, b []byte) error
+}
+
+// Version is the VM version, 1.0, as GetVersion and BREAK 1 return it.
+const Version = 0x10000
+
+// NativeArgs is how many arguments a call from native code passes.
+// There is no knowing how many there really are, so assume the worst.
+const NativeArgs = 16
+
+// Flags bits.
+const (
+	FlagsCC   = 1
+	FlagsStep = 2
+)
+
+// retMagic is the return address pushed for a call from native code.
+const retMagic = 0x1234567887654321
+
+// Opcodes, in the low 6 bits of the first byte of an instruction.
+const (
+	opBREAK    = 0x00
+	opJMP      = 0x01
+	opJMP8     = 0x02
+	opCALL     = 0x03
+	opRET      = 0x04
+	opCMPeq    = 0x05
+	opCMPlte   = 0x06
+	opCMPgte   = 0x07
+	opCMPulte  = 0x08
+	opCMPugte  = 0x09
+	opNOT      = 0x0a
+	opNEG      = 0x0b
+	opADD      = 0x0c
+	opSUB      = 0x0d
+	opMUL      = 0x0e
+	opMULU     = 0x0f
+	opDIV      = 0x10
+	opDIVU     = 0x11
+	opMOD      = 0x12
+	opMODU     = 0x13
+	opAND      = 0x14
+	opOR       = 0x15
+	opXOR      = 0x16
+	opSHL      = 0x17
+	opSHR      = 0x18
+	opASHR     = 0x19
+	opEXTNDB   = 0x1a
+	opEXTNDW   = 0x1b
+	opEXTNDD   = 0x1c
+	opMOVbw    = 0x1d
+	opMOVww    = 0x1e
+	opMOVdw    = 0x1f
+	opMOVqw    = 0x20
+	opMOVbd    = 0x21
+	opMOVwd    = 0x22
+	opMOVdd    = 0x23
+	opMOVqd    = 0x24
+	opMOVsnw   = 0x25
+	opMOVsnd   = 0x26
+	opMOVqq    = 0x28
+	opLOADSP   = 0x29
+	opSTORESP  = 0x2a
+	opPUSH     = 0x2b
+	opPOP      = 0x2c
+	opCMPIeq   = 0x2d
+	opCMPIlte  = 0x2e
+	opCMPIgte  = 0x2f
+	opCMPIulte = 0x30
+	opCMPIugte = 0x31
+	opMOVnw    = 0x32
+	opMOVnd    = 0x33
+	opPUSHn    = 0x35
+	opPOPn     = 0x36
+	opMOVI     = 0x37
+	opMOVIn    = 0x38
+	opMOVREL   = 0x39
+)
+
+// Call is a call from EBC code to native code.
+type Call struct {
+	Fn   uint64
+	Args []uint64
+}
+
+// VM is a call to EBC code, from native code.
+type VM struct {
+	R     [8]uint64
+	IP    uint64
+	Flags uint64
+	// Thunk, if set, says whether a native address is a thunk for
+	// EBC code, and where that code is, so calls to it stay in the VM.
+	Thunk func(addr uint64) (uint64, bool)
+	// CreateThunk, if set, makes a thunk for EBC code, for BREAK 5.
+	CreateThunk func(entry uint64) (uint64, error)
+
+	mem Memory
+	// frame is the top of the current function's frame.
+	frame uint64
+	// retSP is R0 after the call from native code. A RET with R0
+	// there returns to it.
+	retSP uint64
+	// call is a native call in progress, and size is the size of
+	// the instruction that made it.
+	call *Call
+	size uint64
+	done bool
+	// err is the first memory error in an instruction.
+	err error
+}
+
+// New returns a VM to call the EBC code at entry with args, as native
+// code would. Its stack starts at sp and grows down.
+func New(mem Memory, entry, sp uint64, args []uint64) *VM {
+	v := &VM{mem: mem, IP: entry}
+	v.R[0] = sp &^ 7
+	if len(args) > NativeArgs {
+		args = args[:NativeArgs]
+	}
+	for i := NativeArgs - 1; i >= 0; i-- {
+		var a uint64
+		if i < len(args) {
+			a = args[i]
+		}
+		v.push(a)
+	}
+	// The EBC code expects a return address and a saved frame
+	// pointer, which native code does not push.
+	v.push(0)
+	v.push(retMagic)
+	v.retSP = v.R[0]
+	v.frame = v.R[0] + 8
+	return v
+}
+
+// Run runs the VM until it returns to native code, with what it
+// returns in R7, or calls native code. It returns the call, if that
+// is why it stopped.
+func (v *VM) Run() (*Call, error) {
+	if v.call != nil {
+		return nil, fmt.Errorf("%#x: native call to %#x has not returned", v.IP, v.call.Fn)
+	}
+	for !v.done && v.call == nil {
+		ip := v.IP
+		if err := v.step(); err != nil {
+			return nil, fmt.Errorf("%#x: %v", ip, err)
+		}
+		if v.err != nil {
+			return nil, fmt.Errorf("%#x: %v", ip, v.err)
+		}
+	}
+	return v.call, nil
+}
+
+// Done says whether the VM has returned to native code.
+func (v *VM) Done() bool {
+	return v.done
+}
+
+// Return finishes the native call Run returned, which returned r.
+func (v *VM) Return(r uint64) {
+	v.R[7] = r
+	v.IP += v.size
+	v.call = nil
+}
+
+func (v *VM) read(addr uint64, n int) uint64 {
+	var b [8]byte
+	if err := v.mem.Read(uintptr(addr), b[:n]); err != nil && v.err == nil {
+		v.err = fmt.Errorf("reading %d bytes at %#x: %v", n, addr, err)
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (v *VM) write(addr uint64, n int, x uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], x)
+	if err := v.mem.Write(uintptr(addr), b[:n]); err != nil && v.err == nil {
+		v.err = fmt.Errorf("writing %d bytes at %#x: %v", n, addr, err)
+	}
+}
+
+func (v *VM) push(x uint64) {
+	v.R[0] -= 8
+	v.write(v.R[0], 8, x)
+}
+
+// imm reads n bytes of signed immediate data at IP+off.
+func (v *VM) imm(off uint64, n int) uint64 {
+	x := v.read(v.IP+off, n)
+	s := uint(64 - 8*n)
+	return uint64(int64(x<<s) >> s)
+}
+
+// index reads an n-byte natural index at IP+off, and returns the
+// offset it is, for 64-bit natural units.
+func (v *VM) index(off uint64, n int) uint64 {
+	return uint64(Natural(v.read(v.IP+off, n), uint(8*n)))
+}
+
+// Natural decodes an n-bit natural index. From the top, there is a
+// sign bit, then 3 bits that say how much of the rest, in units of
+// n/8 bits, is natural units; the natural units are at the bottom,
+// and constant units are in between. The offset is the constant
+// units plus the natural units times the size of a pointer.
+func Natural(x uint64, n uint) int64 {
+	w := (x >> (n - 4) & 7) * uint64(n/8)
+	nat := x & (1<<w - 1)
+	c := (x & (1<<(n-4) - 1)) >> w
+	off := int64(c + nat*8)
+	if x>>(n-1)&1 != 0 {
+		return -off
+	}
+	return off
+}
+
+func mask(n int) uint64 {
+	if n == 8 {
+		return ^uint64(0)
+	}
+	return 1<<(8*uint(n)) - 1
+}
+
+// step runs one instruction.
+func (v *VM) step() error {
+	op := byte(v.read(v.IP, 1))
+	ops := byte(v.read(v.IP+1, 1))
+	if v.err != nil {
+		return v.err
+	}
+	r1, ind1 := ops&7, ops&8 != 0
+	r2, ind2 := ops>>4&7, ops&0x80 != 0
+	switch code := op & 0x3f; code {
+	case opBREAK:
+		return v.brk(ops)
+	case opJMP, opCALL:
+		return v.jmp(op, ops)
+	case opJMP8:
+		if op&0x80 != 0 && (v.Flags&FlagsCC != 0) != (op&0x40 != 0) {
+			v.IP += 2
+			return nil
+		}
+		v.IP += 2 + uint64(int64(int8(ops))*2)
+	case opRET:
+		if v.R[0] == v.retSP {
+			v.done = true
+			return nil
+		}
+		v.IP = v.read(v.R[0], 8)
+		v.frame = v.read(v.R[0]+8, 8)
+		v.R[0] += 16
+	case opCMPeq, opCMPlte, opCMPgte, opCMPulte, opCMPugte:
+		var x uint64
+		size := uint64(2)
+		if op&0x80 != 0 {
+			if ind2 {
+				x = v.index(2, 2)
+			} else {
+				x = v.imm(2, 2)
+			}
+			size = 4
+		}
+		b := v.R[r2] + x
+		if ind2 {
+			if op&0x40 != 0 {
+				b = v.read(b, 8)
+			} else {
+				b = v.read(b, 4)
+			}
+		}
+		v.compare(code-opCMPeq, op&0x40 != 0, v.R[r1], b)
+		v.IP += size
+	case opCMPIeq, opCMPIlte, opCMPIgte, opCMPIulte, opCMPIugte:
+		size := uint64(2)
+		var x uint64
+		if ops&0x10 != 0 {
+			if !ind1 {
+				return fmt.Errorf("CMPI with an index on a register")
+			}
+			x = v.index(2, 2)
+			size += 2
+		}
+		a := v.R[r1]
+		if ind1 {
+			if op&0x40 != 0 {
+				a = v.read(a+x, 8)
+			} else {
+				a = v.read(a+x, 4)
+			}
+		}
+		var b uint64
+		if op&0x80 != 0 {
+			b = v.imm(size, 4)
+			size += 4
+		} else {
+			b = v.imm(size, 2)
+			size += 2
+		}
+		v.compare(code-opCMPIeq, op&0x40 != 0, a, b)
+		v.IP += size
+	case opNOT, opNEG, opADD, opSUB, opMUL, opMULU, opDIV, opDIVU, opMOD, opMODU,
+		opAND, opOR, opXOR, opSHL, opSHR, opASHR, opEXTNDB, opEXTNDW, opEXTNDD:
+		return v.data(op, r1, ind1, r2, ind2)
+	case opMOVbw, opMOVww, opMOVdw, opMOVqw, opMOVbd, opMOVwd, opMOVdd, opMOVqd, opMOVqq:
+		return v.mov(op, r1, ind1, r2, ind2)
+	case opMOVsnw, opMOVsnd, opMOVnw, opMOVnd:
+		n := 2
+		if code == opMOVsnd || code == opMOVnd {
+			n = 4
+		}
+		size := uint64(2)
+		var x1, x2 uint64
+		if op&0x80 != 0 {
+			if !ind1 {
+				return fmt.Errorf("MOVn with an index on a register")
+			}
+			x1 = v.index(size, n)
+			size += uint64(n)
+		}
+		if op&0x40 != 0 {
+			// The signed forms take an immediate for a register.
+			if ind2 || code == opMOVnw || code == opMOVnd {
+				x2 = v.index(size, n)
+			} else {
+				x2 = v.imm(size, n)
+			}
+			size += uint64(n)
+		}
+		x := v.R[r2] + x2
+		if ind2 {
+			x = v.read(x, 8)
+		}
+		if ind1 {
+			v.write(v.R[r1]+x1, 8, x)
+		} else {
+			v.R[r1] = x
+		}
+		v.IP += size
+	case opLOADSP:
+		if r1 != 0 {
+			return fmt.Errorf("LOADSP to dedicated register %d", r1)
+		}
+		v.Flags = v.Flags&^(FlagsCC|FlagsStep) | v.R[r2]&(FlagsCC|FlagsStep)
+		v.IP += 2
+	case opSTORESP:
+		switch r2 {
+		case 0:
+			v.R[r1] = v.Flags
+		case 1:
+			v.R[r1] = v.IP
+		default:
+			return fmt.Errorf("STORESP from dedicated register %d", r2)
+		}
+		v.IP += 2
+	case opPUSH, opPOP, opPUSHn, opPOPn:
+		n := 8
+		if (code == opPUSH || code == opPOP) && op&0x40 == 0 {
+			n = 4
+		}
+		size := uint64(2)
+		var x uint64
+		if op&0x80 != 0 {
+			if ind1 {
+				x = v.index(2, 2)
+			} else {
+				x = v.imm(2, 2)
+			}
+			size = 4
+		}
+		if code == opPUSH || code == opPUSHn {
+			d := v.R[r1] + x
+			if ind1 {
+				d = v.read(d, n)
+			}
+			v.R[0] -= uint64(n)
+			v.write(v.R[0], n, d)
+		} else {
+			d := v.read(v.R[0], n)
+			v.R[0] += uint64(n)
+			if n == 4 {
+				d = uint64(int64(int32(d)))
+			}
+			if ind1 {
+				v.write(v.R[r1]+x, n, d)
+			} else {
+				v.R[r1] = d + x
+			}
+		}
+		v.IP += size
+	case opMOVI, opMOVIn, opMOVREL:
+		return v.movi(op, ops, r1, ind1)
+	default:
+		return fmt.Errorf("bad opcode %#x", op)
+	}
+	return nil
+}
+
+// brk runs BREAK code.
+func (v *VM) brk(code byte) error {
+	switch code {
+	case 0:
+		return fmt.Errorf("BREAK 0: runaway program")
+	case 1:
+		v.R[7] = Version
+	case 2, 3, 4, 6:
+		// Reserved, debug breakpoint, system call, and compiler
+		// version: nothing for us to do.
+	case 5:
+		// R7 points at a 32-bit offset to an EBC function, from the
+		// end of the offset; it becomes a pointer to a thunk for it.
+		if v.CreateThunk == nil {
+			return fmt.Errorf("BREAK 5: can't create thunks")
+		}
+		off := v.read(v.R[7], 4)
+		entry := v.R[7] + 4 + uint64(int64(int32(off)))
+		t, err := v.CreateThunk(entry)
+		if err != nil {
+			return fmt.Errorf("BREAK 5: %v", err)
+		}
+		v.write(v.R[7], 8, t)
+	default:
+		return fmt.Errorf("BREAK %d", code)
+	}
+	v.IP += 2
+	return nil
+}
+
+// jmp runs JMP and CALL, which work out where to go the same way.
+func (v *VM) jmp(op, ops byte) error {
+	r1, ind1 := ops&7, ops&8 != 0
+	rel := ops&0x10 != 0
+	call := op&0x3f == opCALL
+	size := uint64(2)
+	switch {
+	case op&0xc0 == 0xc0:
+		size = 10
+	case op&0x80 != 0:
+		size = 6
+	}
+	if !call && ops&0x80 != 0 && (v.Flags&FlagsCC != 0) != (ops&0x40 != 0) {
+		v.IP += size
+		return nil
+	}
+	var to uint64
+	if size == 10 {
+		to = v.read(v.IP+2, 8)
+	} else {
+		var x uint64
+		if size == 6 {
+			if ind1 {
+				x = v.index(2, 4)
+			} else {
+				x = v.imm(2, 4)
+			}
+		}
+		// R0 here means no register.
+		if r1 != 0 {
+			to = v.R[r1]
+		}
+		to += x
+		if ind1 {
+			to = v.read(to, 8)
+		}
+	}
+	if rel {
+		to += v.IP + size
+	}
+	if !call {
+		v.IP = to
+		return nil
+	}
+	native := ops&0x20 != 0
+	if native && v.Thunk != nil {
+		if e, ok := v.Thunk(to); ok {
+			to, native = e, false
+		}
+	}
+	if !native {
+		v.push(v.frame)
+		v.frame = v.R[0]
+		v.push(v.IP + size)
+		v.IP = to
+		return nil
+	}
+	c := &Call{Fn: to}
+	for a := v.R[0]; a < v.frame && len(c.Args) < NativeArgs; a += 8 {
+		c.Args = append(c.Args, v.read(a, 8))
+	}
+	v.call, v.size = c, size
+	return nil
+}
+
+// compare sets the condition code for compare c, 0 to 4 for eq, lte,
+// gte, ulte, and ugte, of a and b, as 64 or 32 bit values.
+func (v *VM) compare(c byte, q bool, a, b uint64) {
+	sa, sb := int64(a), int64(b)
+	if !q {
+		a, b = uint64(uint32(a)), uint64(uint32(b))
+		sa, sb = int64(int32(a)), int64(int32(b))
+	}
+	var cc bool
+	switch c {
+	case 0:
+		cc = a == b
+	case 1:
+		cc = sa <= sb
+	case 2:
+		cc = sa >= sb
+	case 3:
+		cc = a <= b
+	case 4:
+		cc = a >= b
+	}
+	v.Flags &^= FlagsCC
+	if cc {
+		v.Flags |= FlagsCC
+	}
+}
+
+// data runs the arithmetic and logic instructions, op1 = op1 op op2.
+func (v *VM) data(op, r1 byte, ind1 bool, r2 byte, ind2 bool) error {
+	code := op & 0x3f
+	q := op&0x40 != 0
+	signed := false
+	switch code {
+	case opNEG, opADD, opSUB, opMUL, opDIV, opMOD, opASHR:
+		signed = true
+	}
+	n := 4
+	if q {
+		n = 8
+	}
+	// widen makes a 32-bit operand 64 bits, the way the op wants.
+	widen := func(x uint64) uint64 {
+		if q {
+			return x
+		}
+		if signed {
+			return uint64(int64(int32(x)))
+		}
+		return uint64(uint32(x))
+	}
+	size := uint64(2)
+	var x uint64
+	if op&0x80 != 0 {
+		if ind2 {
+			x = v.index(2, 2)
+		} else {
+			x = v.imm(2, 2)
+		}
+		size = 4
+	}
+	b := v.R[r2] + x
+	if ind2 {
+		b = v.read(b, n)
+	}
+	b = widen(b)
+	a := v.R[r1]
+	if ind1 {
+		a = v.read(a, n)
+	}
+	a = widen(a)
+	var r uint64
+	switch code {
+	case opNOT:
+		r = ^b
+	case opNEG:
+		r = -b
+	case opADD:
+		r = a + b
+	case opSUB:
+		r = a - b
+	case opMUL:
+		r = uint64(int64(a) * int64(b))
+	case opMULU:
+		r = a * b
+	case opDIV, opDIVU, opMOD, opMODU:
+		if b == 0 {
+			return fmt.Errorf("divide by zero")
+		}
+		switch code {
+		case opDIV:
+			r = uint64(int64(a) / int64(b))
+		case opDIVU:
+			r = a / b
+		case opMOD:
+			r = uint64(int64(a) % int64(b))
+		case opMODU:
+			r = a % b
+		}
+	case opAND:
+		r = a & b
+	case opOR:
+		r = a | b
+	case opXOR:
+		r = a ^ b
+	case opSHL:
+		r = a << b
+	case opSHR:
+		r = a >> b
+	case opASHR:
+		r = uint64(int64(a) >> b)
+	case opEXTNDB:
+		r = uint64(int64(int8(b)))
+	case opEXTNDW:
+		r = uint64(int64(int16(b)))
+	case opEXTNDD:
+		r = uint64(int64(int32(b)))
+	}
+	if ind1 {
+		v.write(v.R[r1], n, r)
+	} else {
+		v.R[r1] = r & mask(n)
+	}
+	v.IP += size
+	return nil
+}
+
+// mov runs MOVbw to MOVqq: the first letter is how much is moved, and
+// the second how big the indexes are.
+func (v *VM) mov(op, r1 byte, ind1 bool, r2 byte, ind2 bool) error {
+	var n, x int
+	switch op & 0x3f {
+	case opMOVbw:
+		n, x = 1, 2
+	case opMOVww:
+		n, x = 2, 2
+	case opMOVdw:
+		n, x = 4, 2
+	case opMOVqw:
+		n, x = 8, 2
+	case opMOVbd:
+		n, x = 1, 4
+	case opMOVwd:
+		n, x = 2, 4
+	case opMOVdd:
+		n, x = 4, 4
+	case opMOVqd:
+		n, x = 8, 4
+	case opMOVqq:
+		n, x = 8, 8
+	}
+	size := uint64(2)
+	var x1, x2 uint64
+	if op&0x80 != 0 {
+		if !ind1 {
+			return fmt.Errorf("MOV with an index on a register")
+		}
+		x1 = v.index(size, x)
+		size += uint64(x)
+	}
+	if op&0x40 != 0 {
+		x2 = v.index(size, x)
+		size += uint64(x)
+	}
+	d := v.R[r2] + x2
+	if ind2 {
+		d = v.read(d, n)
+	}
+	d &= mask(n)
+	if ind1 {
+		v.write(v.R[r1]+x1, n, d)
+	} else {
+		v.R[r1] = d
+	}
+	v.IP += size
+	return nil
+}
+
+// movi runs MOVI, MOVIn, and MOVREL, which have immediate data, and
+// maybe an index for operand 1.
+func (v *VM) movi(op, ops, r1 byte, ind1 bool) error {
+	size := uint64(2)
+	var x uint64
+	if ops&0x40 != 0 {
+		if !ind1 {
+			return fmt.Errorf("MOVI with an index on a register")
+		}
+		x = v.index(2, 2)
+		size = 4
+	}
+	var n int
+	switch op & 0xc0 {
+	case 0x40:
+		n = 2
+	case 0x80:
+		n = 4
+	case 0xc0:
+		n = 8
+	default:
+		return fmt.Errorf("bad immediate size in %#x", op)
+	}
+	var d uint64
+	w := 8
+	switch op & 0x3f {
+	case opMOVI:
+		d = v.imm(size, n)
+		w = 1 << (ops >> 4 & 3)
+	case opMOVIn:
+		d = v.index(size, n)
+	case opMOVREL:
+		d = v.imm(size, n) + v.IP + size + uint64(n)
+	}
+	size += uint64(n)
+	if ind1 {
+		v.write(v.R[r1]+x, w, d)
+	} else {
+		v.R[r1] = d & mask(w)
+	}
+	v.IP += size
+	return nil
+}
@@ -0,0 +1,214 @@
+package ebc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// mem is memory from base up.
+type mem struct {
+	base uintptr
+	b    []byte
+}
+
+func (m *mem) Read(addr uintptr, b []byte) error {
+	if addr < m.base || addr+uintptr(len(b)) > m.base+uintptr(len(m.b)) {
+		return fmt.Errorf("%#x is not mapped", addr)
+	}
+	copy(b, m.b[addr-m.base:])
+	return nil
+}
+
+func (m *mem) Write(addr uintptr, b []byte) error {
+	if addr < m.base || addr+uintptr(len(b)) > m.base+uintptr(len(m.b)) {
+		return fmt.Errorf("%#x is not mapped", addr)
+	}
+	copy(m.b[addr-m.base:], b)
+	return nil
+}
+
+// Code goes at base, and the stack is at the top of memory.
+const (
+	base  = 0x1000
+	stack = 0x3000
+)
+
+// vm returns a VM to call code, at base, with args.
+func vm(code []byte, args ...uint64) (*VM, *mem) {
+	m := &mem{base: base, b: make([]byte, stack-base)}
+	copy(m.b, code)
+	return New(m, base, stack, args), m
+}
+
+func TestNatural(t *testing.T) {
+	for _, tt := range []struct {
+		x   uint64
+		n   uint
+		off int64
+	}{
+		{0x0010, 16, 16},
+		{0x1005, 16, 9},
+		{0x9005, 16, -9},
+		{0x2021, 16, 8 + 2},
+		{0x20000104, 32, 33},
+		{0x80000008, 32, -8},
+		{0x1000000000000203, 64, 3*8 + 2},
+	} {
+		if off := Natural(tt.x, tt.n); off != tt.off {
+			t.Errorf("Natural(%#x, %d): got %d, want %d", tt.x, tt.n, off, tt.off)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		code []byte
+		args []uint64
+		r7   uint64
+	}{
+		{
+			// MOVqw R1, @R0(+0,+16); MOVqw R2, @R0(+0,+24)
+			// ADD64 R1, R2; MOVqw R7, R1; RET
+			name: "add args",
+			code: []byte{0x60, 0x81, 0x10, 0x00, 0x60, 0x82, 0x18, 0x00, 0x4c, 0x21, 0x20, 0x17, 0x04, 0x00},
+			args: []uint64{40, 2},
+			r7:   42,
+		},
+		{
+			// MOVIqw R1, 0; MOVIqw R2, 10; MOVIqw R3, 1
+			// loop: ADD64 R1, R2; SUB64 R2, R3; CMPI64eq R2, 0; JMP8cc loop
+			// MOVqw R7, R1; RET
+			name: "loop",
+			code: []byte{0x77, 0x31, 0x00, 0x00, 0x77, 0x32, 0x0a, 0x00, 0x77, 0x33, 0x01, 0x00,
+				0x4c, 0x21, 0x4d, 0x32, 0x6d, 0x02, 0x00, 0x00, 0x82, 0xfb,
+				0x20, 0x17, 0x04, 0x00},
+			r7: 55,
+		},
+		{
+			// MOVIqw R1, 21; PUSH64 R1; CALL32 f (relative); POP64 R1; RET
+			// f: MOVqw R1, @R0(+0,+16); ADD64 R1, R1; MOVqw R7, R1; RET
+			name: "call",
+			code: []byte{0x77, 0x31, 0x15, 0x00, 0x6b, 0x01, 0x83, 0x10, 0x04, 0x00, 0x00, 0x00, 0x6c, 0x01, 0x04, 0x00,
+				0x60, 0x81, 0x10, 0x00, 0x4c, 0x11, 0x20, 0x17, 0x04, 0x00},
+			r7: 42,
+		},
+		{
+			// MOVIdw R1, -1; EXTNDD64 R2, R1; MOVIqw R3, 4; ASHR64 R2, R3
+			// MUL32 R2, R3; MOVqw R7, R2; RET
+			// 32-bit results clear the top of the register.
+			name: "signed",
+			code: []byte{0x77, 0x21, 0xff, 0xff, 0x5c, 0x12, 0x77, 0x33, 0x04, 0x00, 0x59, 0x32,
+				0x0e, 0x32, 0x20, 0x27, 0x04, 0x00},
+			r7: 0xfffffffc,
+		},
+		{
+			// MOVRELw R1, 4; MOVbw R7, @R1; RET; data 0x99
+			name: "movrel",
+			code: []byte{0x79, 0x01, 0x04, 0x00, 0x1d, 0x97, 0x04, 0x00, 0x99},
+			r7:   0x99,
+		},
+		{
+			// BREAK 1; RET
+			name: "version",
+			code: []byte{0x00, 0x01, 0x04, 0x00},
+			r7:   Version,
+		},
+	} {
+		v, _ := vm(tt.code, tt.args...)
+		c, err := v.Run()
+		if err != nil || c != nil {
+			t.Errorf("%s: Run: got (%v, %v), want (nil, nil)", tt.name, c, err)
+			continue
+		}
+		if !v.Done() {
+			t.Errorf("%s: Done: got false, want true", tt.name)
+		}
+		if v.R[7] != tt.r7 {
+			t.Errorf("%s: R7: got %#x, want %#x", tt.name, v.R[7], tt.r7)
+		}
+		if v.R[0] != v.retSP {
+			t.Errorf("%s: R0: got %#x, want %#x", tt.name, v.R[0], v.retSP)
+		}
+	}
+}
+
+func TestNativeCall(t *testing.T) {
+	// MOVIqq R1, 0xff400100; MOVIqw R2, 7; PUSH64 R2
+	// CALLEX R1; POP64 R2; ADD64 R7, R7; RET
+	code := []byte{0xf7, 0x31, 0x00, 0x01, 0x40, 0xff, 0x00, 0x00, 0x00, 0x00,
+		0x77, 0x32, 0x07, 0x00, 0x6b, 0x02, 0x03, 0x21, 0x6c, 0x02, 0x4c, 0x77, 0x04, 0x00}
+	v, _ := vm(code)
+	c, err := v.Run()
+	if err != nil || c == nil {
+		t.Fatalf("Run: got (%v, %v), want (a call, nil)", c, err)
+	}
+	if c.Fn != 0xff400100 || len(c.Args) == 0 || c.Args[0] != 7 {
+		t.Fatalf("Run: got call %#x(%#x), want 0xff400100(7, ...)", c.Fn, c.Args)
+	}
+	if _, err := v.Run(); err == nil {
+		t.Errorf("Run with a call in progress: got nil, want error")
+	}
+	v.Return(21)
+	if c, err := v.Run(); err != nil || c != nil {
+		t.Fatalf("Run: got (%v, %v), want (nil, nil)", c, err)
+	}
+	if v.R[7] != 42 {
+		t.Errorf("R7: got %d, want 42", v.R[7])
+	}
+
+	// The same call, to a thunk, stays in the VM: the function at
+	// 0x1100 returns 5.
+	v, m := vm(code)
+	copy(m.b[0x100:], []byte{0x77, 0x37, 0x05, 0x00, 0x04, 0x00})
+	v.Thunk = func(a uint64) (uint64, bool) {
+		return 0x1100, a == 0xff400100
+	}
+	if c, err := v.Run(); err != nil || c != nil {
+		t.Fatalf("Run with a thunk: got (%v, %v), want (nil, nil)", c, err)
+	}
+	if v.R[7] != 10 {
+		t.Errorf("R7 with a thunk: got %d, want 10", v.R[7])
+	}
+}
+
+func TestCreateThunk(t *testing.T) {
+	// MOVRELw R7, 4; BREAK 5; RET; offset to 0x1100
+	v, m := vm([]byte{0x79, 0x07, 0x04, 0x00, 0x00, 0x05, 0x04, 0x00, 0xf4, 0x00, 0x00, 0x00})
+	var entry uint64
+	v.CreateThunk = func(e uint64) (uint64, error) {
+		entry = e
+		return 0xff400108, nil
+	}
+	if _, err := v.Run(); err != nil {
+		t.Fatalf("Run: got %v, want nil", err)
+	}
+	if entry != 0x1100 {
+		t.Errorf("CreateThunk: got %#x, want 0x1100", entry)
+	}
+	if p := binary.LittleEndian.Uint64(m.b[8:]); p != 0xff400108 {
+		t.Errorf("thunk: got %#x, want 0xff400108", p)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		code []byte
+	}{
+		{"break 0", []byte{0x00, 0x00}},
+		{"bad opcode", []byte{0x27, 0x00}},
+		// MOVIqw R1, 0; DIV64 R2, R1
+		{"divide by zero", []byte{0x77, 0x31, 0x00, 0x00, 0x50, 0x12}},
+		// MOVIqq R1, 0x100000; MOVqw R2, @R1
+		{"bad address", []byte{0xf7, 0x31, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x92}},
+		// MOVqw R1 (+0,+8), R2
+		{"index on register", []byte{0xa0, 0x21, 0x08, 0x00}},
+	} {
+		v, _ := vm(tt.code)
+		if _, err := v.Run(); err == nil {
+			t.Errorf("%s: Run: got nil, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Package fmp describes fake firmware devices, for the Firmware
+// Management Protocol. Each device has an image, kept in a host file,
+// and the versions update tools look at. The description is JSON.
+package fmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+// Image attributes.
+const (
+	IMAGE_ATTRIBUTE_IMAGE_UPDATABLE         = 0x1
+	IMAGE_ATTRIBUTE_RESET_REQUIRED          = 0x2
+	IMAGE_ATTRIBUTE_AUTHENTICATION_REQUIRED = 0x4
+	IMAGE_ATTRIBUTE_IN_USE                  = 0x8
+	IMAGE_ATTRIBUTE_UEFI_IMAGE              = 0x10
+)
+
+// ImageUpdatable values, from CheckImage.
+const (
+	IMAGE_UPDATABLE_VALID                  = 0x1
+	IMAGE_UPDATABLE_INVALID                = 0x2
+	IMAGE_UPDATABLE_INVALID_TYPE           = 0x4
+	IMAGE_UPDATABLE_INVALID_OLD            = 0x8
+	IMAGE_UPDATABLE_VALID_WITH_VENDOR_CODE = 0x10
+)
+
+// LastAttemptStatus values.
+const (
+	LAST_ATTEMPT_STATUS_SUCCESS                      = 0
+	LAST_ATTEMPT_STATUS_ERROR_UNSUCCESSFUL           = 1
+	LAST_ATTEMPT_STATUS_ERROR_INSUFFICIENT_RESOURCES = 2
+	LAST_ATTEMPT_STATUS_ERROR_INCORRECT_VERSION      = 3
+	LAST_ATTEMPT_STATUS_ERROR_INVALID_FORMAT         = 4
+)
+
+// The EFI_FIRMWARE_IMAGE_DESCRIPTOR we hand out is version 3.
+const (
+	DescriptorVersion = 3
+	DescriptorSize    = 0x70
+)
+
+// Device is a fake firmware device.
+type Device struct {
+	// ImageTypeID is the GUID of the kind of image, which capsules name.
+	ImageTypeID string `json:"imageTypeId"`
+	ImageID     uint64 `json:"imageId"`
+	Name        string `json:"name"`
+	// Image is the host file with the image.
+	Image                  string `json:"image"`
+	Version                uint32 `json:"version"`
+	VersionName            string `json:"versionName"`
+	LowestSupportedVersion uint32 `json:"lowestSupportedVersion"`
+	HardwareInstance       uint64 `json:"hardwareInstance"`
+	// ResetRequired says an update needs a reset to take effect.
+	ResetRequired      bool   `json:"resetRequired"`
+	LastAttemptVersion uint32 `json:"lastAttemptVersion"`
+	LastAttemptStatus  uint32 `json:"lastAttemptStatus"`
+	// MaxSize is the largest image SetImage and CheckImage take.
+	// If it is 0, it is DefaultMaxSize.
+	MaxSize uint64 `json:"maxSize"`
+	typeID  guid.GUID
+}
+
+// DefaultMaxSize is the largest image a device takes, unless it says.
+const DefaultMaxSize = 32 << 20
+
+// Config is the devices, and the package version that covers them all.
+type Config struct {
+	PackageVersion     uint32    `json:"packageVersion"`
+	PackageVersionName string    `json:"packageVersionName"`
+	Devices            []*Device `json:"devices"`
+}
+
+// Load reads a JSON device description from a file.
+func Load(n string) (*Config, error) {
+	b, err := ioutil.ReadFile(n)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses a JSON device description.
+func Parse(b []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("FMP config: %v", err)
+	}
+	if len(c.Devices) == 0 || len(c.Devices) > 255 {
+		return nil, fmt.Errorf("FMP config: %d devices, want 1 to 255", len(c.Devices))
+	}
+	for i, d := range c.Devices {
+		g, err := guid.Parse(d.ImageTypeID)
+		if err != nil {
+			return nil, fmt.Errorf("FMP config: device %d: %v", i, err)
+		}
+		d.typeID = *g
+		if len(d.Image) == 0 {
+			return nil, fmt.Errorf("FMP config: device %d: no image file", i)
+		}
+		if d.ImageID == 0 {
+			d.ImageID = uint64(i + 1)
+		}
+		if len(d.VersionName) == 0 {
+			d.VersionName = strconv.Itoa(int(d.Version))
+		}
+		if d.MaxSize == 0 {
+			d.MaxSize = DefaultMaxSize
+		}
+	}
+	return &c, nil
+}
+
+// TypeID returns the image type GUID.
+func (d *Device) TypeID() guid.GUID {
+	return d.typeID
+}
+
+// Attributes returns the image attributes. They are what is supported
+// and what is set: we don't do authentication.
+func (d *Device) Attributes() uint64 {
+	a := uint64(IMAGE_ATTRIBUTE_IMAGE_UPDATABLE | IMAGE_ATTRIBUTE_IN_USE)
+	if d.ResetRequired {
+		a |= IMAGE_ATTRIBUTE_RESET_REQUIRED
+	}
+	return a
+}
+
+// ReadImage returns the image.
+func (d *Device) ReadImage() ([]byte, error) {
+	return ioutil.ReadFile(d.Image)
+}
+
+// Descriptor returns the EFI_FIRMWARE_IMAGE_DESCRIPTOR for the device,
+// which is image index. The names are pointers to CHAR16 strings.
+// The offsets are those of the C struct: an EFI_GUID is 4-byte aligned,
+// so ImageTypeId follows the UINT8 ImageIndex at 4.
+func (d *Device) Descriptor(index uint8, size uint64, name, versionName uint64) []byte {
+	b := make([]byte, DescriptorSize)
+	b[0] = index
+	copy(b[0x4:], d.typeID[:])
+	binary.LittleEndian.PutUint64(b[0x18:], d.ImageID)
+	binary.LittleEndian.PutUint64(b[0x20:], name)
+	binary.LittleEndian.PutUint32(b[0x28:], d.Version)
+	binary.LittleEndian.PutUint64(b[0x30:], versionName)
+	binary.LittleEndian.PutUint64(b[0x38:], size)
+	binary.LittleEndian.PutUint64(b[0x40:], d.Attributes())
+	binary.LittleEndian.PutUint64(b[0x48:], d.Attributes())
+	binary.LittleEndian.PutUint32(b[0x58:], d.LowestSupportedVersion)
+	binary.LittleEndian.PutUint32(b[0x5c:], d.LastAttemptVersion)
+	binary.LittleEndian.PutUint32(b[0x60:], d.LastAttemptStatus)
+	binary.LittleEndian.PutUint64(b[0x68:], d.HardwareInstance)
+	return b
+}
+
+// PayloadSignature is the FMP_PAYLOAD_HEADER signature, "MSS1".
+const PayloadSignature = 0x3153534d
+
+// PayloadHeader is the FMP_PAYLOAD_HEADER edk2 puts in front of images,
+// so the firmware knows their version without looking inside.
+type PayloadHeader struct {
+	Signature              uint32
+	HeaderSize             uint32
+	FwVersion              uint32
+	LowestSupportedVersion uint32
+}
+
+// Payload splits an image into its payload header, if it has one, and
+// the payload.
+func Payload(image []byte) (*PayloadHeader, []byte) {
+	var h PayloadHeader
+	if err := binary.Read(bytes.NewReader(image), binary.LittleEndian, &h); err != nil {
+		return nil, image
+	}
+	if h.Signature != PayloadSignature || h.HeaderSize < uint32(binary.Size(h)) || uint64(h.HeaderSize) > uint64(len(image)) {
+		return nil, image
+	}
+	return &h, image[h.HeaderSize:]
+}
+
+// Check says whether image can go on the device, as CheckImage does.
+// It also returns the LastAttemptStatus for a SetImage of it.
+func (d *Device) Check(image []byte) (uint32, uint32) {
+	if len(image) == 0 {
+		return IMAGE_UPDATABLE_INVALID, LAST_ATTEMPT_STATUS_ERROR_INVALID_FORMAT
+	}
+	h, _ := Payload(image)
+	if h != nil && h.FwVersion < d.LowestSupportedVersion {
+		return IMAGE_UPDATABLE_INVALID_OLD, LAST_ATTEMPT_STATUS_ERROR_INCORRECT_VERSION
+	}
+	return IMAGE_UPDATABLE_VALID, LAST_ATTEMPT_STATUS_SUCCESS
+}
+
+// Update writes the payload of image to the image file, and takes the
+// versions from its payload header, if it has one. It records the
+// attempt, whether it works or not.
+func (d *Device) Update(image []byte) error {
+	h, p := Payload(image)
+	v := d.Version
+	if h != nil {
+		v = h.FwVersion
+	}
+	ok, status := d.Check(image)
+	d.LastAttemptVersion, d.LastAttemptStatus = v, status
+	if ok != IMAGE_UPDATABLE_VALID {
+		return fmt.Errorf("%s: image version %d is not updatable (%#x)", d.Name, v, ok)
+	}
+	if err := ioutil.WriteFile(d.Image, p, 0644); err != nil {
+		d.LastAttemptStatus = LAST_ATTEMPT_STATUS_ERROR_UNSUCCESSFUL
+		return err
+	}
+	if h != nil {
+		d.Version, d.VersionName = h.FwVersion, strconv.Itoa(int(h.FwVersion))
+		if h.LowestSupportedVersion > d.LowestSupportedVersion {
+			d.LowestSupportedVersion = h.LowestSupportedVersion
+		}
+	}
+	return nil
+}
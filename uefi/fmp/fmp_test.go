@@ -0,0 +1,113 @@
+package fmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func payload(version, lowest uint32, p string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &PayloadHeader{Signature: PayloadSignature, HeaderSize: 16, FwVersion: version, LowestSupportedVersion: lowest})
+	b.WriteString(p)
+	return b.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		in string
+		ok bool
+	}{
+		{`{"devices": [{"imageTypeId": "A0A3B1B6-3E3B-4F5E-8F1F-6C2D2E1A5C01", "image": "x"}]}`, true},
+		{`{"devices": []}`, false},
+		{`{"devices": [{"imageTypeId": "nope", "image": "x"}]}`, false},
+		{`{"devices": [{"imageTypeId": "A0A3B1B6-3E3B-4F5E-8F1F-6C2D2E1A5C01"}]}`, false},
+	} {
+		_, err := Parse([]byte(tt.in))
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse(%s): got %v, want ok %v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	n := filepath.Join(t.TempDir(), "image")
+	if err := ioutil.WriteFile(n, []byte("old firmware"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Parse([]byte(`{"devices": [{"imageTypeId": "A0A3B1B6-3E3B-4F5E-8F1F-6C2D2E1A5C01", "image": "` + n + `", "version": 3, "lowestSupportedVersion": 2}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := c.Devices[0]
+	if d.ImageID != 1 || d.VersionName != "3" || d.MaxSize != DefaultMaxSize {
+		t.Errorf("Defaults: got ImageId %d VersionName %q MaxSize %#x, want 1, \"3\", %#x", d.ImageID, d.VersionName, d.MaxSize, DefaultMaxSize)
+	}
+	if ok, _ := d.Check(payload(1, 1, "too old")); ok != IMAGE_UPDATABLE_INVALID_OLD {
+		t.Errorf("Check(old image): got %#x, want %#x", ok, IMAGE_UPDATABLE_INVALID_OLD)
+	}
+	if err := d.Update(payload(1, 1, "too old")); err == nil || d.LastAttemptStatus != LAST_ATTEMPT_STATUS_ERROR_INCORRECT_VERSION || d.LastAttemptVersion != 1 {
+		t.Errorf("Update(old image): got %v, status %d, version %d, want err, %d, 1", err, d.LastAttemptStatus, d.LastAttemptVersion, LAST_ATTEMPT_STATUS_ERROR_INCORRECT_VERSION)
+	}
+	if err := d.Update(payload(5, 4, "new firmware")); err != nil {
+		t.Fatalf("Update: got %v, want nil", err)
+	}
+	b, err := d.ReadImage()
+	if err != nil || string(b) != "new firmware" {
+		t.Errorf("ReadImage: got %q, %v, want \"new firmware\", nil", b, err)
+	}
+	if d.Version != 5 || d.LowestSupportedVersion != 4 || d.LastAttemptStatus != LAST_ATTEMPT_STATUS_SUCCESS {
+		t.Errorf("After Update: version %d, lowest %d, status %d, want 5, 4, 0", d.Version, d.LowestSupportedVersion, d.LastAttemptStatus)
+	}
+	// No payload header: the image goes as it is, and the version stays.
+	if err := d.Update([]byte("raw")); err != nil || d.Version != 5 {
+		t.Errorf("Update(raw): got %v, version %d, want nil, 5", err, d.Version)
+	}
+}
+
+func TestDescriptor(t *testing.T) {
+	c, err := Parse([]byte(`{"devices": [{"imageTypeId": "A0A3B1B6-3E3B-4F5E-8F1F-6C2D2E1A5C01", "image": "x", "imageId": 7, "version": 5,
+		"lowestSupportedVersion": 4, "resetRequired": true, "hardwareInstance": 9}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := c.Devices[0]
+	d.LastAttemptVersion, d.LastAttemptStatus = 6, LAST_ATTEMPT_STATUS_ERROR_INVALID_FORMAT
+	b := d.Descriptor(2, 0x1234, 0x1000, 0x2000)
+	if len(b) != 0x70 {
+		t.Fatalf("Descriptor: got %d bytes, want 0x70", len(b))
+	}
+	// The offsets of EFI_FIRMWARE_IMAGE_DESCRIPTOR, version 3, in C.
+	for _, tt := range []struct {
+		name      string
+		off, size int
+		want      uint64
+	}{
+		{"ImageIndex", 0x0, 1, 2},
+		{"ImageId", 0x18, 8, 7},
+		{"ImageIdName", 0x20, 8, 0x1000},
+		{"Version", 0x28, 4, 5},
+		{"VersionName", 0x30, 8, 0x2000},
+		{"Size", 0x38, 8, 0x1234},
+		{"AttributesSupported", 0x40, 8, IMAGE_ATTRIBUTE_IMAGE_UPDATABLE | IMAGE_ATTRIBUTE_RESET_REQUIRED | IMAGE_ATTRIBUTE_IN_USE},
+		{"AttributesSetting", 0x48, 8, IMAGE_ATTRIBUTE_IMAGE_UPDATABLE | IMAGE_ATTRIBUTE_RESET_REQUIRED | IMAGE_ATTRIBUTE_IN_USE},
+		{"Compatibilities", 0x50, 8, 0},
+		{"LowestSupportedImageVersion", 0x58, 4, 4},
+		{"LastAttemptVersion", 0x5c, 4, 6},
+		{"LastAttemptStatus", 0x60, 4, LAST_ATTEMPT_STATUS_ERROR_INVALID_FORMAT},
+		{"HardwareInstance", 0x68, 8, 9},
+	} {
+		var v [8]byte
+		copy(v[:], b[tt.off:tt.off+tt.size])
+		if got := binary.LittleEndian.Uint64(v[:]); got != tt.want {
+			t.Errorf("%s at %#x: got %#x, want %#x", tt.name, tt.off, got, tt.want)
+		}
+	}
+	// ImageTypeId, as an EFI_GUID: Data1, Data2, Data3 little endian, then Data4.
+	want := []byte{0xb6, 0xb1, 0xa3, 0xa0, 0x3b, 0x3e, 0x5e, 0x4f, 0x8f, 0x1f, 0x6c, 0x2d, 0x2e, 0x1a, 0x5c, 0x01}
+	if got := b[0x4:0x14]; !bytes.Equal(got, want) {
+		t.Errorf("ImageTypeId at 0x4: got %#x, want %#x", got, want)
+	}
+}
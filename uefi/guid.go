@@ -13,4 +13,16 @@ var (
 	ConOutGUID                                           = guid.MustParse("387477C2-69C7-11D2-8E39-0A00C969723B")
 	LoadedImageGUID                                      = guid.MustParse(LoadedImageProtocol)
 	ConsoleSupportTest_SimpleTextInputExProtocolTestGUID = guid.MustParse(ConsoleSupportTest_SimpleTextInputExProtocolTest)
+	GOPGUID                                              = guid.MustParse("9042A9DE-23DC-4A38-96FB-7ADED080516A")
+	SerialIOGUID                                         = guid.MustParse("BB25CF6F-F1D4-11D2-9A0C-0090273FC1FD")
+	SMBIOSGUID                                           = guid.MustParse("03583FF6-CB36-4940-947E-B9B39F4AFAF7")
+	SMBIOS3TableGUID                                     = guid.MustParse("F2FD1544-9794-4A2C-992E-E5BBCF20E394")
+	UnicodeCollationGUID                                 = guid.MustParse("1D85CD7F-F43D-11D2-9A0C-0090273FC14D")
+	UnicodeCollation2GUID                                = guid.MustParse("A4C751FC-23AE-4C3E-92E9-4964CF63F349")
+	DevicePathToTextGUID                                 = guid.MustParse("8B843E20-8132-4852-90CC-551A4E4A7F1C")
+	DevicePathFromTextGUID                               = guid.MustParse("05C99A21-C70F-4AD2-8A5F-35DF3343F51E")
+	DevicePathUtilitiesGUID                              = guid.MustParse("0379BE4E-D706-437D-B037-EDB82FB772A4")
+	EBCGUID                                              = guid.MustParse("13AC6DD1-73D0-11D4-B06B-00AA00BD6DE7")
+	FMPGUID                                              = guid.MustParse("86C77A67-0B97-4633-A187-49104D0685C7")
+	DriverBindingGUID                                    = guid.MustParse("18A031AB-B443-4D1A-A5C0-0C09261E9F71")
 )
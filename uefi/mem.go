@@ -64,6 +64,8 @@ const (
 	RequiresRuntimeMapping = 0x8000000000000000
 	// The memory descriptor version -- always 1.
 	MemoryDescriptorVersion = 1
+	// EFI_OPTIONAL_PTR, for ConvertPointer: the pointer may be NULL.
+	EFI_OPTIONAL_PTR = 1
 )
 
 // MemRegion defines a single UEFI memory region
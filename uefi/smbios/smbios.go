@@ -0,0 +1,525 @@
+// Package smbios builds SMBIOS 3.x tables from a simple description
+// of a platform. The description is JSON or YAML, so one voodoo binary can
+// pretend to be any number of fake machines.
+package smbios
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"gopkg.in/yaml.v3"
+)
+
+// SMBIOS structure types we know how to build.
+const (
+	TypeBIOS                = 0
+	TypeSystem              = 1
+	TypeBaseboard           = 2
+	TypeChassis             = 3
+	TypeProcessor           = 4
+	TypePhysicalMemoryArray = 16
+	TypeMemoryDevice        = 17
+	TypeEnd                 = 127
+)
+
+const (
+	// HeaderSize is the size of the common structure header.
+	HeaderSize = 4
+	// EntryPointSize is the size of the 64-bit (_SM3_) entry point.
+	EntryPointSize = 0x18
+	// Major and Minor are the SMBIOS version we claim.
+	Major = 3
+	Minor = 0
+	// HandleReserved asks Add to pick a handle. It is also the start
+	// and end marker for GetNext. It's the EFI_SMBIOS_PROTOCOL's idea.
+	HandleReserved = 0xfffe
+	// HandleNone is the "no handle" value used in structures.
+	HandleNone = 0xffff
+)
+
+// BIOS describes the type 0 structure.
+type BIOS struct {
+	Vendor      string `json:"vendor" yaml:"vendor"`
+	Version     string `json:"version" yaml:"version"`
+	ReleaseDate string `json:"releaseDate" yaml:"releaseDate"`
+	Major       uint8  `json:"major" yaml:"major"`
+	Minor       uint8  `json:"minor" yaml:"minor"`
+}
+
+// System describes the type 1 structure.
+type System struct {
+	Manufacturer string `json:"manufacturer" yaml:"manufacturer"`
+	Product      string `json:"product" yaml:"product"`
+	Version      string `json:"version" yaml:"version"`
+	Serial       string `json:"serial" yaml:"serial"`
+	UUID         string `json:"uuid" yaml:"uuid"`
+	SKU          string `json:"sku" yaml:"sku"`
+	Family       string `json:"family" yaml:"family"`
+}
+
+// Baseboard describes the type 2 structure.
+type Baseboard struct {
+	Manufacturer string `json:"manufacturer" yaml:"manufacturer"`
+	Product      string `json:"product" yaml:"product"`
+	Version      string `json:"version" yaml:"version"`
+	Serial       string `json:"serial" yaml:"serial"`
+	AssetTag     string `json:"assetTag" yaml:"assetTag"`
+	Location     string `json:"location" yaml:"location"`
+}
+
+// Chassis describes the type 3 structure.
+type Chassis struct {
+	Manufacturer string `json:"manufacturer" yaml:"manufacturer"`
+	Type         uint8  `json:"type" yaml:"type"`
+	Version      string `json:"version" yaml:"version"`
+	Serial       string `json:"serial" yaml:"serial"`
+	AssetTag     string `json:"assetTag" yaml:"assetTag"`
+	SKU          string `json:"sku" yaml:"sku"`
+}
+
+// Processor describes a type 4 structure.
+type Processor struct {
+	Socket       string `json:"socket" yaml:"socket"`
+	Manufacturer string `json:"manufacturer" yaml:"manufacturer"`
+	Version      string `json:"version" yaml:"version"`
+	Family       uint16 `json:"family" yaml:"family"`
+	ID           uint64 `json:"id" yaml:"id"`
+	ClockMHz     uint16 `json:"clockMHz" yaml:"clockMHz"`
+	MaxMHz       uint16 `json:"maxMHz" yaml:"maxMHz"`
+	CurrentMHz   uint16 `json:"currentMHz" yaml:"currentMHz"`
+	Serial       string `json:"serial" yaml:"serial"`
+	AssetTag     string `json:"assetTag" yaml:"assetTag"`
+	PartNumber   string `json:"partNumber" yaml:"partNumber"`
+	Cores        uint16 `json:"cores" yaml:"cores"`
+	Threads      uint16 `json:"threads" yaml:"threads"`
+}
+
+// Memory describes a type 17 structure.
+type Memory struct {
+	Locator      string `json:"locator" yaml:"locator"`
+	BankLocator  string `json:"bankLocator" yaml:"bankLocator"`
+	SizeMB       uint32 `json:"sizeMB" yaml:"sizeMB"`
+	SpeedMTs     uint16 `json:"speedMTs" yaml:"speedMTs"`
+	Type         uint8  `json:"type" yaml:"type"`
+	Manufacturer string `json:"manufacturer" yaml:"manufacturer"`
+	Serial       string `json:"serial" yaml:"serial"`
+	AssetTag     string `json:"assetTag" yaml:"assetTag"`
+	PartNumber   string `json:"partNumber" yaml:"partNumber"`
+	Rank         uint8  `json:"rank" yaml:"rank"`
+}
+
+// Config is the description of a platform.
+type Config struct {
+	BIOS       BIOS        `json:"bios" yaml:"bios"`
+	System     System      `json:"system" yaml:"system"`
+	Baseboard  Baseboard   `json:"baseboard" yaml:"baseboard"`
+	Chassis    Chassis     `json:"chassis" yaml:"chassis"`
+	Processors []Processor `json:"processors" yaml:"processors"`
+	Memory     []Memory    `json:"memory" yaml:"memory"`
+}
+
+// Default returns the platform voodoo describes when nobody says otherwise.
+func Default() *Config {
+	return &Config{
+		BIOS:      BIOS{Vendor: "linuxboot", Version: "voodoo", ReleaseDate: "01/01/2021", Major: 1},
+		System:    System{Manufacturer: "linuxboot", Product: "voodoo", Version: "1.0", Serial: "0", UUID: "00000000-0000-0000-0000-000000000000", Family: "voodoo"},
+		Baseboard: Baseboard{Manufacturer: "linuxboot", Product: "voodoo"},
+		Chassis:   Chassis{Manufacturer: "linuxboot", Type: 1},
+		Processors: []Processor{
+			{Socket: "CPU0", Manufacturer: "voodoo", Version: "vCPU", Cores: 1, Threads: 1},
+		},
+		Memory: []Memory{
+			{Locator: "DIMM0", BankLocator: "BANK0", SizeMB: 2048, Type: 0x1a},
+		},
+	}
+}
+
+// Load reads a Config from a file: YAML if it is named .yaml or .yml,
+// JSON otherwise. Anything not in the file is zero; use Default for a
+// full platform.
+func Load(n string) (*Config, error) {
+	b, err := ioutil.ReadFile(n)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(n) {
+	case ".yaml", ".yml":
+		return ParseYAML(b)
+	}
+	return Parse(b)
+}
+
+// Parse parses a JSON platform description.
+func Parse(b []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("SMBIOS config: %v", err)
+	}
+	return &c, nil
+}
+
+// ParseYAML parses a YAML platform description. The names are the
+// ones in JSON.
+func ParseYAML(b []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("SMBIOS config: %v", err)
+	}
+	return &c, nil
+}
+
+// Record is one SMBIOS structure. Formatted includes the 4-byte header,
+// and the handle in it is kept in sync with Handle by Marshal.
+type Record struct {
+	Type      uint8
+	Handle    uint16
+	Formatted []byte
+	Strings   []string
+}
+
+// String implements String
+func (r *Record) String() string {
+	return fmt.Sprintf("SMBIOS type %d handle %#04x len %d %q", r.Type, r.Handle, len(r.Formatted), r.Strings)
+}
+
+// Marshal returns the structure as it appears in the table:
+// formatted area followed by the string set.
+func (r *Record) Marshal() []byte {
+	b := append([]byte{}, r.Formatted...)
+	b[0] = r.Type
+	b[1] = uint8(len(r.Formatted))
+	binary.LittleEndian.PutUint16(b[2:], r.Handle)
+	if len(r.Strings) == 0 {
+		return append(b, 0, 0)
+	}
+	for _, s := range r.Strings {
+		b = append(b, s...)
+		b = append(b, 0)
+	}
+	return append(b, 0)
+}
+
+// SetString replaces string number n, counting from 1 as SMBIOS does.
+func (r *Record) SetString(n int, s string) error {
+	if n < 1 || n > len(r.Strings) {
+		return fmt.Errorf("SMBIOS type %d handle %#04x: no string %d", r.Type, r.Handle, n)
+	}
+	r.Strings[n-1] = s
+	return nil
+}
+
+// Unmarshal parses one structure from the front of b. It returns
+// the record and the number of bytes it used.
+func Unmarshal(b []byte) (*Record, int, error) {
+	if len(b) < HeaderSize {
+		return nil, 0, fmt.Errorf("SMBIOS record: %d bytes is too short for a header", len(b))
+	}
+	l := int(b[1])
+	if l < HeaderSize || l > len(b) {
+		return nil, 0, fmt.Errorf("SMBIOS record: bad length %d (have %d bytes)", l, len(b))
+	}
+	r := &Record{Type: b[0], Handle: binary.LittleEndian.Uint16(b[2:]), Formatted: append([]byte{}, b[:l]...)}
+	// The string set ends with two NULs. If there are no strings, it is just the two NULs.
+	end := bytes.Index(b[l:], []byte{0, 0})
+	if end < 0 {
+		return nil, 0, fmt.Errorf("SMBIOS record type %d: unterminated string set", r.Type)
+	}
+	if end > 0 {
+		r.Strings = strings.Split(string(b[l:l+end]), "\x00")
+	}
+	return r, l + end + 2, nil
+}
+
+// record is a helper for building records. It hands out string numbers.
+type record struct {
+	*Record
+}
+
+func newRecord(t uint8, l int) *record {
+	return &record{&Record{Type: t, Formatted: make([]byte, l)}}
+}
+
+// str adds a string and puts its number at off. SMBIOS uses
+// 0 for "no string", so empty strings cost nothing.
+func (r *record) str(off int, s string) {
+	if s == "" {
+		return
+	}
+	r.Strings = append(r.Strings, s)
+	r.Formatted[off] = uint8(len(r.Strings))
+}
+
+func (r *record) u8(off int, v uint8) {
+	r.Formatted[off] = v
+}
+
+func (r *record) u16(off int, v uint16) {
+	binary.LittleEndian.PutUint16(r.Formatted[off:], v)
+}
+
+func (r *record) u32(off int, v uint32) {
+	binary.LittleEndian.PutUint32(r.Formatted[off:], v)
+}
+
+func (r *record) u64(off int, v uint64) {
+	binary.LittleEndian.PutUint64(r.Formatted[off:], v)
+}
+
+func (c *Config) bios() *Record {
+	r := newRecord(TypeBIOS, 0x18)
+	r.str(0x04, c.BIOS.Vendor)
+	r.str(0x05, c.BIOS.Version)
+	r.u16(0x06, 0xe800)
+	r.str(0x08, c.BIOS.ReleaseDate)
+	// 64K * (n+1). We're tiny.
+	r.u8(0x09, 0)
+	// Characteristics: bit 3, "BIOS characteristics not supported".
+	// It's the truth.
+	r.u64(0x0a, 1<<3)
+	// Extension byte 2: UEFI is supported (bit 3), this is a VM (bit 4).
+	r.u8(0x13, 1<<3|1<<4)
+	r.u8(0x14, c.BIOS.Major)
+	r.u8(0x15, c.BIOS.Minor)
+	r.u8(0x16, 0xff)
+	r.u8(0x17, 0xff)
+	return r.Record
+}
+
+func (c *Config) system() (*Record, error) {
+	r := newRecord(TypeSystem, 0x1b)
+	r.str(0x04, c.System.Manufacturer)
+	r.str(0x05, c.System.Product)
+	r.str(0x06, c.System.Version)
+	r.str(0x07, c.System.Serial)
+	if c.System.UUID != "" {
+		// SMBIOS 2.6 and later store the first three fields little-endian,
+		// which is exactly what an EFI GUID does.
+		g, err := guid.Parse(c.System.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("system UUID %q: %v", c.System.UUID, err)
+		}
+		copy(r.Formatted[0x08:], g[:])
+	}
+	// Wake-up type: power switch.
+	r.u8(0x18, 6)
+	r.str(0x19, c.System.SKU)
+	r.str(0x1a, c.System.Family)
+	return r.Record, nil
+}
+
+func (c *Config) baseboard(chassis uint16) *Record {
+	r := newRecord(TypeBaseboard, 0x0f)
+	r.str(0x04, c.Baseboard.Manufacturer)
+	r.str(0x05, c.Baseboard.Product)
+	r.str(0x06, c.Baseboard.Version)
+	r.str(0x07, c.Baseboard.Serial)
+	r.str(0x08, c.Baseboard.AssetTag)
+	// Feature flags: hosting board.
+	r.u8(0x09, 1)
+	r.str(0x0a, c.Baseboard.Location)
+	r.u16(0x0b, chassis)
+	// Board type: motherboard.
+	r.u8(0x0d, 0x0a)
+	return r.Record
+}
+
+func (c *Config) chassis() *Record {
+	r := newRecord(TypeChassis, 0x16)
+	r.str(0x04, c.Chassis.Manufacturer)
+	t := c.Chassis.Type
+	if t == 0 {
+		// Other.
+		t = 1
+	}
+	r.u8(0x05, t)
+	r.str(0x06, c.Chassis.Version)
+	r.str(0x07, c.Chassis.Serial)
+	r.str(0x08, c.Chassis.AssetTag)
+	// Boot-up, power supply, thermal state: safe. Security: none.
+	r.u8(0x09, 3)
+	r.u8(0x0a, 3)
+	r.u8(0x0b, 3)
+	r.u8(0x0c, 3)
+	r.str(0x15, c.Chassis.SKU)
+	return r.Record
+}
+
+func (c *Config) processor(p *Processor) *Record {
+	r := newRecord(TypeProcessor, 0x30)
+	r.str(0x04, p.Socket)
+	// Central processor.
+	r.u8(0x05, 3)
+	// Family is in Family 2.
+	r.u8(0x06, 0xfe)
+	r.str(0x07, p.Manufacturer)
+	r.u64(0x08, p.ID)
+	r.str(0x10, p.Version)
+	r.u16(0x12, p.ClockMHz)
+	r.u16(0x14, p.MaxMHz)
+	r.u16(0x16, p.CurrentMHz)
+	// Socket populated, CPU enabled.
+	r.u8(0x18, 0x41)
+	// Upgrade: other.
+	r.u8(0x19, 1)
+	r.u16(0x1a, HandleNone)
+	r.u16(0x1c, HandleNone)
+	r.u16(0x1e, HandleNone)
+	r.str(0x20, p.Serial)
+	r.str(0x21, p.AssetTag)
+	r.str(0x22, p.PartNumber)
+	cores, threads := p.Cores, p.Threads
+	r.u8(0x23, count8(cores))
+	r.u8(0x24, count8(cores))
+	r.u8(0x25, count8(threads))
+	// 64-bit capable.
+	r.u16(0x26, 1<<2)
+	f := p.Family
+	if f == 0 {
+		// Unknown.
+		f = 2
+	}
+	r.u16(0x28, f)
+	r.u16(0x2a, cores)
+	r.u16(0x2c, cores)
+	r.u16(0x2e, threads)
+	return r.Record
+}
+
+// count8 returns the value for an 8-bit count field, which is 0xff when
+// the real count lives in the 16-bit field.
+func count8(n uint16) uint8 {
+	if n > 0xfe {
+		return 0xff
+	}
+	return uint8(n)
+}
+
+func (c *Config) memoryArray() *Record {
+	r := newRecord(TypePhysicalMemoryArray, 0x17)
+	// System board, system memory, no ECC.
+	r.u8(0x04, 3)
+	r.u8(0x05, 3)
+	r.u8(0x06, 3)
+	var total uint64
+	for _, m := range c.Memory {
+		total += uint64(m.SizeMB)
+	}
+	// In KiB, unless it won't fit; then it's in bytes in the extended field.
+	if kb := total * 1024; kb < 0x80000000 {
+		r.u32(0x07, uint32(kb))
+	} else {
+		r.u32(0x07, 0x80000000)
+		r.u64(0x0f, total<<20)
+	}
+	r.u16(0x0b, HandleReserved)
+	r.u16(0x0d, uint16(len(c.Memory)))
+	return r.Record
+}
+
+func (c *Config) memory(m *Memory, array uint16) *Record {
+	r := newRecord(TypeMemoryDevice, 0x28)
+	r.u16(0x04, array)
+	r.u16(0x06, HandleReserved)
+	r.u16(0x08, 64)
+	r.u16(0x0a, 64)
+	// Sizes of 32G and up go in the extended size field.
+	if m.SizeMB < 0x7fff {
+		r.u16(0x0c, uint16(m.SizeMB))
+	} else {
+		r.u16(0x0c, 0x7fff)
+		r.u32(0x1c, m.SizeMB)
+	}
+	// DIMM.
+	r.u8(0x0e, 0x09)
+	r.str(0x10, m.Locator)
+	r.str(0x11, m.BankLocator)
+	t := m.Type
+	if t == 0 {
+		// Unknown.
+		t = 2
+	}
+	r.u8(0x12, t)
+	// Synchronous.
+	r.u16(0x13, 1<<7)
+	r.u16(0x15, m.SpeedMTs)
+	r.str(0x17, m.Manufacturer)
+	r.str(0x18, m.Serial)
+	r.str(0x19, m.AssetTag)
+	r.str(0x1a, m.PartNumber)
+	r.u8(0x1b, m.Rank&0xf)
+	r.u16(0x20, m.SpeedMTs)
+	return r.Record
+}
+
+// Records returns the SMBIOS structures for a Config, with handles
+// assigned in order, ending with the type 127 end-of-table structure.
+func (c *Config) Records() ([]*Record, error) {
+	var recs []*Record
+	add := func(r *Record) uint16 {
+		r.Handle = uint16(len(recs))
+		recs = append(recs, r)
+		return r.Handle
+	}
+	add(c.bios())
+	s, err := c.system()
+	if err != nil {
+		return nil, err
+	}
+	add(s)
+	// The chassis goes before the board so the board can point to it.
+	ch := c.chassis()
+	b := c.baseboard(uint16(len(recs) + 1))
+	add(b)
+	add(ch)
+	for i := range c.Processors {
+		add(c.processor(&c.Processors[i]))
+	}
+	if len(c.Memory) > 0 {
+		a := add(c.memoryArray())
+		for i := range c.Memory {
+			add(c.memory(&c.Memory[i], a))
+		}
+	}
+	add(&Record{Type: TypeEnd, Formatted: make([]byte, HeaderSize)})
+	return recs, nil
+}
+
+// Table returns the structure table for a set of records.
+// The end-of-table record, if any, is always put last.
+func Table(recs []*Record) []byte {
+	var b, end []byte
+	for _, r := range recs {
+		if r.Type == TypeEnd {
+			end = r.Marshal()
+			continue
+		}
+		b = append(b, r.Marshal()...)
+	}
+	return append(b, end...)
+}
+
+// EntryPoint returns the 64-bit (_SM3_) entry point for a table
+// of size bytes at addr.
+func EntryPoint(addr uint64, size uint32) []byte {
+	var b [EntryPointSize]byte
+	copy(b[:], "_SM3_")
+	b[0x06] = EntryPointSize
+	b[0x07] = Major
+	b[0x08] = Minor
+	// Entry point revision: 3.0
+	b[0x0a] = 1
+	binary.LittleEndian.PutUint32(b[0x0c:], size)
+	binary.LittleEndian.PutUint64(b[0x10:], addr)
+	var sum uint8
+	for _, c := range b {
+		sum += c
+	}
+	b[0x05] = -sum
+	return b[:]
+}
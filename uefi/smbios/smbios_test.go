@@ -0,0 +1,149 @@
+package smbios
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	for i, tt := range []struct {
+		r   *Record
+		out []byte
+	}{
+		{r: &Record{Type: TypeEnd, Handle: 7, Formatted: make([]byte, 4)}, out: []byte{0x7f, 0x04, 0x07, 0x00, 0x00, 0x00}},
+		{r: &Record{Type: TypeSystem, Handle: 1, Formatted: make([]byte, 5), Strings: []string{"a", "bc"}}, out: []byte{0x01, 0x05, 0x01, 0x00, 0x00, 'a', 0, 'b', 'c', 0, 0}},
+	} {
+		b := tt.r.Marshal()
+		if !bytes.Equal(b, tt.out) {
+			t.Errorf("Test %d: got %#02x, want %#02x", i, b, tt.out)
+			continue
+		}
+		r, n, err := Unmarshal(append(b, 0xaa, 0xbb))
+		if err != nil {
+			t.Errorf("Test %d: Unmarshal: got %v, want nil", i, err)
+			continue
+		}
+		if n != len(b) {
+			t.Errorf("Test %d: Unmarshal used %d bytes, want %d", i, n, len(b))
+		}
+		if !bytes.Equal(r.Marshal(), b) {
+			t.Errorf("Test %d: round trip: got %#02x, want %#02x", i, r.Marshal(), b)
+		}
+	}
+}
+
+func TestUnmarshalBad(t *testing.T) {
+	for i, b := range [][]byte{
+		{},
+		{0x01, 0x02, 0x00, 0x00},
+		{0x01, 0x10, 0x00, 0x00},
+		{0x01, 0x04, 0x00, 0x00, 'a', 0},
+	} {
+		if _, _, err := Unmarshal(b); err == nil {
+			t.Errorf("Test %d: Unmarshal(%#02x): got nil, want error", i, b)
+		}
+	}
+}
+
+func TestDefaultTable(t *testing.T) {
+	recs, err := Default().Records()
+	if err != nil {
+		t.Fatalf("Records: got %v, want nil", err)
+	}
+	want := []uint8{TypeBIOS, TypeSystem, TypeBaseboard, TypeChassis, TypeProcessor, TypePhysicalMemoryArray, TypeMemoryDevice, TypeEnd}
+	if len(recs) != len(want) {
+		t.Fatalf("Records: got %d, want %d", len(recs), len(want))
+	}
+	for i, r := range recs {
+		if r.Type != want[i] || r.Handle != uint16(i) {
+			t.Errorf("Record %d: got type %d handle %d, want type %d handle %d", i, r.Type, r.Handle, want[i], i)
+		}
+	}
+	// The baseboard points at the chassis.
+	if h := recs[2].Formatted[0x0b]; h != 3 {
+		t.Errorf("Baseboard chassis handle: got %d, want 3", h)
+	}
+	tab := Table(recs)
+	var n int
+	for b := tab; len(b) > 0; n++ {
+		r, l, err := Unmarshal(b)
+		if err != nil {
+			t.Fatalf("Table record %d: got %v, want nil", n, err)
+		}
+		if r.Type != want[n] {
+			t.Errorf("Table record %d: got type %d, want %d", n, r.Type, want[n])
+		}
+		b = b[l:]
+	}
+	if n != len(want) {
+		t.Errorf("Table: got %d records, want %d", n, len(want))
+	}
+}
+
+func TestUUID(t *testing.T) {
+	c, err := Parse([]byte(`{"system": {"uuid": "4C4C4544-0042-3610-8057-B4C04F4D4E31", "serial": "ABC123"}}`))
+	if err != nil {
+		t.Fatalf("Parse: got %v, want nil", err)
+	}
+	s, err := c.system()
+	if err != nil {
+		t.Fatalf("system: got %v, want nil", err)
+	}
+	want := []byte{0x44, 0x45, 0x4c, 0x4c, 0x42, 0x00, 0x10, 0x36, 0x80, 0x57, 0xb4, 0xc0, 0x4f, 0x4d, 0x4e, 0x31}
+	if !bytes.Equal(s.Formatted[0x08:0x18], want) {
+		t.Errorf("UUID: got %#02x, want %#02x", s.Formatted[0x08:0x18], want)
+	}
+	if len(s.Strings) != 1 || s.Strings[0] != "ABC123" || s.Formatted[0x07] != 1 {
+		t.Errorf("Serial: got strings %q, index %d, want [ABC123], 1", s.Strings, s.Formatted[0x07])
+	}
+	c, err = Parse([]byte(`{"system": {"uuid": "nope"}}`))
+	if err != nil {
+		t.Fatalf("Parse: got %v, want nil", err)
+	}
+	if _, err := c.system(); err == nil {
+		t.Errorf("system with bad UUID: got nil, want error")
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	y, err := ParseYAML([]byte(`
+system:
+  manufacturer: Fake
+  serial: 0123
+  uuid: 4C4C4544-0042-3610-8057-B4C04F4D4E31
+memory:
+  - locator: DIMM0
+    sizeMB: 4096
+  - locator: DIMM1
+    sizeMB: 8192
+`))
+	if err != nil {
+		t.Fatalf("ParseYAML: got %v, want nil", err)
+	}
+	j, err := Parse([]byte(`{"system": {"manufacturer": "Fake", "serial": "0123", "uuid": "4C4C4544-0042-3610-8057-B4C04F4D4E31"},
+		"memory": [{"locator": "DIMM0", "sizeMB": 4096}, {"locator": "DIMM1", "sizeMB": 8192}]}`))
+	if err != nil {
+		t.Fatalf("Parse: got %v, want nil", err)
+	}
+	if !reflect.DeepEqual(y, j) {
+		t.Errorf("ParseYAML: got %+v, want %+v, as from JSON", y, j)
+	}
+	if _, err := ParseYAML([]byte("system: [")); err == nil {
+		t.Errorf("ParseYAML of bad YAML: got nil, want error")
+	}
+}
+
+func TestEntryPoint(t *testing.T) {
+	b := EntryPoint(0xff0a1000, 0x1234)
+	if len(b) != EntryPointSize || string(b[:5]) != "_SM3_" {
+		t.Fatalf("EntryPoint: got %#02x", b)
+	}
+	var sum uint8
+	for _, c := range b {
+		sum += c
+	}
+	if sum != 0 {
+		t.Errorf("EntryPoint checksum: got %#x, want 0", sum)
+	}
+}
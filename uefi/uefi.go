@@ -7,40 +7,43 @@ import (
 	"github.com/linuxboot/fiano/pkg/guid"
 )
 
-// All the things we hate about UEFI in one convenient place
+// All the things we hate about UEFI in one convenient place.
+// Errors have the high bit set, so EFI_ERROR() in the guest sees them;
+// warnings do not.
 const (
+	errBit                    = 1 << 63
 	EFI_SUCCESS               = 0
-	EFI_LOAD_ERROR            = (1)
-	EFI_INVALID_PARAMETER     = (2)
-	EFI_UNSUPPORTED           = (3)
-	EFI_BAD_BUFFER_SIZE       = (4)
-	EFI_BUFFER_TOO_SMALL      = (5)
-	EFI_NOT_READY             = (6)
-	EFI_DEVICE_ERROR          = (7)
-	EFI_WRITE_PROTECTED       = (8)
-	EFI_OUT_OF_RESOURCES      = (9)
-	EFI_VOLUME_CORRUPTED      = (10)
-	EFI_VOLUME_FULL           = (11)
-	EFI_NO_MEDIA              = (12)
-	EFI_MEDIA_CHANGED         = (13)
-	EFI_NOT_FOUND             = (14)
-	EFI_ACCESS_DENIED         = (15)
-	EFI_NO_RESPONSE           = (16)
-	EFI_NO_MAPPING            = (17)
-	EFI_TIMEOUT               = (18)
-	EFI_NOT_STARTED           = (19)
-	EFI_ALREADY_STARTED       = (20)
-	EFI_ABORTED               = (21)
-	EFI_ICMP_ERROR            = (22)
-	EFI_TFTP_ERROR            = (23)
-	EFI_PROTOCOL_ERROR        = (24)
-	EFI_INCOMPATIBLE_VERSION  = (25)
-	EFI_SECURITY_VIOLATION    = (26)
-	EFI_CRC_ERROR             = (27)
-	EFI_END_OF_MEDIA          = (28)
-	EFI_END_OF_FILE           = (31)
-	EFI_INVALID_LANGUAGE      = (32)
-	EFI_COMPROMISED_DATA      = (33)
+	EFI_LOAD_ERROR            = errBit | 1
+	EFI_INVALID_PARAMETER     = errBit | 2
+	EFI_UNSUPPORTED           = errBit | 3
+	EFI_BAD_BUFFER_SIZE       = errBit | 4
+	EFI_BUFFER_TOO_SMALL      = errBit | 5
+	EFI_NOT_READY             = errBit | 6
+	EFI_DEVICE_ERROR          = errBit | 7
+	EFI_WRITE_PROTECTED       = errBit | 8
+	EFI_OUT_OF_RESOURCES      = errBit | 9
+	EFI_VOLUME_CORRUPTED      = errBit | 10
+	EFI_VOLUME_FULL           = errBit | 11
+	EFI_NO_MEDIA              = errBit | 12
+	EFI_MEDIA_CHANGED         = errBit | 13
+	EFI_NOT_FOUND             = errBit | 14
+	EFI_ACCESS_DENIED         = errBit | 15
+	EFI_NO_RESPONSE           = errBit | 16
+	EFI_NO_MAPPING            = errBit | 17
+	EFI_TIMEOUT               = errBit | 18
+	EFI_NOT_STARTED           = errBit | 19
+	EFI_ALREADY_STARTED       = errBit | 20
+	EFI_ABORTED               = errBit | 21
+	EFI_ICMP_ERROR            = errBit | 22
+	EFI_TFTP_ERROR            = errBit | 23
+	EFI_PROTOCOL_ERROR        = errBit | 24
+	EFI_INCOMPATIBLE_VERSION  = errBit | 25
+	EFI_SECURITY_VIOLATION    = errBit | 26
+	EFI_CRC_ERROR             = errBit | 27
+	EFI_END_OF_MEDIA          = errBit | 28
+	EFI_END_OF_FILE           = errBit | 31
+	EFI_INVALID_LANGUAGE      = errBit | 32
+	EFI_COMPROMISED_DATA      = errBit | 33
 	EFI_WARN_UNKOWN_GLYPH     = (1)
 	EFI_WARN_UNKNOWN_GLYPH    = (1)
 	EFI_WARN_DELETE_FAILURE   = (2)
@@ -115,9 +118,10 @@ type EFIError struct {
 }
 
 func (e EFIError) Error() string {
-	s := strconv.Itoa(int(e.Val))
-	if 0 <= int(e.Val) && int(e.Val) < len(errors) {
-		s = errors[e.Val]
+	v := e.Val &^ errBit
+	s := strconv.Itoa(int(v))
+	if v < uintptr(len(errors)) {
+		s = errors[v]
 	}
 	return "EFIERR " + e.Err.Error() + s
 }
@@ -153,7 +157,103 @@ const (
 	EFI_OPEN_PROTOCOL_EXCLUSIVE           = 0x00000020
 )
 
+// EFI_NATIVE_INTERFACE is the only EFI_INTERFACE_TYPE.
+const EFI_NATIVE_INTERFACE = 0
+
 // from u-boot:
 // UEFI has a poor man's OO model where one "object" can be polymorphic and have
 // multiple different protocols (classes) attached to it.
 // The hits just keep coming.
+
+// Event types.
+const (
+	EVT_TIMER                         = 0x80000000
+	EVT_RUNTIME                       = 0x40000000
+	EVT_NOTIFY_WAIT                   = 0x00000100
+	EVT_NOTIFY_SIGNAL                 = 0x00000200
+	EVT_SIGNAL_EXIT_BOOT_SERVICES     = 0x00000201
+	EVT_SIGNAL_VIRTUAL_ADDRESS_CHANGE = 0x60000202
+)
+
+// Task priority levels.
+const (
+	TPL_APPLICATION = 4
+	TPL_CALLBACK    = 8
+	TPL_NOTIFY      = 16
+	TPL_HIGH_LEVEL  = 31
+)
+
+// Timer types for SetTimer.
+const (
+	TimerCancel   = 0
+	TimerPeriodic = 1
+	TimerRelative = 2
+)
+
+// Key shift and toggle state, for SimpleTextInputEx.
+const (
+	EFI_SHIFT_STATE_VALID     = 0x80000000
+	EFI_RIGHT_SHIFT_PRESSED   = 0x00000001
+	EFI_LEFT_SHIFT_PRESSED    = 0x00000002
+	EFI_RIGHT_CONTROL_PRESSED = 0x00000004
+	EFI_LEFT_CONTROL_PRESSED  = 0x00000008
+	EFI_RIGHT_ALT_PRESSED     = 0x00000010
+	EFI_LEFT_ALT_PRESSED      = 0x00000020
+	EFI_RIGHT_LOGO_PRESSED    = 0x00000040
+	EFI_LEFT_LOGO_PRESSED     = 0x00000080
+	EFI_MENU_KEY_PRESSED      = 0x00000100
+	EFI_SYS_REQ_PRESSED       = 0x00000200
+
+	EFI_TOGGLE_STATE_VALID = 0x80
+	EFI_KEY_STATE_EXPOSED  = 0x40
+	EFI_SCROLL_LOCK_ACTIVE = 0x01
+	EFI_NUM_LOCK_ACTIVE    = 0x02
+	EFI_CAPS_LOCK_ACTIVE   = 0x04
+)
+
+// Serial IO control bits.
+const (
+	EFI_SERIAL_DATA_TERMINAL_READY          = 0x0001
+	EFI_SERIAL_REQUEST_TO_SEND              = 0x0002
+	EFI_SERIAL_CLEAR_TO_SEND                = 0x0010
+	EFI_SERIAL_DATA_SET_READY               = 0x0020
+	EFI_SERIAL_RING_INDICATE                = 0x0040
+	EFI_SERIAL_CARRIER_DETECT               = 0x0080
+	EFI_SERIAL_INPUT_BUFFER_EMPTY           = 0x0100
+	EFI_SERIAL_OUTPUT_BUFFER_EMPTY          = 0x0200
+	EFI_SERIAL_HARDWARE_LOOPBACK_ENABLE     = 0x1000
+	EFI_SERIAL_SOFTWARE_LOOPBACK_ENABLE     = 0x2000
+	EFI_SERIAL_HARDWARE_FLOW_CONTROL_ENABLE = 0x4000
+)
+
+// Serial IO parity and stop bits.
+const (
+	DefaultParity = iota
+	NoParity
+	EvenParity
+	OddParity
+	MarkParity
+	SpaceParity
+)
+
+const (
+	DefaultStopBits = iota
+	OneStopBit
+	OneFiveStopBits
+	TwoStopBits
+)
+
+// EFI_TIME time zone and daylight saving values.
+const (
+	EFI_UNSPECIFIED_TIMEZONE = 0x07ff
+	EFI_TIME_ADJUST_DAYLIGHT = 0x01
+	EFI_TIME_IN_DAYLIGHT     = 0x02
+)
+
+// EFI_RESET_TYPE values, for ResetSystem.
+const (
+	EfiResetCold = iota
+	EfiResetWarm
+	EfiResetShutdown
+	EfiResetPlatformSpecific
+)
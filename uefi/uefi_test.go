@@ -0,0 +1,44 @@
+package uefi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		s    uint64
+		want uint64
+	}{
+		{"EFI_SUCCESS", EFI_SUCCESS, 0},
+		{"EFI_LOAD_ERROR", EFI_LOAD_ERROR, 0x8000000000000001},
+		{"EFI_INVALID_PARAMETER", EFI_INVALID_PARAMETER, 0x8000000000000002},
+		{"EFI_UNSUPPORTED", EFI_UNSUPPORTED, 0x8000000000000003},
+		{"EFI_BUFFER_TOO_SMALL", EFI_BUFFER_TOO_SMALL, 0x8000000000000005},
+		{"EFI_NOT_READY", EFI_NOT_READY, 0x8000000000000006},
+		{"EFI_DEVICE_ERROR", EFI_DEVICE_ERROR, 0x8000000000000007},
+		{"EFI_OUT_OF_RESOURCES", EFI_OUT_OF_RESOURCES, 0x8000000000000009},
+		{"EFI_NOT_FOUND", EFI_NOT_FOUND, 0x800000000000000e},
+		{"EFI_ACCESS_DENIED", EFI_ACCESS_DENIED, 0x800000000000000f},
+		{"EFI_TIMEOUT", EFI_TIMEOUT, 0x8000000000000012},
+		{"EFI_ALREADY_STARTED", EFI_ALREADY_STARTED, 0x8000000000000014},
+		{"EFI_SECURITY_VIOLATION", EFI_SECURITY_VIOLATION, 0x800000000000001a},
+		{"EFI_COMPROMISED_DATA", EFI_COMPROMISED_DATA, 0x8000000000000021},
+		// Warnings are not errors.
+		{"EFI_WARN_UNKNOWN_GLYPH", EFI_WARN_UNKNOWN_GLYPH, 1},
+		{"EFI_WARN_BUFFER_TOO_SMALL", EFI_WARN_BUFFER_TOO_SMALL, 4},
+	} {
+		if tt.s != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, tt.s, tt.want)
+		}
+	}
+}
+
+func TestEFIErrorString(t *testing.T) {
+	e := EFIError{Err: fmt.Errorf("x: "), Val: EFI_NOT_FOUND}
+	if s := e.Error(); !strings.HasSuffix(s, "EFI_NOT_FOUND") {
+		t.Errorf("EFIError(EFI_NOT_FOUND): got %q, want it to end in EFI_NOT_FOUND", s)
+	}
+}
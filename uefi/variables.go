@@ -0,0 +1,79 @@
+package uefi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+// Variable attributes.
+const (
+	EFI_VARIABLE_NON_VOLATILE                          = 0x00000001
+	EFI_VARIABLE_BOOTSERVICE_ACCESS                    = 0x00000002
+	EFI_VARIABLE_RUNTIME_ACCESS                        = 0x00000004
+	EFI_VARIABLE_HARDWARE_ERROR_RECORD                 = 0x00000008
+	EFI_VARIABLE_AUTHENTICATED_WRITE_ACCESS            = 0x00000010
+	EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS = 0x00000020
+	EFI_VARIABLE_APPEND_WRITE                          = 0x00000040
+)
+
+// WriteVariable sets a UEFI variable. As SetVariable does, it deletes
+// the variable if attr is 0, or if there is no data and it is not an
+// append. An append adds data to what is there, and keeps the attributes,
+// or, if nothing is, sets the variable.
+func WriteVariable(n string, g guid.GUID, attr uintptr, data []byte) error {
+	p := fmt.Sprintf("%s:%s", n, g)
+	v, ok := EFIVariables[p]
+	if attr&EFI_VARIABLE_APPEND_WRITE != 0 {
+		// Appending to what is not there creates it; appending
+		// nothing does nothing.
+		attr &^= EFI_VARIABLE_APPEND_WRITE
+		if !ok {
+			if len(data) > 0 {
+				EFIVariables[p] = &EFIVariable{N: n, Attr: attr, Data: append([]byte{}, data...)}
+			}
+			return nil
+		}
+		v.Data = append(v.Data, data...)
+		return nil
+	}
+	if attr == 0 || len(data) == 0 {
+		if !ok {
+			return fmt.Errorf("%s is not set", p)
+		}
+		delete(EFIVariables, p)
+		return nil
+	}
+	if ok && v.Attr != attr {
+		return fmt.Errorf("%s has attributes %#x, not %#x", p, v.Attr, attr)
+	}
+	EFIVariables[p] = &EFIVariable{N: n, Attr: attr, Data: append([]byte{}, data...)}
+	return nil
+}
+
+// SaveVariables writes the non-volatile variables to w, as JSON.
+func SaveVariables(w io.Writer) error {
+	nv := map[string]*EFIVariable{}
+	for p, v := range EFIVariables {
+		if v.Attr&EFI_VARIABLE_NON_VOLATILE != 0 {
+			nv[p] = v
+		}
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return e.Encode(nv)
+}
+
+// LoadVariables reads variables SaveVariables wrote from r, and sets them.
+func LoadVariables(r io.Reader) error {
+	nv := map[string]*EFIVariable{}
+	if err := json.NewDecoder(r).Decode(&nv); err != nil {
+		return err
+	}
+	for p, v := range nv {
+		EFIVariables[p] = v
+	}
+	return nil
+}
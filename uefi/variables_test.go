@@ -0,0 +1,69 @@
+package uefi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+func TestVariables(t *testing.T) {
+	EFIVariables = map[string]*EFIVariable{}
+	g := guid.MustParse("8BE4DF61-93CA-11D2-AA0D-00E098032B8C")
+	nv := uintptr(EFI_VARIABLE_NON_VOLATILE | EFI_VARIABLE_BOOTSERVICE_ACCESS | EFI_VARIABLE_RUNTIME_ACCESS)
+	if err := WriteVariable("BootOrder", *g, nv, []byte{1, 0}); err != nil {
+		t.Fatalf("WriteVariable: got %v, want nil", err)
+	}
+	if err := WriteVariable("BootOrder", *g, nv|EFI_VARIABLE_APPEND_WRITE, []byte{2, 0}); err != nil {
+		t.Fatalf("WriteVariable(append): got %v, want nil", err)
+	}
+	if err := WriteVariable("BootOrder", *g, EFI_VARIABLE_BOOTSERVICE_ACCESS, []byte{3, 0}); err == nil {
+		t.Errorf("WriteVariable with other attributes: got nil, want err")
+	}
+	if err := WriteVariable("Scratch", *g, EFI_VARIABLE_BOOTSERVICE_ACCESS, []byte{1}); err != nil {
+		t.Fatalf("WriteVariable: got %v, want nil", err)
+	}
+	if err := WriteVariable("Gone", *g, nv, nil); err == nil {
+		t.Errorf("Deleting a variable that is not set: got nil, want err")
+	}
+	// Appending to a variable that is not set creates it, without
+	// EFI_VARIABLE_APPEND_WRITE; appending nothing does nothing.
+	if err := WriteVariable("New", *g, EFI_VARIABLE_BOOTSERVICE_ACCESS|EFI_VARIABLE_APPEND_WRITE, []byte{4}); err != nil {
+		t.Fatalf("WriteVariable(append) of a new variable: got %v, want nil", err)
+	}
+	if v, err := ReadVariable("New", *g); err != nil || !bytes.Equal(v.Data, []byte{4}) || v.Attr != EFI_VARIABLE_BOOTSERVICE_ACCESS {
+		t.Errorf("New: got %v, %v, want [4] attr %#x", v, err, EFI_VARIABLE_BOOTSERVICE_ACCESS)
+	}
+	if err := WriteVariable("Empty", *g, EFI_VARIABLE_BOOTSERVICE_ACCESS|EFI_VARIABLE_APPEND_WRITE, nil); err != nil {
+		t.Fatalf("WriteVariable(append) of nothing: got %v, want nil", err)
+	}
+	if _, err := ReadVariable("Empty", *g); err == nil {
+		t.Errorf("Appending nothing to a variable that is not set created it")
+	}
+
+	var b bytes.Buffer
+	if err := SaveVariables(&b); err != nil {
+		t.Fatalf("SaveVariables: got %v, want nil", err)
+	}
+	EFIVariables = map[string]*EFIVariable{}
+	if err := LoadVariables(&b); err != nil {
+		t.Fatalf("LoadVariables: got %v, want nil", err)
+	}
+	v, err := ReadVariable("BootOrder", *g)
+	if err != nil {
+		t.Fatalf("ReadVariable: got %v, want nil", err)
+	}
+	if !bytes.Equal(v.Data, []byte{1, 0, 2, 0}) || v.Attr != nv {
+		t.Errorf("BootOrder: got %#x attr %#x, want [1 0 2 0] attr %#x", v.Data, v.Attr, nv)
+	}
+	if _, err := ReadVariable("Scratch", *g); err == nil {
+		t.Errorf("Volatile variable survived a save and load")
+	}
+
+	if err := WriteVariable("BootOrder", *g, 0, nil); err != nil {
+		t.Fatalf("Deleting: got %v, want nil", err)
+	}
+	if _, err := ReadVariable("BootOrder", *g); err == nil {
+		t.Errorf("Deleted variable is still there")
+	}
+}